@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// accessList decides which clients may query a listener. Deny entries take
+// precedence; an empty allow list allows everyone not denied.
+type accessList struct {
+	allow, deny *cidrSet
+}
+
+func (a *accessList) Allowed(w dns.ResponseWriter) bool {
+	ip := addrIP(w.RemoteAddr())
+	if ip == nil {
+		// Unix sockets have no client address; access is governed by the
+		// socket file permissions instead.
+		return true
+	}
+	if a.deny.Contains(ip) {
+		return false
+	}
+	return a.allow.Empty() || a.allow.Contains(ip)
+}
+
+// parseListenSpec splits a listen address of the form
+// "ADDR[;allow=CIDR|CIDR...][;deny=CIDR|CIDR...]" into the address and its
+// access list, which is nil when neither option is given.
+func parseListenSpec(spec string) (string, *accessList, error) {
+	parts := strings.Split(spec, ";")
+	addr := strings.TrimSpace(parts[0])
+	if len(parts) == 1 {
+		return addr, nil, nil
+	}
+
+	acl := &accessList{allow: &cidrSet{}, deny: &cidrSet{}}
+	for _, opt := range parts[1:] {
+		kv := strings.SplitN(strings.TrimSpace(opt), "=", 2)
+		if len(kv) != 2 {
+			return "", nil, fmt.Errorf("listen address %s: malformed option %q", addr, opt)
+		}
+		var set *cidrSet
+		switch kv[0] {
+		case "allow":
+			set = acl.allow
+		case "deny":
+			set = acl.deny
+		default:
+			return "", nil, fmt.Errorf("listen address %s: unknown option %q", addr, kv[0])
+		}
+		for _, cidr := range strings.Split(kv[1], "|") {
+			if err := set.Add(strings.TrimSpace(cidr)); err != nil {
+				return "", nil, fmt.Errorf("listen address %s: %v", addr, err)
+			}
+		}
+	}
+	return addr, acl, nil
+}
+
+var aclLogger = newLogEvery(time.Minute)
+
+// aclHandler wraps next so that only clients permitted by acl reach it. The
+// others are answered REFUSED, or ignored with -acl-action=drop.
+func aclHandler(acl *accessList, next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if acl.Allowed(w) {
+			next.ServeDNS(w, req)
+			return
+		}
+		denyQuery(w, req)
+	})
+}
+
+// denyQuery turns away a query from a client an access list denies.
+func denyQuery(w dns.ResponseWriter, req *dns.Msg) {
+	stats.QueriesDenied.Inc()
+	if len(req.Question) > 0 {
+		topDenied.Add(normalizeName(req.Question[0].Name))
+	}
+	aclLogger.Printf("Denied query from %s on %s", w.RemoteAddr(), w.LocalAddr())
+	if *aclAction != "drop" {
+		writeFailure(w, req, dns.RcodeRefused)
+	}
+}
+
+// Networks "private" stands for in -allow-from, besides the listeners' own.
+var privateNetworks = []string{
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "127.0.0.0/8",
+	"::1/128", "fc00::/7", "fe80::/10",
+}
+
+// parseAllowFrom parses the -allow-from access list, returning nil if it
+// allows everyone. The networks "private" stands for include those of the
+// given listeners.
+func parseAllowFrom(value string, listeners []*dnsListener) (*accessList, error) {
+	allow := &cidrSet{}
+	for _, v := range splitList(value) {
+		switch v {
+		case "any":
+			return nil, nil
+		case "private":
+			for _, cidr := range privateNetworks {
+				allow.Add(cidr)
+			}
+			for _, l := range listeners {
+				for _, ipnet := range listenerNetworks(l) {
+					allow.Add(ipnet.String())
+				}
+			}
+		default:
+			if err := allow.Add(v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if allow.Empty() {
+		return nil, fmt.Errorf("expected CIDRs, private or any")
+	}
+	return &accessList{allow: allow, deny: &cidrSet{}}, nil
+}
+
+// allowFromACL holds the -allow-from access list, a *accessList which is
+// nil if everyone is allowed. A config reload may replace it, parsed with
+// the networks of allowFromListeners.
+var (
+	allowFromACL       atomic.Value
+	allowFromListeners []*dnsListener
+)
+
+func init() {
+	allowFromACL.Store((*accessList)(nil))
+}
+
+// setAllowFrom makes value the -allow-from access list in use.
+func setAllowFrom(value string) {
+	acl, err := parseAllowFrom(value, allowFromListeners)
+	if err != nil {
+		warnf("Keeping the current -allow-from: %v", err)
+		return
+	}
+	allowFromACL.Store(acl)
+}
+
+// allowFromHandler wraps next so that only clients permitted by the
+// -allow-from access list in use reach it.
+func allowFromHandler(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if acl := allowFromACL.Load().(*accessList); acl != nil && !acl.Allowed(w) {
+			denyQuery(w, req)
+			return
+		}
+		next.ServeDNS(w, req)
+	})
+}
+
+// applyAllowFrom puts every listener behind the -allow-from access list,
+// which is checked before any per-listener list.
+func applyAllowFrom(listeners []*dnsListener) {
+	for _, l := range listeners {
+		next := l.Server.Handler
+		if next == nil {
+			next = dns.DefaultServeMux
+		}
+		l.Server.Handler = allowFromHandler(next)
+	}
+}
+
+// listenerNetworks returns the /24 (IPv4) or /64 (IPv6) around the address
+// a listener is bound to, or around every interface address when it is bound
+// to a wildcard address.
+func listenerNetworks(l *dnsListener) []*net.IPNet {
+	if l.Proto == "unix" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(l.Addr)
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		ips = append(ips, ip)
+	} else if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				ips = append(ips, ipnet.IP)
+			}
+		}
+	}
+	var nets []*net.IPNet
+	for _, ip := range ips {
+		mask := net.CIDRMask(64, 128)
+		if ip.To4() != nil {
+			ip, mask = ip.To4(), net.CIDRMask(24, 32)
+		}
+		nets = append(nets, &net.IPNet{IP: ip.Mask(mask), Mask: mask})
+	}
+	return nets
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// First file descriptor passed by systemd socket activation, a variable
+// so tests can pass sockets of their own.
+var listenFdsStart = 3
+
+// activationListeners returns DNS listeners for the sockets passed in by
+// systemd socket activation (sd_listen_fds(3)), or nil if the process was
+// not socket activated. Stream sockets are served as DNS-over-TCP and
+// datagram sockets as DNS-over-UDP.
+func activationListeners() ([]*dnsListener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// Don't pass the sockets on to anything we might start
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []*dnsListener
+	for i := 0; i < nfds; i++ {
+		fd := listenFdsStart + i
+		name := fmt.Sprintf("fd%d", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		l, err := activationListener(os.NewFile(uintptr(fd), name))
+		if err != nil {
+			closeDNS(listeners)
+			return nil, fmt.Errorf("cannot use activated socket %s: %v", name, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+func activationListener(f *os.File) (*dnsListener, error) {
+	// Both calls duplicate the descriptor, so the original can be closed
+	defer f.Close()
+
+	if ln, err := net.FileListener(f); err == nil {
+		l := &dnsListener{Proto: "tcp", Addr: ln.Addr().String()}
+		if _, ok := ln.(*net.TCPListener); ok {
+			l.Server = newTCPServer(ln)
+		} else {
+			l.Proto = "unix"
+			l.Server = &dns.Server{Listener: ln, Net: "tcp"}
+		}
+		return l, nil
+	}
+
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := pc.(*net.UDPConn); !ok {
+		pc.Close()
+		return nil, fmt.Errorf("unsupported socket type %T", pc)
+	}
+	l := &dnsListener{Proto: "udp", Addr: pc.LocalAddr().String()}
+	l.Server = &dns.Server{PacketConn: pc, Net: "udp"}
+	return l, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sys/unix"
+)
+
+// inheritSockets puts the sockets where systemd would, at consecutive
+// descriptors from listenFdsStart, and sets the environment naming them.
+func inheritSockets(t *testing.T, files ...*os.File) {
+	t.Helper()
+	start := listenFdsStart
+	t.Cleanup(func() { listenFdsStart = start })
+	listenFdsStart = 100
+	for i, f := range files {
+		if err := unix.Dup2(int(f.Fd()), listenFdsStart+i); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", strconv.Itoa(len(files)))
+	t.Setenv("LISTEN_FDNAMES", "dns-udp:dns-tcp")
+}
+
+func TestActivationListeners(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpFile, err := pc.(*net.UDPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpFile, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpAddr, tcpAddr := pc.LocalAddr().String(), ln.Addr().String()
+	pc.Close()
+	ln.Close()
+
+	inheritSockets(t, udpFile, tcpFile)
+	listeners, err := activationListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeDNS(listeners)
+	if len(listeners) != 2 {
+		t.Fatalf("got %d listeners, want 2", len(listeners))
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("LISTEN_FDS is left for child processes")
+	}
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = append(resp.Answer, mustRR(t, "activated.example. 60 IN A 192.0.2.1"))
+		w.WriteMsg(resp)
+	})
+	for i, want := range []struct{ proto, addr string }{{"udp", udpAddr}, {"tcp", tcpAddr}} {
+		l := listeners[i]
+		if l.Proto != want.proto || l.Addr != want.addr {
+			t.Errorf("socket %d: got %s, want %s (%s)", i, l, want.addr, want.proto)
+			continue
+		}
+		started := make(chan struct{})
+		l.Server.Handler = handler
+		l.Server.NotifyStartedFunc = func() { close(started) }
+		go l.Server.ActivateAndServe()
+		<-started
+
+		req := new(dns.Msg)
+		req.SetQuestion("activated.example.", dns.TypeA)
+		c := &dns.Client{Net: want.proto}
+		resp, _, err := c.Exchange(req, want.addr)
+		if err != nil {
+			t.Errorf("%s: %v", l, err)
+		} else if len(resp.Answer) != 1 {
+			t.Errorf("%s: got answer %v, want the handler's", l, resp.Answer)
+		}
+	}
+}
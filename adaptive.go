@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The adaptive timeout of an endpoint is twice the 99th percentile latency
+// of its successful requests over the last one to two minutes, within
+// -adaptive-timeout-min and -adaptive-timeout-max. Until an endpoint has
+// latencySamples requests in that time, -timeout applies.
+const (
+	latencySpan    = time.Minute
+	latencySamples = 50
+	latencyFactor  = 2
+	// timeoutsDown is how many requests to an endpoint must time out in a
+	// row before it counts as failed, rather than just slow
+	timeoutsDown = 3
+)
+
+// latencyWindow counts the latencies of an endpoint's recent requests into
+// durationBuckets, plus a total, for this span and the last. The timeout is
+// recomputed from the counts at most once a second.
+type latencyWindow struct {
+	endpoint string
+
+	mu       sync.Mutex
+	current  []uint64
+	previous []uint64
+	rotate   time.Time
+	computed time.Time
+	timeout  time.Duration
+	timeouts int
+}
+
+var latencyWindows sync.Map // endpoint to *latencyWindow
+
+func endpointLatency(endpoint string) *latencyWindow {
+	if l, ok := latencyWindows.Load(endpoint); ok {
+		return l.(*latencyWindow)
+	}
+	l, _ := latencyWindows.LoadOrStore(endpoint, &latencyWindow{
+		endpoint: endpoint,
+		current:  make([]uint64, len(durationBuckets)+1),
+		previous: make([]uint64, len(durationBuckets)+1),
+		rotate:   time.Now().Add(latencySpan),
+	})
+	return l.(*latencyWindow)
+}
+
+// observe records a successful request that took d.
+func (l *latencyWindow) observe(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.roll(time.Now())
+	for i, b := range durationBuckets {
+		if d.Seconds() <= b {
+			l.current[i]++
+		}
+	}
+	l.current[len(durationBuckets)]++
+	l.timeouts = 0
+}
+
+// roll starts a new span if the current one is over.
+func (l *latencyWindow) roll(now time.Time) {
+	if now.Before(l.rotate) {
+		return
+	}
+	l.current, l.previous = l.previous, l.current
+	for i := range l.current {
+		l.current[i] = 0
+	}
+	if now.Sub(l.rotate) >= latencySpan {
+		// Nothing was recorded for a whole span, so the last is stale too
+		for i := range l.previous {
+			l.previous[i] = 0
+		}
+	}
+	l.rotate = now.Add(latencySpan)
+}
+
+// deadline returns the adaptive timeout, or 0 while there are too few
+// samples.
+func (l *latencyWindow) deadline() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.computed) < time.Second {
+		return l.timeout
+	}
+	l.roll(now)
+	l.computed = now
+
+	h := newHistogram(durationBuckets)
+	for i := range h.counts {
+		h.counts[i] = l.current[i] + l.previous[i]
+	}
+	h.count = l.current[len(durationBuckets)] + l.previous[len(durationBuckets)]
+	var t time.Duration
+	if h.count >= latencySamples {
+		t = latencyFactor * h.quantile(.99)
+		if t < *adaptiveTimeoutMin {
+			t = *adaptiveTimeoutMin
+		}
+		if max := *adaptiveTimeoutMax; max > 0 && t > max {
+			t = max
+		}
+		if t > *timeout {
+			t = *timeout
+		}
+	}
+	if t != l.timeout {
+		debugf("Adaptive timeout for %s is now %v", l.endpoint, t)
+	}
+	l.timeout = t
+	return t
+}
+
+// upstreamTimeout returns how long a request to endpoint may take, or 0 if
+// only the query's -timeout applies.
+func upstreamTimeout(endpoint string) time.Duration {
+	if !*adaptiveTimeout {
+		return 0
+	}
+	return endpointLatency(endpoint).deadline()
+}
+
+// timedOut records a request to endpoint that timed out, and reports
+// whether the endpoint should count as failed: it is timing out
+// repeatedly rather than being occasionally slow.
+func timedOut(endpoint string) bool {
+	l := endpointLatency(endpoint)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.timeouts++
+	return l.timeouts >= timeoutsDown
+}
+
+// writeAdaptiveTimeouts writes the current adaptive timeout of each
+// endpoint, 0 for those still using -timeout.
+func writeAdaptiveTimeouts(w io.Writer) {
+	if !*adaptiveTimeout {
+		return
+	}
+	var endpoints []string
+	latencyWindows.Range(func(k, v interface{}) bool {
+		endpoints = append(endpoints, k.(string))
+		return true
+	})
+	sort.Strings(endpoints)
+	name := "doh_proxy_upstream_adaptive_timeout_seconds"
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, "Current adaptive upstream request timeout, 0 until there are enough samples.", name)
+	for _, endpoint := range endpoints {
+		fmt.Fprintf(w, "%s{%s} %g\n", name, labelPairs([]string{"endpoint"}, endpoint, ""),
+			endpointLatency(endpoint).deadline().Seconds())
+	}
+}
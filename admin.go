@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// adminServer is an HTTP listener for operational endpoints. Endpoints
+// configured on the same address share one listener.
+type adminServer struct {
+	addr  string
+	names []string
+	mux   *http.ServeMux
+}
+
+var adminServers []*adminServer
+
+// adminMux returns the mux for the admin listener on addr, creating it if
+// needed. name describes the endpoints added, for logging.
+func adminMux(addr, name string) *http.ServeMux {
+	for _, s := range adminServers {
+		if s.addr == addr {
+			s.names = append(s.names, name)
+			return s.mux
+		}
+	}
+	s := &adminServer{addr: addr, names: []string{name}, mux: http.NewServeMux()}
+	adminServers = append(adminServers, s)
+	return s.mux
+}
+
+// serveAdmin starts every admin listener set up with adminMux.
+func serveAdmin() error {
+	for _, s := range adminServers {
+		if err := serveHTTP(strings.Join(s.names, ", "), s.addr, s.mux, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addPprof serves the net/http/pprof handlers on the admin listener on addr.
+func addPprof(addr string) {
+	mux := adminMux(addr, "pprof")
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAddPprof(t *testing.T) {
+	saved := adminServers
+	t.Cleanup(func() { adminServers = saved })
+	get := func(mux http.Handler, target string) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w.Code
+	}
+
+	// On an address of its own, pprof gets a listener of its own
+	adminServers = nil
+	addAPI("api.test:0")
+	addPprof("pprof.test:0")
+	if len(adminServers) != 2 {
+		t.Fatalf("got %d admin listeners, want 2", len(adminServers))
+	}
+	api, pprof := adminServers[0].mux, adminServers[1].mux
+	if code := get(pprof, "/debug/pprof/"); code != http.StatusOK {
+		t.Errorf("pprof listener: /debug/pprof/ got status %d", code)
+	}
+	if code := get(pprof, "/api/stats"); code != http.StatusNotFound {
+		t.Errorf("pprof listener: /api/stats got status %d, want 404", code)
+	}
+	if code := get(api, "/debug/pprof/"); code != http.StatusNotFound {
+		t.Errorf("API listener: /debug/pprof/ got status %d, want 404", code)
+	}
+
+	// On the API's address, they share its listener
+	adminServers = nil
+	addAPI("admin.test:0")
+	addPprof("admin.test:0")
+	if len(adminServers) != 1 {
+		t.Fatalf("got %d admin listeners, want 1", len(adminServers))
+	}
+	if names := adminServers[0].names; len(names) != 2 || names[0] != "api" || names[1] != "pprof" {
+		t.Errorf("got listener for %q, want api and pprof", names)
+	}
+	mux := adminServers[0].mux
+	for _, target := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/api/stats"} {
+		if code := get(mux, target); code != http.StatusOK {
+			t.Errorf("shared listener: %s got status %d", target, code)
+		}
+	}
+}
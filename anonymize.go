@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+)
+
+// Ways of hiding client addresses in query logs, dnstap and traces.
+const (
+	anonymizeOff      = ""
+	anonymizeTruncate = "truncate"
+	anonymizeHash     = "hash"
+	anonymizeDrop     = "drop"
+)
+
+// anonymizeKey keys the HMAC used by -log-anonymize=hash.
+var anonymizeKey []byte
+
+// initAnonymize checks -log-anonymize and sets up its key: the given one,
+// or a random one for this run.
+func initAnonymize(mode, key string) error {
+	if err := checkAnonymize(mode); err != nil || mode != anonymizeHash {
+		return err
+	}
+	if key != "" {
+		anonymizeKey = []byte(key)
+		return nil
+	}
+	anonymizeKey = make([]byte, 32)
+	_, err := rand.Read(anonymizeKey)
+	return err
+}
+
+// checkAnonymize returns an error unless mode is a -log-anonymize mode.
+func checkAnonymize(mode string) error {
+	switch mode {
+	case anonymizeOff, anonymizeTruncate, anonymizeHash, anonymizeDrop:
+		return nil
+	}
+	return fmt.Errorf("-log-anonymize must be truncate, hash or drop")
+}
+
+// anonymizeIP returns ip as it may be logged: unchanged, with the host part
+// zeroed (the last octet of IPv4, the last 80 bits of IPv6), replaced by a
+// keyed hash of the same length, or nil when it must not be logged at all.
+func anonymizeIP(ip net.IP) net.IP {
+	switch *logAnonymize {
+	case anonymizeTruncate:
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32))
+		}
+		return ip.Mask(net.CIDRMask(48, 128))
+	case anonymizeHash:
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return net.IP(ipHMAC(ip)[:len(ip)])
+	case anonymizeDrop:
+		return nil
+	}
+	return ip
+}
+
+// anonymizeAddrString formats a client IP for text and JSON logs, where a
+// hashed address is written as "h:" and the hex digest rather than as a
+// made-up IP. It returns "" when the address must not be logged.
+func anonymizeAddrString(ip net.IP) string {
+	switch *logAnonymize {
+	case anonymizeHash:
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return "h:" + hex.EncodeToString(ipHMAC(ip)[:8])
+	case anonymizeDrop:
+		return ""
+	}
+	return anonymizeIP(ip).String()
+}
+
+func ipHMAC(ip net.IP) []byte {
+	mac := hmac.New(sha256.New, anonymizeKey)
+	mac.Write(ip)
+	return mac.Sum(nil)
+}
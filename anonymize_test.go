@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TestAnonymize checks the client address written by each -log-anonymize
+// mode to the text log, the JSON query log and dnstap.
+func TestAnonymize(t *testing.T) {
+	defer func(mode string, key []byte) { *logAnonymize, anonymizeKey = mode, key }(*logAnonymize, anonymizeKey)
+	anonymizeKey = []byte("secret")
+	defer func(w io.Writer, flags int) { log.SetOutput(w); log.SetFlags(flags) }(log.Writer(), log.Flags())
+	log.SetFlags(0)
+	v4 := &net.UDPAddr{IP: net.ParseIP("192.0.2.123"), Port: 5353}
+	v6 := &net.UDPAddr{IP: net.ParseIP("2001:db8:1:2:3:4:5:6"), Port: 5353}
+
+	for _, tc := range []struct {
+		mode   string
+		client *net.UDPAddr
+		logged string // in the text and JSON logs, "" for none
+		tapIP  string // in dnstap, "" for none
+	}{
+		{anonymizeOff, v4, "192.0.2.123", "192.0.2.123"},
+		{anonymizeOff, v6, "2001:db8:1:2:3:4:5:6", "2001:db8:1:2:3:4:5:6"},
+		{anonymizeTruncate, v4, "192.0.2.0", "192.0.2.0"},
+		{anonymizeTruncate, v6, "2001:db8:1::", "2001:db8:1::"},
+		{anonymizeHash, v4, "h:9ea5ff738fcf7246", "158.165.255.115"},
+		{anonymizeHash, v6, "h:99b2b6d9b2e54a49", "99b2:b6d9:b2e5:4a49:abd6:1c51:ec5f:a226"},
+		{anonymizeDrop, v4, "", ""},
+		{anonymizeDrop, v6, "", ""},
+	} {
+		*logAnonymize = tc.mode
+		name := tc.mode + " " + tc.client.IP.String()
+		local := &net.UDPAddr{IP: net.ParseIP("192.0.2.53"), Port: 53}
+		if tc.client == v6 {
+			local = &net.UDPAddr{IP: net.ParseIP("2001:db8::53"), Port: 53}
+		}
+		w := &httpResponseWriter{local: local, remote: tc.client}
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+
+		var text bytes.Buffer
+		log.SetOutput(&text)
+		logQuery(w, req)
+		want := "query[A] example.com. \n"
+		if tc.logged != "" {
+			want = "query[A] example.com. from " + tc.logged + "\n"
+		}
+		if text.String() != want {
+			t.Errorf("%s: text log %q, want %q", name, text.String(), want)
+		}
+
+		var out bytes.Buffer
+		(&jsonQueryLog{out: &out}).Log(req, &responseRecorder{ResponseWriter: w}, time.Now())
+		var entry map[string]interface{}
+		if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+			t.Fatalf("%s: JSON log %q: %v", name, out.String(), err)
+		}
+		if got, _ := entry["client"].(string); got != tc.logged {
+			t.Errorf("%s: JSON log client %q, want %q", name, got, tc.logged)
+		}
+
+		got := tapAddrs(nil, tc.client, local, tc.mode != anonymizeOff)
+		var tap []byte
+		if tc.tapIP != "" {
+			ip := net.ParseIP(tc.tapIP)
+			rip := local.IP
+			if ip4 := ip.To4(); ip4 != nil {
+				tap = pbVarint(tap, 2, dnstapINET)
+				ip, rip = ip4, rip.To4()
+			} else {
+				tap = pbVarint(tap, 2, dnstapINET6)
+			}
+			tap = pbBytes(tap, 4, ip)
+			if tc.mode == anonymizeOff {
+				tap = pbVarint(tap, 6, uint64(tc.client.Port))
+			}
+			tap = pbBytes(tap, 5, rip)
+			tap = pbVarint(tap, 7, 53)
+		}
+		if !bytes.Equal(got, tap) {
+			t.Errorf("%s: dnstap addresses %x, want %x", name, got, tap)
+		}
+	}
+}
+
+// A client without an IP, such as one on a Unix socket, is logged by its
+// address unless addresses are dropped.
+func TestAnonymizeNoIP(t *testing.T) {
+	defer func(mode string) { *logAnonymize = mode }(*logAnonymize)
+	w := &httpResponseWriter{remote: &net.UnixAddr{Name: "@client", Net: "unix"}}
+	for mode, want := range map[string]string{anonymizeTruncate: "@client", anonymizeDrop: ""} {
+		*logAnonymize = mode
+		if got := clientAddr(w); got != want {
+			t.Errorf("%s: got %q, want %q", mode, got, want)
+		}
+	}
+}
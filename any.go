@@ -0,0 +1,53 @@
+package main
+
+import "github.com/miekg/dns"
+
+// -refuse-any modes.
+const (
+	anyRefuse  = "refuse"
+	anyMinimal = "minimal"
+	anyForward = "forward"
+	anyCached  = "cache"
+)
+
+// TTL of the synthesized RFC 8482 answer. It never changes, so clients and
+// caches may as well keep it.
+const anyHINFOTTL = 86400
+
+// answerANY applies the -refuse-any policy to a query for type ANY,
+// reporting whether it has been answered without going upstream.
+func answerANY(w dns.ResponseWriter, req *dns.Msg) bool {
+	metrics.AnyQueries.With(*refuseAny).Inc()
+	switch *refuseAny {
+	case anyRefuse:
+		writeFailure(w, req, dns.RcodeNotImplemented)
+		return true
+	case anyMinimal, anyCached:
+		resp := newFailure(req, dns.RcodeSuccess)
+		if *refuseAny == anyCached && anyCache != nil {
+			// What is kept for the name, which RFC 8482 allows to be any
+			// subset of its records
+			resp.Answer = anyCache.Get(req)
+			for _, rr := range resp.Answer {
+				rr.Header().Name = req.Question[0].Name
+			}
+			overrideTTL(resp, normalizeName(req.Question[0].Name), activeTTLRules.Load().(ttlRules))
+		}
+		if len(resp.Answer) == 0 {
+			resp.Answer = []dns.RR{&dns.HINFO{
+				Hdr: dns.RR_Header{
+					Name:   req.Question[0].Name,
+					Rrtype: dns.TypeHINFO,
+					Class:  dns.ClassINET,
+					Ttl:    anyHINFOTTL,
+				},
+				Cpu: "RFC8482",
+			}}
+		}
+		if err := w.WriteMsg(resp); err != nil {
+			errorf("Error writing DNS response: %v", err)
+		}
+		return true
+	}
+	return false
+}
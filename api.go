@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The REST API offers the control socket's operations over HTTP, for
+// dashboards and scripts. Reads are open to anyone who can reach the admin
+// listener; changes need the -api-token as a bearer token.
+
+// apiError is the JSON body of a failed API request.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// addAPI serves the /api/ endpoints on the admin listener on addr.
+func addAPI(addr string) {
+	mux := adminMux(addr, "api")
+	mux.HandleFunc("/api/stats", apiMethods(handleAPIStats, "GET"))
+	mux.HandleFunc("/api/config", apiMethods(handleAPIConfig, "GET"))
+	mux.HandleFunc("/api/upstreams", apiMethods(handleAPIUpstreams, "GET", "POST"))
+	mux.HandleFunc("/api/blocks", apiMethods(handleAPIBlocks, "GET"))
+	mux.HandleFunc("/api/cache", apiMethods(handleAPINoCache, "GET", "DELETE"))
+	mux.HandleFunc("/api/blocklist", apiMethods(handleAPINoCache, "GET", "POST", "DELETE"))
+}
+
+// apiMethods wraps an API handler, refusing other methods and requiring the
+// bearer token for any but GET.
+func apiMethods(h http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(hw http.ResponseWriter, r *http.Request) {
+		allowed := false
+		for _, m := range methods {
+			allowed = allowed || r.Method == m
+		}
+		if !allowed {
+			hw.Header().Set("Allow", strings.Join(methods, ", "))
+			writeAPI(hw, http.StatusMethodNotAllowed, apiError{"method not allowed"})
+			return
+		}
+		if r.Method != "GET" {
+			if *apiToken == "" {
+				writeAPI(hw, http.StatusForbidden, apiError{"changes are disabled without -api-token"})
+				return
+			}
+			auth := r.Header.Get("Authorization")
+			given := strings.TrimPrefix(auth, "Bearer ")
+			if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(given), []byte(*apiToken)) != 1 {
+				hw.Header().Set("WWW-Authenticate", "Bearer")
+				writeAPI(hw, http.StatusUnauthorized, apiError{"missing or wrong bearer token"})
+				return
+			}
+		}
+		h(hw, r)
+	}
+}
+
+func writeAPI(hw http.ResponseWriter, code int, v interface{}) {
+	hw.Header().Set("Content-Type", "application/json")
+	hw.Header().Set("Cache-Control", "no-store")
+	hw.WriteHeader(code)
+	json.NewEncoder(hw).Encode(v)
+}
+
+// handleAPIStats returns the statistics of the stats command, a record per
+// line. The key=value pairs of a line become the fields of its record, and
+// a leading word without a value its "section".
+func handleAPIStats(hw http.ResponseWriter, r *http.Request) {
+	var records []map[string]string
+	writeStats(func(format string, v ...interface{}) {
+		fields := strings.Fields(strings.TrimPrefix(fmt.Sprintf(format, v...), "stats: "))
+		record := make(map[string]string)
+		for i, field := range fields {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) == 2 {
+				record[kv[0]] = kv[1]
+			} else if i == 0 && field != "none" {
+				record["section"] = field
+			}
+		}
+		records = append(records, record)
+	})
+	writeAPI(hw, http.StatusOK, map[string]interface{}{"stats": records})
+}
+
+// handleAPIConfig returns the settings in effect, with secrets masked.
+func handleAPIConfig(hw http.ResponseWriter, r *http.Request) {
+	settings := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		if modeFlags[f.Name] {
+			return
+		}
+		value := f.Value.String()
+		if secretFlags[f.Name] && value != "" {
+			value = "********"
+		}
+		settings[f.Name] = value
+	})
+	writeAPI(hw, http.StatusOK, map[string]interface{}{"config": settings})
+}
+
+// handleAPIUpstreams lists the endpoints of the upstream group, or with
+// POST ?endpoint=URL&action=drain|undrain drains one or takes it back.
+func handleAPIUpstreams(hw http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		action := r.FormValue("action")
+		if action != "drain" && action != "undrain" {
+			writeAPI(hw, http.StatusBadRequest, apiError{"action must be drain or undrain"})
+			return
+		}
+		if err := setDrained(r.FormValue("endpoint"), action == "drain", "API request from "+r.RemoteAddr); err != nil {
+			writeAPI(hw, http.StatusBadRequest, apiError{err.Error()})
+			return
+		}
+	}
+	writeAPI(hw, http.StatusOK, map[string]interface{}{"upstreams": upstreamStates()})
+}
+
+// handleAPIBlocks returns the blocked queries counted by source and the
+// recent block events.
+func handleAPIBlocks(hw http.ResponseWriter, r *http.Request) {
+	sources := make(map[string]uint64)
+	v := metrics.BlockedQueries
+	v.mu.RLock()
+	for source, c := range v.counters {
+		sources[source] = c.Value()
+	}
+	v.mu.RUnlock()
+	writeAPI(hw, http.StatusOK, map[string]interface{}{"sources": sources, "recent": recentBlocks()})
+}
+
+// handleAPINoCache answers the cache and blocklist endpoints, which the
+// control socket also refuses.
+func handleAPINoCache(hw http.ResponseWriter, r *http.Request) {
+	command := strings.TrimPrefix(r.URL.Path, "/api/")
+	writeAPI(hw, http.StatusNotImplemented, apiError{errNoCache(command).Error()})
+}
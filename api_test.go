@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// apiMux returns the mux addAPI serves the API on.
+func apiMux(t *testing.T) *http.ServeMux {
+	saved := adminServers
+	t.Cleanup(func() { adminServers = saved })
+	addAPI("api.test:0")
+	return adminMux("api.test:0", "test")
+}
+
+// apiCall sends a request to mux, with token as the bearer token unless it
+// is empty, decoding the JSON response into v if it is not nil.
+func apiCall(t *testing.T, mux http.Handler, method, target, token string, v interface{}) int {
+	t.Helper()
+	r := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s %s: got Content-Type %q", method, target, ct)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%s %s: %v in %q", method, target, err, w.Body.String())
+	}
+	if v != nil {
+		json.Unmarshal(w.Body.Bytes(), v)
+	}
+	return w.Code
+}
+
+func TestAPIStats(t *testing.T) {
+	mux := apiMux(t)
+	var body struct{ Stats []map[string]string }
+	if code := apiCall(t, mux, "GET", "/api/stats", "", &body); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if len(body.Stats) == 0 {
+		t.Error("got no statistics")
+	}
+	if code := apiCall(t, mux, "POST", "/api/stats", "", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST got status %d, want 405", code)
+	}
+}
+
+func TestAPIConfig(t *testing.T) {
+	defer func(token string) { *apiToken = token }(*apiToken)
+	*apiToken = "s3cret"
+	var body struct{ Config map[string]string }
+	if code := apiCall(t, apiMux(t), "GET", "/api/config", "", &body); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if body.Config["api-token"] != "********" {
+		t.Errorf("got api-token %q, want it masked", body.Config["api-token"])
+	}
+	if body.Config["timeout"] != timeout.String() {
+		t.Errorf("got timeout %q, want %s", body.Config["timeout"], timeout)
+	}
+	if _, ok := body.Config["version"]; ok {
+		t.Error("got the -version mode flag among the settings")
+	}
+}
+
+func TestAPIUpstreams(t *testing.T) {
+	endpoint := "https://a.example/resolve"
+	upstream.Store(&upstreamGroup{name: "default", endpoints: []string{endpoint}, policy: policyFailover})
+	defer drainedEndpoints.Delete(endpoint)
+	defer func(token string) { *apiToken = token }(*apiToken)
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	mux := apiMux(t)
+	drain := "/api/upstreams?action=drain&endpoint=" + endpoint
+
+	*apiToken = ""
+	if code := apiCall(t, mux, "POST", drain, "", nil); code != http.StatusForbidden {
+		t.Errorf("POST without -api-token got status %d, want 403", code)
+	}
+	*apiToken = "s3cret"
+	for _, token := range []string{"", "wrong"} {
+		if code := apiCall(t, mux, "POST", drain, token, nil); code != http.StatusUnauthorized {
+			t.Errorf("POST with token %q got status %d, want 401", token, code)
+		}
+	}
+	for _, auth := range []string{"s3cret", "Basic s3cret"} {
+		r := httptest.NewRequest("POST", drain, nil)
+		r.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("POST with Authorization %q got status %d, want 401", auth, w.Code)
+		}
+	}
+
+	var body struct{ Upstreams []endpointState }
+	if code := apiCall(t, mux, "POST", drain, "s3cret", &body); code != http.StatusOK {
+		t.Fatalf("drain got status %d", code)
+	}
+	if len(body.Upstreams) != 1 || body.Upstreams[0].State != "drained" {
+		t.Errorf("got upstreams %v, want %s drained", body.Upstreams, endpoint)
+	}
+	if !strings.Contains(logged.String(), "API request from 192.0.2.1:1234: upstream "+endpoint+" marked down") {
+		t.Errorf("logged %q, want the drain and its caller", logged.String())
+	}
+	apiCall(t, mux, "GET", "/api/upstreams", "", &body)
+	if body.Upstreams[0].State != "drained" {
+		t.Errorf("GET got state %s, want drained", body.Upstreams[0].State)
+	}
+	apiCall(t, mux, "POST", "/api/upstreams?action=undrain&endpoint="+endpoint, "s3cret", &body)
+	if body.Upstreams[0].State != "up" {
+		t.Errorf("undrain got state %s, want up", body.Upstreams[0].State)
+	}
+
+	for _, target := range []string{
+		"/api/upstreams?action=restart&endpoint=" + endpoint,
+		"/api/upstreams?action=drain&endpoint=https://b.example/resolve",
+	} {
+		if code := apiCall(t, mux, "POST", target, "s3cret", nil); code != http.StatusBadRequest {
+			t.Errorf("POST %s got status %d, want 400", target, code)
+		}
+	}
+}
+
+func TestAPIBlocks(t *testing.T) {
+	var body struct {
+		Sources map[string]uint64
+		Recent  []blockEvent
+	}
+	if code := apiCall(t, apiMux(t), "GET", "/api/blocks", "", &body); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if body.Sources == nil || body.Recent == nil {
+		t.Errorf("got %+v, want the sources and recent events", body)
+	}
+}
+
+func TestAPINoCache(t *testing.T) {
+	defer func(token string) { *apiToken = token }(*apiToken)
+	*apiToken = "s3cret"
+	mux := apiMux(t)
+	for _, req := range []struct{ method, target string }{
+		{"GET", "/api/cache?name=example.com"},
+		{"DELETE", "/api/cache?name=example.com"},
+		{"GET", "/api/blocklist"},
+		{"POST", "/api/blocklist?name=ads.example"},
+		{"DELETE", "/api/blocklist?name=ads.example"},
+	} {
+		var body apiError
+		if code := apiCall(t, mux, req.method, req.target, "s3cret", &body); code != http.StatusNotImplemented {
+			t.Errorf("%s %s got status %d, want 501", req.method, req.target, code)
+		}
+		if !strings.Contains(body.Error, "no cache or blocklist") {
+			t.Errorf("%s %s got error %q", req.method, req.target, body.Error)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Suppression period used when the upstream gives no usable Retry-After.
+	defaultBackoff = 1 * time.Second
+	// Upper bound for both the exponential default and Retry-After values.
+	maxBackoff = 5 * time.Minute
+)
+
+// endpointBackoff tracks upstream endpoints that have asked us to slow down
+// (HTTP 429, or 503 with Retry-After) and how long new requests to them stay
+// suspended.
+type endpointBackoff struct {
+	mu       sync.Mutex
+	until    map[string]time.Time
+	failures map[string]uint
+}
+
+var upstreamBackoff = &endpointBackoff{
+	until:    make(map[string]time.Time),
+	failures: make(map[string]uint),
+}
+
+// Suspended reports whether requests to endpoint are currently paused, and
+// clears the suspension once it has expired.
+func (b *endpointBackoff) Suspended(endpoint string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	until, ok := b.until[endpoint]
+	if !ok {
+		return false
+	}
+	if time.Now().Before(until) {
+		return true
+	}
+	delete(b.until, endpoint)
+	infof("Resuming requests to upstream %s", endpoint)
+	return false
+}
+
+// Observe inspects an upstream response and suspends the endpoint if it is
+// rate limiting us. A successful response resets the exponential backoff.
+func (b *endpointBackoff) Observe(endpoint string, resp *http.Response) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	retryAfter, hasRetryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+	case resp.StatusCode == http.StatusServiceUnavailable && hasRetryAfter:
+	default:
+		if resp.StatusCode == http.StatusOK {
+			delete(b.failures, endpoint)
+		}
+		return
+	}
+
+	n := b.failures[endpoint]
+	b.failures[endpoint] = n + 1
+	delay := retryAfter
+	if !hasRetryAfter {
+		delay = defaultBackoff << n
+		if n > 16 || delay > maxBackoff {
+			delay = maxBackoff
+		}
+	}
+	b.until[endpoint] = time.Now().Add(delay)
+	warnf("Upstream %s returned %s, suspending requests for %v",
+		endpoint, resp.Status, delay)
+}
+
+// parseRetryAfter parses a Retry-After header in either delay-seconds or
+// HTTP-date form.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	var delay time.Duration
+	if secs, err := strconv.ParseUint(value, 10, 32); err == nil {
+		delay = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		delay = t.Sub(now)
+	} else {
+		return 0, false
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay, true
+}
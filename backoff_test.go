@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		value string
+		delay time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"0", 0, true},
+		{"120", 2 * time.Minute, true},
+		{"86400", maxBackoff, true},
+		{"Wed, 14 Oct 2026 12:00:30 GMT", 30 * time.Second, true},
+		{"Wednesday, 14-Oct-26 12:01:00 GMT", time.Minute, true},
+		{"Wed Oct 14 12:00:10 2026", 10 * time.Second, true},
+		{"Wed, 14 Oct 2026 11:00:00 GMT", 0, true},
+		{"-5", 0, false},
+		{"soon", 0, false},
+	} {
+		delay, ok := parseRetryAfter(c.value, now)
+		if delay != c.delay || ok != c.ok {
+			t.Errorf("parseRetryAfter(%q) = %v, %v, want %v, %v", c.value, delay, ok, c.delay, c.ok)
+		}
+	}
+}
+
+func TestBackoffObserve(t *testing.T) {
+	b := &endpointBackoff{until: make(map[string]time.Time), failures: make(map[string]uint)}
+	respond := func(status int, retryAfter string) *http.Response {
+		resp := &http.Response{StatusCode: status, Status: http.StatusText(status), Header: http.Header{}}
+		if retryAfter != "" {
+			resp.Header.Set("Retry-After", retryAfter)
+		}
+		return resp
+	}
+	const endpoint = "https://dns.example/resolve"
+
+	b.Observe(endpoint, respond(http.StatusServiceUnavailable, ""))
+	if b.Suspended(endpoint) {
+		t.Error("a 503 without Retry-After suspended the endpoint")
+	}
+	b.Observe(endpoint, respond(http.StatusTooManyRequests, "60"))
+	if !b.Suspended(endpoint) {
+		t.Error("a 429 with Retry-After: 60 didn't suspend the endpoint")
+	}
+	if d := time.Until(b.until[endpoint]); d < 59*time.Second || d > time.Minute {
+		t.Errorf("suspended for %v, want a minute", d)
+	}
+
+	// Without Retry-After the backoff doubles with each 429, until a 200
+	b.until[endpoint] = time.Now()
+	b.Observe(endpoint, respond(http.StatusTooManyRequests, ""))
+	if d := time.Until(b.until[endpoint]); d < defaultBackoff || d > 2*defaultBackoff {
+		t.Errorf("second 429 suspended for %v, want %v", d, 2*defaultBackoff)
+	}
+	b.Observe(endpoint, respond(http.StatusOK, ""))
+	if b.failures[endpoint] != 0 {
+		t.Error("a 200 didn't reset the backoff")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Every blocked query is counted by the source of the block, and the last
+// blockEventsMax are kept for the stats dump and /api/blocks. A source is
+// the list a -policy-hook names in the "source" of its decision, if
+// -block-sources has it, else "policy-hook" or "other", or the endpoint
+// whose comment said it blocked the name. The counts thus have a bounded
+// set of sources, whatever a hook sends; the recent events keep the name
+// the hook gave. Sources are plain names, so their counts carry over a
+// reload of the lists behind them. Nothing here runs for queries that
+// aren't blocked.
+
+const (
+	// hookSource is the source of a hook's blocks that name none.
+	hookSource = "policy-hook"
+	// otherSource counts a hook's blocks from lists not in -block-sources.
+	otherSource = "other"
+)
+
+// hookBlockSource returns the source to count a hook's block from list
+// under.
+func hookBlockSource(list string) string {
+	if list == "" {
+		return hookSource
+	}
+	for _, s := range splitList(*blockSources) {
+		if s == list {
+			return list
+		}
+	}
+	return otherSource
+}
+
+// blockEventsMax bounds the recent block events kept.
+const blockEventsMax = 32
+
+// blockEvent is one blocked query.
+type blockEvent struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client,omitempty"`
+	Name   string    `json:"name"`
+	Source string    `json:"source"`
+	Rule   string    `json:"rule,omitempty"`
+}
+
+var (
+	blockEventsMu sync.Mutex
+	// blockEvents is a ring of the recent events, the next written at
+	// blockEventsNext once it is full
+	blockEvents     []blockEvent
+	blockEventsNext int
+)
+
+// recordBlock counts a query for name blocked by source's rule, which may
+// be "", under counted, and keeps it as a recent event of source.
+func recordBlock(w dns.ResponseWriter, name, source, counted, rule string) {
+	metrics.BlockedQueries.With(counted).Inc()
+	e := blockEvent{Time: time.Now(), Client: clientAddr(w), Name: name, Source: source, Rule: rule}
+	blockEventsMu.Lock()
+	defer blockEventsMu.Unlock()
+	if len(blockEvents) < blockEventsMax {
+		blockEvents = append(blockEvents, e)
+		return
+	}
+	blockEvents[blockEventsNext] = e
+	blockEventsNext = (blockEventsNext + 1) % blockEventsMax
+}
+
+// recentBlocks returns the recent block events, oldest first.
+func recentBlocks() []blockEvent {
+	blockEventsMu.Lock()
+	defer blockEventsMu.Unlock()
+	events := make([]blockEvent, 0, len(blockEvents))
+	events = append(events, blockEvents[blockEventsNext:]...)
+	return append(events, blockEvents[:blockEventsNext]...)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+)
+
+var errBodyTooLarge = errors.New("response body exceeds size limit")
+
+// bodyBuffers holds buffers for reading upstream response bodies, reused
+// between queries.
+var bodyBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// limitBody caps how much of an outbound fetch's body will be read. Every
+// response body read from the network should go through it so that a broken
+// or hostile server can't make the proxy buffer arbitrary amounts of data.
+func limitBody(r io.Reader) io.Reader {
+	return &bodyLimiter{r: r, remaining: *maxBodySize}
+}
+
+type bodyLimiter struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *bodyLimiter) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// Distinguish a body of exactly the limit from a longer one
+		var b [1]byte
+		if n, _ := l.r.Read(b[:]); n > 0 {
+			return 0, errBodyTooLarge
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// checkConfig validates the settings without binding, starting or writing
+// anything, and returns every problem found. Startup runs the same checks,
+// so settings that pass -check-config will start.
+func checkConfig() []error {
+	var errs []error
+	check := func(prefix string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s%v", prefix, err))
+		}
+	}
+
+	if *defaultServer == "" {
+		check("", fmt.Errorf("-default is required"))
+	} else if _, err := resolveUpstream(*defaultServer); err != nil {
+		check("-default: ", err)
+	} else if strings.Contains(*defaultServer, "://") {
+		check("-default: ", checkUpstreamURL(*defaultServer))
+	}
+	if presetGroup != nil {
+		for _, endpoint := range presetGroup.endpoints {
+			check("-preset: ", checkUpstreamURL(endpoint))
+		}
+	}
+	for _, group := range upstreamGroups {
+		for _, endpoint := range group.endpoints {
+			check("-upstream-group "+group.name+": ", checkUpstreamURL(endpoint))
+		}
+	}
+	_, err := upstreamDialer(*upstreamInterface, *upstreamSourceIP)
+	check("", err)
+	if *subnet != "" {
+		_, _, err = net.ParseCIDR(*subnet)
+		check("-subnet: ", err)
+	}
+	if *subnet6 != "" {
+		ip, _, err := net.ParseCIDR(*subnet6)
+		if err == nil && ip.To4() != nil {
+			err = fmt.Errorf("%s is not an IPv6 subnet", *subnet6)
+		}
+		check("-subnet6: ", err)
+	}
+	if *privacyECS {
+		if *subnet != "" || *subnet6 != "" {
+			check("", fmt.Errorf("-privacy-ecs conflicts with -subnet and -subnet6"))
+		}
+		for _, group := range upstreamGroups {
+			if group.subnet != "" && group.subnet != "none" {
+				check("", fmt.Errorf("-privacy-ecs conflicts with the subnet of upstream group %s", group.name))
+			}
+		}
+	}
+	switch *dohJSONMethod {
+	case methodGet, methodPost, methodPostJSON:
+	default:
+		check("", fmt.Errorf("-doh-json-method must be get, post or post-json"))
+	}
+	if *subnetPrefer != "ipv4" && *subnetPrefer != "ipv6" {
+		check("", fmt.Errorf("-subnet-prefer must be ipv4 or ipv6"))
+	}
+
+	switch *refuseAny {
+	case anyRefuse, anyMinimal, anyCached, anyForward:
+	default:
+		check("", fmt.Errorf("-refuse-any must be refuse, minimal, cache or forward"))
+	}
+	switch *rotateMode {
+	case rotateOff, rotateCounter, rotateShuffle:
+	default:
+		check("", fmt.Errorf("-rotate-answers must be rotate or shuffle"))
+	}
+	switch *filterAAAA {
+	case filterAAAAOff, filterAAAANoData, filterAAAAStrip:
+	default:
+		check("", fmt.Errorf("-filter-aaaa must be nodata or strip"))
+	}
+	if *udpQueueOverflow != overflowReject && *udpQueueOverflow != overflowDropOldest {
+		check("", fmt.Errorf("-udp-queue-overflow must be reject or drop-oldest"))
+	}
+	if *udpWorkerCount > 0 && *udpQueueSize < 1 {
+		check("", fmt.Errorf("-udp-queue must be at least 1"))
+	}
+	if *policyHookFail != "open" && *policyHookFail != "closed" {
+		check("", fmt.Errorf("-policy-hook-fail must be open or closed"))
+	}
+	if *policyHook != "" {
+		if u, err := url.Parse(*policyHook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			check("", fmt.Errorf("-policy-hook must be an http or https URL"))
+		}
+	}
+	if len(ipsets) > 0 {
+		if err := checkIPSetBackend(*ipsetBackend); err != nil {
+			check("", fmt.Errorf("-ipset: %v", err))
+		}
+	}
+	if *lockShards < 1 {
+		check("", fmt.Errorf("-lock-shards must be at least 1"))
+	}
+	if *hedgeRatio < 0 || *hedgeRatio > 1 {
+		check("", fmt.Errorf("-hedge-ratio must be between 0 and 1"))
+	}
+	if *aclAction != "refuse" && *aclAction != "drop" {
+		check("", fmt.Errorf("-acl-action must be refuse or drop"))
+	}
+	if *queryLogFormat != "" && *queryLogFormat != "json" {
+		check("", fmt.Errorf("-query-log-format must be json or empty"))
+	}
+	if *upstreamAttemptDelay <= 0 {
+		check("", fmt.Errorf("-upstream-attempt-delay must be positive"))
+	}
+	if *watchdogInterval > 0 {
+		if *watchdogFailures < 1 || *watchdogTimeout <= 0 {
+			check("", fmt.Errorf("-watchdog-failures must be at least 1 and -watchdog-timeout positive"))
+		}
+		check("", checkWatchdogActions(*watchdogAction))
+	}
+	if *failback && (*failbackProbes < 1 || *failbackInterval <= 0 || *failbackRamp < 0) {
+		check("", fmt.Errorf("-failback-probes must be at least 1, -failback-interval positive and -failback-ramp not negative"))
+	}
+	if *mdns && *mdnsTimeout <= 0 {
+		check("", fmt.Errorf("-mdns-timeout must be positive"))
+	}
+	if *mdnsInterface != "" {
+		_, err = net.InterfaceByName(*mdnsInterface)
+		check("-mdns-interface: ", err)
+	}
+	for _, domain := range searchDomains() {
+		if _, ok := dns.IsDomainName(domain); !ok || domain == "." {
+			check("", fmt.Errorf("-search: %q is not a domain name", domain))
+		}
+	}
+	if *searchNdots < 1 {
+		check("", fmt.Errorf("-search-ndots must be at least 1"))
+	}
+	if *queryLogDB != "" {
+		check("-query-log-db: ", checkQueryDB())
+		if *queryLogDBRetention <= 0 {
+			check("", fmt.Errorf("-query-log-db-retention must be positive"))
+		}
+	}
+	check("", checkAnonymize(*logAnonymize))
+	_, err = parseLogLevel(*logLevelName)
+	check("", err)
+	if *logSyslog {
+		_, err = syslogFacility(*syslogFacilityName)
+		check("-syslog-facility: ", err)
+	}
+
+	for _, f := range []struct{ name, value string }{
+		{"trusted-proxies", *trustedProxiesList},
+		{"client-qps-exempt", *clientQPSExempt},
+		{"rrl-exempt", *rrlExempt},
+	} {
+		_, err = parseCIDRSet(f.value)
+		check("-"+f.name+": ", err)
+	}
+	_, err = parseAllowFrom(*allowFrom, nil)
+	check("-allow-from: ", err)
+
+	if *rrlResponses > 0 && (*rrlIPv4Prefix < 0 || *rrlIPv4Prefix > 32 || *rrlIPv6Prefix < 0 || *rrlIPv6Prefix > 128) {
+		check("", fmt.Errorf("-rrl-ipv4-prefix and -rrl-ipv6-prefix must be valid prefix lengths"))
+	}
+	if *nxdomainBurst > 0 {
+		if *nxdomainBurstWindow < 2*time.Second {
+			check("", fmt.Errorf("-nxdomain-burst-window must be at least 2s"))
+		}
+		switch *dgaAction {
+		case "log":
+		case "limit":
+			if *dgaQPS <= 0 {
+				check("", fmt.Errorf("-dga-qps must be positive"))
+			}
+		default:
+			check("", fmt.Errorf("-dga-action must be log or limit"))
+		}
+	}
+	if *dnsCookies && *cookieSecretRotation <= 0 {
+		check("", fmt.Errorf("-cookie-secret-rotation must be positive"))
+	}
+
+	errs = append(errs, checkListenAddrs()...)
+	if *listenTLSAddr != "" || *listenQUICAddr != "" {
+		check("-tls-cert: ", (&certReloader{certFile: *tlsCert, keyFile: *tlsKey}).Reload())
+	}
+	if *quicMaxStreams < 1 {
+		check("", fmt.Errorf("-quic-max-streams must be at least 1"))
+	}
+	if *dohCert != "" || *dohKey != "" {
+		check("-doh-cert: ", (&certReloader{certFile: *dohCert, keyFile: *dohKey}).Reload())
+	}
+	return errs
+}
+
+// checkListenAddrs checks the -listen-* addresses are well formed, without
+// binding them. Listeners from socket activation are not known until then.
+func checkListenAddrs() []error {
+	var errs []error
+	for _, t := range []struct{ name, addrs string }{
+		{"listen-udp", *listenUDP},
+		{"listen-tcp", *listenTCP},
+		{"listen-unix", *listenUnixPath},
+		{"listen-tls", *listenTLSAddr},
+	} {
+		for _, spec := range splitList(t.addrs) {
+			addr, _, err := parseListenSpec(spec)
+			if err == nil && t.name != "listen-unix" {
+				err = checkHostPort(addr)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("-%s: %v", t.name, err))
+			}
+		}
+	}
+	if *listenDoH != "" {
+		if err := checkHostPort(*listenDoH); err != nil {
+			errs = append(errs, fmt.Errorf("-listen-doh: %v", err))
+		}
+	}
+	for _, addr := range splitList(*listenQUICAddr) {
+		if err := checkHostPort(addr); err != nil {
+			errs = append(errs, fmt.Errorf("-listen-quic: %v", err))
+		}
+	}
+	if *listenUnixPath != "" {
+		if _, err := strconv.ParseUint(*listenUnixMode, 8, 32); err != nil {
+			errs = append(errs, fmt.Errorf("invalid -listen-unix-mode %q: %v", *listenUnixMode, err))
+		}
+	}
+	if *listenInterface != "" {
+		if _, err := listenControl(false); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// checkHostPort checks that addr is a host:port with a numeric port.
+func checkHostPort(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("address %s: invalid port %q", addr, port)
+	}
+	return nil
+}
+
+// checkUpstreamURL checks that endpoint is an absolute http or https URL.
+func checkUpstreamURL(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("%q is not an http or https URL", endpoint)
+	}
+	return nil
+}
+
+// runCheckConfig implements -check-config, printing the problems found and
+// returning the exit status.
+func runCheckConfig() int {
+	errs := checkConfig()
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "%d problems found\n", len(errs))
+		return 1
+	}
+	fmt.Println("Configuration OK")
+	return 0
+}
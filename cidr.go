@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// cidrSet is a compiled set of network prefixes. Lookups cost one map probe
+// per distinct prefix length in the set rather than one comparison per
+// prefix.
+type cidrSet struct {
+	v4, v6 prefixTable
+}
+
+// prefixTable maps a prefix length to the set of masked network addresses
+// of that length.
+type prefixTable struct {
+	lengths []int
+	nets    map[int]map[string]struct{}
+}
+
+func (t *prefixTable) add(ip net.IP, ones int) {
+	if t.nets == nil {
+		t.nets = make(map[int]map[string]struct{})
+	}
+	nets, ok := t.nets[ones]
+	if !ok {
+		nets = make(map[string]struct{})
+		t.nets[ones] = nets
+		t.lengths = append(t.lengths, ones)
+	}
+	nets[string(ip.Mask(net.CIDRMask(ones, len(ip)*8)))] = struct{}{}
+}
+
+func (t *prefixTable) contains(ip net.IP) bool {
+	for _, ones := range t.lengths {
+		if _, ok := t.nets[ones][string(ip.Mask(net.CIDRMask(ones, len(ip)*8)))]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRSet compiles a comma-separated list of CIDRs. Bare addresses are
+// accepted as single-host prefixes.
+func parseCIDRSet(value string) (*cidrSet, error) {
+	s := &cidrSet{}
+	for _, v := range splitList(value) {
+		if err := s.Add(v); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Add inserts a CIDR or bare address into the set.
+func (s *cidrSet) Add(cidr string) error {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return fmt.Errorf("invalid address %q", cidr)
+		}
+		if ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR %q", cidr)
+	}
+	ones, _ := ipnet.Mask.Size()
+	if ip4 := ipnet.IP.To4(); ip4 != nil {
+		s.v4.add(ip4, ones)
+	} else {
+		s.v6.add(ipnet.IP.To16(), ones)
+	}
+	return nil
+}
+
+// Contains reports whether ip falls within any prefix of the set.
+func (s *cidrSet) Contains(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		return s.v4.contains(ip4)
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return s.v6.contains(ip16)
+	}
+	return false
+}
+
+// Empty reports whether the set holds no prefixes.
+func (s *cidrSet) Empty() bool {
+	return len(s.v4.lengths) == 0 && len(s.v6.lengths) == 0
+}
+
+// addrIP extracts the IP address of a network address, or nil.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
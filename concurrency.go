@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// upstreamSlots bounds the number of queries waiting on the upstream at once.
+// It is nil when -max-concurrent is unset.
+var upstreamSlots chan struct{}
+
+func initUpstreamSlots() {
+	if *maxConcurrent > 0 {
+		upstreamSlots = make(chan struct{}, *maxConcurrent)
+	}
+}
+
+// acquireUpstreamSlot reserves a slot for an upstream request, waiting up to
+// -max-concurrent-wait for one to free up. It reports false if the query
+// should be refused instead.
+func acquireUpstreamSlot(ctx context.Context) bool {
+	if upstreamSlots == nil {
+		return true
+	}
+	select {
+	case upstreamSlots <- struct{}{}:
+		return true
+	default:
+	}
+	if *maxConcurrentWait <= 0 {
+		stats.QueriesRejected.Inc()
+		return false
+	}
+
+	stats.QueriesQueued.Inc()
+	timer := time.NewTimer(*maxConcurrentWait)
+	defer timer.Stop()
+	select {
+	case upstreamSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	stats.QueriesRejected.Inc()
+	return false
+}
+
+// tryUpstreamSlot reserves a slot for an upstream request if one is free.
+func tryUpstreamSlot() bool {
+	if upstreamSlots == nil {
+		return true
+	}
+	select {
+	case upstreamSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func releaseUpstreamSlot() {
+	if upstreamSlots != nil {
+		<-upstreamSlots
+	}
+}
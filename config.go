@@ -0,0 +1,281 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configSections maps the keys of config file mappings onto the flags they
+// set. Top-level keys are flag names.
+var configSections = map[string]map[string]string{
+	"listen": {
+		"udp":  "listen-udp",
+		"tcp":  "listen-tcp",
+		"tls":  "listen-tls",
+		"unix": "listen-unix",
+		"doh":  "listen-doh",
+		"quic": "listen-quic",
+	},
+	"upstream": {
+		"url": "default",
+	},
+}
+
+// Keys allowed in each item of groups, which defines an -upstream-group.
+var groupKeys = map[string]bool{"name": true, "urls": true, "policy": true, "subnet": true}
+
+// cmdlineFlags records the flags given on the command line, before a
+// config file first set any.
+var cmdlineFlags map[string]bool
+
+// recordCmdlineFlags fills in cmdlineFlags, once.
+func recordCmdlineFlags() {
+	if cmdlineFlags == nil {
+		cmdlineFlags = make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { cmdlineFlags[f.Name] = true })
+	}
+}
+
+// flagSet reports whether a flag was given on the command line, in the
+// environment or in the config file.
+func flagSet(name string) bool {
+	if _, ok := envFlags[name]; ok {
+		return true
+	}
+	set := false
+	flag.Visit(func(f *flag.Flag) { set = set || f.Name == name })
+	return set
+}
+
+// configured holds the flag values the config file last set.
+var configured map[string]string
+
+// reloadableFlags are the settings a config reload applies at runtime. The
+// others only take effect on restart.
+var reloadableFlags = map[string]func(value string){
+	"default":   setUpstream,
+	"log-level": reloadLogLevel,
+	"debug":     reloadLogLevel,
+	"quiet":     reloadLogLevel,
+
+	"upstream-group": setUpstreamGroups,
+	"allow-from":     setAllowFrom,
+	"ttl-override":   setTTLOverrides,
+}
+
+// loadConfig applies the settings of a YAML config file to the flags.
+// Flags given on the command line or in the environment take precedence
+// over the file.
+func loadConfig(path string) error {
+	recordCmdlineFlags()
+	settings, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	for name, value := range settings {
+		flag.Set(name, value)
+	}
+	configured = settings
+	return nil
+}
+
+// reloadConfig rereads the config file, applying changes to the settings
+// in reloadableFlags and logging the others as needing a restart. If the
+// file is invalid the current configuration is kept.
+func reloadConfig(path string) {
+	settings, err := readConfig(path)
+	if err != nil {
+		metrics.ConfigReloads.With("failure").Inc()
+		warnf("Cannot reload %s, keeping the current configuration: %v", path, err)
+		return
+	}
+
+	var names []string
+	for name := range configured {
+		names = append(names, name)
+	}
+	for name := range settings {
+		if _, ok := configured[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	// The groups go first, so that -default can name a new one
+	sort.Slice(names, func(i, j int) bool {
+		if first := names[i] == "upstream-group"; first != (names[j] == "upstream-group") {
+			return first
+		}
+		return names[i] < names[j]
+	})
+	for _, name := range names {
+		f := flag.Lookup(name)
+		value, ok := settings[name]
+		if !ok {
+			// Removed from the file, so back to the default
+			value = f.DefValue
+		}
+		if value == f.Value.String() {
+			continue
+		}
+		apply := reloadableFlags[name]
+		if apply == nil {
+			warnf("Setting %s changed in %s, restart required to apply it", name, path)
+			continue
+		}
+		if r, ok := f.Value.(interface{ Reset() }); ok {
+			// The value accumulates repeated flags; the file's replaces it
+			r.Reset()
+		}
+		if err := f.Value.Set(value); err != nil {
+			// Values were checked by readConfig
+			continue
+		}
+		apply(value)
+		infof("Reloaded %s = %q", name, value)
+	}
+	configured = settings
+	metrics.ConfigReloads.With("success").Inc()
+	infof("Reloaded configuration from %s", path)
+	logEffectiveConfig()
+}
+
+func reloadLogLevel(string) {
+	if err := setLogLevel(); err != nil {
+		warnf("Keeping the current log level: %v", err)
+	}
+}
+
+// readConfig parses a config file into the flag values it sets, leaving
+// out flags given on the command line or in the environment. Values are
+// checked and returned in the flag's own format, so they can be compared
+// with current values.
+func readConfig(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values, err := parseConfigFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	settings := make(map[string]string)
+	groups := make(map[string]map[string]string)
+	var groupTables []string
+	for _, v := range values {
+		if len(v.Path) == 2 && strings.HasPrefix(v.Path[0], "groups[") {
+			value, err := configString(v.Value)
+			if err == nil && !groupKeys[v.Path[1]] {
+				err = fmt.Errorf("unknown key")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s: %v", path, v.Line, v.Key(), err)
+			}
+			if groups[v.Path[0]] == nil {
+				groups[v.Path[0]] = make(map[string]string)
+				groupTables = append(groupTables, v.Path[0])
+			}
+			groups[v.Path[0]][v.Path[1]] = value
+			continue
+		}
+		name, err := configFlag(v.Path)
+		if err == nil {
+			var value string
+			if value, err = configString(v.Value); err == nil {
+				value, err = checkFlagValue(flag.Lookup(name), value)
+			}
+			if err == nil && !cmdlineFlags[name] && envFlags[name] == "" {
+				settings[name] = value
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %v", path, v.Line, v.Key(), err)
+		}
+	}
+
+	// The groups together make up -upstream-group
+	if len(groupTables) > 0 && !cmdlineFlags["upstream-group"] && envFlags["upstream-group"] == "" {
+		var specs []string
+		for _, table := range groupTables {
+			g := groups[table]
+			if g["name"] == "" || g["urls"] == "" {
+				return nil, fmt.Errorf("%s: %s: name and urls are required", path, table)
+			}
+			spec := g["name"] + "=" + g["urls"]
+			for _, key := range []string{"policy", "subnet"} {
+				if g[key] != "" {
+					spec += ";" + key + "=" + g[key]
+				}
+			}
+			specs = append(specs, spec)
+		}
+		value, err := checkFlagValue(flag.Lookup("upstream-group"), strings.Join(specs, " "))
+		if err != nil {
+			return nil, fmt.Errorf("%s: groups: %v", path, err)
+		}
+		settings["upstream-group"] = value
+	}
+	return settings, nil
+}
+
+// checkFlagValue parses value as f would without changing f, returning it
+// formatted as f formats its value.
+func checkFlagValue(f *flag.Flag, value string) (string, error) {
+	scratch, ok := reflect.New(reflect.TypeOf(f.Value).Elem()).Interface().(flag.Value)
+	if !ok {
+		return value, nil
+	}
+	if err := scratch.Set(value); err != nil {
+		return "", err
+	}
+	return scratch.String(), nil
+}
+
+// configFlag returns the name of the flag a config file key sets.
+func configFlag(path []string) (string, error) {
+	key := path[len(path)-1]
+	if len(path) == 1 {
+		if key == "config" {
+			return "", fmt.Errorf("cannot be set in a config file")
+		}
+		if flag.Lookup(key) == nil {
+			return "", fmt.Errorf("unknown key")
+		}
+		return key, nil
+	}
+
+	section, ok := configSections[path[0]]
+	if !ok {
+		return "", fmt.Errorf("unknown mapping %s", path[0])
+	}
+	if name, ok := section[key]; ok {
+		return name, nil
+	}
+	return "", fmt.Errorf("unknown key")
+}
+
+// configString formats a config file value as a flag value. Lists become
+// the comma-separated lists that list flags take.
+func configString(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i], _ = configString(item)
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
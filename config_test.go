@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// answerUpstream serves example.com A addr to every query once release,
+// if not nil, is closed, reporting each request on started.
+func answerUpstream(t *testing.T, addr string, started chan<- struct{}, release <-chan struct{}) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if started != nil {
+			started <- struct{}{}
+		}
+		if release != nil {
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/dns-json")
+		fmt.Fprintf(w, `{"Status":0,"Question":[{"name":"example.com.","type":1}],`+
+			`"Answer":[{"name":"example.com.","type":1,"TTL":300,"data":%q}]}`, addr)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/resolve"
+}
+
+func writeConfig(t *testing.T, path, endpoint string, ttl int) {
+	config := fmt.Sprintf(`default: "lan"
+ttl-override: ["example.com:%d"]
+groups:
+  - name: "lan"
+    urls: [%q]
+`, ttl, endpoint)
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// resolveExample sends a query for example.com through forward, as a
+// listener would, returning the response.
+func resolveExample(t *testing.T) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	w := &captureWriter{ResponseWriter: &httpResponseWriter{
+		local:  &net.TCPAddr{},
+		remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 53), Port: 5353},
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	forward(ctx, w, req)
+	if w.msg == nil || len(w.msg.Answer) != 1 {
+		t.Fatalf("got response %v, want one address", w.msg)
+	}
+	return w.msg
+}
+
+func TestReloadWithQueriesInFlight(t *testing.T) {
+	oldDefault := *defaultServer
+	t.Cleanup(func() {
+		*defaultServer = oldDefault
+		upstreamGroups.Reset()
+		activeGroups.Store(upstreamGroups)
+		ttlOverrides = nil
+		activeTTLRules.Store(ttlRules(nil))
+		configured = nil
+	})
+
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	before := answerUpstream(t, "192.0.2.1", started, release)
+	after := answerUpstream(t, "192.0.2.2", nil, nil)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, before, 600)
+	if err := loadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	setUpstreamGroups("")
+	activeTTLRules.Store(ttlOverrides)
+
+	inFlight := make(chan *dns.Msg, 1)
+	go func() { inFlight <- resolveExample(t) }()
+	<-started
+
+	writeConfig(t, path, after, 60)
+	reloadConfig(path)
+	a := resolveExample(t).Answer[0].(*dns.A)
+	if a.A.String() != "192.0.2.2" || a.Hdr.Ttl != 60 {
+		t.Errorf("query after the reload got %v, want 192.0.2.2 from the new group with TTL 60", a)
+	}
+
+	close(release)
+	a = (<-inFlight).Answer[0].(*dns.A)
+	if a.A.String() != "192.0.2.1" || a.Hdr.Ttl != 600 {
+		t.Errorf("query in flight across the reload got %v, want 192.0.2.1 with the old TTL 600", a)
+	}
+}
+
+func TestReloadAllowFrom(t *testing.T) {
+	t.Cleanup(func() { allowFromACL.Store((*accessList)(nil)) })
+	answered := false
+	handler := allowFromHandler(dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		answered = true
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		w.WriteMsg(resp)
+	}))
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	query := func(remote string) bool {
+		answered = false
+		dohExchange(t, handler, remote, req)
+		return answered
+	}
+
+	setAllowFrom("192.0.2.0/24")
+	if !query("192.0.2.7:4000") || query("198.51.100.7:4000") {
+		t.Error("-allow-from 192.0.2.0/24 not applied")
+	}
+	setAllowFrom("198.51.100.0/24")
+	if query("192.0.2.7:4000") || !query("198.51.100.7:4000") {
+		t.Error("reloaded -allow-from 198.51.100.0/24 not applied")
+	}
+	setAllowFrom("not a network")
+	if !query("198.51.100.7:4000") {
+		t.Error("an invalid -allow-from replaced the one in use")
+	}
+}
+
+// fullConfig sets a flag of each kind, every listen key, a group and the
+// upstream, and exercises the config file's every form.
+const fullConfig = `debug: true
+timeout: "3s"
+allow-from: ["private", "100.64.0.0/10"]
+client-qps: 50.5
+client-burst: 100
+client-qps-exempt:
+  - 127.0.0.0/8
+  - "::1"
+refuse-any: "minimal"
+max-answers: 64
+ttl-override: ["corp.example:600", "dyn.example.net:15"]
+query-log-format: "json"
+
+listen:
+  udp: ["127.0.0.1:5353", "[::1]:5353"]
+  tcp: ["127.0.0.1:5353"]
+  tls: [":8853"]
+  unix: "/run/dns-over-https-proxy.sock"
+  doh: ":8443"
+  quic: [":8853"]
+
+upstream:
+  url: "privacy"
+
+groups:
+  - name: "privacy"
+    urls: ["https://a.example/resolve", "https://b.example/resolve"]
+    policy: "round-robin"
+    subnet: "none"
+  - name: "lan"
+    urls: ["https://lan.example/resolve"]
+`
+
+func TestConfigRoundTrip(t *testing.T) {
+	saved := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) { saved[f.Name] = f.Value.String() })
+	t.Cleanup(func() {
+		flag.VisitAll(func(f *flag.Flag) {
+			if f.Name != "upstream-group" && f.Value.String() != saved[f.Name] {
+				f.Value.Set(saved[f.Name])
+			}
+		})
+		upstreamGroups.Reset()
+		activeGroups.Store(upstreamGroups)
+		configured = nil
+	})
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(fullConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want, err := readConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"debug", "client-qps-exempt", "listen-quic", "default", "upstream-group"} {
+		if want[name] == "" {
+			t.Errorf("%s not set by the file", name)
+		}
+	}
+	if err := loadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// The effective configuration, read back, sets the flags the same way
+	var effective bytes.Buffer
+	writeEffectiveConfig(&effective)
+	// Leaving out the flags of the test binary itself
+	var lines []string
+	for _, line := range strings.Split(effective.String(), "\n") {
+		if !strings.HasPrefix(line, "test.") {
+			lines = append(lines, line)
+		}
+	}
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readConfig(path)
+	if err != nil {
+		t.Fatalf("reading the effective configuration: %v\n%s", err, effective.String())
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("%s round-tripped as %q, want %q", name, got[name], value)
+		}
+	}
+}
+
+func TestExampleConfig(t *testing.T) {
+	if _, err := readConfig("config.example.yaml"); err != nil {
+		t.Error(err)
+	}
+}
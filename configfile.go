@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configValue is one key of a parsed config file. Path holds the mapping
+// names and the key; the mappings of a list are numbered, as in
+// "groups[1]".
+type configValue struct {
+	Path  []string
+	Value interface{} // string, int64, float64, bool or []interface{}
+	Line  int
+}
+
+// Key returns the dotted path of the value, for error messages.
+func (v configValue) Key() string {
+	return strings.Join(v.Path, ".")
+}
+
+// parseConfigFile parses a YAML config file. Its keys hold values, lists
+// of values, or, at the top level, mappings of those or lists of such
+// mappings. Keys are returned in document order.
+func parseConfigFile(data []byte) ([]configValue, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	p := &configParser{seen: make(map[string]int)}
+	if err := p.mapping(doc.Content[0], nil); err != nil {
+		return nil, err
+	}
+	return p.values, nil
+}
+
+type configParser struct {
+	values []configValue
+	seen   map[string]int // key to the line it was set on
+}
+
+func (p *configParser) mapping(node *yaml.Node, path []string) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: expected a mapping of keys to values", node.Line)
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k, v := node.Content[i], node.Content[i+1]
+		if v.Kind == yaml.AliasNode {
+			v = v.Alias
+		}
+		if k.Kind != yaml.ScalarNode || k.Value == "" {
+			return fmt.Errorf("line %d: expected a key", k.Line)
+		}
+		keyPath := append(append([]string(nil), path...), k.Value)
+		key := strings.Join(keyPath, ".")
+		if prev, ok := p.seen[key]; ok {
+			return fmt.Errorf("line %d: %s already set on line %d", k.Line, key, prev)
+		}
+		p.seen[key] = k.Line
+
+		nested := v.Kind == yaml.MappingNode ||
+			v.Kind == yaml.SequenceNode && len(v.Content) > 0 && v.Content[0].Kind == yaml.MappingNode
+		if nested && len(path) > 0 {
+			return fmt.Errorf("line %d: %s: mappings can only be nested one level", v.Line, key)
+		}
+		switch {
+		case v.Kind == yaml.MappingNode:
+			if err := p.mapping(v, keyPath); err != nil {
+				return err
+			}
+		case nested:
+			for j, item := range v.Content {
+				if err := p.mapping(item, []string{fmt.Sprintf("%s[%d]", k.Value, j)}); err != nil {
+					return err
+				}
+			}
+		case v.Kind == yaml.SequenceNode:
+			items := []interface{}{}
+			for _, item := range v.Content {
+				value, err := configScalar(item)
+				if err != nil {
+					return err
+				}
+				items = append(items, value)
+			}
+			p.values = append(p.values, configValue{Path: keyPath, Value: items, Line: k.Line})
+		default:
+			value, err := configScalar(v)
+			if err != nil {
+				return err
+			}
+			p.values = append(p.values, configValue{Path: keyPath, Value: value, Line: k.Line})
+		}
+	}
+	return nil
+}
+
+// configScalar returns the value of a scalar node. Integers must be
+// decimal, as YAML 1.2 has them, rather than anything strconv.ParseInt
+// takes with base 0.
+func configScalar(node *yaml.Node) (interface{}, error) {
+	if node.Kind != yaml.ScalarNode {
+		return nil, fmt.Errorf("line %d: expected a value, lists of lists are not supported", node.Line)
+	}
+	switch node.ShortTag() {
+	case "!!str":
+		return node.Value, nil
+	case "!!bool":
+		var b bool
+		if err := node.Decode(&b); err != nil {
+			return nil, err
+		}
+		return b, nil
+	case "!!int":
+		n, err := strconv.ParseInt(node.Value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s is not a decimal integer", node.Line, node.Value)
+		}
+		return n, nil
+	case "!!float":
+		var f float64
+		if err := node.Decode(&f); err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	return nil, fmt.Errorf("line %d: expected a value, found %s", node.Line, node.ShortTag())
+}
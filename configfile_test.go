@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfigFile(t *testing.T) {
+	values, err := parseConfigFile([]byte(`# comment
+debug: true
+timeout: "5s"
+client-qps: 50.5
+max-answers: 064
+allow-from: [private, "100.64.0.0/10"]
+client-qps-exempt:
+  - 127.0.0.0/8
+  - "::1"
+listen:
+  udp: ["127.0.0.1:53"]
+groups:
+  - name: lan
+    urls: ["https://a.example/resolve"]
+  - name: wan
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []configValue{
+		{[]string{"debug"}, true, 2},
+		{[]string{"timeout"}, "5s", 3},
+		{[]string{"client-qps"}, 50.5, 4},
+		{[]string{"max-answers"}, int64(64), 5},
+		{[]string{"allow-from"}, []interface{}{"private", "100.64.0.0/10"}, 6},
+		{[]string{"client-qps-exempt"}, []interface{}{"127.0.0.0/8", "::1"}, 7},
+		{[]string{"listen", "udp"}, []interface{}{"127.0.0.1:53"}, 11},
+		{[]string{"groups[0]", "name"}, "lan", 13},
+		{[]string{"groups[0]", "urls"}, []interface{}{"https://a.example/resolve"}, 14},
+		{[]string{"groups[1]", "name"}, "wan", 15},
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("got\n%v\nwant\n%v", values, want)
+	}
+
+	if values, err := parseConfigFile([]byte("# nothing set\n")); err != nil || len(values) != 0 {
+		t.Errorf("an empty file gave %v, %v", values, err)
+	}
+}
+
+func TestParseConfigFileErrors(t *testing.T) {
+	for _, c := range []struct {
+		config, err string
+	}{
+		{"max-answers: 0x40", "0x40 is not a decimal integer"},
+		{"max-answers: 0o100", "0o100 is not a decimal integer"},
+		{"timeout: 5s\ntimeout: 6s", "line 2: timeout already set on line 1"},
+		{"listen:\n  udp:\n    inner: x", "mappings can only be nested one level"},
+		{"allow-from: [[a, b]]", "lists of lists are not supported"},
+		{"default:", "expected a value"},
+		{"- just\n- a list", "expected a mapping"},
+		{"timeout: \"5s", "yaml:"},
+	} {
+		_, err := parseConfigFile([]byte(c.config))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("parsing %q: got error %v, want %q", c.config, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// connListener wraps a TCP listener so that query handlers can find the
+// connection their client is using and notice when it goes away.
+type connListener struct {
+	net.Listener
+}
+
+var (
+	clientConnsMu sync.Mutex
+	clientConns   = make(map[string]*trackedConn)
+)
+
+func connKey(local, remote net.Addr) string {
+	return local.String() + "|" + remote.String()
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &trackedConn{Conn: c}, nil
+}
+
+// limitListener caps the number of simultaneously open connections accepted
+// from ln; connections over the limit are closed straight away. A max of
+// zero or less means no limit. Open connections are counted in open and
+// refused ones in rejected.
+func limitListener(ln net.Listener, max int, open *gauge, rejected *counter) net.Listener {
+	l := &connLimiter{
+		Listener: ln,
+		open:     open,
+		rejected: rejected,
+		logger:   newLogEvery(time.Minute),
+	}
+	if max > 0 {
+		l.slots = make(chan struct{}, max)
+	}
+	return l
+}
+
+type connLimiter struct {
+	net.Listener
+	slots    chan struct{}
+	open     *gauge
+	rejected *counter
+	logger   *logEvery
+}
+
+func (l *connLimiter) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.slots == nil {
+			l.open.Inc()
+			return &limitedConn{Conn: c, release: l.open.Dec}, nil
+		}
+		select {
+		case l.slots <- struct{}{}:
+			l.open.Inc()
+			return &limitedConn{Conn: c, release: func() {
+				l.open.Dec()
+				<-l.slots
+			}}, nil
+		default:
+			l.rejected.Inc()
+			l.logger.Printf("Connection limit of %d reached on %s, refusing connections",
+				cap(l.slots), l.Addr())
+			c.Close()
+		}
+	}
+}
+
+// limitedConn gives its slot back to the connLimiter when closed.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// lookupConn returns the tracked TCP connection behind w, or nil for UDP
+// and untracked connections.
+func lookupConn(w dns.ResponseWriter) *trackedConn {
+	clientConnsMu.Lock()
+	defer clientConnsMu.Unlock()
+	return clientConns[connKey(w.LocalAddr(), w.RemoteAddr())]
+}
+
+// trackedConn is a client TCP connection which can be watched for
+// disconnection while a query on it is being resolved. It is tracked once
+// its first Read returns, by when a PROXY protocol header has given its
+// remote address.
+type trackedConn struct {
+	net.Conn
+	once sync.Once
+	key  string // under clientConnsMu
+
+	mu      sync.Mutex
+	pending []byte
+}
+
+func (c *trackedConn) track() {
+	key := connKey(c.Conn.LocalAddr(), c.Conn.RemoteAddr())
+	clientConnsMu.Lock()
+	c.key = key
+	clientConns[key] = c
+	clientConnsMu.Unlock()
+}
+
+// Read returns any bytes consumed while watching the connection before
+// reading from the network again.
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.read(p)
+	c.once.Do(c.track)
+	return n, err
+}
+
+func (c *trackedConn) read(p []byte) (int, error) {
+	c.mu.Lock()
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	c.mu.Unlock()
+	if n == 0 {
+		return c.Conn.Read(p)
+	}
+	if n == len(p) {
+		return n, nil
+	}
+	m, err := c.Conn.Read(p[n:])
+	return n + m, err
+}
+
+func (c *trackedConn) Close() error {
+	clientConnsMu.Lock()
+	if c.key != "" {
+		delete(clientConns, c.key)
+	}
+	clientConnsMu.Unlock()
+	return c.Conn.Close()
+}
+
+// watch returns a context which is cancelled if the client closes the
+// connection. The DNS server does not read from the connection while a
+// handler runs, so a blocking read here only completes on disconnection or
+// when the client pipelines its next query, which is kept for the server.
+// The returned stop function must be called before the handler returns.
+func (c *trackedConn) watch(parent context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	done := make(chan struct{})
+
+	c.Conn.SetReadDeadline(time.Time{})
+	go func() {
+		defer close(done)
+		var b [1]byte
+		n, err := c.Conn.Read(b[:])
+		if n > 0 {
+			c.mu.Lock()
+			c.pending = append(c.pending, b[:n]...)
+			c.mu.Unlock()
+			return
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return
+		}
+		cancel()
+	}()
+
+	return ctx, func() {
+		c.Conn.SetReadDeadline(time.Now())
+		<-done
+		cancel()
+	}
+}
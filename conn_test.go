@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamCancelledOnDisconnect(t *testing.T) {
+	started := make(chan struct{}, 1)
+	cancelled := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer srv.Close()
+	upstream.Store(&upstreamGroup{name: "default", endpoints: []string{srv.URL + "/resolve"}, policy: policyFailover})
+	defer func(d time.Duration) { *timeout = d }(*timeout)
+	*timeout = time.Minute
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{Listener: &connListener{ln}, Net: "tcp", Handler: dns.HandlerFunc(route)}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	conn, err := dns.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("disconnect.example.com.", dns.TypeA)
+	if err := conn.WriteMsg(req); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the query never reached the upstream")
+	}
+	conn.Close()
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upstream request outlived the client's connection")
+	}
+}
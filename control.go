@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The control socket takes one command line per connection and answers
+// with any output, then "ok" or "error: <reason>" as the last line.
+
+const controlTimeout = 10 * time.Second
+
+var controlListener net.Listener
+
+// serveControl listens on the -control-socket path. Only the owner may use
+// the socket, which is what authenticates commands.
+func serveControl(path string) error {
+	ln, err := listenUnixSocket(path, 0600)
+	if err != nil {
+		return fmt.Errorf("-control-socket: %v", err)
+	}
+	controlListener = ln
+	infof("Listening for control commands on %s", path)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleControl(conn)
+		}
+	}()
+	return nil
+}
+
+// closeControl stops the control socket, removing the socket file.
+func closeControl() {
+	if controlListener != nil {
+		controlListener.Close()
+	}
+}
+
+func handleControl(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+	line, err := bufio.NewReader(io.LimitReader(conn, 4096)).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	out := bufio.NewWriter(conn)
+	defer out.Flush()
+	if err := runControl(strings.Fields(line), out); err != nil {
+		fmt.Fprintf(out, "error: %v\n", err)
+		return
+	}
+	fmt.Fprintln(out, "ok")
+}
+
+// runControl carries out a control command, writing its output to out.
+func runControl(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("empty command, try help")
+	}
+	switch args[0] {
+	case "help":
+		fmt.Fprint(out, controlHelp)
+		return nil
+	case "stats":
+		writeStats(func(format string, v ...interface{}) { fmt.Fprintf(out, format+"\n", v...) })
+		return nil
+	case "upstreams":
+		for _, e := range upstreamStates() {
+			fmt.Fprintf(out, "group=%s endpoint=%s state=%s failed=%s\n", e.Group, e.Endpoint, e.State, e.Failed)
+		}
+		return nil
+	case "log-level":
+		if len(args) != 2 {
+			return errors.New("usage: log-level error|warn|info|debug")
+		}
+		level, err := parseLogLevel(args[1])
+		if err != nil {
+			return err
+		}
+		atomic.StoreInt32(&logLevel, level)
+		log.Printf("Control: log level set to %s", args[1])
+		return nil
+	case "drain", "undrain":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: %s <endpoint>", args[0])
+		}
+		return setDrained(args[1], args[0] == "drain", "Control")
+	case "flush", "block", "unblock":
+		return errNoCache(args[0])
+	}
+	return fmt.Errorf("unknown command %q, try help", args[0])
+}
+
+const controlHelp = `stats                 statistics, as SIGUSR1 logs them
+upstreams             the endpoints of the upstream group and their state
+log-level LEVEL       change the log level until the next reload
+drain ENDPOINT        stop sending queries to an endpoint
+undrain ENDPOINT      send queries to a drained endpoint again
+`
+
+// endpointState is an endpoint of the upstream group and its health.
+type endpointState struct {
+	Group    string `json:"group"`
+	Endpoint string `json:"endpoint"`
+	State    string `json:"state"`
+	Failed   string `json:"failed"`
+}
+
+// upstreamStates returns the endpoints of the upstream group, up, down or
+// drained, with their failed requests.
+func upstreamStates() []endpointState {
+	group := currentUpstream()
+	states := make([]endpointState, len(group.endpoints))
+	for i, endpoint := range group.endpoints {
+		state := "up"
+		if _, drained := drainedEndpoints.Load(endpoint); drained {
+			state = "drained"
+		} else if endpointDown(endpoint) {
+			state = "down"
+		}
+		states[i] = endpointState{Group: group.name, Endpoint: endpoint, State: state, Failed: upstreamErrors(endpoint)}
+	}
+	return states
+}
+
+// setDrained marks an endpoint of the upstream group down for maintenance,
+// or up again, logging who asked.
+func setDrained(endpoint string, drain bool, caller string) error {
+	if !groupHasEndpoint(currentUpstream(), endpoint) {
+		return fmt.Errorf("%s is not an endpoint of upstream group %s", endpoint, currentUpstream().name)
+	}
+	if drain {
+		drainedEndpoints.Store(endpoint, true)
+		log.Printf("%s: upstream %s marked down for maintenance", caller, endpoint)
+	} else {
+		drainedEndpoints.Delete(endpoint)
+		log.Printf("%s: upstream %s marked up", caller, endpoint)
+		markEndpointUp(endpoint)
+	}
+	return nil
+}
+
+// errNoCache is the error of the cache and blocklist commands.
+func errNoCache(command string) error {
+	return fmt.Errorf("%s: this proxy has no cache or blocklist", command)
+}
+
+func groupHasEndpoint(g *upstreamGroup, endpoint string) bool {
+	for _, e := range g.endpoints {
+		if e == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// runCtl implements the ctl subcommand, sending a command to the control
+// socket of a running proxy and printing the answer. It returns the exit
+// status.
+func runCtl(args []string) int {
+	if *controlSocket == "" {
+		fmt.Fprintln(os.Stderr, "ctl: -control-socket is not set")
+		return 2
+	}
+	conn, err := net.DialTimeout("unix", *controlSocket, controlTimeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ctl:", err)
+		return 1
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+	if _, err := fmt.Fprintln(conn, strings.Join(args, " ")); err != nil {
+		fmt.Fprintln(os.Stderr, "ctl:", err)
+		return 1
+	}
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ctl:", err)
+		return 1
+	}
+	lines := strings.Split(strings.TrimSuffix(string(reply), "\n"), "\n")
+	last := lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		fmt.Println(line)
+	}
+	if last != "ok" {
+		fmt.Fprintln(os.Stderr, last)
+		return 1
+	}
+	return 0
+}
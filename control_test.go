@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startControl serves the control socket in a temporary directory,
+// returning a function sending it a command and returning the reply.
+func startControl(t *testing.T) (path string, send func(command string) string) {
+	path = filepath.Join(t.TempDir(), "control.sock")
+	if err := serveControl(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(closeControl)
+	return path, func(command string) string {
+		conn, err := net.DialTimeout("unix", path, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintln(conn, command)
+		reply, err := ioutil.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(reply)
+	}
+}
+
+func TestControlSocket(t *testing.T) {
+	endpoint := "https://a.example/resolve"
+	upstream.Store(&upstreamGroup{name: "default", endpoints: []string{endpoint}, policy: policyFailover})
+	defer drainedEndpoints.Delete(endpoint)
+	defer atomic.StoreInt32(&logLevel, atomic.LoadInt32(&logLevel))
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	path, send := startControl(t)
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("control socket has mode %v, want 0600", fi.Mode().Perm())
+	}
+
+	for _, tc := range []struct {
+		command string
+		want    []string // in the output
+		logs    string   // for mutating commands
+	}{
+		{"help", []string{"log-level LEVEL", "drain ENDPOINT", "ok\n"}, ""},
+		{"stats", []string{"ok\n"}, ""},
+		{"upstreams", []string{"group=default endpoint=" + endpoint + " state=up", "ok\n"}, ""},
+		{"drain " + endpoint, []string{"ok\n"}, "Control: upstream " + endpoint + " marked down for maintenance"},
+		{"upstreams", []string{"state=drained"}, ""},
+		{"undrain " + endpoint, []string{"ok\n"}, "Control: upstream " + endpoint + " marked up"},
+		{"upstreams", []string{"state=up"}, ""},
+		{"drain https://b.example/resolve", []string{"error: https://b.example/resolve is not an endpoint of upstream group default"}, ""},
+		{"drain", []string{"error: usage: drain <endpoint>"}, ""},
+		{"log-level debug", []string{"ok\n"}, "Control: log level set to debug"},
+		{"log-level loud", []string{"error: "}, ""},
+		{"flush", []string{"error: flush: this proxy has no cache or blocklist"}, ""},
+		{"block ads.example", []string{"error: block: "}, ""},
+		{"unblock ads.example", []string{"error: unblock: "}, ""},
+		{"reboot", []string{`error: unknown command "reboot", try help`}, ""},
+		{"", []string{"error: empty command, try help"}, ""},
+	} {
+		logged.Reset()
+		reply := send(tc.command)
+		for _, want := range tc.want {
+			if !strings.Contains(reply, want) {
+				t.Errorf("%q answered %q, want %q in it", tc.command, reply, want)
+			}
+		}
+		if tc.logs != "" && !strings.Contains(logged.String(), tc.logs) {
+			t.Errorf("%q logged %q, want %q", tc.command, logged.String(), tc.logs)
+		}
+	}
+	if atomic.LoadInt32(&logLevel) != levelDebug {
+		t.Error("log-level debug did not change the log level")
+	}
+}
+
+func TestCtl(t *testing.T) {
+	upstream.Store(&upstreamGroup{name: "default", endpoints: []string{"https://a.example/resolve"}, policy: policyFailover})
+	path, _ := startControl(t)
+	defer func(s string) { *controlSocket = s }(*controlSocket)
+	*controlSocket = path
+
+	stdout := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() { os.Stdout = stdout }()
+	if status := runCtl([]string{"upstreams"}); status != 0 {
+		t.Errorf("ctl upstreams exited %d, want 0", status)
+	}
+	if status := runCtl([]string{"reboot"}); status != 1 {
+		t.Errorf("ctl reboot exited %d, want 1", status)
+	}
+	*controlSocket = filepath.Join(t.TempDir(), "none.sock")
+	if status := runCtl([]string{"upstreams"}); status != 1 {
+		t.Errorf("ctl without a server exited %d, want 1", status)
+	}
+}
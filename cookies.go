@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Server cookies follow the interoperable format of RFC 9018: version,
+// three reserved bytes, a timestamp and a SipHash-2-4 over the client
+// cookie, those fields and the client address.
+const (
+	clientCookieSize = 8
+	serverCookieSize = 16
+	cookieVersion    = 1
+
+	// How old, or how far in the future, a server cookie may be dated
+	cookieMaxAge    = time.Hour
+	cookieMaxFuture = 5 * time.Minute
+)
+
+// cookies issues and checks server cookies, or is nil with -dns-cookies
+// off.
+var cookies *cookieSecrets
+
+// cookieSecrets holds the secret used to issue server cookies and the one
+// it replaced, which is still accepted until the next rotation.
+type cookieSecrets struct {
+	mu                sync.RWMutex
+	current, previous [16]byte
+}
+
+// newCookieSecrets starts rotating a random secret every interval.
+func newCookieSecrets(interval time.Duration) *cookieSecrets {
+	s := &cookieSecrets{}
+	rand.Read(s.current[:])
+	s.previous = s.current
+	go func() {
+		for range time.Tick(interval) {
+			s.rotate()
+		}
+	}()
+	return s
+}
+
+func (s *cookieSecrets) rotate() {
+	var secret [16]byte
+	rand.Read(secret[:])
+	s.mu.Lock()
+	s.previous, s.current = s.current, secret
+	s.mu.Unlock()
+}
+
+// Issue returns a fresh server cookie for client at ip.
+func (s *cookieSecrets) Issue(client []byte, ip net.IP) []byte {
+	s.mu.RLock()
+	secret := s.current
+	s.mu.RUnlock()
+	return serverCookie(secret, client, ip, uint32(time.Now().Unix()))
+}
+
+// Valid reports whether server is a cookie we issued to client at ip,
+// recently enough.
+func (s *cookieSecrets) Valid(client, server []byte, ip net.IP) bool {
+	if len(server) != serverCookieSize || server[0] != cookieVersion {
+		return false
+	}
+	ts := binary.BigEndian.Uint32(server[4:8])
+	now := uint32(time.Now().Unix())
+	// Compare as serial numbers so the clock wrapping doesn't matter
+	if age := int32(now - ts); age > int32(cookieMaxAge/time.Second) || -age > int32(cookieMaxFuture/time.Second) {
+		return false
+	}
+	s.mu.RLock()
+	current, previous := s.current, s.previous
+	s.mu.RUnlock()
+	return subtle.ConstantTimeCompare(serverCookie(current, client, ip, ts), server) == 1 ||
+		subtle.ConstantTimeCompare(serverCookie(previous, client, ip, ts), server) == 1
+}
+
+func serverCookie(secret [16]byte, client []byte, ip net.IP, ts uint32) []byte {
+	cookie := make([]byte, 8, serverCookieSize)
+	cookie[0] = cookieVersion
+	binary.BigEndian.PutUint32(cookie[4:], ts)
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	input := make([]byte, 0, len(client)+8+len(ip))
+	input = append(append(append(input, client...), cookie...), ip...)
+	var hash [8]byte
+	binary.BigEndian.PutUint64(hash[:], siphash24(
+		binary.LittleEndian.Uint64(secret[:8]), binary.LittleEndian.Uint64(secret[8:]), input))
+	return append(cookie, hash[:]...)
+}
+
+// queryCookie returns the client and server cookies of req. ok is false if
+// a COOKIE option is present but malformed (RFC 7873 section 5.2.2).
+func queryCookie(req *dns.Msg) (client, server []byte, ok bool) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return nil, nil, true
+	}
+	for _, o := range opt.Option {
+		c, isCookie := o.(*dns.EDNS0_COOKIE)
+		if !isCookie {
+			continue
+		}
+		b, err := hex.DecodeString(c.Cookie)
+		if err != nil || len(b) != clientCookieSize && (len(b) < 16 || len(b) > 40) {
+			return nil, nil, false
+		}
+		return b[:clientCookieSize], b[clientCookieSize:], true
+	}
+	return nil, nil, true
+}
+
+// cookieHandler wraps next to return server cookies to clients which send
+// a DNS cookie, and to mark queries carrying a valid one so rate limits
+// can let them through: a client that echoes our cookie can't be spoofing
+// its address.
+func cookieHandler(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		client, server, ok := queryCookie(req)
+		if !ok {
+			writeFailure(w, req, dns.RcodeFormatError)
+			return
+		}
+		ip := addrIP(w.RemoteAddr())
+		if client == nil || ip == nil {
+			next.ServeDNS(w, req)
+			return
+		}
+		next.ServeDNS(&cookieWriter{
+			ResponseWriter: w,
+			req:            req,
+			client:         client,
+			ip:             ip,
+			valid:          len(server) > 0 && cookies.Valid(client, server, ip),
+		}, req)
+	})
+}
+
+// cookieWriter adds a fresh server cookie to every response it writes.
+type cookieWriter struct {
+	dns.ResponseWriter
+	req    *dns.Msg
+	client []byte
+	ip     net.IP
+	valid  bool
+}
+
+func (w *cookieWriter) WriteMsg(m *dns.Msg) error {
+	if m.Rcode > 0xF {
+		// Packing folds an extended rcode into the OPT record, changing the
+		// message; keep the caller's copy as it was for logging.
+		m = m.Copy()
+	}
+	opt := m.IsEdns0()
+	if opt == nil {
+		opt = newOPT(w.req)
+		m.Extra = append(m.Extra, opt)
+	}
+	options := opt.Option[:0:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0COOKIE {
+			options = append(options, o)
+		}
+	}
+	cookie := append(append([]byte(nil), w.client...), cookies.Issue(w.client, w.ip)...)
+	opt.Option = append(options, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(cookie)})
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// queryCookieState reports whether the query behind w carried a DNS cookie,
+// and whether that included a valid server cookie.
+func queryCookieState(w dns.ResponseWriter) (present, valid bool) {
+	if cw, ok := w.(*cookieWriter); ok {
+		return true, cw.valid
+	}
+	return false, false
+}
+
+// siphash24 is SipHash-2-4 of p with the key k0, k1.
+func siphash24(k0, k1 uint64, p []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+	round := func() {
+		v0 += v1
+		v1 = v1<<13 | v1>>51
+		v1 ^= v0
+		v0 = v0<<32 | v0>>32
+		v2 += v3
+		v3 = v3<<16 | v3>>48
+		v3 ^= v2
+		v0 += v3
+		v3 = v3<<21 | v3>>43
+		v3 ^= v0
+		v2 += v1
+		v1 = v1<<17 | v1>>47
+		v1 ^= v2
+		v2 = v2<<32 | v2>>32
+	}
+
+	n := len(p)
+	for ; len(p) >= 8; p = p[8:] {
+		m := binary.LittleEndian.Uint64(p)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+	var last [8]byte
+	copy(last[:], p)
+	last[7] = byte(n)
+	m := binary.LittleEndian.Uint64(last[:])
+	v3 ^= m
+	round()
+	round()
+	v0 ^= m
+
+	v2 ^= 0xff
+	for i := 0; i < 4; i++ {
+		round()
+	}
+	return v0 ^ v1 ^ v2 ^ v3
+}
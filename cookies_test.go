@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSipHash24(t *testing.T) {
+	// The test vector of the SipHash paper, appendix A
+	var k [16]byte
+	p := make([]byte, 15)
+	for i := range k {
+		k[i] = byte(i)
+	}
+	for i := range p {
+		p[i] = byte(i)
+	}
+	if got := siphash24(leUint64(k[:8]), leUint64(k[8:]), p); got != 0xa129ca6149be45e5 {
+		t.Errorf("got %#x, want 0xa129ca6149be45e5", got)
+	}
+}
+
+func leUint64(b []byte) uint64 {
+	var v uint64
+	for i := 7; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v
+}
+
+func TestCookieSecrets(t *testing.T) {
+	s := &cookieSecrets{}
+	s.rotate()
+	client := []byte("\x01\x02\x03\x04\x05\x06\x07\x08")
+	ip := net.IPv4(192, 0, 2, 7)
+	server := s.Issue(client, ip)
+	if len(server) != serverCookieSize {
+		t.Fatalf("got a %d byte server cookie, want %d", len(server), serverCookieSize)
+	}
+	if !s.Valid(client, server, ip) {
+		t.Error("the cookie just issued is not valid")
+	}
+	if s.Valid(client, server, net.IPv4(192, 0, 2, 8)) {
+		t.Error("the cookie is valid from another address")
+	}
+	if s.Valid([]byte("\x08\x07\x06\x05\x04\x03\x02\x01"), server, ip) {
+		t.Error("the cookie is valid with another client cookie")
+	}
+
+	// Too old, or dated in the future
+	for _, age := range []time.Duration{cookieMaxAge + time.Minute, -cookieMaxFuture - time.Minute} {
+		old := serverCookie(s.current, client, ip, uint32(time.Now().Add(-age).Unix()))
+		if s.Valid(client, old, ip) {
+			t.Errorf("a cookie dated %v ago is valid", age)
+		}
+	}
+
+	s.rotate()
+	if !s.Valid(client, server, ip) {
+		t.Error("the cookie is not valid after one rotation")
+	}
+	s.rotate()
+	if s.Valid(client, server, ip) {
+		t.Error("the cookie is still valid after two rotations")
+	}
+}
+
+// cookieQuery returns a query carrying cookie, in hex.
+func cookieQuery(cookie string) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	return req
+}
+
+// responseCookie returns the cookie of resp, in hex.
+func responseCookie(t *testing.T, resp *dns.Msg) string {
+	t.Helper()
+	opt := resp.IsEdns0()
+	if opt == nil {
+		t.Fatalf("got no OPT in %v", resp)
+	}
+	for _, o := range opt.Option {
+		if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+			return c.Cookie
+		}
+	}
+	t.Fatalf("got no cookie in %v", resp)
+	return ""
+}
+
+func TestCookieHandlerBadCookie(t *testing.T) {
+	defer func(s *cookieSecrets) { cookies = s }(cookies)
+	cookies = &cookieSecrets{}
+	cookies.rotate()
+
+	answered := 0
+	answer := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		answered++
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{mustRR(t, "example.com. 300 IN A 192.0.2.1")}
+		echoOPT(resp, req)
+		w.WriteMsg(resp)
+	})
+	// A client allowed a single query
+	exempt, _ := parseCIDRSet("")
+	limiter := newClientLimiter(0.001, 1, exempt)
+	handler := cookieHandler(rateLimitHandler(limiter, answer))
+	serve := func(req *dns.Msg) *dns.Msg {
+		w := &httpResponseWriter{local: &net.UDPAddr{}, remote: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 5353}}
+		handler.ServeDNS(w, req)
+		if w.msg == nil {
+			t.Fatal("got no response")
+		}
+		// As it would go out on the wire
+		packed, err := w.msg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(packed); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	clientCookie := "0102030405060708"
+	resp := serve(cookieQuery(clientCookie))
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Fatalf("got %v, want the answer", resp)
+	}
+	cookie := responseCookie(t, resp)
+	if len(cookie) != 2*(clientCookieSize+serverCookieSize) || cookie[:16] != clientCookie {
+		t.Fatalf("got cookie %s, want the client cookie and a server cookie", cookie)
+	}
+	if opts := resp.IsEdns0().Option; len(opts) != 1 {
+		t.Errorf("got options %v, want the one cookie", opts)
+	}
+
+	// Over the limit, a client cookie alone gets BADCOOKIE and a server
+	// cookie to retry with
+	resp = serve(cookieQuery(clientCookie))
+	if resp.Rcode != dns.RcodeBadCookie || len(resp.Answer) != 0 {
+		t.Fatalf("got %v over the limit, want BADCOOKIE", resp)
+	}
+	retry := responseCookie(t, resp)
+
+	// The retry echoing the server cookie is let through the limit
+	resp = serve(cookieQuery(retry))
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Fatalf("got %v retrying with the server cookie, want the answer", resp)
+	}
+	if answered != 2 {
+		t.Errorf("answered %d queries, want 2", answered)
+	}
+
+	// A forged server cookie is not
+	forged, _ := hex.DecodeString(retry)
+	forged[len(forged)-1] ^= 1
+	if resp = serve(cookieQuery(hex.EncodeToString(forged))); resp.Rcode != dns.RcodeBadCookie {
+		t.Errorf("got rcode %s with a forged server cookie, want BADCOOKIE", dns.RcodeToString[resp.Rcode])
+	}
+
+	// A cookie of the wrong length is a FORMERR
+	if resp = serve(cookieQuery("01020304")); resp.Rcode != dns.RcodeFormatError {
+		t.Errorf("got rcode %s for a short cookie, want FORMERR", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestCookieWriterOPT(t *testing.T) {
+	defer func(s *cookieSecrets) { cookies = s }(cookies)
+	cookies = &cookieSecrets{}
+	cookies.rotate()
+	req := cookieQuery("0102030405060708")
+	req.IsEdns0().SetDo()
+	client, ip := []byte("\x01\x02\x03\x04\x05\x06\x07\x08"), net.IPv4(192, 0, 2, 7)
+
+	// A response without an OPT gets ours, and one with a stale cookie,
+	// such as the upstream's, has it replaced
+	stale := new(dns.Msg)
+	stale.SetReply(req)
+	stale.SetEdns0(512, true)
+	stale.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "ffffffffffffffff"}}
+	bare := new(dns.Msg)
+	bare.SetReply(req)
+	for _, m := range []*dns.Msg{bare, stale} {
+		w := &httpResponseWriter{local: &net.UDPAddr{}, remote: &net.UDPAddr{IP: ip}}
+		(&cookieWriter{ResponseWriter: w, req: req, client: client, ip: ip}).WriteMsg(m)
+		opt := w.msg.IsEdns0()
+		if opt == nil || !opt.Do() {
+			t.Fatalf("got OPT %v, want one echoing DO", opt)
+		}
+		if len(opt.Option) != 1 || responseCookie(t, w.msg)[:16] != "0102030405060708" {
+			t.Errorf("got options %v, want only the fresh cookie", opt.Option)
+		}
+	}
+
+	// Writing BADCOOKIE leaves the caller's message as it was
+	m := newFailure(req, dns.RcodeBadCookie)
+	before := m.String()
+	w := &httpResponseWriter{local: &net.UDPAddr{}, remote: &net.UDPAddr{IP: ip}}
+	(&cookieWriter{ResponseWriter: w, req: req, client: client, ip: ip}).WriteMsg(m)
+	if m.String() != before {
+		t.Errorf("the BADCOOKIE response was changed to\n%v\nfrom\n%v", m, before)
+	}
+	if w.msg.Rcode != dns.RcodeBadCookie {
+		t.Errorf("wrote rcode %s, want BADCOOKIE", dns.RcodeToString[w.msg.Rcode])
+	}
+	responseCookie(t, w.msg)
+}
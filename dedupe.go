@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// nameRdataTypes are the types whose rdata is made of domain names and
+// numbers only, so that it compares without regard to case (RFC 4034
+// section 6.2).
+var nameRdataTypes = map[uint16]bool{
+	dns.TypeNS:    true,
+	dns.TypeCNAME: true,
+	dns.TypePTR:   true,
+	dns.TypeMX:    true,
+	dns.TypeSRV:   true,
+	dns.TypeSOA:   true,
+	dns.TypeDNAME: true,
+}
+
+// dedupeRecords removes the records an upstream repeated from each section
+// of resp, keeping the first of each in its place with the lowest TTL of
+// the copies. Owner names, and names in the rdata of nameRdataTypes,
+// compare without regard to case. Nil records, which can't be packed, are
+// dropped too.
+func dedupeRecords(resp *dns.Msg) {
+	name := resp.Question[0].Name
+	resp.Answer = dedupeSection(name, "answer", resp.Answer)
+	resp.Ns = dedupeSection(name, "authority", resp.Ns)
+	resp.Extra = dedupeSection(name, "additional", resp.Extra)
+}
+
+func dedupeSection(name, section string, rrs []dns.RR) []dns.RR {
+	if len(rrs) == 1 && rrs[0] != nil {
+		return rrs
+	}
+	first := make(map[string]dns.RR, len(rrs))
+	kept := rrs[:0]
+	dropped := 0
+	for _, rr := range rrs {
+		if rr == nil {
+			continue
+		}
+		key := recordKey(rr)
+		if f, ok := first[key]; ok {
+			if rr.Header().Ttl < f.Header().Ttl {
+				f.Header().Ttl = rr.Header().Ttl
+			}
+			dropped++
+			continue
+		}
+		first[key] = rr
+		kept = append(kept, rr)
+	}
+	if dropped > 0 {
+		debugf("Dropped %d duplicate %s records from the upstream response for %s", dropped, section, name)
+	}
+	return kept
+}
+
+// recordKey identifies a record regardless of its TTL and the case of its
+// owner name.
+func recordKey(rr dns.RR) string {
+	h := rr.Header()
+	rdata := strings.TrimPrefix(rr.String(), h.String())
+	if nameRdataTypes[h.Rrtype] {
+		rdata = strings.ToLower(rdata)
+	}
+	return strings.ToLower(dns.Fqdn(h.Name)) + "\t" + dns.Class(h.Class).String() + "\t" +
+		dns.Type(h.Rrtype).String() + "\t" + rdata
+}
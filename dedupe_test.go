@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func mustRR(t testing.TB, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("dns.NewRR(%q): %v", s, err)
+	}
+	return rr
+}
+
+func TestDedupeRecords(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.SetQuestion("example.com.", dns.TypeA)
+	resp.Answer = []dns.RR{
+		mustRR(t, "example.com. 300 IN CNAME www.Example.com."),
+		mustRR(t, "www.example.com. 300 IN A 192.0.2.1"),
+		mustRR(t, "EXAMPLE.com. 60 IN CNAME WWW.example.com."),
+		nil,
+		mustRR(t, "www.example.com. 120 IN A 192.0.2.1"),
+		mustRR(t, "www.example.com. 300 IN A 192.0.2.2"),
+	}
+	resp.Ns = []dns.RR{nil}
+	resp.Extra = []dns.RR{
+		mustRR(t, `example.com. 300 IN TXT "Case"`),
+		mustRR(t, `example.com. 300 IN TXT "case"`),
+		mustRR(t, `example.com. 300 IN TXT "Case"`),
+	}
+
+	dedupeRecords(resp)
+	want := []string{
+		"example.com.\t60\tIN\tCNAME\twww.Example.com.",
+		"www.example.com.\t120\tIN\tA\t192.0.2.1",
+		"www.example.com.\t300\tIN\tA\t192.0.2.2",
+	}
+	if len(resp.Answer) != len(want) {
+		t.Fatalf("got answer %v, want %v", resp.Answer, want)
+	}
+	for i, rr := range resp.Answer {
+		if rr.String() != want[i] {
+			t.Errorf("answer %d = %q, want %q", i, rr, want[i])
+		}
+	}
+	if len(resp.Ns) != 0 {
+		t.Errorf("got authority %v, want none", resp.Ns)
+	}
+	// TXT strings are compared with their case
+	if len(resp.Extra) != 2 {
+		t.Errorf("got additional %v, want the two TXT records", resp.Extra)
+	}
+	if _, err := resp.Pack(); err != nil {
+		t.Errorf("Pack: %v", err)
+	}
+}
+
+func BenchmarkDedupeRecords(b *testing.B) {
+	var answer []dns.RR
+	for _, s := range []string{
+		"www.example.com. 300 IN CNAME example.com.",
+		"example.com. 300 IN A 192.0.2.1",
+		"example.com. 300 IN A 192.0.2.2",
+		"EXAMPLE.com. 120 IN A 192.0.2.1",
+		"example.com. 300 IN AAAA 2001:db8::1",
+	} {
+		answer = append(answer, mustRR(b, s))
+	}
+	resp := new(dns.Msg)
+	resp.SetQuestion("www.example.com.", dns.TypeA)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		resp.Answer = append(resp.Answer[:0], answer...)
+		dedupeRecords(resp)
+	}
+}
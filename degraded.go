@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// The listeners come up without waiting for the upstream, which on a
+// router may start before the WAN link does. The upstream is then probed
+// in the background: while no endpoint has answered, the proxy runs
+// degraded, failing the queries it would forward and reporting not ready.
+
+// Startup states of the upstream.
+const (
+	upstreamChecking int32 = iota
+	upstreamDegraded
+	upstreamReachable
+)
+
+// upstreamStartState is the upstream's startup state.
+var upstreamStartState int32
+
+// maxDegradedRetry bounds the wait between probes while degraded.
+const maxDegradedRetry = time.Minute
+
+// watchStartupUpstream probes the upstream group until an endpoint
+// answers, backing off from a second to maxDegradedRetry between rounds.
+func watchStartupUpstream() {
+	retry := time.Second
+	for {
+		err := checkUpstreamLink(*upstreamInterface, *upstreamSourceIP)
+		if err == nil {
+			err = probeGroup()
+		}
+		if err == nil || upstreamAnswered() {
+			if atomic.SwapInt32(&upstreamStartState, upstreamReachable) == upstreamDegraded {
+				infof("Upstream reachable, leaving degraded mode")
+				sdNotify("STATUS=Serving")
+			}
+			return
+		}
+		if atomic.CompareAndSwapInt32(&upstreamStartState, upstreamChecking, upstreamDegraded) {
+			warnf("Starting degraded, upstream unreachable: %v; retrying in the background", err)
+			sdNotify("STATUS=Degraded: upstream unreachable")
+		} else {
+			debugf("Upstream still unreachable, retrying in %s: %v", retry, err)
+		}
+		time.Sleep(retry)
+		if retry *= 2; retry > maxDegradedRetry {
+			retry = maxDegradedRetry
+		}
+	}
+}
+
+// probeGroup probes the endpoints of the upstream group until one answers,
+// returning the last error if none does.
+func probeGroup() error {
+	var err error
+	for _, endpoint := range currentUpstream().endpoints {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		err = probeUpstream(ctx, endpoint)
+		cancel()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// upstreamAnswered reports whether an endpoint of the upstream group has
+// ever answered a query or probe.
+func upstreamAnswered() bool {
+	for _, endpoint := range currentUpstream().endpoints {
+		if !lastUpstreamSuccess(endpoint).IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// startupDegraded reports why the proxy isn't ready yet because of the
+// upstream at startup, or "" once an endpoint has answered.
+func startupDegraded() string {
+	switch atomic.LoadInt32(&upstreamStartState) {
+	case upstreamReachable:
+		return ""
+	case upstreamDegraded:
+		if upstreamAnswered() {
+			return ""
+		}
+		return "degraded: upstream unreachable since startup"
+	}
+	if upstreamAnswered() {
+		return ""
+	}
+	return "checking the upstream"
+}
@@ -8,209 +8,987 @@ go run dns_reverse_proxy.go -debug=true -address=127.0.0.1:8500
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/wrouesnel/dns-over-https-proxy/dohproxy"
 )
 
 var (
-	address = flag.String("address", ":53", "Address to listen to (TCP and UDP)")
-	subnet  = flag.String("subnet", "", "edns-subnet-client argument to pass")
+	showVersion = flag.Bool("version", false, "Print the version and build information and exit")
+	queryType   = flag.String("qtype", "A", "Query type for -query")
+	configPath  = flag.String("config", "", "YAML file to read settings from; command line flags and DOH_PROXY_* variables take precedence")
+	checkOnly   = flag.Bool("check-config", false, "Check the settings and the files they name, then exit without starting")
+	printConfig = flag.Bool("print-config", false, "Print the effective settings as a config file and exit")
+
+	listenUDP = flag.String("listen-udp", ":53",
+		"Comma-separated addresses to listen to over UDP, each optionally followed by ;allow=CIDR|... and ;deny=CIDR|...")
+	listenTCP = flag.String("listen-tcp", ":53",
+		"Comma-separated addresses to listen to over TCP, with optional access lists as for -listen-udp")
+	address = flag.String("address", "", "Deprecated: sets both -listen-udp and -listen-tcp")
+
+	listenDoH = flag.String("listen-doh", "", "Address to serve DNS-over-HTTPS on")
+	dohCert   = flag.String("doh-cert", "", "TLS certificate file for -listen-doh (plain HTTP if unset)")
+	dohKey    = flag.String("doh-key", "", "TLS key file for -listen-doh")
+
+	tcpIdleTimeout = flag.Duration("tcp-idle-timeout", 8*time.Second,
+		"Close TCP connections idle for this long")
+	tcpMaxConns = flag.Int("tcp-max-conns", 1000, "Maximum concurrent TCP connections (0 for no limit)")
+
+	allowFrom = flag.String("allow-from", "private",
+		"Comma-separated CIDRs allowed to query; \"private\" adds private and loopback networks and the listeners' own /24, \"any\" allows everyone")
+	aclAction = flag.String("acl-action", "refuse",
+		"What to do with queries denied by an access list: refuse or drop")
+
+	proxyProtocol = flag.Bool("proxy-protocol", false,
+		"Accept PROXY protocol headers on TCP connections from -trusted-proxies")
+	trustedProxiesList = flag.String("trusted-proxies", "127.0.0.1,::1",
+		"Comma-separated CIDRs allowed to send PROXY protocol headers")
+
+	listenTLSAddr  = flag.String("listen-tls", "", "Comma-separated addresses to serve DNS-over-TLS on")
+	tlsCert        = flag.String("tls-cert", "", "TLS certificate file for -listen-tls")
+	tlsKey         = flag.String("tls-key", "", "TLS key file for -listen-tls")
+	tlsIdleTimeout = flag.Duration("tls-idle-timeout", 10*time.Second,
+		"Close DNS-over-TLS connections idle for this long")
+	tlsMaxConns = flag.Int("tls-max-conns", 1000, "Maximum concurrent DNS-over-TLS connections (0 for no limit)")
+
+	listenQUICAddr = flag.String("listen-quic", "",
+		"Comma-separated addresses to serve DNS-over-QUIC on, such as :853, with the -tls-cert certificate")
+	quicMaxConns    = flag.Int("quic-max-conns", 1000, "Maximum concurrent DNS-over-QUIC connections (0 for no limit)")
+	quicMaxStreams  = flag.Int("quic-max-streams", 100, "Maximum concurrent queries on a DNS-over-QUIC connection")
+	quicIdleTimeout = flag.Duration("quic-idle-timeout", 30*time.Second,
+		"Close DNS-over-QUIC connections idle for this long")
+	quic0RTT = flag.Bool("quic-0rtt", false,
+		"Accept DNS-over-QUIC queries in 0-RTT data, which an attacker can replay")
+
+	// Workers spend most of a query waiting on the upstream; with only a few
+	// per CPU, a handful of slow upstream requests hold up every UDP query
+	udpWorkerCount = flag.Int("udp-workers", 64*runtime.GOMAXPROCS(0),
+		"Goroutines answering UDP queries (0 for one per query)")
+	udpQueueSize     = flag.Int("udp-queue", 1000, "UDP queries waiting for a worker before -udp-queue-overflow applies")
+	udpQueueOverflow = flag.String("udp-queue-overflow", overflowReject,
+		"What to do with a UDP query when -udp-queue is full: reject (SERVFAIL) or drop-oldest")
+
+	reusePort = flag.Int("reuseport", 1, "Number of SO_REUSEPORT sockets to open per UDP address")
+
+	listenInterface      = flag.String("interface", "", "Network interface to bind DNS listeners to (Linux only)")
+	upstreamInterface    = flag.String("upstream-interface", "", "Network interface for upstream connections (Linux only)")
+	upstreamSourceIP     = flag.String("upstream-source-ip", "", "Source address for upstream connections")
+	upstreamAttemptDelay = flag.Duration("upstream-attempt-delay", 250*time.Millisecond,
+		"Head start of each upstream connection attempt before the next address, alternating IPv6 and IPv4, is tried")
+
+	dohJSONMethod = flag.String("doh-json-method", methodGet,
+		"HTTP method of JSON API requests: get, post (form body) or post-json (JSON body)")
+	dohJSONMethodFallback = flag.Bool("doh-json-method-fallback", true,
+		"Switch an endpoint between GET and POST after repeated 4xx responses")
+
+	failback = flag.Bool("failback", true,
+		"Take a failed upstream endpoint back once it passes -failback-probes probes in a row")
+	failbackProbes   = flag.Int("failback-probes", 3, "Probes in a row a failed upstream endpoint must pass to be taken back")
+	failbackInterval = flag.Duration("failback-interval", 10*time.Second, "Interval between probes of failed upstream endpoints")
+	failbackRamp     = flag.Duration("failback-ramp", 0,
+		"Time over which an endpoint taken back gets from none to all of its queries (0 for all at once)")
+
+	listenUnixPath = flag.String("listen-unix", "", "Unix socket path to listen to (TCP framing)")
+	listenUnixMode = flag.String("listen-unix-mode", "0660", "Permissions of the -listen-unix socket")
+
+	subnet       = flag.String("subnet", "", "edns-subnet-client argument to pass")
+	subnet6      = flag.String("subnet6", "", "IPv6 edns-subnet-client argument to pass for AAAA queries, instead of -subnet")
+	subnetPrefer = flag.String("subnet-prefer", "ipv4",
+		"With -subnet and -subnet6, the subnet to pass for query types other than A and AAAA: ipv4 or ipv6")
+	privacyECS = flag.Bool("privacy-ecs", false,
+		"Pass edns-client-subnet 0.0.0.0/0 with every query, clients' own included, so the upstream uses no client subnet at all")
 
 	defaultServer = flag.String("default", "https://dns.google.com/resolve",
-		"DNS-over-HTTPS service endpoint")
+		"DNS-over-HTTPS service endpoint, or the name of an -upstream-group")
+	preset = flag.String("preset", "",
+		"Public providers to use as the group \"preset\", made the -default unless that is set, comma-separated in failover order (\"list\" to list them)")
 
-	debug = flag.Bool("debug", false, "Verbose debugging")
-)
+	skipContentType = flag.Bool("skip-content-type-check", false,
+		"Decode upstream responses regardless of their Content-Type")
 
-// Rough translation of the Google DNS over HTTP API
-type DNSResponseJson struct {
-	Status             int32         `json:"Status,omitempty"`
-	TC                 bool          `json:"TC,omitempty"`
-	RD                 bool          `json:"RD,omitempty"`
-	RA                 bool          `json:"RA,omitempty"`
-	AD                 bool          `json:"AD,omitempty"`
-	CD                 bool          `json:"CD,omitempty"`
-	Question           []DNSQuestion `json:"Question,omitempty"`
-	Answer             []DNSRR       `json:"Answer,omitempty"`
-	Authority          []DNSRR       `json:"Authority,omitempty"`
-	Additional         []DNSRR       `json:"Additional,omitempty"`
-	Edns_client_subnet string        `json:"edns_client_subnet,omitempty"`
-	Comment            string        `json:"Comment,omitempty"`
-}
+	maxBodySize = flag.Int64("max-body-size", 64*1024,
+		"Maximum size in bytes of a response body fetched from upstream")
 
-type DNSQuestion struct {
-	Name string `json:"name,omitempty"`
-	Type int32  `json:"type,omitempty"`
-}
+	trustUpstreamAD = flag.Bool("trust-upstream-ad", true,
+		"Pass the upstream's AD bit to clients which ask for it")
+	rotateMode = flag.String("rotate-answers", rotateOff,
+		"Reorder multiple A or AAAA records for a name in each response: rotate (by a counter) or shuffle")
+	flattenCNAMEList = flag.String("flatten-cnames", "",
+		"Comma-separated domains (\".\" for all) whose A and AAAA answers are flattened from a CNAME chain to the address records alone, for clients that can't follow CNAMEs")
+	filterAAAA = flag.String("filter-aaaa", filterAAAAOff,
+		"Suppress IPv6 addresses: nodata (answer AAAA queries with no records, without asking the upstream) or strip (remove AAAA records from upstream responses)")
+	filterAAAAExceptions = flag.String("filter-aaaa-except", "",
+		"Comma-separated domains whose IPv6 addresses -filter-aaaa keeps")
 
-type DNSRR struct {
-	Name string `json:"name,omitempty"`
-	Type int32  `json:"type,omitempty"`
-	TTL  int32  `json:"TTL,omitempty"`
-	Data string `json:"data,omitempty"`
-}
+	clientQPS = flag.Float64("client-qps", 0,
+		"Maximum queries per second from each client IP (0 for no limit)")
+	clientBurst = flag.Int("client-burst", 50,
+		"How many queries a client may send at once before -client-qps applies")
+	clientQPSExempt = flag.String("client-qps-exempt", "127.0.0.0/8,::1",
+		"Comma-separated CIDRs not subject to -client-qps")
 
-// Initialize a new RRGeneric from a DNSRR
-func NewRR(a DNSRR) dns.RR {
-	rrhdr := dns.RR_Header{
-		Name:     a.Name,
-		Rrtype:   uint16(a.Type),
-		Class:    dns.ClassINET,
-		Ttl:      uint32(a.TTL),
-		Rdlength: uint16(len(a.Data)),
-	}
-	str := rrhdr.String() + a.Data
-	rr, _ := dns.NewRR(str)
-	return rr
-}
+	nxdomainBurst = flag.Int("nxdomain-burst", 0,
+		"Warn about clients getting this many NXDOMAIN answers within -nxdomain-burst-window (0 to disable)")
+	nxdomainBurstWindow = flag.Duration("nxdomain-burst-window", time.Minute,
+		"Sliding window for -nxdomain-burst")
+	dgaAction = flag.String("dga-action", "log",
+		"What to do with clients in an NXDOMAIN burst: log, or limit them to -dga-qps")
+	dgaQPS = flag.Float64("dga-qps", 1, "Queries per second allowed to clients in an NXDOMAIN burst with -dga-action=limit")
+
+	dnsCookies = flag.Bool("dns-cookies", true,
+		"Return DNS cookies (RFC 7873) to clients which send them, exempting those echoing a valid one from rate limits")
+	cookieSecretRotation = flag.Duration("cookie-secret-rotation", time.Hour,
+		"How often to replace the DNS cookie secret; cookies from the previous secret stay valid until the next")
+
+	rrlResponses = flag.Int("rrl-responses-per-second", 0,
+		"Response rate limiting: identical UDP responses per second to one client network (0 to disable)")
+	rrlSlip = flag.Int("rrl-slip", 2,
+		"Send every Nth rate limited response truncated instead of dropping it (0 to always drop)")
+	rrlIPv4Prefix = flag.Int("rrl-ipv4-prefix", 24, "Prefix length grouping IPv4 clients for -rrl-responses-per-second")
+	rrlIPv6Prefix = flag.Int("rrl-ipv6-prefix", 56, "Prefix length grouping IPv6 clients for -rrl-responses-per-second")
+	rrlExempt     = flag.String("rrl-exempt", "127.0.0.0/8,::1",
+		"Comma-separated CIDRs not subject to response rate limiting")
+
+	refuseAny = flag.String("refuse-any", anyForward,
+		"How to answer queries for type ANY: refuse (NOTIMP), minimal (an RFC 8482 HINFO record), cache (the records of recent answers for the name, or the HINFO record) or forward")
+
+	maxAnswers = flag.Int("max-answers", 64,
+		"Maximum answer records relayed from an upstream response (0 for no limit)")
+	maxResponseBytes = flag.Int("max-response-bytes", 16*1024,
+		"Maximum size in bytes of a response relayed from upstream (0 for no limit)")
+
+	permissiveNames = flag.Bool("permissive-names", false,
+		"Forward query names with characters other than letters, digits, hyphens and underscores")
+
+	maxConcurrent = flag.Int("max-concurrent", 0,
+		"Maximum concurrent upstream requests (0 for no limit)")
+	maxConcurrentWait = flag.Duration("max-concurrent-wait", 0,
+		"How long a query may wait for an upstream request slot before SERVFAIL")
+
+	hedge      = flag.Bool("hedge", false, "Send a second upstream request when the first is slower than usual")
+	hedgeDelay = flag.Duration("hedge-delay", 0,
+		"How long to wait before hedging (0 for the endpoint's 95th percentile latency)")
+	hedgeRatio = flag.Float64("hedge-ratio", 0.05, "Most upstream requests that may be hedged, as a fraction of all of them")
+
+	prefetch = flag.Bool("prefetch", false,
+		"After answering an A query from the upstream, fetch AAAA for the same name ahead of the client's next query")
+	prefetchHTTPS = flag.Bool("prefetch-https", false, "With -prefetch, fetch HTTPS (type 65) records too")
+
+	policyHook = flag.String("policy-hook", "",
+		"URL to POST each query to for a policy decision: allow, block, rewrite or route")
+	policyHookTimeout = flag.Duration("policy-hook-timeout", 200*time.Millisecond, "How long to wait for the -policy-hook")
+	policyHookFail    = flag.String("policy-hook-fail", "open",
+		"What to do with queries when the -policy-hook fails: open (forward them) or closed (refuse them)")
+	blockSources = flag.String("block-sources", "",
+		"Comma-separated lists a -policy-hook may name as the source of a block; blocks from others are counted as \"other\"")
+
+	mdns = flag.Bool("mdns", false,
+		"Resolve names under local. with multicast DNS on the LAN; they are never sent upstream, and are NXDOMAIN without -mdns")
+	mdnsTimeout   = flag.Duration("mdns-timeout", 250*time.Millisecond, "How long to wait for mDNS responders")
+	mdnsInterface = flag.String("mdns-interface", "", "Network interface to send mDNS queries on (Linux only; the default route's if unset)")
+
+	searchList = flag.String("search", "",
+		"Comma-separated domains to try names with fewer than -search-ndots dots under, in order, before sending them upstream as they are")
+	searchNdots = flag.Int("search-ndots", 1,
+		"Names with fewer dots than this are bare, for -search and -block-bare-names")
+	searchCNAME = flag.Bool("search-cname", true,
+		"Answer a bare name found under a -search domain with a CNAME to the full name, rather than with the full name's records renamed")
+	blockBareNames = flag.Bool("block-bare-names", false,
+		"Never send bare names upstream as they are: answer NXDOMAIN if no -search domain has them")
+
+	notifyAfterProbe = flag.Bool("notify-after-probe", false,
+		"Under systemd, only report readiness once the upstream has answered a probe")
+
+	logQueries = flag.Bool("log-queries", false, "Log every query and its outcome")
+
+	dnstapSocket = flag.String("dnstap-socket", "",
+		"Send dnstap messages to this Unix socket path or TCP address")
+
+	logFilePath = flag.String("log-file", "", "Log to this file instead of stderr, reopening it on SIGHUP")
+	logMaxSize  = flag.Int64("log-max-size", 0, "Rotate -log-file when it reaches this many bytes (0 to never rotate)")
+	logMaxFiles = flag.Int("log-max-files", 5, "How many rotated log files to keep")
+
+	logSyslog          = flag.Bool("log-syslog", false, "Also log to syslog")
+	syslogAddress      = flag.String("syslog-address", "", "Remote syslog as [udp:|tcp:]host:port (local syslog if unset)")
+	syslogFacilityName = flag.String("syslog-facility", "daemon", "Syslog facility for -log-syslog")
+	logStderr          = flag.Bool("log-stderr", true, "Keep logging to stderr or -log-file when -log-syslog is set")
+
+	logAnonymize = flag.String("log-anonymize", "",
+		"Hide client addresses in query logs, dnstap and traces: truncate, hash or drop")
+	logAnonymizeKey = flag.String("log-anonymize-key", "",
+		"Key for -log-anonymize=hash, so hashes stay comparable across restarts (random if unset)")
+
+	queryLogFormat = flag.String("query-log-format", "",
+		"Log each completed query in this format: json, or empty for none")
+	queryLogFile = flag.String("query-log-file", "", "File for -query-log-format output (stderr if unset)")
+
+	queryLogDB = flag.String("query-log-db", "",
+		"SQLite database to record completed queries in")
+	queryLogDBRetention = flag.Duration("query-log-db-retention", 7*24*time.Hour,
+		"How long -query-log-db keeps queries")
+
+	topDomains = flag.Bool("top-domains", true,
+		"Keep approximate counts of the most queried domains and busiest clients for the SIGUSR1 dump")
+	topDomainsWindow = flag.Duration("top-domains-window", time.Hour,
+		"Halve the top domain counts this often, so they reflect recent traffic")
+	lockShards = flag.Int("lock-shards", shardCount(runtime.GOMAXPROCS(0)),
+		"Independently locked shards of the -top-domains trackers")
+
+	otelEndpoint = flag.String("otel-endpoint", "",
+		"OpenTelemetry collector base URL to export query traces to over OTLP/HTTP, e.g. http://localhost:4318")
+	otelSampleRatio = flag.Float64("otel-sample-ratio", 0.01, "Fraction of queries to trace")
+
+	controlSocket = flag.String("control-socket", "", "Unix socket for runtime commands from the ctl subcommand, usable only by its owner")
+
+	pidfilePath = flag.String("pidfile", "", "Write the process ID to this file once listening, and remove it on exit")
+
+	metricsAddress = flag.String("metrics-address", "", "Address to serve Prometheus metrics on at /metrics")
+	pprofAddress   = flag.String("pprof-address", "", "Address to serve net/http/pprof on at /debug/pprof/")
+
+	apiAddress = flag.String("api-address", "", "Address to serve the REST admin API on at /api/, and a statistics page at /stats")
+	apiToken   = flag.String("api-token", "", "Bearer token the REST admin API requires for changes; without one it is read-only")
+
+	healthAddress = flag.String("health-address", "",
+		"Address to serve /healthz and /readyz on (defaults to -metrics-address)")
+	readyWindow = flag.Duration("ready-window", time.Minute,
+		"How recently an upstream must have answered for /readyz to report ready")
+	readyRequireUpstream = flag.Bool("ready-require-upstream", true,
+		"Only report ready while an upstream is answering; if false, ready once listening")
+
+	watchdogInterval = flag.Duration("watchdog-interval", 0,
+		"Interval between self-test queries sent to our own listener (0 for no watchdog)")
+	watchdogName     = flag.String("watchdog-name", "example.com", "Name the -watchdog self-test queries")
+	watchdogTimeout  = flag.Duration("watchdog-timeout", 10*time.Second, "How long a self-test query may take")
+	watchdogFailures = flag.Int("watchdog-failures", 3, "Self-test queries in a row that must fail for the watchdog to act")
+	watchdogAction   = flag.String("watchdog-action", watchdogLog,
+		"What the watchdog does: any of log, stacks (log goroutine stacks), unhealthy (fail /healthz) and exit, comma-separated")
+
+	timeout         = flag.Duration("timeout", 5*time.Second, "Upstream request timeout per query")
+	adaptiveTimeout = flag.Bool("adaptive-timeout", false,
+		"Time out upstream requests after twice the endpoint's recent 99th percentile latency, once it is known")
+	adaptiveTimeoutMin = flag.Duration("adaptive-timeout-min", 250*time.Millisecond, "Shortest -adaptive-timeout")
+	adaptiveTimeoutMax = flag.Duration("adaptive-timeout-max", 0, "Longest -adaptive-timeout (0 for -timeout)")
+
+	debug        = flag.Bool("debug", false, "Verbose debugging, the same as -log-level=debug")
+	logLevelName = flag.String("log-level", "info", "Least severe messages to log: error, warn, info or debug")
+	quiet        = flag.Bool("quiet", false, "Only log warnings and errors, whatever -log-level says")
+	traceDomain  = flag.String("trace-domain", "",
+		"Comma-separated domains whose queries are logged in full detail, regardless of -debug")
+)
 
 func main() {
-	flag.Parse()
-	if *defaultServer == "" {
-		log.Fatal("-default is required")
+	if ok, err := serviceCommand(os.Args[1:]); ok {
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "loadtest" {
+		os.Exit(runLoadtest(os.Args[2:]))
+	}
+	// "doctor" diagnoses the upstream with the settings that follow it, and
+	// "ctl" sends the command after its flags to a running proxy
+	args := os.Args[1:]
+	doctorMode := len(args) > 0 && args[0] == "doctor"
+	ctlMode := len(args) > 0 && args[0] == "ctl"
+	if doctorMode || ctlMode {
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	if err := loadEnv(); err != nil {
+		log.Fatal(err)
 	}
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+	if *configPath != "" {
+		if err := loadConfig(*configPath); err != nil {
+			log.Fatal(err)
+		}
+		onReload(func() { reloadConfig(*configPath) })
+	}
+	if *address != "" {
+		*listenUDP = *address
+		*listenTCP = *address
+	}
+	if *preset == "list" {
+		writePresets(os.Stdout)
+		return
+	}
+	if err := applyPresets(*preset, flagSet("default")); err != nil {
+		log.Fatal(err)
+	}
+	if *checkOnly {
+		os.Exit(runCheckConfig())
+	}
+	if doctorMode {
+		os.Exit(runDoctor())
+	}
+	if ctlMode {
+		os.Exit(runCtl(flag.Args()))
+	}
+	if *printConfig {
+		writeEffectiveConfig(os.Stdout)
+		return
+	}
+	if *logFilePath != "" {
+		if err := setupLogFile(*logFilePath, *logMaxSize, *logMaxFiles); err != nil {
+			log.Fatal("-log-file: ", err)
+		}
+	}
+	if *logSyslog {
+		if err := setupSyslog(*syslogAddress, *syslogFacilityName, *logStderr); err != nil {
+			log.Fatal("-log-syslog: ", err)
+		}
+	}
+	if err := initService(); err != nil {
+		log.Fatal(err)
+	}
+	// An invalid -log-level is reported by checkConfig below
+	setLogLevel()
+	infof("Starting %s", versionString())
+	logEnvFlags()
+	if *address != "" {
+		warnf("-address is deprecated, use -listen-udp and -listen-tcp")
+	}
+	if without := presetsWithoutECS(*preset); len(without) > 0 && (*subnet != "" || *subnet6 != "") {
+		warnf("-preset %s ignores client subnets, so -subnet and -subnet6 have no effect there", strings.Join(without, ","))
+	}
+	if errs := checkConfig(); len(errs) > 0 {
+		for _, err := range errs {
+			errorf("%v", err)
+		}
+		log.Fatal("Invalid configuration, not starting")
+	}
+	logEffectiveConfig()
+	setUpstream(*defaultServer)
+	// The settings parsed below were all checked by checkConfig
+	trustedProxies, _ = parseCIDRSet(*trustedProxiesList)
 
-	udpServer := &dns.Server{Addr: *address, Net: "udp"}
-	tcpServer := &dns.Server{Addr: *address, Net: "tcp"}
-	dns.HandleFunc(".", route)
-	go func() {
-		if err := udpServer.ListenAndServe(); err != nil {
+	if err := initUpstreamClient(); err != nil {
+		log.Fatal(err)
+	}
+	initUpstreamSlots()
+	if err := startIPSets(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initAnonymize(*logAnonymize, *logAnonymizeKey); err != nil {
+		log.Fatal(err)
+	}
+	if *dnstapSocket != "" {
+		tap = newDnstapWriter(*dnstapSocket)
+	}
+	traceDomains = parseSuffixSet(*traceDomain)
+	activeTTLRules.Store(ttlOverrides)
+	filterAAAAExcept = parseSuffixSet(*filterAAAAExceptions)
+	flattenDomains = parseSuffixSet(*flattenCNAMEList)
+	if *otelEndpoint != "" {
+		tracer = newOTelTracer(*otelEndpoint, *otelSampleRatio)
+	}
+	if *refuseAny == anyCached {
+		anyCache = newRRsetCache(anyCacheNames)
+	}
+	if *topDomains {
+		topQueries = newTopK(*topDomainsWindow, *lockShards)
+		topDenied = newTopK(*topDomainsWindow, *lockShards)
+		topBlocked = newTopK(*topDomainsWindow, *lockShards)
+		topClients = newTopK(*topDomainsWindow, *lockShards)
+	}
+	if *queryLogFormat == "json" {
+		var err error
+		if queryLog, err = newJSONQueryLog(*queryLogFile); err != nil {
+			log.Fatal("-query-log-file: ", err)
+		}
+	}
+	if *queryLogDB != "" {
+		var err error
+		if queryDB, err = newQueryDB(*queryLogDB, *queryLogDBRetention); err != nil {
+			log.Fatal("-query-log-db: ", err)
+		}
+	}
+	var handler dns.Handler = dns.HandlerFunc(route)
+	if *udpWorkerCount > 0 {
+		// The queue sits inside the limits and cookies, so that queries it
+		// turns away get the same treatment as the others
+		handler = newUDPWorkers(*udpWorkerCount, *udpQueueSize, *udpQueueOverflow, recoverHandler(handler))
+	}
+	if *rrlResponses > 0 {
+		exempt, _ := parseCIDRSet(*rrlExempt)
+		handler = rrlHandler(newResponseLimiter(*rrlResponses, *rrlSlip,
+			*rrlIPv4Prefix, *rrlIPv6Prefix, exempt), handler)
+	}
+	clientExempt, _ := parseCIDRSet(*clientQPSExempt)
+	if *nxdomainBurst > 0 {
+		nxdomains = newNXDomainDetector(*nxdomainBurst, *nxdomainBurstWindow)
+		if *dgaAction == "limit" {
+			handler = nxdomainLimitHandler(nxdomains, newClientLimiter(*dgaQPS, 1, clientExempt), handler)
+		}
+	}
+	if *clientQPS > 0 {
+		handler = rateLimitHandler(newClientLimiter(*clientQPS, *clientBurst, clientExempt), handler)
+	}
+	if *dnsCookies {
+		cookies = newCookieSecrets(*cookieSecretRotation)
+		handler = cookieHandler(handler)
+	}
+	handler = recoverHandler(handler)
+	dns.Handle(".", handler)
+	if len(oneShotQueries) > 0 {
+		os.Exit(runQueries(oneShotQueries, *queryType))
+	}
+
+	if *pidfilePath != "" {
+		if err := checkPidfile(*pidfilePath); err != nil {
 			log.Fatal(err)
 		}
-	}()
-	go func() {
-		if err := tcpServer.ListenAndServe(); err != nil {
+	}
+
+	listeners, err := openListeners()
+	if err != nil {
+		log.Fatal(err)
+	}
+	allowFromListeners = listeners
+	if *listenDoH != "" {
+		allowFromListeners = append(listeners[:len(listeners):len(listeners)], &dnsListener{Proto: "tcp", Addr: *listenDoH})
+	}
+	for _, addr := range splitList(*listenQUICAddr) {
+		allowFromListeners = append(allowFromListeners[:len(allowFromListeners):len(allowFromListeners)],
+			&dnsListener{Proto: "quic", Addr: addr})
+	}
+	acl, err := parseAllowFrom(*allowFrom, allowFromListeners)
+	if err != nil {
+		closeDNS(listeners)
+		log.Fatal("-allow-from: ", err)
+	}
+	allowFromACL.Store(acl)
+	applyAllowFrom(listeners)
+
+	if err := serveDNS(listeners); err != nil {
+		closeDNS(listeners)
+		log.Fatal(err)
+	}
+	atomic.StoreInt32(&dnsServing, 1)
+
+	if *listenDoH != "" {
+		if err := serveDoH(*listenDoH); err != nil {
+			shutdownDNS(listeners)
 			log.Fatal(err)
 		}
-	}()
+	}
+	if *listenQUICAddr != "" {
+		if err := serveDoQ(splitList(*listenQUICAddr)); err != nil {
+			shutdownDNS(listeners)
+			shutdownHTTP()
+			shutdownDoQ()
+			log.Fatal(err)
+		}
+	}
+
+	go watchStartupUpstream()
+	if *watchdogInterval > 0 {
+		go runWatchdog(listeners)
+	}
+	if *failback {
+		go failbackLoop(*failbackInterval)
+	}
+	if *metricsAddress != "" {
+		addMetrics(*metricsAddress)
+	}
+	if *healthAddress == "" {
+		*healthAddress = *metricsAddress
+	}
+	if *healthAddress != "" {
+		addHealth(*healthAddress)
+	}
+	if *apiAddress != "" {
+		addAPI(*apiAddress)
+		addStatsPage(*apiAddress)
+	}
+	if *pprofAddress != "" {
+		warnf("Warning: pprof on %s is unauthenticated, do not expose it publicly", *pprofAddress)
+		addPprof(*pprofAddress)
+	}
+	if err := serveAdmin(); err != nil {
+		shutdownDNS(listeners)
+		shutdownHTTP()
+		shutdownDoQ()
+		log.Fatal(err)
+	}
+	if *controlSocket != "" {
+		if err := serveControl(*controlSocket); err != nil {
+			shutdownDNS(listeners)
+			shutdownHTTP()
+			shutdownDoQ()
+			log.Fatal(err)
+		}
+	}
+	if *pidfilePath != "" {
+		if err := writePidfile(*pidfilePath); err != nil {
+			shutdownDNS(listeners)
+			shutdownHTTP()
+			shutdownDoQ()
+			log.Fatal(err)
+		}
+	}
 
-	// Wait for SIGINT or SIGTERM
+	if *notifyAfterProbe {
+		go func() {
+			for {
+				ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+				err := probeUpstream(ctx, upstreamEndpoint())
+				cancel()
+				if err == nil {
+					break
+				}
+				warnf("Upstream probe failed, not ready yet: %v", err)
+				time.Sleep(5 * time.Second)
+			}
+			sdNotify("READY=1")
+		}()
+	} else {
+		sdNotify("READY=1")
+	}
+
+	// The watchdog is only fed from this loop, so it stops if the loop wedges
+	var watchdog <-chan time.Time
+	if interval := sdWatchdogInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+
+	// Wait for SIGINT or SIGTERM, or for a server to fail. SIGHUP reloads and
+	// SIGUSR1 logs statistics. A Windows service gets these from the service
+	// control manager instead.
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	<-sigs
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	if statsSignal != nil {
+		signal.Notify(sigs, statsSignal)
+	}
+	startService(sigs)
+	exitCode := 0
+wait:
+	for {
+		select {
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				infof("Reloading")
+				sdNotify("RELOADING=1")
+				reload()
+				sdNotify("READY=1")
+				continue
+			}
+			if statsSignal != nil && sig == statsSignal {
+				go dumpStats()
+				continue
+			}
+			break wait
+		case err := <-serverErrs:
+			errorf("%v", err)
+			exitCode = 1
+			break wait
+		case <-watchdog:
+			sdNotify("WATCHDOG=1")
+		}
+	}
+
+	sdNotify("STOPPING=1")
+	shutdownDNS(listeners)
+	shutdownHTTP()
+	shutdownDoQ()
+	closeControl()
+	if queryDB != nil {
+		queryDB.Close()
+	}
+	if *pidfilePath != "" {
+		removePidfile(*pidfilePath)
+	}
+	serviceStopped(exitCode)
+	os.Exit(exitCode)
+}
+
+// splitList splits a comma-separated flag value, ignoring empty entries.
+func splitList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
 
-	udpServer.Shutdown()
-	tcpServer.Shutdown()
+// normalizeName returns the canonical form of a query name: lowercase and
+// fully qualified. This is the form sent upstream and used for matching.
+func normalizeName(name string) string {
+	return dns.Fqdn(strings.ToLower(name))
 }
 
 func route(w dns.ResponseWriter, req *dns.Msg) {
-	proxy(*defaultServer, w, req)
+	start := time.Now()
+	rec := &responseRecorder{ResponseWriter: w}
+	w = rec
+	defer func() {
+		countQuery(req, rec)
+		if tap != nil {
+			tapClient(dnstapClientResponse, w, rec.msg, start)
+		}
+		if queryLog != nil {
+			queryLog.Log(req, rec, start)
+		}
+		if queryDB != nil {
+			queryDB.Log(req, rec, start)
+		}
+		if *logQueries {
+			logReply(req, rec)
+		}
+		if nxdomains != nil && rec.msg != nil && rec.msg.Rcode == dns.RcodeNameError {
+			if ip := addrIP(w.RemoteAddr()); ip != nil {
+				nxdomains.Record(ip, normalizeName(req.Question[0].Name))
+			}
+		}
+	}()
+	if *logQueries {
+		logQuery(w, req)
+	}
+	if len(req.Question) > 0 {
+		topQueries.Add(normalizeName(req.Question[0].Name))
+	}
+	if topClients != nil {
+		if client := clientAddr(w); client != "" {
+			topClients.Add(client)
+		}
+	}
+	if tap != nil {
+		tapClient(dnstapClientQuery, w, req, start)
+	}
+
+	if len(req.Question) != 1 {
+		writeFailure(w, req, dns.RcodeFormatError, newEDE(edeOther, "query must contain exactly one question"))
+		return
+	}
+	switch err := checkQueryName(req.Question[0].Name); err {
+	case nil:
+	case errNameNotHost:
+		if !*permissiveNames {
+			writeFailure(w, req, dns.RcodeRefused, newEDE(edeProhibited, err.Error()))
+			return
+		}
+	default:
+		writeFailure(w, req, dns.RcodeFormatError, newEDE(edeOther, err.Error()))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if tracer != nil {
+		var qspan *span
+		ctx, qspan = tracer.startQuery(ctx, "dns query")
+		defer func() { endQuerySpan(qspan, req, rec) }()
+	}
+
+	// Abandon the upstream request if a TCP client disconnects
+	if conn := lookupConn(w); conn != nil {
+		var stop func()
+		ctx, stop = conn.watch(ctx)
+		defer stop()
+	}
+
+	if req.Question[0].Qtype == dns.TypeANY && answerANY(w, req) {
+		return
+	}
+	if answerFilteredAAAA(w, req) {
+		return
+	}
+	if answerLocal(ctx, w, req) {
+		return
+	}
+	if answerSearch(ctx, w, req) {
+		return
+	}
+	forward(ctx, w, req)
 }
 
-func proxy(addr string, w dns.ResponseWriter, req *dns.Msg) {
-	httpreq, err := http.NewRequest(http.MethodGet, *defaultServer, nil)
+// forward answers req from the upstream group the policy hook, if any,
+// picks.
+func forward(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) {
+	group, ok := consultHook(ctx, w, req, currentUpstream())
+	if !ok {
+		return
+	}
+	endpoint := group.pick()
+	debugf("Upstream group %s: sending %s to %s", group.name, req.Question[0].Name, endpoint)
+	proxy(ctx, group, endpoint, w, req)
+}
+
+// proxy answers req from the upstream endpoint addr of group. Identical
+// queries in flight at the same time share one upstream request.
+func proxy(ctx context.Context, group *upstreamGroup, addr string, w dns.ResponseWriter, req *dns.Msg) {
+	subnets := group.ecs()
+	ecs := subnets.forType(req.Question[0].Qtype)
+	var httpreq *http.Request
+	builder, err := requestBuilder(addr)
+	if err == nil {
+		httpreq, err = builder.NewRequest(ctx, req, ecs)
+	}
 	if err != nil {
-		log.Println("Error setting up request:", err)
-		dns.HandleFailed(w, req)
+		errorf("Error setting up request: %v", err)
+		handleFailed(w, req)
 		return
 	}
 
-	qry := httpreq.URL.Query()
-	qry.Add("name", req.Question[0].Name)
-	qry.Add("type", fmt.Sprintf("%v", req.Question[0].Qtype))
-	if req.CheckingDisabled {
-		qry.Add("cd", "1")
+	qname := normalizeName(req.Question[0].Name)
+	ttls := activeTTLRules.Load().(ttlRules)
+	trace := newQueryTrace(qname)
+	if logAt(levelDebug) {
+		log.Println(httpreq.URL.String())
 	}
 
-	var ecs string
-	if ednsOpt := req.IsEdns0(); ednsOpt != nil {
-		for _, s := range ednsOpt.Option {
-			switch e := s.(type) {
-			case *dns.EDNS0_SUBNET:
-				ecs = fmt.Sprintf("%s/%d", e.Address, e.SourceNetmask)
+	key := flightKey(addr, httpreq)
+	reply, shared := prefetched.take(key), true
+	if reply == nil {
+		reply, shared = upstreamFlights.Do(ctx, key, func(ctx context.Context) *upstreamReply {
+			if !acquireUpstreamSlot(ctx) {
+				if logAt(levelDebug) {
+					log.Println("Too many concurrent upstream requests, failing query")
+				}
+				return &upstreamReply{fail: []dns.EDNS0{newEDE(edeOther, "too many concurrent queries")}}
 			}
+			defer releaseUpstreamSlot()
+			stats.UpstreamInFlight.Inc()
+			defer stats.UpstreamInFlight.Dec()
+			return fetchHedged(ctx, group, addr, ecs, httpreq.WithContext(ctx), w, req, trace)
+		})
+	}
+	if reply.prefetched {
+		prefetched.take(key)
+		stats.PrefetchHits.Inc()
+		trace.Printf("answered by a prefetch")
+	} else if shared {
+		stats.UpstreamDeduplicated.Inc()
+		trace.Printf("answered by an identical query's upstream request")
+	}
+	if rec, ok := w.(*responseRecorder); ok {
+		rec.upstream = reply.endpoint
+	}
+	if reply.abandoned {
+		if shared {
+			handleFailed(w, req, newEDE(edeNetworkError, "upstream request abandoned"))
 		}
+		return
 	}
-	if len(ecs) == 0 && len(*subnet) > 0 {
-		ecs = *subnet
+	if !shared && ctx.Err() == context.Canceled {
+		// The client went away while queries sharing its request waited
+		return
 	}
-	if len(ecs) > 0 {
-		qry.Add("edns_client_subnet", ecs)
+	if reply.json == nil {
+		handleFailed(w, req, reply.fail...)
+		return
 	}
-	httpreq.URL.RawQuery = qry.Encode()
 
-	if *debug {
-		log.Println(httpreq.URL.String())
+	// Each query gets its own message built from the shared JSON, so that
+	// nothing is shared between the responses
+	resp := dohproxy.NewResponse(req, reply.json)
+	if !*trustUpstreamAD {
+		resp.AuthenticatedData = false
 	}
+	dedupeRecords(resp)
+	echoOPT(resp, req)
+	flattenCNAMEs(ctx, w, req, resp)
+	stripAAAA(resp, qname)
+	rotateAnswers(resp)
+	relayComment(w, req, resp, qname, string(reply.json.Comment))
 
-	httpresp, err := http.DefaultClient.Do(httpreq)
-	if err != nil {
-		log.Println("Error sending DNS response:", err)
-		dns.HandleFailed(w, req)
+	// Apply the size caps first, so that UDP truncation only ever works on
+	// a response we are prepared to send over TCP.
+	if !capResponse(resp) {
+		upstreamFailed(reply.endpoint, errClassOversized)
+		handleFailed(w, req, newEDE(edeInvalidData, "upstream response too large"))
 		return
 	}
-	defer httpresp.Body.Close()
 
-	// Parse the JSON response
-	dnsResp := new(DNSResponseJson)
-	decoder := json.NewDecoder(httpresp.Body)
-	err = decoder.Decode(&dnsResp)
+	// The cache keeps the upstream's TTLs, so that what it serves follows
+	// the -ttl-override rules in use at the time
+	if anyCache != nil {
+		anyCache.Add(req, resp)
+	}
+	overrideTTL(resp, qname, ttls)
+
+	if tap != nil && !shared {
+		tapForwarder(dnstapForwarderResponse, resp, reply.start)
+	}
+
+	addToIPSets(resp, qname)
+
+	if w.RemoteAddr().Network() == "udp" {
+		truncateForUDP(resp, req)
+	}
+
+	trace.Printf("response:\n%s", resp)
+
+	// Write the response
+	err = w.WriteMsg(resp)
 	if err != nil {
-		log.Println("Malformed JSON DNS response:", err)
-		dns.HandleFailed(w, req)
-		return
+		errorf("Error writing DNS response: %v", err)
 	}
 
-	// Parse the google Questions to DNS RRs
-	questions := []dns.Question{}
-	for idx, c := range dnsResp.Question {
-		questions = append(questions, dns.Question{
-			Name:   c.Name,
-			Qtype:  uint16(c.Type),
-			Qclass: req.Question[idx].Qclass,
-		})
+	if *prefetch && !shared && req.Question[0].Qtype == dns.TypeA && resp.Rcode == dns.RcodeSuccess {
+		prefetchFor(addr, subnets, w, req)
+	}
+}
+
+// upstreamReply is the outcome of an upstream request: the decoded
+// response, or the EDNS options to fail the query with.
+type upstreamReply struct {
+	endpoint string
+	start    time.Time
+	json     *dohproxy.DNSResponseJson
+	fail     []dns.EDNS0
+	// The client went away and the request was abandoned
+	abandoned bool
+	// The request was a prefetch, not made for a client's query
+	prefetched bool
+}
+
+// fetch sends httpreq, the upstream request to addr for req, which w sent.
+func fetch(ctx context.Context, addr string, httpreq *http.Request, w dns.ResponseWriter, req *dns.Msg, trace *queryTrace) *upstreamReply {
+	reply := &upstreamReply{endpoint: addr}
+	if upstreamBackoff.Suspended(addr) {
+		if logAt(levelDebug) {
+			log.Println("Upstream is backing off, failing query:", addr)
+		}
+		reply.fail = []dns.EDNS0{newEDE(edeNetworkError, "upstream rate limited")}
+		return reply
 	}
 
-	// Parse google RRs to DNS RRs
-	answers := []dns.RR{}
-	for _, a := range dnsResp.Answer {
-		answers = append(answers, NewRR(a))
+	qname := normalizeName(req.Question[0].Name)
+	if *logQueries {
+		log.Printf("forwarded %s to %s", req.Question[0].Name, addr)
 	}
+	trace.Printf("query %s from %q, upstream request %s",
+		dns.Type(req.Question[0].Qtype), clientAddr(w), httpreq.URL)
 
-	// Parse google RRs to DNS RRs
-	authorities := []dns.RR{}
-	for _, ns := range dnsResp.Authority {
-		authorities = append(authorities, NewRR(ns))
+	reply.start = time.Now()
+	if tap != nil {
+		tapForwarder(dnstapForwarderQuery, req, reply.start)
+	}
+	if d := upstreamTimeout(addr); d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+		httpreq = httpreq.WithContext(ctx)
+	}
+	httpreq, method := upstreamRequest(addr, httpreq)
+	if uspan := startChild(ctx, "upstream request", spanKindClient); uspan != nil {
+		uspan.SetAttr("server.endpoint", addr)
+		httpreq.Header.Set("traceparent", uspan.traceparent())
+		ctx = context.WithValue(ctx, spanKey{}, uspan)
+		defer uspan.End()
+	}
+	httpresp, err := upstreamClient.Do(httpreq)
+	if err != nil && ctx.Err() == context.Canceled {
+		if logAt(levelDebug) {
+			log.Println("Client went away, abandoned upstream request:", addr)
+		}
+		reply.abandoned = true
+		return reply
 	}
+	if err != nil {
+		spanFromContext(ctx).Fail()
+		trace.Printf("upstream request failed: %v", err)
+		class := transportErrorClass(ctx, err)
+		upstreamFailed(addr, class)
+		warnf("Upstream request failed [%s]: %v", class, err)
+		reply.fail = []dns.EDNS0{newEDE(edeNetworkError, "")}
+		return reply
+	}
+	defer httpresp.Body.Close()
+	upstreamBackoff.Observe(addr, httpresp)
+	observeMethod(addr, method, httpresp.StatusCode)
+	spanFromContext(ctx).SetAttr("http.response.status_code", httpresp.StatusCode)
+	trace.Printf("upstream headers: %s, Content-Type %q", httpresp.Status, httpresp.Header.Get("Content-Type"))
 
-	// Parse google RRs to DNS RRs
-	extras := []dns.RR{}
-	for _, extra := range dnsResp.Additional {
-		authorities = append(authorities, NewRR(extra))
+	if httpresp.StatusCode != http.StatusOK {
+		class := httpErrorClass(httpresp.StatusCode)
+		upstreamFailed(addr, class)
+		warnf("Upstream returned HTTP status [%s]: %s", class, httpresp.Status)
+		if logAt(levelDebug) {
+			snippet, _ := ioutil.ReadAll(io.LimitReader(httpresp.Body, 512))
+			log.Printf("Upstream response body: %q", snippet)
+		}
+		reply.fail = []dns.EDNS0{newEDE(edeNetworkError, "upstream HTTP "+httpresp.Status)}
+		return reply
 	}
 
-	resp := dns.Msg{
-		MsgHdr: dns.MsgHdr{
-			Id:                 req.Id,
-			Response:           (dnsResp.Status == 0),
-			Opcode:             dns.OpcodeQuery,
-			Authoritative:      false,
-			Truncated:          dnsResp.TC,
-			RecursionDesired:   dnsResp.RD,
-			RecursionAvailable: dnsResp.RA,
-			//Zero: false,
-			AuthenticatedData: dnsResp.AD,
-			CheckingDisabled:  dnsResp.CD,
-			Rcode:             int(dnsResp.Status),
-		},
-		Compress: req.Compress,
-		Question: questions,
-		Answer:   answers,
-		Ns:       authorities,
-		Extra:    extras,
+	if !*skipContentType && !dohproxy.JSONContentType(httpresp.Header.Get("Content-Type")) {
+		stats.UpstreamBadContentType.Inc()
+		upstreamFailed(addr, errClassContentType)
+		snippet, _ := ioutil.ReadAll(io.LimitReader(httpresp.Body, 200))
+		warnf("Upstream returned unexpected Content-Type [%s] %q: %q", errClassContentType,
+			httpresp.Header.Get("Content-Type"), snippet)
+		reply.fail = []dns.EDNS0{newEDE(edeInvalidData, "unexpected upstream content type")}
+		return reply
 	}
 
-	// Write the response
-	err = w.WriteMsg(&resp)
+	// Parse the JSON response
+	dnsResp := new(dohproxy.DNSResponseJson)
+	body := bodyBuffers.Get().(*bytes.Buffer)
+	defer bodyBuffers.Put(body)
+	body.Reset()
+	if _, err = body.ReadFrom(trace.capture(limitBody(httpresp.Body))); err == nil {
+		err = json.Unmarshal(body.Bytes(), dnsResp)
+	}
+	if err != nil && ctx.Err() == context.Canceled {
+		reply.abandoned = true
+		return reply
+	}
+	if trace != nil {
+		trace.Printf("upstream body (up to %d bytes): %s", traceBodyLimit, trace.body)
+	}
 	if err != nil {
-		log.Println("Error writing DNS response:", err)
+		class := errClassParse
+		if err == errBodyTooLarge {
+			stats.UpstreamBodyTooLarge.Inc()
+			class = errClassBodyTooLarge
+		}
+		trace.Printf("cannot decode upstream body: %v", err)
+		upstreamFailed(addr, class)
+		warnf("Malformed JSON DNS response [%s]: %v", class, err)
+		reply.fail = []dns.EDNS0{newEDE(edeInvalidData, "")}
+		return reply
+	}
+
+	observeUpstream(addr, reply.start)
+	ageTTLs(dnsResp, httpresp.Header)
+
+	// Extended rcodes such as BADVERS or BADCOOKIE describe the upstream's own
+	// EDNS exchange and don't fit the 4-bit header field, so don't relay them.
+	if dnsResp.Status > 0xF {
+		rcode := dns.RcodeToString[int(dnsResp.Status)]
+		if rcode == "" {
+			rcode = "unknown"
+		}
+		warnf("Upstream returned extended rcode %d (%s) for %s", dnsResp.Status, rcode, qname)
+		reply.fail = []dns.EDNS0{newEDE(edeOther, fmt.Sprintf("upstream rcode %d (%s)", dnsResp.Status, rcode))}
+		return reply
 	}
+	reply.json = dnsResp
+	return reply
 }
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnstap message types (dnstap.proto Message.Type).
+const (
+	dnstapClientQuery       = 5
+	dnstapClientResponse    = 6
+	dnstapForwarderQuery    = 7
+	dnstapForwarderResponse = 8
+)
+
+// dnstap socket families and protocols.
+const (
+	dnstapINET  = 1
+	dnstapINET6 = 2
+	dnstapUDP   = 1
+	dnstapTCP   = 2
+	dnstapDOH   = 4
+)
+
+// Frame Streams control frame types and the content type carried.
+const (
+	fstrmAccept      = 1
+	fstrmStart       = 2
+	fstrmReady       = 4
+	fstrmContentType = 1
+
+	dnstapContentType = "protobuf:dnstap.Dnstap"
+)
+
+const (
+	// How many encoded messages may wait for a slow collector.
+	dnstapBufferSize = 1024
+	// How long to wait between attempts to reach the collector.
+	dnstapRetryInterval = 5 * time.Second
+	dnstapWriteTimeout  = 5 * time.Second
+)
+
+// tap is the dnstap writer, or nil when -dnstap-socket is unset.
+var tap *dnstapWriter
+
+// dnstapWriter sends dnstap messages to a collector over Frame Streams.
+// Messages are queued without blocking and dropped when the queue is full.
+type dnstapWriter struct {
+	network, addr string
+	queue         chan []byte
+	logger        *logEvery
+}
+
+// newDnstapWriter starts a writer for addr, which is a Unix socket path if
+// it contains a slash and a TCP address otherwise.
+func newDnstapWriter(addr string) *dnstapWriter {
+	t := &dnstapWriter{
+		network: "tcp",
+		addr:    addr,
+		queue:   make(chan []byte, dnstapBufferSize),
+		logger:  newLogEvery(time.Minute),
+	}
+	if strings.Contains(addr, "/") {
+		t.network = "unix"
+	}
+	go t.run()
+	return t
+}
+
+func (t *dnstapWriter) send(frame []byte) {
+	select {
+	case t.queue <- frame:
+	default:
+		stats.DnstapDropped.Inc()
+	}
+}
+
+// run keeps a connection to the collector open and writes queued messages
+// to it, reconnecting whenever it fails.
+func (t *dnstapWriter) run() {
+	for {
+		conn, err := net.DialTimeout(t.network, t.addr, dnstapWriteTimeout)
+		if err == nil {
+			err = fstrmHandshake(conn)
+			if err == nil {
+				infof("Connected to dnstap collector %s", t.addr)
+				err = t.write(conn)
+			}
+			conn.Close()
+		}
+		t.logger.Printf("dnstap collector %s: %v", t.addr, err)
+		time.Sleep(dnstapRetryInterval)
+	}
+}
+
+func (t *dnstapWriter) write(conn net.Conn) error {
+	for frame := range t.queue {
+		conn.SetWriteDeadline(time.Now().Add(dnstapWriteTimeout))
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(frame)))
+		if _, err := conn.Write(append(length[:], frame...)); err != nil {
+			stats.DnstapDropped.Inc()
+			return err
+		}
+	}
+	return nil
+}
+
+// fstrmHandshake negotiates a bidirectional Frame Streams session: READY,
+// the collector's ACCEPT, then START.
+func fstrmHandshake(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(dnstapWriteTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write(fstrmControl(fstrmReady)); err != nil {
+		return err
+	}
+	var hdr [12]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+	if typ := binary.BigEndian.Uint32(hdr[8:]); binary.BigEndian.Uint32(hdr[:4]) != 0 || typ != fstrmAccept {
+		return fmt.Errorf("expected ACCEPT from collector")
+	}
+	// Skip the content types the collector accepts
+	if _, err := io.CopyN(ioutil.Discard, conn, int64(binary.BigEndian.Uint32(hdr[4:8]))-4); err != nil {
+		return err
+	}
+	_, err := conn.Write(fstrmControl(fstrmStart))
+	return err
+}
+
+// fstrmControl encodes a control frame carrying the dnstap content type.
+func fstrmControl(typ uint32) []byte {
+	b := make([]byte, 20, 20+len(dnstapContentType))
+	binary.BigEndian.PutUint32(b[4:], uint32(12+len(dnstapContentType)))
+	binary.BigEndian.PutUint32(b[8:], typ)
+	binary.BigEndian.PutUint32(b[12:], fstrmContentType)
+	binary.BigEndian.PutUint32(b[16:], uint32(len(dnstapContentType)))
+	return append(b, dnstapContentType...)
+}
+
+// tapClient logs a query received from, or a response sent to, the client
+// behind w.
+func tapClient(typ uint64, w dns.ResponseWriter, m *dns.Msg, queryTime time.Time) {
+	if m == nil {
+		return
+	}
+	packed, err := m.Pack()
+	if err != nil {
+		return
+	}
+	msg := tapMessage(typ, queryTime, packed)
+	msg = tapAddrs(msg, w.RemoteAddr(), w.LocalAddr(), *logAnonymize != anonymizeOff)
+	proto := uint64(dnstapUDP)
+	if w.RemoteAddr().Network() != "udp" {
+		proto = dnstapTCP
+	}
+	msg = pbVarint(msg, 3, proto)
+	tap.send(tapEnvelope(msg))
+}
+
+// tapForwarder logs a query sent upstream, or the response built from the
+// upstream's answer. Upstreams speak JSON, so the wire messages logged are
+// the client's query and the response as relayed.
+func tapForwarder(typ uint64, m *dns.Msg, queryTime time.Time) {
+	packed, err := m.Pack()
+	if err != nil {
+		return
+	}
+	msg := tapMessage(typ, queryTime, packed)
+	msg = pbVarint(msg, 3, dnstapDOH)
+	tap.send(tapEnvelope(msg))
+}
+
+// tapMessage starts a dnstap Message holding the wire message and its
+// timestamps. Responses also record when the query was sent.
+func tapMessage(typ uint64, queryTime time.Time, packed []byte) []byte {
+	var msg []byte
+	msg = pbVarint(msg, 1, typ)
+	msg = pbVarint(msg, 8, uint64(queryTime.Unix()))
+	msg = pbFixed32(msg, 9, uint32(queryTime.Nanosecond()))
+	if typ == dnstapClientQuery || typ == dnstapForwarderQuery {
+		return pbBytes(msg, 10, packed)
+	}
+	now := time.Now()
+	msg = pbVarint(msg, 12, uint64(now.Unix()))
+	msg = pbFixed32(msg, 13, uint32(now.Nanosecond()))
+	return pbBytes(msg, 14, packed)
+}
+
+// tapAddrs adds the query (client) and response (server) addresses. An
+// anonymized client address is logged without its port.
+func tapAddrs(msg []byte, query, response net.Addr, anonymize bool) []byte {
+	qip, qport := addrIPPort(query)
+	rip, rport := addrIPPort(response)
+	if qip == nil {
+		return msg
+	}
+	if anonymize {
+		isV4 := qip.To4() != nil
+		if qip = anonymizeIP(qip); qip == nil {
+			return msg
+		}
+		if isV4 {
+			qip = qip.To4()
+		}
+		qport = 0
+	}
+	if ip4 := qip.To4(); ip4 != nil {
+		msg = pbVarint(msg, 2, dnstapINET)
+		qip = ip4
+		if rip != nil {
+			rip = rip.To4()
+		}
+	} else {
+		msg = pbVarint(msg, 2, dnstapINET6)
+	}
+	msg = pbBytes(msg, 4, qip)
+	if qport != 0 {
+		msg = pbVarint(msg, 6, uint64(qport))
+	}
+	if rip != nil {
+		msg = pbBytes(msg, 5, rip)
+		msg = pbVarint(msg, 7, uint64(rport))
+	}
+	return msg
+}
+
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
+
+// tapEnvelope wraps a Message in a Dnstap frame.
+func tapEnvelope(msg []byte) []byte {
+	var b []byte
+	b = pbBytes(b, 2, []byte("dns-over-https-proxy"))
+	b = pbBytes(b, 14, msg)
+	return pbVarint(b, 15, 1) // Dnstap.Type MESSAGE
+}
+
+// Minimal protobuf encoding of the field types dnstap uses.
+
+func pbUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func pbVarint(b []byte, field int, v uint64) []byte {
+	return pbUvarint(pbUvarint(b, uint64(field)<<3), v)
+}
+
+func pbFixed32(b []byte, field int, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(pbUvarint(b, uint64(field)<<3|5), buf[:]...)
+}
+
+func pbBytes(b []byte, field int, v []byte) []byte {
+	b = pbUvarint(b, uint64(field)<<3|2)
+	return append(pbUvarint(b, uint64(len(v))), v...)
+}
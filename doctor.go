@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/wrouesnel/dns-over-https-proxy/dohproxy"
+)
+
+const (
+	// The doctor gives up on each check after doctorStepTimeout, so it
+	// finishes each endpoint within doctorTimeout even when it is
+	// blackholed.
+	doctorStepTimeout = 5 * time.Second
+	doctorTimeout     = 4 * doctorStepTimeout
+)
+
+// doctor runs the upstream connectivity checks, printing a line for each.
+type doctor struct {
+	ctx    context.Context
+	ecs    ecsSubnets
+	failed bool
+}
+
+func (d *doctor) pass(check, format string, v ...interface{}) {
+	fmt.Printf("PASS  %-12s %s\n", check, fmt.Sprintf(format, v...))
+}
+
+func (d *doctor) warn(check, detail, hint string) {
+	fmt.Printf("WARN  %-12s %s\n", check, detail)
+	if hint != "" {
+		fmt.Printf("      %-12s hint: %s\n", "", hint)
+	}
+}
+
+// fail reports a critical check as failed, making the doctor exit non-zero.
+func (d *doctor) fail(check, detail, hint string) {
+	d.failed = true
+	fmt.Printf("FAIL  %-12s %s\n", check, detail)
+	if hint != "" {
+		fmt.Printf("      %-12s hint: %s\n", "", hint)
+	}
+}
+
+func (d *doctor) skip(check string) {
+	fmt.Printf("SKIP  %-12s an earlier check failed\n", check)
+}
+
+func (d *doctor) step() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(d.ctx, doctorStepTimeout)
+}
+
+// runDoctor implements the doctor subcommand: it checks, with the configured
+// settings, each step the proxy takes to reach each upstream endpoint, and
+// returns the exit status.
+func runDoctor() int {
+	d := new(doctor)
+	group, err := resolveUpstream(*defaultServer)
+	if err != nil {
+		d.fail("url", err.Error(), "define the group with -upstream-group, or set -default to a URL")
+	} else {
+		d.ecs = group.ecs()
+		for _, endpoint := range group.endpoints {
+			fmt.Println("Checking upstream", endpoint)
+			var cancel context.CancelFunc
+			d.ctx, cancel = context.WithTimeout(context.Background(), doctorTimeout)
+			d.run(endpoint)
+			cancel()
+		}
+	}
+	if d.failed {
+		fmt.Println("Some critical checks failed")
+		return 1
+	}
+	fmt.Println("All critical checks passed")
+	return 0
+}
+
+func (d *doctor) run(endpoint string) {
+	u, err := url.Parse(endpoint)
+	if err == nil {
+		err = checkUpstreamURL(endpoint)
+	}
+	if err != nil {
+		d.fail("url", err.Error(), "set -default to the https:// URL of a DNS JSON API")
+		return
+	}
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	d.pass("url", "%s, host %s port %s", u.Scheme, host, port)
+
+	addrs := d.resolve(host)
+	if addrs == nil {
+		for _, check := range []string{"connect", "tls", "query"} {
+			d.skip(check)
+		}
+		return
+	}
+	if !d.connect(addrs, port) {
+		for _, check := range []string{"tls", "query"} {
+			d.skip(check)
+		}
+		return
+	}
+	if u.Scheme == "https" && !d.handshake(addrs[0], port, host) {
+		d.skip("query")
+		return
+	}
+	d.query(endpoint)
+}
+
+// resolve looks the upstream host up the way the HTTP client will.
+func (d *doctor) resolve(host string) []string {
+	if net.ParseIP(host) != nil {
+		d.pass("resolve", "%s is an IP address, no lookup needed", host)
+		return []string{host}
+	}
+	ctx, cancel := d.step()
+	defer cancel()
+	start := time.Now()
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		d.fail("resolve", err.Error(),
+			"the upstream name is resolved with the system resolver; if that is this proxy, "+
+				"put an IP address in -default or point /etc/resolv.conf elsewhere")
+		return nil
+	}
+	var addrs []string
+	for _, ip := range ips {
+		addrs = append(addrs, ip.IP.String())
+	}
+	d.pass("resolve", "%s is %s (%v)", host, strings.Join(addrs, ", "), time.Since(start).Round(time.Millisecond))
+	for _, ip := range ips {
+		if ip.IP.IsUnspecified() || ip.IP.IsLoopback() {
+			d.warn("resolve", fmt.Sprintf("%s resolves to %s", host, ip.IP),
+				"a DNS filter may be blocking the upstream name")
+			break
+		}
+	}
+	return addrs
+}
+
+// connect opens a TCP connection to one of addrs, with the same dialer
+// settings as the proxy.
+func (d *doctor) connect(addrs []string, port string) bool {
+	dialer, err := upstreamDialer(*upstreamInterface, *upstreamSourceIP)
+	if err == nil {
+		err = checkUpstreamLink(*upstreamInterface, *upstreamSourceIP)
+	}
+	if err != nil {
+		d.fail("connect", err.Error(), "fix -upstream-interface or -upstream-source-ip")
+		return false
+	}
+	for _, addr := range addrs {
+		ctx, cancel := d.step()
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr, port))
+		cancel()
+		if err == nil {
+			conn.Close()
+			d.pass("connect", "TCP to %s in %v", net.JoinHostPort(addr, port), time.Since(start).Round(time.Millisecond))
+			return true
+		}
+		d.warn("connect", fmt.Sprintf("TCP to %s: %v", net.JoinHostPort(addr, port), err), "")
+	}
+	d.fail("connect", "no address of the upstream accepted a connection",
+		"check firewalls and routing; a timeout usually means the traffic is dropped on the way")
+	return false
+}
+
+// handshake checks the upstream's certificate, flagging chains that don't
+// verify, which usually means something is intercepting TLS.
+func (d *doctor) handshake(addr, port, host string) bool {
+	dialer, _ := upstreamDialer(*upstreamInterface, *upstreamSourceIP)
+	ctx, cancel := d.step()
+	defer cancel()
+	raw, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr, port))
+	if err != nil {
+		d.fail("tls", err.Error(), "")
+		return false
+	}
+	defer raw.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		raw.SetDeadline(deadline)
+	}
+	// Verify by hand afterwards, to describe the chain that was presented
+	conn := tls.Client(raw, &tls.Config{
+		ServerName:         host,
+		NextProtos:         []string{"h2", "http/1.1"},
+		InsecureSkipVerify: true,
+	})
+	if err := conn.Handshake(); err != nil {
+		d.fail("tls", err.Error(), "the upstream or a middlebox refused or stalled the TLS handshake")
+		return false
+	}
+	state := conn.ConnectionState()
+	alpn := state.NegotiatedProtocol
+	if alpn == "" {
+		alpn = "none"
+	}
+	d.pass("tls", "%s, ALPN %s", tlsVersionName(state.Version), alpn)
+	for i, cert := range state.PeerCertificates {
+		fmt.Printf("      %-12s cert %d: %s, issued by %s, expires %s\n", "", i,
+			cert.Subject.CommonName, cert.Issuer.CommonName, cert.NotAfter.Format("2006-01-02"))
+	}
+
+	leaf := state.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: host, Intermediates: intermediates})
+	switch err.(type) {
+	case nil:
+		d.pass("certificate", "valid for %s", host)
+	case x509.UnknownAuthorityError:
+		d.fail("certificate", err.Error(),
+			"the chain ends at "+state.PeerCertificates[len(state.PeerCertificates)-1].Issuer.CommonName+
+				", which is not a trusted CA; a proxy, firewall or antivirus is probably intercepting TLS")
+		return false
+	default:
+		d.fail("certificate", err.Error(), "check the system clock, and that -default names the right host")
+		return false
+	}
+	if left := time.Until(leaf.NotAfter); left < 14*24*time.Hour {
+		d.warn("certificate", fmt.Sprintf("expires in %v", left.Round(time.Hour)), "")
+	}
+	return true
+}
+
+// query sends a real query for the root NS set through the proxy's own
+// HTTP client.
+func (d *doctor) query(endpoint string) {
+	if err := initUpstreamClient(); err != nil {
+		d.fail("query", err.Error(), "")
+		return
+	}
+	ctx, cancel := d.step()
+	defer cancel()
+	req := new(dns.Msg)
+	req.SetQuestion(".", dns.TypeNS)
+	httpreq, err := dohproxy.NewRequest(ctx, endpoint, req, d.ecs.forType(dns.TypeNS))
+	if err != nil {
+		d.fail("query", err.Error(), "")
+		return
+	}
+	httpreq, _ = upstreamRequest(endpoint, httpreq)
+	start := time.Now()
+	httpresp, err := upstreamClient.Do(httpreq)
+	if err != nil {
+		d.fail("query", err.Error(), "")
+		return
+	}
+	defer httpresp.Body.Close()
+	latency := time.Since(start).Round(time.Millisecond)
+	if httpresp.StatusCode != http.StatusOK {
+		d.fail("query", "HTTP status "+httpresp.Status, "check that -default is the JSON API path, such as /resolve")
+		return
+	}
+	if ct := httpresp.Header.Get("Content-Type"); !*skipContentType && !dohproxy.JSONContentType(ct) {
+		d.fail("query", fmt.Sprintf("unexpected Content-Type %q", ct),
+			"the URL may serve RFC 8484 wire format or a captive portal page rather than the JSON API")
+		return
+	}
+	var dnsResp dohproxy.DNSResponseJson
+	if err := json.NewDecoder(limitBody(httpresp.Body)).Decode(&dnsResp); err != nil {
+		d.fail("query", "malformed JSON response: "+err.Error(), "")
+		return
+	}
+	rcode := dns.RcodeToString[int(dnsResp.Status)]
+	if dnsResp.Status != dns.RcodeSuccess {
+		d.fail("query", fmt.Sprintf(". NS answered %s in %v over %s", rcode, latency, httpresp.Proto), "")
+		return
+	}
+	d.pass("query", ". NS answered %s with %d records in %v over %s", rcode, len(dnsResp.Answer), latency, httpresp.Proto)
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("TLS version %#x", v)
+}
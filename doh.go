@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/wrouesnel/dns-over-https-proxy/dohproxy"
+)
+
+const (
+	dohPath        = "/dns-query"
+	dnsMessageType = "application/dns-message"
+	dnsJSONType    = "application/dns-json"
+)
+
+// serveDoH starts the downstream DNS-over-HTTPS server (RFC 8484) on addr.
+// Its queries go through the same handlers as the DNS listeners', behind
+// the -allow-from access list.
+func serveDoH(addr string) error {
+	var tlsConfig *tls.Config
+	if *dohCert != "" || *dohKey != "" {
+		certs, err := newCertReloader(*dohCert, *dohKey)
+		if err != nil {
+			return err
+		}
+		tlsConfig = certs.TLSConfig()
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(dohPath, dohHandler(allowFromHandler(dns.DefaultServeMux)))
+	return serveHTTP("doh", addr, mux, tlsConfig)
+}
+
+// dohHandler answers RFC 8484 GET and POST requests, and Google-style JSON
+// requests, by passing the decoded query to handler. The client is the
+// HTTP peer, connected over TCP.
+func dohHandler(handler dns.Handler) http.HandlerFunc {
+	return func(hw http.ResponseWriter, r *http.Request) {
+		handleDoH(handler, hw, r)
+	}
+}
+
+func handleDoH(handler dns.Handler, hw http.ResponseWriter, r *http.Request) {
+	var req *dns.Msg
+	var err error
+	asJSON := false
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Query().Get("dns") != "":
+		req, err = dohGetQuery(r)
+	case r.Method == http.MethodGet && r.URL.Query().Get("name") != "":
+		req, err = dohJSONQuery(r)
+		asJSON = true
+	case r.Method == http.MethodPost:
+		req, err = dohPostQuery(r)
+	default:
+		http.Error(hw, "expected a GET with dns= or name=, or a POST of "+dnsMessageType,
+			http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(hw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Question) != 1 {
+		http.Error(hw, "query must contain exactly one question", http.StatusBadRequest)
+		return
+	}
+
+	w := newHTTPResponseWriter(r)
+	handler.ServeDNS(w, req)
+	if w.msg == nil {
+		http.Error(hw, "no response", http.StatusInternalServerError)
+		return
+	}
+
+	hw.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(w.msg)))
+	if asJSON {
+		hw.Header().Set("Content-Type", dnsJSONType)
+		json.NewEncoder(hw).Encode(msgToJSON(w.msg))
+		return
+	}
+	buf := packBuffers.Get().(*[]byte)
+	defer packBuffers.Put(buf)
+	packed, err := w.msg.PackBuffer(*buf)
+	if err != nil {
+		http.Error(hw, "cannot pack response: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if cap(packed) > len(*buf) {
+		*buf = packed[:cap(packed)]
+	}
+	hw.Header().Set("Content-Type", dnsMessageType)
+	hw.Write(packed)
+}
+
+// packBuffers holds buffers for packing responses, reused once the packed
+// message has been written.
+var packBuffers = sync.Pool{New: func() interface{} {
+	buf := make([]byte, 2*ednsUDPSize)
+	return &buf
+}}
+
+func dohGetQuery(r *http.Request) (*dns.Msg, error) {
+	b64 := strings.TrimRight(r.URL.Query().Get("dns"), "=")
+	packed, err := base64.RawURLEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64url in dns parameter: %v", err)
+	}
+	return unpackQuery(packed)
+}
+
+func dohPostQuery(r *http.Request) (*dns.Msg, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != dnsMessageType {
+		return nil, fmt.Errorf("Content-Type must be %s", dnsMessageType)
+	}
+	packed, err := ioutil.ReadAll(limitBody(r.Body))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read request body: %v", err)
+	}
+	return unpackQuery(packed)
+}
+
+func dohJSONQuery(r *http.Request) (*dns.Msg, error) {
+	qry := r.URL.Query()
+	qtype := dns.TypeA
+	if t := qry.Get("type"); t != "" {
+		var err error
+		if qtype, err = parseQType(t); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := dns.IsDomainName(qry.Get("name")); !ok {
+		return nil, fmt.Errorf("invalid name %q", qry.Get("name"))
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(qry.Get("name")), qtype)
+	switch qry.Get("cd") {
+	case "1", "true":
+		req.CheckingDisabled = true
+	}
+	if do := qry.Get("do"); do == "1" || do == "true" {
+		req.SetEdns0(ednsUDPSize, true)
+	}
+	return req, nil
+}
+
+// parseQType parses a query type given by number or by name.
+func parseQType(t string) (uint16, error) {
+	if n, err := strconv.ParseUint(t, 10, 16); err == nil {
+		return uint16(n), nil
+	}
+	if n, ok := dns.StringToType[strings.ToUpper(t)]; ok {
+		return n, nil
+	}
+	return 0, fmt.Errorf("unknown type %q", t)
+}
+
+func unpackQuery(packed []byte) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	if err := req.Unpack(packed); err != nil {
+		return nil, fmt.Errorf("malformed DNS message: %v", err)
+	}
+	if req.Response {
+		return nil, fmt.Errorf("DNS message is not a query")
+	}
+	return req, nil
+}
+
+// minTTL returns the smallest TTL in the answer and authority sections,
+// which bounds how long an HTTP cache may keep the response. A negative
+// answer is kept no longer than its SOA's MINIMUM (RFC 8484 section 5.1,
+// RFC 2308 section 5), nor the SOA's own TTL.
+func minTTL(m *dns.Msg) uint32 {
+	var ttl uint32
+	first := true
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range rrs {
+			rrTTL := rr.Header().Ttl
+			if soa, ok := rr.(*dns.SOA); ok && len(m.Answer) == 0 && soa.Minttl < rrTTL {
+				rrTTL = soa.Minttl
+			}
+			if first || rrTTL < ttl {
+				ttl = rrTTL
+				first = false
+			}
+		}
+	}
+	return ttl
+}
+
+// msgToJSON converts a response to the Google JSON API representation.
+func msgToJSON(m *dns.Msg) *dohproxy.DNSResponseJson {
+	resp := &dohproxy.DNSResponseJson{
+		Status: int32(m.Rcode),
+		TC:     m.Truncated,
+		RD:     m.RecursionDesired,
+		RA:     m.RecursionAvailable,
+		AD:     m.AuthenticatedData,
+		CD:     m.CheckingDisabled,
+	}
+	for _, q := range m.Question {
+		resp.Question = append(resp.Question, dohproxy.DNSQuestion{Name: q.Name, Type: int32(q.Qtype)})
+	}
+	resp.Answer = rrsToJSON(m.Answer)
+	resp.Authority = rrsToJSON(m.Ns)
+	resp.Additional = rrsToJSON(m.Extra)
+	return resp
+}
+
+func rrsToJSON(rrs []dns.RR) []dohproxy.DNSRR {
+	var out []dohproxy.DNSRR
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+		out = append(out, dohproxy.DNSRR{
+			Name: hdr.Name,
+			Type: int32(hdr.Rrtype),
+			TTL:  int32(hdr.Ttl),
+			Data: strings.TrimPrefix(rr.String(), hdr.String()),
+		})
+	}
+	return out
+}
+
+// httpResponseWriter is a dns.ResponseWriter which captures the response to
+// a query received over HTTP.
+type httpResponseWriter struct {
+	local, remote net.Addr
+	msg           *dns.Msg
+}
+
+func newHTTPResponseWriter(r *http.Request) *httpResponseWriter {
+	w := &httpResponseWriter{local: &net.TCPAddr{}, remote: &net.TCPAddr{}}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		w.local = addr
+	}
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		w.remote = addr
+	}
+	return w
+}
+
+func (w *httpResponseWriter) LocalAddr() net.Addr  { return w.local }
+func (w *httpResponseWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *httpResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *httpResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *httpResponseWriter) Close() error        { return nil }
+func (w *httpResponseWriter) TsigStatus() error   { return nil }
+func (w *httpResponseWriter) TsigTimersOnly(bool) {}
+func (w *httpResponseWriter) Hijack()             {}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// dohExchange posts req to a DoH server passing queries to handler, as the
+// client remote, returning the unpacked answer.
+func dohExchange(t *testing.T, handler dns.Handler, remote string, req *dns.Msg) (*http.Response, *dns.Msg) {
+	packed, err := req.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, dohPath, bytes.NewReader(packed))
+	r.Header.Set("Content-Type", dnsMessageType)
+	r.RemoteAddr = remote
+	hw := httptest.NewRecorder()
+	dohHandler(handler).ServeHTTP(hw, r)
+	result := hw.Result()
+	if result.StatusCode != http.StatusOK {
+		return result, nil
+	}
+	body, _ := ioutil.ReadAll(result.Body)
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	return result, resp
+}
+
+func TestDoHUsesHandlerChain(t *testing.T) {
+	var client string
+	answer := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		client = w.RemoteAddr().String()
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		w.WriteMsg(resp)
+	})
+	acl := &accessList{allow: &cidrSet{}, deny: &cidrSet{}}
+	if err := acl.allow.Add("192.0.2.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	handler := aclHandler(acl, answer)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, resp := dohExchange(t, handler, "192.0.2.7:4000", req); resp == nil || resp.Rcode != dns.RcodeSuccess {
+		t.Errorf("allowed client: got %v, want NOERROR", resp)
+	}
+	if client != "192.0.2.7:4000" {
+		t.Errorf("handler saw client %q, want the HTTP peer 192.0.2.7:4000", client)
+	}
+	client = ""
+	if _, resp := dohExchange(t, handler, "198.51.100.7:4000", req); resp == nil || resp.Rcode != dns.RcodeRefused {
+		t.Errorf("denied client: got %v, want REFUSED", resp)
+	}
+	if client != "" {
+		t.Errorf("denied client %s reached the handler", client)
+	}
+}
+
+func TestDoHCacheControl(t *testing.T) {
+	soa := func(ttl, minimum int) string {
+		return fmt.Sprintf("example.com. %d IN SOA ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 %d", ttl, minimum)
+	}
+	for _, tc := range []struct {
+		name   string
+		rcode  int
+		answer []string
+		ns     []string
+		maxAge string
+	}{
+		{"answer", dns.RcodeSuccess, []string{"example.com. 300 IN A 192.0.2.1", "example.com. 60 IN A 192.0.2.2"}, nil, "max-age=60"},
+		{"answer with a SOA", dns.RcodeSuccess, []string{"example.com. 300 IN A 192.0.2.1"}, []string{soa(3600, 30)}, "max-age=300"},
+		{"NXDOMAIN", dns.RcodeNameError, nil, []string{soa(3600, 900)}, "max-age=900"},
+		{"NODATA", dns.RcodeSuccess, nil, []string{soa(3600, 900)}, "max-age=900"},
+		{"NODATA under a short SOA TTL", dns.RcodeSuccess, nil, []string{soa(120, 900)}, "max-age=120"},
+		{"NXDOMAIN without a SOA", dns.RcodeNameError, nil, nil, "max-age=0"},
+	} {
+		answer := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			resp := new(dns.Msg)
+			resp.SetRcode(req, tc.rcode)
+			for _, s := range tc.answer {
+				resp.Answer = append(resp.Answer, mustRR(t, s))
+			}
+			for _, s := range tc.ns {
+				resp.Ns = append(resp.Ns, mustRR(t, s))
+			}
+			w.WriteMsg(resp)
+		})
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		result, _ := dohExchange(t, answer, "192.0.2.7:4000", req)
+		if got := result.Header.Get("Cache-Control"); got != tc.maxAge {
+			t.Errorf("%s: got Cache-Control %q, want %q", tc.name, got, tc.maxAge)
+		}
+	}
+}
+
+// BenchmarkPackResponse packs a five-record answer as a DoH response is,
+// into a pooled buffer, and into a fresh one.
+func BenchmarkPackResponse(b *testing.B) {
+	resp := new(dns.Msg)
+	resp.SetQuestion("www.example.com.", dns.TypeA)
+	resp.Response = true
+	for _, s := range []string{
+		"www.example.com. 300 IN CNAME example.com.",
+		"example.com. 300 IN A 192.0.2.1",
+		"example.com. 300 IN A 192.0.2.2",
+		"example.com. 300 IN AAAA 2001:db8::1",
+		"1.2.0.192.in-addr.arpa. 300 IN PTR example.com.",
+	} {
+		resp.Answer = append(resp.Answer, mustRR(b, s))
+	}
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf := packBuffers.Get().(*[]byte)
+			if _, err := resp.PackBuffer(*buf); err != nil {
+				b.Fatal(err)
+			}
+			packBuffers.Put(buf)
+		}
+	})
+	b.Run("fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := resp.Pack(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
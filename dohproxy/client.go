@@ -0,0 +1,314 @@
+// Package dohproxy resolves DNS queries through a DNS-over-HTTPS JSON API
+// such as https://dns.google.com/resolve, translating between wire-format
+// messages and the JSON the endpoint speaks. It is the core of the
+// dns-over-https-proxy command, and can be used without any listeners.
+package dohproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultMaxBodySize limits the upstream responses Client reads.
+const DefaultMaxBodySize = 64 * 1024
+
+// ErrBodyTooLarge is returned by Client.Resolve for an upstream response
+// longer than its MaxBodySize.
+var ErrBodyTooLarge = errors.New("dohproxy: response body exceeds size limit")
+
+// Client resolves queries against a DNS-over-HTTPS JSON endpoint.
+type Client struct {
+	// Endpoint is the URL of the JSON API. It is parsed on first use and
+	// must not change afterwards.
+	Endpoint string
+	// HTTPClient sends the requests; http.DefaultClient if nil.
+	HTTPClient *http.Client
+	// Subnet is the edns_client_subnet to send for queries without an
+	// EDNS Client Subnet option of their own, such as "192.0.2.0/24", or
+	// OptOutSubnet for every query.
+	Subnet string
+	// MaxBodySize limits the size of responses; DefaultMaxBodySize if 0.
+	MaxBodySize int64
+
+	once       sync.Once
+	builder    *RequestBuilder
+	builderErr error
+}
+
+// Resolve sends req upstream and returns the response. The query must have
+// exactly one question. Upstream failures, including extended rcodes that
+// don't fit the message header, are returned as errors rather than as
+// SERVFAIL responses.
+func (c *Client) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if len(req.Question) != 1 {
+		return nil, errors.New("dohproxy: query must contain exactly one question")
+	}
+	c.once.Do(func() { c.builder, c.builderErr = NewRequestBuilder(c.Endpoint) })
+	if c.builderErr != nil {
+		return nil, c.builderErr
+	}
+	httpreq, err := c.builder.NewRequest(ctx, req, c.Subnet)
+	if err != nil {
+		return nil, err
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	httpresp, err := client.Do(httpreq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpresp.Body.Close()
+	if httpresp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dohproxy: upstream HTTP status %s", httpresp.Status)
+	}
+	if ct := httpresp.Header.Get("Content-Type"); !JSONContentType(ct) {
+		return nil, fmt.Errorf("dohproxy: unexpected upstream Content-Type %q", ct)
+	}
+
+	limit := c.MaxBodySize
+	if limit == 0 {
+		limit = DefaultMaxBodySize
+	}
+	// One byte past the limit tells a body of exactly the limit from a
+	// longer one
+	body, err := io.ReadAll(io.LimitReader(httpresp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, ErrBodyTooLarge
+	}
+	var r DNSResponseJson
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("dohproxy: malformed JSON response: %v", err)
+	}
+	if r.Status > 0xF {
+		return nil, fmt.Errorf("dohproxy: upstream returned extended rcode %d", r.Status)
+	}
+	return NewResponse(req, &r), nil
+}
+
+// OptOutSubnet, passed as the subnet to NewRequest, tells the upstream not
+// to use any client subnet for the answer (RFC 7871 section 7.1.2), even
+// for queries with an EDNS Client Subnet option of their own.
+const OptOutSubnet = "0.0.0.0/0"
+
+// NewRequest builds the GET request asking endpoint for the question of
+// req. The client's EDNS Client Subnet option is passed on, truncated to
+// its source prefix, or subnet if the query has none or subnet is
+// OptOutSubnet. A RequestBuilder avoids
+// parsing endpoint each time.
+func NewRequest(ctx context.Context, endpoint string, req *dns.Msg, subnet string) (*http.Request, error) {
+	b, err := NewRequestBuilder(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return b.NewRequest(ctx, req, subnet)
+}
+
+// RequestBuilder builds the requests for one endpoint, which is parsed
+// once.
+type RequestBuilder struct {
+	u url.URL
+	// prefix is the endpoint's own query parameters, ready for ours to be
+	// appended
+	prefix string
+}
+
+// NewRequestBuilder parses endpoint for building requests.
+func NewRequestBuilder(endpoint string) (*RequestBuilder, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	b := &RequestBuilder{u: *u}
+	if u.RawQuery != "" {
+		b.prefix = u.Query().Encode() + "&"
+	}
+	return b, nil
+}
+
+// NewRequest builds the request for req as the package's NewRequest does.
+func (b *RequestBuilder) NewRequest(ctx context.Context, req *dns.Msg, subnet string) (*http.Request, error) {
+	httpreq, err := http.NewRequestWithContext(ctx, http.MethodGet, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	u := b.u
+	httpreq.URL = &u
+	httpreq.Host = u.Host
+
+	// The parameters are written in the order url.Values.Encode sorts them
+	var qry strings.Builder
+	qry.Grow(len(b.prefix) + len(req.Question[0].Name) + 64)
+	qry.WriteString(b.prefix)
+	if req.CheckingDisabled {
+		qry.WriteString("cd=1&")
+	}
+
+	ecs := subnet
+	if ednsOpt := req.IsEdns0(); ednsOpt != nil && subnet != OptOutSubnet {
+		for _, s := range ednsOpt.Option {
+			switch e := s.(type) {
+			case *dns.EDNS0_SUBNET:
+				// Only the source prefix is the client's to share (RFC 7871
+				// section 6), whatever it put in the rest of the address
+				bits := 128
+				if e.Family == 1 {
+					bits = 32
+				}
+				addr := e.Address
+				if int(e.SourceNetmask) <= bits {
+					addr = addr.Mask(net.CIDRMask(int(e.SourceNetmask), bits))
+				}
+				ecs = addr.String() + "/" + strconv.Itoa(int(e.SourceNetmask))
+			}
+		}
+	}
+	if len(ecs) > 0 {
+		qry.WriteString("edns_client_subnet=")
+		qry.WriteString(url.QueryEscape(ecs))
+		qry.WriteByte('&')
+	}
+	qry.WriteString("name=")
+	qry.WriteString(url.QueryEscape(dns.Fqdn(strings.ToLower(req.Question[0].Name))))
+	qry.WriteString("&type=")
+	qry.WriteString(strconv.Itoa(int(req.Question[0].Qtype)))
+	u.RawQuery = qry.String()
+	return httpreq, nil
+}
+
+// Content types of the bodies NewPostRequest can send.
+const (
+	PostForm = "application/x-www-form-urlencoded"
+	PostJSON = "application/json"
+)
+
+// NewPostRequest turns get, a request built by NewRequest, into a POST
+// sending the same parameters in a body of contentType, PostForm or
+// PostJSON, for endpoints which refuse GET. The endpoint's own query
+// parameters stay in the URL.
+func (b *RequestBuilder) NewPostRequest(get *http.Request, contentType string) (*http.Request, error) {
+	params := strings.TrimPrefix(get.URL.RawQuery, b.prefix)
+	body := []byte(params)
+	if contentType == PostJSON {
+		values, err := url.ParseQuery(params)
+		if err != nil {
+			return nil, err
+		}
+		fields := make(map[string]string, len(values))
+		for k, v := range values {
+			fields[k] = v[0]
+		}
+		if body, err = json.Marshal(fields); err != nil {
+			return nil, err
+		}
+	}
+	httpreq, err := http.NewRequestWithContext(get.Context(), http.MethodPost, "", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	u := *get.URL
+	u.RawQuery = strings.TrimSuffix(b.prefix, "&")
+	httpreq.URL = &u
+	httpreq.Host = get.Host
+	httpreq.Header = get.Header.Clone()
+	httpreq.Header.Set("Content-Type", contentType)
+	return httpreq, nil
+}
+
+// NewResponse builds the response to req from the endpoint's answer. The
+// client's question is echoed rather than the upstream's copy, which may be
+// normalized, and records owned by the query name get the client's casing
+// back. Records NewRR can't build are left out, so that the others still
+// pack. AD is only set for clients that asked for it (see WantsAD).
+func NewResponse(req *dns.Msg, r *DNSResponseJson) *dns.Msg {
+	qname := dns.Fqdn(strings.ToLower(req.Question[0].Name))
+	questions := make([]dns.Question, len(req.Question))
+	copy(questions, req.Question)
+
+	answers := make([]dns.RR, 0, len(r.Answer))
+	for _, a := range r.Answer {
+		rr := NewRR(a)
+		if rr == nil {
+			continue
+		}
+		if dns.Fqdn(strings.ToLower(rr.Header().Name)) == qname {
+			rr.Header().Name = req.Question[0].Name
+		}
+		answers = append(answers, rr)
+	}
+	authorities := newRRs(r.Authority, 0)
+	extras := newRRs(r.Additional, 1)
+
+	return &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Id:                 req.Id,
+			Response:           true,
+			Opcode:             dns.OpcodeQuery,
+			Authoritative:      false,
+			Truncated:          r.TC,
+			RecursionDesired:   r.RD,
+			RecursionAvailable: r.RA,
+			AuthenticatedData:  r.AD && WantsAD(req),
+			CheckingDisabled:   r.CD,
+			Rcode:              int(r.Status),
+		},
+		Compress: req.Compress,
+		Question: questions,
+		Answer:   answers,
+		Ns:       authorities,
+		Extra:    extras,
+	}
+}
+
+// newRRs builds the records of a section, leaving out those NewRR can't
+// build, with room for spare more.
+func newRRs(section []DNSRR, spare int) []dns.RR {
+	rrs := make([]dns.RR, 0, len(section)+spare)
+	for _, a := range section {
+		if rr := NewRR(a); rr != nil {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// JSONContentType reports whether an upstream Content-Type header names one
+// of the media types used for DNS JSON responses.
+func JSONContentType(value string) bool {
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "application/dns-json", "application/json", "application/x-javascript":
+		return true
+	}
+	return false
+}
+
+// WantsAD reports whether a query signalled that the client understands the
+// AD bit, by setting AD itself or the DO bit (RFC 6840 section 5.7).
+func WantsAD(req *dns.Msg) bool {
+	if req.AuthenticatedData {
+		return true
+	}
+	opt := req.IsEdns0()
+	return opt != nil && opt.Do()
+}
@@ -0,0 +1,270 @@
+package dohproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestNewResponseSkipsRecordsItCantBuild(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	r := &DNSResponseJson{
+		Answer: []DNSRR{
+			{Name: "example.com.", Type: int32(dns.TypeA), TTL: 300, Data: "192.0.2.1"},
+			// An unknown type whose data isn't in the RFC 3597 form
+			{Name: "example.com.", Type: 65280, TTL: 300, Data: "opaque"},
+			{Name: "example.com.", Type: int32(dns.TypeA), TTL: 300, Data: "not an address"},
+			{Name: "example.com.", Type: int32(dns.TypeA), TTL: 300, Data: "192.0.2.2"},
+		},
+		Authority:  []DNSRR{{Name: "example.com.", Type: int32(dns.TypeMX), TTL: 300, Data: "ten mx.example.com."}},
+		Additional: []DNSRR{{Name: "example.com.", Type: 65281, TTL: 300, Data: `\# 2 0102`}},
+	}
+
+	resp := NewResponse(req, r)
+	if len(resp.Answer) != 2 || len(resp.Ns) != 0 || len(resp.Extra) != 1 {
+		t.Fatalf("got %d answer, %d authority and %d additional records, want 2, 0 and 1:\n%s",
+			len(resp.Answer), len(resp.Ns), len(resp.Extra), resp)
+	}
+	packed, err := resp.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	var unpacked dns.Msg
+	if err := unpacked.Unpack(packed); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	for i, want := range []string{"192.0.2.1", "192.0.2.2"} {
+		if a, ok := unpacked.Answer[i].(*dns.A); !ok || a.A.String() != want {
+			t.Errorf("answer %d = %v, want A %s", i, unpacked.Answer[i], want)
+		}
+	}
+	if rr, ok := unpacked.Extra[0].(*dns.RFC3597); !ok || rr.Rdata != "0102" {
+		t.Errorf("additional = %v, want the generic record with rdata 0102", unpacked.Extra[0])
+	}
+}
+
+func TestNewResponseEchoesTheQuestion(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("Example.COM.", dns.TypeA)
+	// An upstream normalizing, or adding to, the question
+	r := &DNSResponseJson{
+		Question: []DNSQuestion{{Name: "example.com.", Type: 1}, {Name: "example.net.", Type: 28}},
+		Answer:   []DNSRR{{Name: "example.com.", Type: int32(dns.TypeA), TTL: 300, Data: "192.0.2.1"}},
+	}
+	resp := NewResponse(req, r)
+	if len(resp.Question) != 1 || resp.Question[0] != req.Question[0] {
+		t.Errorf("got question %v, want the query's %v", resp.Question, req.Question)
+	}
+	if resp.Answer[0].Header().Name != "Example.COM." {
+		t.Errorf("answer owner %q, want the query's spelling", resp.Answer[0].Header().Name)
+	}
+}
+
+func TestNewRequestNormalizesTheName(t *testing.T) {
+	b, err := NewRequestBuilder("https://dns.example/resolve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"example.com.", "ExAmPlE.CoM.", "EXAMPLE.COM", "example.com"} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		httpreq, err := b.NewRequest(context.Background(), req, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := httpreq.URL.Query().Get("name"); got != "example.com." {
+			t.Errorf("%q sent upstream as name=%q, want example.com.", name, got)
+		}
+	}
+}
+
+func TestNewRequestSubnet(t *testing.T) {
+	b, err := NewRequestBuilder("https://dns.example/resolve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withECS := func(family uint16, prefix uint8, addr string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		req.SetEdns0(4096, false)
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+			Code: dns.EDNS0SUBNET, Family: family, SourceNetmask: prefix, Address: net.ParseIP(addr),
+		})
+		return req
+	}
+	plain := new(dns.Msg)
+	plain.SetQuestion("example.com.", dns.TypeA)
+	for _, tc := range []struct {
+		name   string
+		req    *dns.Msg
+		subnet string
+		want   string
+	}{
+		{"no subnet", plain, "", ""},
+		{"configured subnet", plain, "198.51.100.0/24", "edns_client_subnet=198.51.100.0%2F24"},
+		{"IPv4 client subnet", withECS(1, 24, "192.0.2.77"), "198.51.100.0/24", "edns_client_subnet=192.0.2.0%2F24"},
+		{"IPv4 client subnet off a byte boundary", withECS(1, 20, "192.0.31.77"), "", "edns_client_subnet=192.0.16.0%2F20"},
+		{"IPv6 client subnet", withECS(2, 56, "2001:db8:1:2ff::1"), "", "edns_client_subnet=2001%3Adb8%3A1%3A200%3A%3A%2F56"},
+		{"opted out", plain, OptOutSubnet, "edns_client_subnet=0.0.0.0%2F0"},
+		{"opted out with a client subnet", withECS(2, 56, "2001:db8::1"), OptOutSubnet, "edns_client_subnet=0.0.0.0%2F0"},
+	} {
+		httpreq, err := b.NewRequest(context.Background(), tc.req, tc.subnet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		for _, param := range strings.Split(httpreq.URL.RawQuery, "&") {
+			if strings.HasPrefix(param, "edns_client_subnet=") {
+				got = param
+			}
+		}
+		if got != tc.want {
+			t.Errorf("%s: sent %q upstream, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNewResponseAD(t *testing.T) {
+	for _, tc := range []struct {
+		client, upstream, want bool
+	}{
+		{false, false, false},
+		{false, true, false},
+		{true, false, false},
+		{true, true, true},
+	} {
+		for _, signal := range []string{"AD", "DO"} {
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			if tc.client {
+				if signal == "AD" {
+					req.AuthenticatedData = true
+				} else {
+					req.SetEdns0(1232, true)
+				}
+			}
+			resp := NewResponse(req, &DNSResponseJson{AD: tc.upstream})
+			if resp.AuthenticatedData != tc.want {
+				t.Errorf("client %s %v, upstream AD %v: got AD %v, want %v",
+					signal, tc.client, tc.upstream, resp.AuthenticatedData, tc.want)
+			}
+		}
+	}
+}
+
+// An upstream streaming a body far over the limit gets ErrBodyTooLarge,
+// having been read no further than the limit.
+func TestResolveBodyTooLarge(t *testing.T) {
+	const answer = `{"Status":0,"Question":[{"name":"example.com.","type":1}]}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/dns-json")
+		if r.URL.Path == "/exact" {
+			io.WriteString(w, answer)
+			return
+		}
+		io.WriteString(w, `{"Status":0,"Comment":"`)
+		chunk := bytes.Repeat([]byte("a"), 32*1024)
+		for i := 0; i < 512; i++ { // 16MB
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+		io.WriteString(w, `"}`)
+	}))
+	defer srv.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := (&Client{Endpoint: srv.URL + "/huge"}).Resolve(context.Background(), req)
+	runtime.ReadMemStats(&after)
+	if err != ErrBodyTooLarge {
+		t.Fatalf("got error %v, want ErrBodyTooLarge", err)
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 4<<20 {
+		t.Errorf("allocated %d bytes reading the body, want well under its 16MB", alloc)
+	}
+
+	// A body of exactly the limit is not too large
+	c := &Client{Endpoint: srv.URL + "/exact", MaxBodySize: int64(len(answer))}
+	if _, err := c.Resolve(context.Background(), req); err != nil {
+		t.Errorf("a body of exactly MaxBodySize: %v", err)
+	}
+}
+
+// benchmarkQuery is www.example.com AAAA with a client subnet.
+func benchmarkQuery() *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeAAAA)
+	req.SetEdns0(4096, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IPv4(192, 0, 2, 0).To4(),
+	})
+	return req
+}
+
+func BenchmarkNewRequest(b *testing.B) {
+	const endpoint = "https://dns.example/resolve?ct=application/dns-json"
+	req := benchmarkQuery()
+	ctx := context.Background()
+	b.Run("builder", func(b *testing.B) {
+		builder, err := NewRequestBuilder(endpoint)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := builder.NewRequest(ctx, req, ""); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	// Parsing the endpoint for each request, as NewRequest does
+	b.Run("parse", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := NewRequest(ctx, endpoint, req, ""); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// benchmarkAnswer is a five-record answer: a CNAME, two A records, an
+// AAAA and a PTR.
+var benchmarkAnswer = &DNSResponseJson{
+	Status:   0,
+	RD:       true,
+	RA:       true,
+	Question: []DNSQuestion{{Name: "www.example.com.", Type: 1}},
+	Answer: []DNSRR{
+		{Name: "www.example.com.", Type: int32(dns.TypeCNAME), TTL: 300, Data: "example.com."},
+		{Name: "example.com.", Type: int32(dns.TypeA), TTL: 300, Data: "192.0.2.1"},
+		{Name: "example.com.", Type: int32(dns.TypeA), TTL: 300, Data: "192.0.2.2"},
+		{Name: "example.com.", Type: int32(dns.TypeAAAA), TTL: 300, Data: "2001:db8::1"},
+		{Name: "1.2.0.192.in-addr.arpa.", Type: int32(dns.TypePTR), TTL: 300, Data: "example.com."},
+	},
+}
+
+func BenchmarkNewResponse(b *testing.B) {
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if resp := NewResponse(req, benchmarkAnswer); len(resp.Answer) != 5 {
+			b.Fatalf("got %d records, want 5", len(resp.Answer))
+		}
+	}
+}
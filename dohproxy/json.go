@@ -0,0 +1,374 @@
+package dohproxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DNSResponseJson is a rough translation of the Google DNS over HTTP API
+// response.
+type DNSResponseJson struct {
+	Status             int32         `json:"Status,omitempty"`
+	TC                 bool          `json:"TC,omitempty"`
+	RD                 bool          `json:"RD,omitempty"`
+	RA                 bool          `json:"RA,omitempty"`
+	AD                 bool          `json:"AD,omitempty"`
+	CD                 bool          `json:"CD,omitempty"`
+	Question           []DNSQuestion `json:"Question,omitempty"`
+	Answer             []DNSRR       `json:"Answer,omitempty"`
+	Authority          []DNSRR       `json:"Authority,omitempty"`
+	Additional         []DNSRR       `json:"Additional,omitempty"`
+	Edns_client_subnet string        `json:"edns_client_subnet,omitempty"`
+	Comment            Comment       `json:"Comment,omitempty"`
+}
+
+// Comment is the free-form diagnostic an endpoint may add to a response.
+// Most send a string; some, such as Cloudflare, a list of strings, which
+// are joined with "; ".
+type Comment string
+
+// UnmarshalJSON accepts a string or a list of strings.
+func (c *Comment) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*c = Comment(s)
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*c = Comment(strings.Join(list, "; "))
+	return nil
+}
+
+// DNSQuestion is a question in a DNSResponseJson.
+type DNSQuestion struct {
+	Name string `json:"name,omitempty"`
+	Type int32  `json:"type,omitempty"`
+}
+
+// DNSRR is a resource record in a DNSResponseJson, with its data in
+// presentation format.
+type DNSRR struct {
+	Name string `json:"name,omitempty"`
+	Type int32  `json:"type,omitempty"`
+	TTL  int32  `json:"TTL,omitempty"`
+	Data string `json:"data,omitempty"`
+}
+
+// NewRR initializes a new RR from a DNSRR. The commonest types are built
+// directly from their fields, data in the RFC 3597 generic form ("\# 4
+// c0000201") from its wire form, and the others from their presentation
+// form; either way Rdlength is left for the packer to compute. It returns
+// nil if the data cannot be parsed.
+func NewRR(a DNSRR) dns.RR {
+	rrhdr := dns.RR_Header{
+		Name:   a.Name,
+		Rrtype: uint16(a.Type),
+		Class:  dns.ClassINET,
+		Ttl:    uint32(a.TTL),
+	}
+	if strings.HasPrefix(strings.TrimSpace(a.Data), `\#`) {
+		return newGenericRR(rrhdr, strings.Fields(a.Data)[1:])
+	}
+	switch rrhdr.Rrtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeNS, dns.TypePTR:
+		if rr := newSimpleRR(rrhdr, strings.TrimSpace(a.Data)); rr != nil {
+			return rr
+		}
+	case dns.TypeMX, dns.TypeSRV, dns.TypeSOA, dns.TypeNAPTR, dns.TypeCAA:
+		if fields, ok := dataFields(a.Data); ok {
+			if rr := newFieldsRR(rrhdr, fields); rr != nil {
+				return rr
+			}
+		}
+	case dns.TypeTXT:
+		return &dns.TXT{Hdr: rrhdr, Txt: txtStrings(a.Data)}
+	case dns.TypeSPF:
+		return &dns.SPF{Hdr: rrhdr, Txt: txtStrings(a.Data)}
+	}
+	str := rrhdr.String() + a.Data
+	rr, _ := dns.NewRR(str)
+	return rr
+}
+
+// newSimpleRR builds an address or single-name record without parsing a
+// presentation-format string, returning nil to leave anything unusual to
+// dns.NewRR.
+func newSimpleRR(hdr dns.RR_Header, data string) dns.RR {
+	var ok bool
+	if hdr.Name, ok = plainName(hdr.Name); !ok {
+		return nil
+	}
+	switch hdr.Rrtype {
+	case dns.TypeA:
+		if ip := net.ParseIP(data).To4(); ip != nil {
+			return &dns.A{Hdr: hdr, A: ip}
+		}
+		return nil
+	case dns.TypeAAAA:
+		if ip := net.ParseIP(data); ip != nil && ip.To4() == nil {
+			return &dns.AAAA{Hdr: hdr, AAAA: ip}
+		}
+		return nil
+	}
+	if data, ok = plainName(data); !ok {
+		return nil
+	}
+	switch hdr.Rrtype {
+	case dns.TypeCNAME:
+		return &dns.CNAME{Hdr: hdr, Target: data}
+	case dns.TypeNS:
+		return &dns.NS{Hdr: hdr, Ns: data}
+	}
+	return &dns.PTR{Hdr: hdr, Ptr: data}
+}
+
+// newGenericRR builds a record from data in the RFC 3597 generic form,
+// which Cloudflare uses for CAA among others: the rdata length, then the
+// rdata in hex, split into any number of fields. The rdata is unpacked as
+// the record's type, so it is passed on as the upstream sent it.
+func newGenericRR(hdr dns.RR_Header, fields []string) dns.RR {
+	if len(fields) == 0 {
+		return nil
+	}
+	n, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil
+	}
+	rdata := strings.Join(fields[1:], "")
+	if len(rdata) != 2*int(n) {
+		return nil
+	}
+	if _, err := hex.DecodeString(rdata); err != nil {
+		return nil
+	}
+	buf := make([]byte, dns.MaxMsgSize)
+	off, err := dns.PackRR(&dns.RFC3597{Hdr: hdr, Rdata: rdata}, buf, 0, nil, false)
+	if err != nil {
+		return nil
+	}
+	rr, _, err := dns.UnpackRR(buf[:off], 0)
+	if err != nil {
+		return nil
+	}
+	return rr
+}
+
+// newFieldsRR builds an MX, SRV, SOA, NAPTR or CAA record from the fields of
+// its data, returning nil to leave anything unusual to dns.NewRR.
+func newFieldsRR(hdr dns.RR_Header, fields []string) dns.RR {
+	var ok bool
+	if hdr.Name, ok = plainName(hdr.Name); !ok {
+		return nil
+	}
+	switch hdr.Rrtype {
+	case dns.TypeMX:
+		if len(fields) != 2 {
+			return nil
+		}
+		pref, err1 := strconv.ParseUint(fields[0], 10, 16)
+		mx, ok := plainName(fields[1])
+		if err1 != nil || !ok {
+			return nil
+		}
+		return &dns.MX{Hdr: hdr, Preference: uint16(pref), Mx: mx}
+	case dns.TypeSRV:
+		if len(fields) != 4 {
+			return nil
+		}
+		priority, err1 := strconv.ParseUint(fields[0], 10, 16)
+		weight, err2 := strconv.ParseUint(fields[1], 10, 16)
+		port, err3 := strconv.ParseUint(fields[2], 10, 16)
+		target, ok := plainName(fields[3])
+		if err1 != nil || err2 != nil || err3 != nil || !ok {
+			return nil
+		}
+		return &dns.SRV{Hdr: hdr, Priority: uint16(priority), Weight: uint16(weight), Port: uint16(port), Target: target}
+	case dns.TypeNAPTR:
+		// order preference flags service regexp replacement
+		if len(fields) != 6 {
+			return nil
+		}
+		order, err1 := strconv.ParseUint(fields[0], 10, 16)
+		pref, err2 := strconv.ParseUint(fields[1], 10, 16)
+		replacement, ok := plainName(fields[5])
+		if err1 != nil || err2 != nil || !ok {
+			return nil
+		}
+		return &dns.NAPTR{Hdr: hdr, Order: uint16(order), Preference: uint16(pref),
+			Flags: fields[2], Service: fields[3], Regexp: fields[4], Replacement: replacement}
+	case dns.TypeCAA:
+		// flag tag value, the tag being letters and digits only
+		if len(fields) != 3 || !isAlnum(fields[1]) {
+			return nil
+		}
+		flag, err := strconv.ParseUint(fields[0], 10, 8)
+		if err != nil {
+			return nil
+		}
+		return &dns.CAA{Hdr: hdr, Flag: uint8(flag), Tag: fields[1], Value: fields[2]}
+	}
+	// SOA: mname rname serial refresh retry expire minimum, with the times
+	// in plain seconds; "1h" and the like are left to dns.NewRR
+	if len(fields) != 7 {
+		return nil
+	}
+	mname, ok1 := plainName(fields[0])
+	rname, ok2 := plainName(fields[1])
+	if !ok1 || !ok2 {
+		return nil
+	}
+	var n [5]uint32
+	for i, f := range fields[2:] {
+		v, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			return nil
+		}
+		n[i] = uint32(v)
+	}
+	return &dns.SOA{Hdr: hdr, Ns: mname, Mbox: rname,
+		Serial: n[0], Refresh: n[1], Retry: n[2], Expire: n[3], Minttl: n[4]}
+}
+
+// plainName returns name fully qualified if it is a domain name without
+// escapes or spaces, which dns.NewRR would take as it is.
+func plainName(name string) (string, bool) {
+	if _, ok := dns.IsDomainName(name); !ok || strings.ContainsAny(name, "\\ ") {
+		return "", false
+	}
+	return dns.Fqdn(name), true
+}
+
+// dataFields splits the data field of an answer into its fields, a quoted
+// string making one field without its quotes. Fields are left escaped as in
+// presentation format, quoted ones re-escaped with escapeTXT, and the
+// parentheses that spread a record over lines are dropped. It returns false
+// for an unterminated quote.
+func dataFields(data string) ([]string, bool) {
+	var fields []string
+	for s := strings.TrimSpace(data); s != ""; s = strings.TrimLeft(s, " \t\r\n") {
+		if s[0] == '"' {
+			raw, rest, ok := unquote(s[1:])
+			if !ok {
+				return nil, false
+			}
+			fields = append(fields, escapeTXT(raw))
+			s = rest
+			continue
+		}
+		end := strings.IndexAny(s, " \t\r\n")
+		if end < 0 {
+			end = len(s)
+		}
+		if f := s[:end]; f != "(" && f != ")" {
+			fields = append(fields, f)
+		}
+		s = s[end:]
+	}
+	return fields, true
+}
+
+// txtStrings converts the data field of a TXT-like answer into the escaped
+// character-strings expected by dns.TXT. Upstreams send either a sequence of
+// quoted strings or a single bare string; either way the content is decoded,
+// re-split at the 255 byte wire limit and re-escaped.
+func txtStrings(data string) []string {
+	var raw []string
+	if s := strings.TrimSpace(data); strings.HasPrefix(s, "\"") {
+		raw = unquoteTXT(s)
+	} else {
+		raw = []string{data}
+	}
+
+	txt := []string{}
+	for _, r := range raw {
+		for len(r) > 255 {
+			txt = append(txt, escapeTXT(r[:255]))
+			r = r[255:]
+		}
+		txt = append(txt, escapeTXT(r))
+	}
+	return txt
+}
+
+// unquoteTXT splits a presentation-format list of quoted strings into their
+// raw contents, resolving \" \\ and \DDD escapes.
+func unquoteTXT(s string) []string {
+	strs := []string{}
+	for len(s) > 0 {
+		if s[0] != '"' {
+			s = s[1:]
+			continue
+		}
+		var raw string
+		raw, s, _ = unquote(s[1:])
+		strs = append(strs, raw)
+	}
+	return strs
+}
+
+// unquote decodes a quoted string s starts inside of up to its closing
+// quote, returning its raw content and what follows the quote, and false if
+// there is none.
+func unquote(s string) (raw, rest string, ok bool) {
+	var b []byte
+	for len(s) > 0 && s[0] != '"' {
+		if s[0] == '\\' && len(s) > 1 {
+			if len(s) > 3 && isDigits(s[1:4]) {
+				n, _ := strconv.Atoi(s[1:4])
+				b = append(b, byte(n))
+				s = s[4:]
+				continue
+			}
+			s = s[1:]
+		}
+		b = append(b, s[0])
+		s = s[1:]
+	}
+	if len(s) == 0 {
+		return string(b), "", false
+	}
+	return string(b), s[1:], true
+}
+
+// escapeTXT escapes a raw character-string for use in a dns.TXT record.
+func escapeTXT(s string) string {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c < ' ' || c > '~':
+			b = append(b, fmt.Sprintf("\\%03d", c)...)
+		default:
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlnum(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i] | 0x20; (c < 'a' || c > 'z') && (s[i] < '0' || s[i] > '9') {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,287 @@
+package dohproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// wireStrings returns the character-strings of a TXT-like record as sent on
+// the wire.
+func wireStrings(t *testing.T, rr dns.RR) []string {
+	t.Helper()
+	buf := make([]byte, 4096)
+	n, err := dns.PackRR(rr, buf, 0, nil, false)
+	if err != nil {
+		t.Fatalf("PackRR: %v", err)
+	}
+	rdata := buf[n-int(rr.Header().Rdlength) : n]
+	var strs []string
+	for len(rdata) > 0 {
+		l := int(rdata[0])
+		strs = append(strs, string(rdata[1:1+l]))
+		rdata = rdata[1+l:]
+	}
+	return strs
+}
+
+func TestNewRRTXT(t *testing.T) {
+	dkim := "v=DKIM1; k=rsa; p=" + strings.Repeat("MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8A", 12)
+	for _, c := range []struct {
+		name string
+		typ  uint16
+		data string
+		want []string
+	}{
+		{"quoted SPF", dns.TypeTXT, `"v=spf1 include:_spf.google.com ~all"`,
+			[]string{"v=spf1 include:_spf.google.com ~all"}},
+		{"bare SPF", dns.TypeSPF, `v=spf1 -all`, []string{"v=spf1 -all"}},
+		{"several strings", dns.TypeTXT, `"first part" "second \"quoted\" part"`,
+			[]string{"first part", `second "quoted" part`}},
+		{"escapes", dns.TypeTXT, `"back\\slash and \007bell"`, []string{"back\\slash and \x07bell"}},
+		{"DKIM key split by the upstream", dns.TypeTXT, `"` + dkim[:255] + `" "` + dkim[255:] + `"`,
+			[]string{dkim[:255], dkim[255:]}},
+		{"DKIM key joined by the upstream", dns.TypeTXT, dkim, []string{dkim[:255], dkim[255:]}},
+		{"empty", dns.TypeTXT, `""`, []string{""}},
+	} {
+		rr := NewRR(DNSRR{Name: "example.com.", Type: int32(c.typ), TTL: 300, Data: c.data})
+		if rr == nil {
+			t.Errorf("%s: NewRR returned nil", c.name)
+			continue
+		}
+		if got := wireStrings(t, rr); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got character-strings %q, want %q", c.name, got, c.want)
+		}
+
+		// What the client gets back parses as the same record
+		again, err := dns.NewRR(rr.String())
+		if err != nil {
+			t.Errorf("%s: the record %q doesn't parse: %v", c.name, rr, err)
+		} else if got := wireStrings(t, again); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: reparsed as %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestNewRRWire(t *testing.T) {
+	for _, c := range []struct {
+		typ   uint16
+		data  string
+		rdata string
+	}{
+		{dns.TypeA, "192.0.2.1", "c0000201"},
+		{dns.TypeAAAA, "2001:db8::1", "20010db8000000000000000000000001"},
+		{dns.TypeMX, "10 mail.example.com.", "000a046d61696c076578616d706c6503636f6d00"},
+		{dns.TypeTXT, `"v=spf1 -all"`, "0b763d73706631202d616c6c"},
+		{dns.TypeTXT, `"a" "bc"`, "0161026263"},
+	} {
+		rr := NewRR(DNSRR{Name: "example.com.", Type: int32(c.typ), TTL: 300, Data: c.data})
+		if rr == nil {
+			t.Errorf("%s %s: NewRR returned nil", dns.TypeToString[c.typ], c.data)
+			continue
+		}
+		buf := make([]byte, 512)
+		n, err := dns.PackRR(rr, buf, 0, nil, false)
+		if err != nil {
+			t.Errorf("%s %s: PackRR: %v", dns.TypeToString[c.typ], c.data, err)
+			continue
+		}
+
+		// The owner name, then type, class, TTL and the rdlength
+		off := len("\x07example\x03com\x00") + 8
+		want, _ := hex.DecodeString(c.rdata)
+		if got := int(binary.BigEndian.Uint16(buf[off:])); got != len(want) {
+			t.Errorf("%s %s: rdlength %d on the wire, want %d", dns.TypeToString[c.typ], c.data, got, len(want))
+		}
+		if got := buf[off+2 : n]; !bytes.Equal(got, want) {
+			t.Errorf("%s %s: rdata %x on the wire, want %x", dns.TypeToString[c.typ], c.data, got, want)
+		}
+	}
+}
+
+func TestNewRRFixtures(t *testing.T) {
+	// Data as Google's and Cloudflare's JSON APIs send it, and the record
+	// it must give
+	for _, c := range []struct {
+		name string
+		typ  uint16
+		data string
+		want string
+	}{
+		{"google MX", dns.TypeMX, "10 smtp.google.com.", "10 smtp.google.com."},
+		{"spaced MX", dns.TypeMX, " 10   smtp.google.com. ", "10 smtp.google.com."},
+		{"cloudflare generic MX", dns.TypeMX, `\# 19 000a04736d747006676f6f676c6503636f6d00`, "10 smtp.google.com."},
+		{"google SRV", dns.TypeSRV, "5 0 5269 xmpp-server.l.google.com.", "5 0 5269 xmpp-server.l.google.com."},
+		{"google SOA", dns.TypeSOA, "ns1.google.com. dns-admin.google.com. 612345678 900 900 1800 60",
+			"ns1.google.com. dns-admin.google.com. 612345678 900 900 1800 60"},
+		{"SOA in parentheses", dns.TypeSOA, "ns1.google.com. dns-admin.google.com. ( 612345678\n 900 900\t1800 60 )",
+			"ns1.google.com. dns-admin.google.com. 612345678 900 900 1800 60"},
+		{"google CAA", dns.TypeCAA, `0 issue "pki.goog"`, `0 issue "pki.goog"`},
+		{"bare CAA", dns.TypeCAA, `0 issue letsencrypt.org`, `0 issue "letsencrypt.org"`},
+		{"CAA iodef", dns.TypeCAA, `128 iodef "mailto:security@example.com"`, `128 iodef "mailto:security@example.com"`},
+		{"cloudflare generic CAA", dns.TypeCAA, `\# 15 00 05 69 73 73 75 65 70 6b 69 2e 67 6f 6f 67`, `0 issue "pki.goog"`},
+		{"google NAPTR", dns.TypeNAPTR, `100 10 "S" "SIP+D2U" "" _sip._udp.example.com.`,
+			`100 10 "S" "SIP+D2U" "" _sip._udp.example.com.`},
+		{"NAPTR regexp", dns.TypeNAPTR, `100 50 "u" "E2U+sip" "!^.*$!sip:info@example.com!" .`,
+			`100 50 "u" "E2U+sip" "!^.*$!sip:info@example.com!" .`},
+		{"NAPTR escaped quote", dns.TypeNAPTR, `10 0 "u" "E2U+web" "!^.*$!\"quoted\"!" .`,
+			`10 0 "u" "E2U+web" "!^.*$!\"quoted\"!" .`},
+	} {
+		rr := NewRR(DNSRR{Name: "example.com.", Type: int32(c.typ), TTL: 300, Data: c.data})
+		if rr == nil {
+			t.Errorf("%s: no record from %q", c.name, c.data)
+			continue
+		}
+		if got := strings.TrimPrefix(rr.String(), rr.Header().String()); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+
+		// Pack, unpack and pack again, byte-identically
+		buf := make([]byte, 4096)
+		n, err := dns.PackRR(rr, buf, 0, nil, false)
+		if err != nil {
+			t.Errorf("%s: PackRR: %v", c.name, err)
+			continue
+		}
+		packed := append([]byte(nil), buf[:n]...)
+		unpacked, _, err := dns.UnpackRR(packed, 0)
+		if err != nil {
+			t.Errorf("%s: UnpackRR: %v", c.name, err)
+			continue
+		}
+		n, err = dns.PackRR(unpacked, buf, 0, nil, false)
+		if err != nil || string(buf[:n]) != string(packed) {
+			t.Errorf("%s: repacked as %x, want %x (%v)", c.name, buf[:n], packed, err)
+		}
+		if rest := strings.TrimPrefix(strings.TrimSpace(c.data), `\#`); rest != strings.TrimSpace(c.data) {
+			// The rdata is the upstream's
+			hex := strings.Join(strings.Fields(rest)[1:], "")
+			if got := fmt.Sprintf("%x", packed[len(packed)-int(rr.Header().Rdlength):]); got != hex {
+				t.Errorf("%s: got rdata %s, want the upstream's %s", c.name, got, hex)
+			}
+		}
+	}
+
+	// Data which can't be right gives no record
+	for _, c := range []struct {
+		typ  uint16
+		data string
+	}{
+		{dns.TypeMX, "10 smtp.google.com. extra"},
+		{dns.TypeMX, "smtp.google.com."},
+		{dns.TypeSRV, "5 0 xmpp-server.l.google.com."},
+		{dns.TypeSOA, "ns1.google.com. dns-admin.google.com. 612345678 900 900 1800 60 60"},
+		{dns.TypeCAA, `0 issue "pki.goog`},
+		{dns.TypeNAPTR, `100 10 "S" "SIP+D2U" _sip._udp.example.com.`},
+		{dns.TypeCAA, `\# 16 00 05 69 73 73 75 65 70 6b 69 2e 67 6f 6f 67`},
+	} {
+		if rr := NewRR(DNSRR{Name: "example.com.", Type: int32(c.typ), TTL: 300, Data: c.data}); rr != nil {
+			t.Errorf("%s %q: got %v, want no record", dns.TypeToString[c.typ], c.data, rr)
+		}
+	}
+}
+
+// The fields of MX, SRV and SOA records are parsed as dns.NewRR would,
+// whether or not the record is built from them.
+func TestNewRRFields(t *testing.T) {
+	for _, c := range []struct {
+		typ   uint16
+		data  string
+		typed bool
+	}{
+		{dns.TypeMX, "10 mx1.example.com.", true},
+		{dns.TypeMX, "0 .", true},
+		{dns.TypeMX, "10 MX1.Example.COM", true},
+		{dns.TypeMX, "  20   mx2.example.com.  ", true},
+		{dns.TypeMX, "65536 mx1.example.com.", false},
+		{dns.TypeMX, "mx1.example.com.", false},
+		{dns.TypeSRV, "10 60 5060 sip.example.com.", true},
+		{dns.TypeSRV, "0 0 0 .", true},
+		{dns.TypeSRV, "10 60 70000 sip.example.com.", false},
+		{dns.TypeSRV, "10 60 sip.example.com.", false},
+		{dns.TypeSOA, "ns1.example.com. hostmaster.example.com. 2024010101 7200 3600 1209600 300", true},
+		{dns.TypeSOA, "ns1.example.com hostmaster.example.com 1 2 3 4 5", true},
+		{dns.TypeSOA, `ns1.example.com. host\.master.example.com. 1 2 3 4 5`, false},
+		{dns.TypeSOA, "ns1.example.com. hostmaster.example.com. 1 2h 1h 2w 5m", false},
+		{dns.TypeSOA, "ns1.example.com. hostmaster.example.com. 4294967296 2 3 4 5", false},
+	} {
+		name := dns.TypeToString[c.typ] + " " + c.data
+		a := DNSRR{Name: "Example.COM", Type: int32(c.typ), TTL: 300, Data: c.data}
+		hdr := dns.RR_Header{Name: a.Name, Rrtype: c.typ, Class: dns.ClassINET, Ttl: 300}
+		if fields, ok := dataFields(a.Data); !ok || (newFieldsRR(hdr, fields) != nil) != c.typed {
+			t.Errorf("%s: built from the fields %v, want %v", name, !c.typed, c.typed)
+		}
+		want, err := dns.NewRR(hdr.String() + c.data)
+		got := NewRR(a)
+		switch {
+		case err != nil && got != nil:
+			t.Errorf("%s: got %v, want nil as dns.NewRR fails: %v", name, got, err)
+		case err == nil && got == nil:
+			t.Errorf("%s: got nil, want %v", name, want)
+		case err == nil && got.String() != want.String():
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+}
+
+// benchmarkJSON is a response as Google's JSON API sends it.
+const benchmarkJSON = `{"Status":0,"TC":false,"RD":true,"RA":true,"AD":false,"CD":false,` +
+	`"Question":[{"name":"www.example.com.","type":1}],` +
+	`"Answer":[{"name":"www.example.com.","type":5,"TTL":300,"data":"example.com."},` +
+	`{"name":"example.com.","type":1,"TTL":300,"data":"192.0.2.1"},` +
+	`{"name":"example.com.","type":1,"TTL":300,"data":"192.0.2.2"}],` +
+	`"edns_client_subnet":"192.0.2.0/24/0","Comment":"Response from 192.0.2.53."}`
+
+func BenchmarkDecodeJSON(b *testing.B) {
+	data := []byte(benchmarkJSON)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		var r DNSResponseJson
+		if err := json.Unmarshal(data, &r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// mailAnswer is the answer of a typical mail-domain response.
+var mailAnswer = []DNSRR{
+	{Name: "example.com.", Type: int32(dns.TypeMX), TTL: 300, Data: "10 mx1.example.com."},
+	{Name: "example.com.", Type: int32(dns.TypeMX), TTL: 300, Data: "20 mx2.example.com."},
+	{Name: "_submission._tcp.example.com.", Type: int32(dns.TypeSRV), TTL: 300, Data: "0 1 587 mail.example.com."},
+	{Name: "example.com.", Type: int32(dns.TypeSOA), TTL: 300,
+		Data: "ns1.example.com. hostmaster.example.com. 2024010101 7200 3600 1209600 300"},
+}
+
+// BenchmarkNewRR builds the records of mailAnswer from their fields, as
+// NewRR does, and through dns.NewRR, as it did before.
+func BenchmarkNewRR(b *testing.B) {
+	b.Run("fields", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, a := range mailAnswer {
+				if NewRR(a) == nil {
+					b.Fatal("NewRR returned nil")
+				}
+			}
+		}
+	})
+	b.Run("string", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, a := range mailAnswer {
+				hdr := dns.RR_Header{Name: a.Name, Rrtype: uint16(a.Type), Class: dns.ClassINET, Ttl: uint32(a.TTL)}
+				if _, err := dns.NewRR(hdr.String() + a.Data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
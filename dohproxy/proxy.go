@@ -0,0 +1,205 @@
+package dohproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultTimeout bounds the queries a Proxy answers when Config sets no
+// Timeout.
+const DefaultTimeout = 5 * time.Second
+
+// Config configures a Proxy.
+type Config struct {
+	// Endpoint is the URL of the JSON API queries are forwarded to.
+	Endpoint string
+	// HTTPClient sends the upstream requests; http.DefaultClient if nil.
+	HTTPClient *http.Client
+	// Subnet is passed on as Client.Subnet.
+	Subnet string
+	// MaxBodySize limits the size of upstream responses;
+	// DefaultMaxBodySize if 0.
+	MaxBodySize int64
+	// Timeout bounds each query answered over DNS; DefaultTimeout if 0.
+	Timeout time.Duration
+
+	// ListenUDP and ListenTCP are the addresses Start serves DNS on, such
+	// as "127.0.0.1:53".
+	ListenUDP, ListenTCP []string
+	// Listeners are listeners Start serves DNS over TCP on as well, such as
+	// sockets passed in by the caller or in-memory listeners in tests.
+	// Shutdown closes them.
+	Listeners []net.Listener
+}
+
+// Proxy answers DNS queries from a DNS-over-HTTPS JSON endpoint, over the
+// listeners of its Config once started, and through Resolve without any.
+type Proxy struct {
+	client  *Client
+	config  Config
+	mu      sync.Mutex
+	servers []*dns.Server
+	started bool
+}
+
+// New returns a Proxy for config, checking the endpoint. It binds nothing
+// until Start.
+func New(config Config) (*Proxy, error) {
+	if config.Endpoint == "" {
+		return nil, errors.New("dohproxy: no endpoint")
+	}
+	if _, err := NewRequestBuilder(config.Endpoint); err != nil {
+		return nil, fmt.Errorf("dohproxy: endpoint: %v", err)
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DefaultTimeout
+	}
+	return &Proxy{
+		client: &Client{
+			Endpoint:    config.Endpoint,
+			HTTPClient:  config.HTTPClient,
+			Subnet:      config.Subnet,
+			MaxBodySize: config.MaxBodySize,
+		},
+		config: config,
+	}, nil
+}
+
+// Resolve sends req upstream and returns the response, as Client.Resolve.
+func (p *Proxy) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	return p.client.Resolve(ctx, req)
+}
+
+// ServeDNS answers a query with Resolve, or SERVFAIL if that fails, so
+// that a Proxy can serve as the handler of a dns.Server of the caller's.
+func (p *Proxy) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) != 1 {
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeFormatError)
+		w.WriteMsg(resp)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeout)
+	defer cancel()
+	resp, err := p.Resolve(ctx, req)
+	if err != nil {
+		resp = new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		resp.RecursionAvailable = true
+	}
+	if w.RemoteAddr().Network() == "udp" {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		if resp.Len() > size {
+			resp.Truncated = true
+			resp.Answer, resp.Ns, resp.Extra = nil, nil, nil
+		}
+	}
+	w.WriteMsg(resp)
+}
+
+// Start binds the addresses of the Config and serves DNS on them and on its
+// Listeners until Shutdown. If an address can't be bound, nothing is served
+// and the error is returned. ctx bounds the binding only.
+func (p *Proxy) Start(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.started {
+		return errors.New("dohproxy: already started")
+	}
+
+	var servers []*dns.Server
+	closeAll := func() {
+		for _, srv := range servers {
+			if srv.PacketConn != nil {
+				srv.PacketConn.Close()
+			}
+			if srv.Listener != nil {
+				srv.Listener.Close()
+			}
+		}
+	}
+	var lc net.ListenConfig
+	for _, addr := range p.config.ListenUDP {
+		conn, err := lc.ListenPacket(ctx, "udp", addr)
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("dohproxy: %v", err)
+		}
+		servers = append(servers, &dns.Server{PacketConn: conn, Handler: p})
+	}
+	for _, addr := range p.config.ListenTCP {
+		l, err := lc.Listen(ctx, "tcp", addr)
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("dohproxy: %v", err)
+		}
+		servers = append(servers, &dns.Server{Listener: l, Handler: p})
+	}
+	for _, l := range p.config.Listeners {
+		servers = append(servers, &dns.Server{Listener: l, Handler: p})
+	}
+
+	// Wait for every server to be serving, so that Shutdown finds them
+	// started
+	var serving sync.WaitGroup
+	for _, srv := range servers {
+		serving.Add(1)
+		srv.NotifyStartedFunc = serving.Done
+		go srv.ActivateAndServe()
+	}
+	serving.Wait()
+	p.servers, p.started = servers, true
+	return nil
+}
+
+// Addrs returns the addresses the Proxy serves DNS on, once started.
+func (p *Proxy) Addrs() []net.Addr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var addrs []net.Addr
+	for _, srv := range p.servers {
+		if srv.PacketConn != nil {
+			addrs = append(addrs, srv.PacketConn.LocalAddr())
+		} else {
+			addrs = append(addrs, srv.Listener.Addr())
+		}
+	}
+	return addrs
+}
+
+// Shutdown stops serving DNS, closing the listeners and waiting for the
+// queries being answered to finish, or until ctx is done. Resolve keeps
+// working.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	servers := p.servers
+	p.servers, p.started = nil, false
+	p.mu.Unlock()
+
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *dns.Server) { errs <- srv.Shutdown() }(srv)
+	}
+	var first error
+	for range servers {
+		select {
+		case err := <-errs:
+			if err != nil && first == nil {
+				first = fmt.Errorf("dohproxy: %v", err)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return first
+}
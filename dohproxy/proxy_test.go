@@ -0,0 +1,253 @@
+package dohproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testEndpoint serves a JSON answer of 192.0.2.1 for every query.
+func testEndpoint(t *testing.T) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/dns-json")
+		w.Write([]byte(`{"Status":0,"Question":[{"name":"example.com.","type":1}],` +
+			`"Answer":[{"name":"example.com.","type":1,"TTL":300,"data":"192.0.2.1"}]}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/resolve"
+}
+
+func exampleQuery() *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	return req
+}
+
+func checkExampleAnswer(t *testing.T, resp *dns.Msg) {
+	t.Helper()
+	if resp == nil || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Fatalf("got %v, want one answer", resp)
+	}
+	if a, ok := resp.Answer[0].(*dns.A); !ok || a.A.String() != "192.0.2.1" {
+		t.Errorf("got answer %v, want A 192.0.2.1", resp.Answer[0])
+	}
+}
+
+func TestNewChecksEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"", "://no-scheme"} {
+		if _, err := New(Config{Endpoint: endpoint}); err == nil {
+			t.Errorf("New accepted endpoint %q", endpoint)
+		}
+	}
+}
+
+func TestProxyResolveWithoutListeners(t *testing.T) {
+	p, err := New(Config{Endpoint: testEndpoint(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := p.Resolve(context.Background(), exampleQuery())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkExampleAnswer(t, resp)
+}
+
+// recorder is a dns.ResponseWriter keeping the response written to it.
+type recorder struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (r *recorder) RemoteAddr() net.Addr      { return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 53)} }
+func (r *recorder) WriteMsg(m *dns.Msg) error { r.msg = m; return nil }
+
+func TestProxyServeDNS(t *testing.T) {
+	p, err := New(Config{Endpoint: testEndpoint(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &recorder{}
+	p.ServeDNS(w, exampleQuery())
+	checkExampleAnswer(t, w.msg)
+
+	// A query must have exactly one question
+	two := exampleQuery()
+	two.Question = append(two.Question, dns.Question{Name: "example.net.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+	p.ServeDNS(w, two)
+	if w.msg.Rcode != dns.RcodeFormatError {
+		t.Errorf("got rcode %s for two questions, want FORMERR", dns.RcodeToString[w.msg.Rcode])
+	}
+
+	// An endpoint that isn't there is a SERVFAIL
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	p, err = New(Config{Endpoint: down.URL, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.ServeDNS(w, exampleQuery())
+	if w.msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("got rcode %s with the endpoint down, want SERVFAIL", dns.RcodeToString[w.msg.Rcode])
+	}
+}
+
+// pipeListener is an in-memory net.Listener whose connections are made
+// with dial.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+func (l *pipeListener) dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func TestProxyInMemoryListener(t *testing.T) {
+	l := newPipeListener()
+	p, err := New(Config{Endpoint: testEndpoint(t), Listeners: []net.Listener{l}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := l.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// dns.Conn only frames messages for TCP connections
+	packed, err := exampleQuery().Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(append([]byte{byte(len(packed) >> 8), byte(len(packed))}, packed...)); err != nil {
+		t.Fatal(err)
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		t.Fatal(err)
+	}
+	packed = make([]byte, int(length[0])<<8|int(length[1]))
+	if _, err := io.ReadFull(conn, packed); err != nil {
+		t.Fatal(err)
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(packed); err != nil {
+		t.Fatal(err)
+	}
+	checkExampleAnswer(t, resp)
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.dial(); err == nil {
+		t.Error("the listener accepted a connection after Shutdown")
+	}
+}
+
+func TestProxyStartShutdown(t *testing.T) {
+	p, err := New(Config{
+		Endpoint:  testEndpoint(t),
+		ListenUDP: []string{"127.0.0.1:0"},
+		ListenTCP: []string{"127.0.0.1:0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Start(context.Background()); err == nil {
+		t.Error("a second Start succeeded")
+	}
+	addrs := p.Addrs()
+	if len(addrs) != 2 {
+		t.Fatalf("got addresses %v, want one UDP and one TCP", addrs)
+	}
+	for _, addr := range addrs {
+		c := &dns.Client{Net: addr.Network(), Timeout: 5 * time.Second}
+		resp, _, err := c.Exchange(exampleQuery(), addr.String())
+		if err != nil {
+			t.Fatalf("query over %s: %v", addr.Network(), err)
+		}
+		checkExampleAnswer(t, resp)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.DialTimeout("tcp", addrs[1].String(), time.Second); err == nil {
+		t.Error("still accepting TCP connections after Shutdown")
+	}
+	resp, err := p.Resolve(context.Background(), exampleQuery())
+	if err != nil {
+		t.Fatalf("Resolve after Shutdown: %v", err)
+	}
+	checkExampleAnswer(t, resp)
+}
+
+func TestProxyStartFailsAsAWhole(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	p, err := New(Config{
+		Endpoint:  testEndpoint(t),
+		ListenUDP: []string{"127.0.0.1:0"},
+		ListenTCP: []string{taken.Addr().String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Start(context.Background()); err == nil {
+		t.Fatal("Start succeeded with the TCP address in use")
+	}
+	if addrs := p.Addrs(); len(addrs) != 0 {
+		t.Errorf("serving on %v after a failed Start", addrs)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import "strings"
+
+// suffixSet matches query names against a set of domains, each of which
+// also covers all of its subdomains.
+type suffixSet struct {
+	names map[string]bool
+}
+
+// parseSuffixSet parses a comma-separated list of domains.
+func parseSuffixSet(value string) *suffixSet {
+	s := &suffixSet{names: make(map[string]bool)}
+	for _, name := range splitList(value) {
+		s.Add(name)
+	}
+	return s
+}
+
+func (s *suffixSet) Add(name string) {
+	s.names[normalizeName(name)] = true
+}
+
+func (s *suffixSet) Empty() bool {
+	return s == nil || len(s.names) == 0
+}
+
+// Match reports whether name, which must be normalized, is one of the
+// domains or a subdomain of one.
+func (s *suffixSet) Match(name string) bool {
+	if s.Empty() {
+		return false
+	}
+	for {
+		if s.names[name] {
+			return true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			return s.names["."]
+		}
+		name = name[i+1:]
+	}
+}
+
+// longestSuffix returns the longest of name, which must be normalized, and
+// its parent domains down to the root for which has reports true.
+func longestSuffix(name string, has func(domain string) bool) (string, bool) {
+	for {
+		if has(name) {
+			return name, true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			return ".", has(".")
+		}
+		name = name[i+1:]
+	}
+}
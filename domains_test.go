@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNormalizeName(t *testing.T) {
+	for _, name := range []string{"www.example.com.", "WWW.Example.COM.", "www.example.com", "wWw.ExAmPlE.cOm"} {
+		if got := normalizeName(name); got != "www.example.com." {
+			t.Errorf("normalizeName(%q) = %q, want www.example.com.", name, got)
+		}
+	}
+}
+
+func TestSuffixSetMatchesAnySpelling(t *testing.T) {
+	s := parseSuffixSet("Example.COM, ads.example.net.")
+	for name, want := range map[string]bool{
+		"example.com":         true,
+		"WWW.EXAMPLE.COM.":    true,
+		"Ads.Example.Net":     true,
+		"example.net.":        false,
+		"notexample.com":      false,
+		"www.ads.EXAMPLE.net": true,
+	} {
+		if got := s.Match(normalizeName(name)); got != want {
+			t.Errorf("Match(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func BenchmarkSuffixSetMatch(b *testing.B) {
+	s := parseSuffixSet("")
+	for i := 0; i < 10000; i++ {
+		s.Add(fmt.Sprintf("ads%d.example.com", i))
+	}
+	names := []string{"www.ads42.example.com.", "tracker.ads9999.example.com.", "www.example.net.", "a.b.c.d.example.org."}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s.Match(names[i%len(names)])
+	}
+}
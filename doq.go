@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// doqALPN is the ALPN token of DNS-over-QUIC.
+const doqALPN = "doq"
+
+// DNS-over-QUIC error codes (RFC 9250 section 4.3)
+const (
+	doqNoError          = 0x0
+	doqInternalError    = 0x1
+	doqProtocolError    = 0x2
+	doqRequestCancelled = 0x3
+	doqExcessiveLoad    = 0x4
+)
+
+var (
+	doqServersMu sync.Mutex
+	doqServers   []*doqServer
+)
+
+// serveDoQ starts the DNS-over-QUIC servers (RFC 9250) on addrs, with the
+// -tls-cert certificate of the DNS-over-TLS listeners. Their queries go
+// through the same handlers as the DNS listeners', behind the -allow-from
+// access list.
+func serveDoQ(addrs []string) error {
+	if tlsCerts == nil {
+		certs, err := newCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			return err
+		}
+		tlsCerts = certs
+	}
+	control, err := listenControl(false)
+	if err != nil {
+		return err
+	}
+	lc := net.ListenConfig{Control: control}
+	for _, addr := range addrs {
+		pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			return fmt.Errorf("cannot listen on %s (quic): %v", addr, err)
+		}
+		s, err := newDoQServer(pc, tlsCerts.TLSConfig(), allowFromHandler(dns.DefaultServeMux))
+		if err != nil {
+			pc.Close()
+			return fmt.Errorf("cannot listen on %s (quic): %v", addr, err)
+		}
+		doqServersMu.Lock()
+		doqServers = append(doqServers, s)
+		doqServersMu.Unlock()
+		go func() {
+			if err := s.serve(); err != nil {
+				serverFailed(fmt.Errorf("DNS-over-QUIC server on %s failed: %v", addr, err))
+			}
+		}()
+		infof("Listening on %s (quic)", addr)
+	}
+	return nil
+}
+
+// shutdownDoQ stops the DNS-over-QUIC servers, letting the queries being
+// answered finish for as long as HTTP requests get.
+func shutdownDoQ() {
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+
+	doqServersMu.Lock()
+	defer doqServersMu.Unlock()
+	for _, s := range doqServers {
+		if err := s.Shutdown(ctx); err != nil {
+			errorf("Error shutting down DNS-over-QUIC server: %v", err)
+		}
+	}
+}
+
+// quicListener is a quic.Listener, or a quic.EarlyListener with -quic-0rtt.
+type quicListener interface {
+	Accept(ctx context.Context) (*quic.Conn, error)
+	Close() error
+	Addr() net.Addr
+}
+
+// doqServer answers DNS-over-QUIC queries, each on its own stream, from
+// one UDP socket.
+type doqServer struct {
+	handler   dns.Handler
+	transport *quic.Transport
+	ln        quicListener
+	slots     chan struct{}
+	logger    *logEvery
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	conns   map[*quic.Conn]struct{}
+	streams sync.WaitGroup
+}
+
+// newDoQServer returns a DNS-over-QUIC server on pc, applying the
+// -quic-* limits. 0-RTT data is only accepted with -quic-0rtt, as a
+// replayed query could be answered twice.
+func newDoQServer(pc net.PacketConn, tlsConfig *tls.Config, handler dns.Handler) (*doqServer, error) {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{doqALPN}
+	tlsConfig.MinVersion = tls.VersionTLS13
+	config := &quic.Config{
+		MaxIdleTimeout:     *quicIdleTimeout,
+		MaxIncomingStreams: int64(*quicMaxStreams),
+		// DoQ uses no unidirectional streams
+		MaxIncomingUniStreams: -1,
+		Allow0RTT:             *quic0RTT,
+	}
+
+	s := &doqServer{
+		handler:   handler,
+		transport: &quic.Transport{Conn: pc},
+		logger:    newLogEvery(time.Minute),
+		conns:     make(map[*quic.Conn]struct{}),
+	}
+	var err error
+	if *quic0RTT {
+		s.ln, err = s.transport.ListenEarly(tlsConfig, config)
+	} else {
+		s.ln, err = s.transport.Listen(tlsConfig, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if *quicMaxConns > 0 {
+		s.slots = make(chan struct{}, *quicMaxConns)
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s, nil
+}
+
+// Addr returns the address the server is bound to.
+func (s *doqServer) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// serve accepts connections until Shutdown.
+func (s *doqServer) serve() error {
+	for {
+		conn, err := s.ln.Accept(s.ctx)
+		if err != nil {
+			if s.ctx.Err() != nil || errors.Is(err, quic.ErrServerClosed) {
+				return nil
+			}
+			return err
+		}
+		if s.slots != nil {
+			select {
+			case s.slots <- struct{}{}:
+			default:
+				stats.QUICConnsRejected.Inc()
+				s.logger.Printf("Connection limit of %d reached on %s, refusing connections",
+					cap(s.slots), s.Addr())
+				conn.CloseWithError(doqExcessiveLoad, "")
+				continue
+			}
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		stats.QUICConns.Inc()
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn answers the queries of a connection, until the client closes
+// it or it is idle for -quic-idle-timeout.
+func (s *doqServer) serveConn(conn *quic.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		stats.QUICConns.Dec()
+		if s.slots != nil {
+			<-s.slots
+		}
+	}()
+	for {
+		stream, err := conn.AcceptStream(s.ctx)
+		if err != nil {
+			return
+		}
+		// Shutdown waits for the streams started before it
+		s.mu.Lock()
+		if s.ctx.Err() != nil {
+			s.mu.Unlock()
+			stream.CancelRead(doqRequestCancelled)
+			stream.CancelWrite(doqRequestCancelled)
+			return
+		}
+		s.streams.Add(1)
+		s.mu.Unlock()
+		go s.serveStream(conn, stream)
+	}
+}
+
+// serveStream answers the query on stream: a message with a two-byte length
+// prefix and an ID of 0, sent before the client closes its side of the
+// stream. The response is written back the same way and the stream closed.
+func (s *doqServer) serveStream(conn *quic.Conn, stream *quic.Stream) {
+	defer s.streams.Done()
+	stream.SetReadDeadline(time.Now().Add(*quicIdleTimeout))
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		stream.CancelRead(doqRequestCancelled)
+		stream.CancelWrite(doqRequestCancelled)
+		return
+	}
+	packed := make([]byte, int(length[0])<<8|int(length[1]))
+	if _, err := io.ReadFull(stream, packed); err != nil {
+		stream.CancelRead(doqRequestCancelled)
+		stream.CancelWrite(doqRequestCancelled)
+		return
+	}
+	req, err := unpackQuery(packed)
+	if err == nil && req.Id != 0 {
+		err = fmt.Errorf("message ID %d is not 0", req.Id)
+	}
+	if err != nil {
+		debugf("Closing DNS-over-QUIC connection from %s: %v", conn.RemoteAddr(), err)
+		conn.CloseWithError(doqProtocolError, err.Error())
+		return
+	}
+
+	// The peer is reported as connected over TCP, as for DoH, as DoQ
+	// responses are not truncated to UDP sizes
+	w := &httpResponseWriter{local: tcpAddr(conn.LocalAddr()), remote: tcpAddr(conn.RemoteAddr())}
+	s.handler.ServeDNS(w, req)
+	if w.msg == nil {
+		// Dropped, as by -acl-action drop
+		stream.CancelWrite(doqRequestCancelled)
+		return
+	}
+	resp, err := w.msg.Pack()
+	if err != nil {
+		warnf("Cannot pack DNS-over-QUIC response for %s: %v", conn.RemoteAddr(), err)
+		stream.CancelWrite(doqInternalError)
+		return
+	}
+	if _, err := stream.Write(append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...)); err != nil {
+		return
+	}
+	stream.Close()
+}
+
+// Shutdown stops accepting connections and waits for the queries being
+// answered, or until ctx is done, then closes the connections and socket.
+func (s *doqServer) Shutdown(ctx context.Context) error {
+	s.ln.Close()
+	s.mu.Lock()
+	s.cancel()
+	s.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.streams.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.CloseWithError(doqNoError, "")
+	}
+	s.mu.Unlock()
+	s.transport.Close()
+	return err
+}
+
+// tcpAddr returns addr as a TCP address with the same IP and port.
+func tcpAddr(addr net.Addr) net.Addr {
+	if u, ok := addr.(*net.UDPAddr); ok {
+		return &net.TCPAddr{IP: u.IP, Port: u.Port, Zone: u.Zone}
+	}
+	return addr
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// testCertificate returns a self-signed certificate for 127.0.0.1.
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns-over-https-proxy test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// startDoQ serves DNS-over-QUIC on a loopback port, answering every A query
+// with 192.0.2.1, and returns a connection to it.
+func startDoQ(t *testing.T) *quic.Conn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if w.RemoteAddr().Network() != "tcp" {
+			t.Errorf("handler sees a %s client, want tcp", w.RemoteAddr().Network())
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(192, 0, 2, 1),
+		}}
+		w.WriteMsg(resp)
+	})
+	s, err := newDoQServer(pc, &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serve()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, s.Addr().String(),
+		&tls.Config{InsecureSkipVerify: true, NextProtos: []string{doqALPN}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.CloseWithError(doqNoError, "") })
+	return conn
+}
+
+// doqExchange sends req on a stream of its own, as RFC 9250 has it.
+func doqExchange(conn *quic.Conn, req *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream.SetDeadline(time.Now().Add(5 * time.Second))
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write(append([]byte{byte(len(packed) >> 8), byte(len(packed))}, packed...)); err != nil {
+		return nil, err
+	}
+	stream.Close()
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return nil, err
+	}
+	packed = make([]byte, int(length[0])<<8|int(length[1]))
+	if _, err := io.ReadFull(stream, packed); err != nil {
+		return nil, err
+	}
+	if _, err := stream.Read(make([]byte, 1)); err != io.EOF {
+		return nil, errors.New("stream not closed after the response")
+	}
+	resp := new(dns.Msg)
+	return resp, resp.Unpack(packed)
+}
+
+func TestDoQ(t *testing.T) {
+	conn := startDoQ(t)
+	if conn.ConnectionState().TLS.NegotiatedProtocol != doqALPN {
+		t.Errorf("negotiated ALPN %q", conn.ConnectionState().TLS.NegotiatedProtocol)
+	}
+
+	// Queries on streams of their own, at once
+	errs := make(chan error, 2)
+	for _, name := range []string{"a.example.", "b.example."} {
+		go func(name string) {
+			req := new(dns.Msg)
+			req.SetQuestion(name, dns.TypeA)
+			req.Id = 0
+			resp, err := doqExchange(conn, req)
+			if err == nil && (resp.Id != 0 || len(resp.Answer) != 1 || resp.Answer[0].Header().Name != name) {
+				err = errors.New("unexpected response " + resp.String())
+			}
+			errs <- err
+		}(name)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDoQRejectsMessageID(t *testing.T) {
+	conn := startDoQ(t)
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.Id = 1234
+	if _, err := doqExchange(conn, req); err == nil {
+		t.Fatal("a query with a message ID was answered")
+	}
+	var appErr *quic.ApplicationError
+	select {
+	case <-conn.Context().Done():
+		if !errors.As(context.Cause(conn.Context()), &appErr) || appErr.ErrorCode != doqProtocolError {
+			t.Errorf("connection closed with %v, want DOQ_PROTOCOL_ERROR", context.Cause(conn.Context()))
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("connection still open after a query with a message ID")
+	}
+}
+
+func TestDoQNeedsALPN(t *testing.T) {
+	conn := startDoQ(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := quic.DialAddr(ctx, conn.RemoteAddr().String(),
+		&tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h3"}}, nil)
+	if err == nil {
+		t.Error("connected without the doq ALPN")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// modeFlags select what the process does rather than configure the proxy,
+// so they are left out of the effective configuration.
+var modeFlags = map[string]bool{
+	"config":       true,
+	"check-config": true,
+	"print-config": true,
+	"version":      true,
+	"query":        true,
+	"qtype":        true,
+}
+
+// summaryFlags are always logged, even at their defaults.
+var summaryFlags = []string{"listen-udp", "listen-tcp", "listen-tls", "listen-unix", "listen-doh", "listen-quic", "default"}
+
+// logEffectiveConfig logs the settings in effect on one line: the listen
+// addresses and upstream, and every other setting changed from its default,
+// with secrets masked.
+func logEffectiveConfig() {
+	always := make(map[string]bool)
+	var parts []string
+	for _, name := range summaryFlags {
+		always[name] = true
+		if f := flag.Lookup(name); f.Value.String() != "" {
+			parts = append(parts, fmt.Sprintf("%s=%q", name, f.Value.String()))
+		}
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if always[f.Name] || modeFlags[f.Name] || value == f.DefValue {
+			return
+		}
+		if secretFlags[f.Name] && value != "" {
+			value = "********"
+		}
+		parts = append(parts, fmt.Sprintf("%s=%q", f.Name, value))
+	})
+	infof("Configuration: %s", strings.Join(parts, " "))
+}
+
+// writeEffectiveConfig writes every setting in effect as a config file for
+// -config, so a command line can be turned into one.
+func writeEffectiveConfig(w io.Writer) {
+	sections := make(map[string]string) // flag name to config mapping
+	keys := make(map[string]string)     // flag name to key in its mapping
+	for section, names := range configSections {
+		for key, name := range names {
+			sections[name], keys[name] = section, key
+		}
+	}
+
+	fmt.Fprintln(w, "# Effective configuration of", versionString())
+	var names []string
+	bySection := make(map[string][]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		if modeFlags[f.Name] || f.Name == "upstream-group" {
+			return
+		}
+		section := sections[f.Name]
+		if section == "" {
+			fmt.Fprintf(w, "%s: %s\n", f.Name, yamlFlagValue(f))
+			return
+		}
+		if _, seen := bySection[section]; !seen {
+			names = append(names, section)
+		}
+		bySection[section] = append(bySection[section], fmt.Sprintf("  %s: %s", keys[f.Name], yamlFlagValue(f)))
+	})
+	// The upstream last, as in config.example.yaml
+	sort.Slice(names, func(i, j int) bool {
+		if (names[i] == "upstream") != (names[j] == "upstream") {
+			return names[j] == "upstream"
+		}
+		return names[i] < names[j]
+	})
+	for _, section := range names {
+		fmt.Fprintf(w, "\n%s:\n", section)
+		for _, line := range bySection[section] {
+			fmt.Fprintln(w, line)
+		}
+	}
+
+	var groups []string
+	for name := range upstreamGroups {
+		groups = append(groups, name)
+	}
+	sort.Strings(groups)
+	if len(groups) > 0 {
+		fmt.Fprintln(w, "\ngroups:")
+	}
+	for _, name := range groups {
+		g := upstreamGroups[name]
+		var urls []string
+		for _, endpoint := range g.endpoints {
+			urls = append(urls, strconv.Quote(endpoint))
+		}
+		fmt.Fprintf(w, "  - name: %q\n    urls: [%s]\n    policy: %q\n", g.name, strings.Join(urls, ", "), g.policy)
+		if g.subnet != "" {
+			fmt.Fprintf(w, "    subnet: %q\n", g.subnet)
+		}
+	}
+}
+
+// yamlFlagValue formats a flag's value as a config file value. Strings
+// holding commas are written as lists, which configString joins back.
+func yamlFlagValue(f *flag.Flag) string {
+	if g, ok := f.Value.(flag.Getter); ok {
+		switch v := g.Get().(type) {
+		case bool:
+			return strconv.FormatBool(v)
+		case int, int64, uint, uint64, float64:
+			return f.Value.String()
+		case time.Duration:
+			return strconv.Quote(v.String())
+		}
+	}
+	value := f.Value.String()
+	if !strings.Contains(value, ",") {
+		return strconv.Quote(value)
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		items = append(items, strconv.Quote(strings.TrimSpace(item)))
+	}
+	return "[" + strings.Join(items, ", ") + "]"
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// envPrefix starts the environment variable for each flag: -listen-udp is
+// read from DOH_PROXY_LISTEN_UDP.
+const envPrefix = "DOH_PROXY_"
+
+// envAliases are further variables for some flags, named like the config
+// file keys.
+var envAliases = map[string]string{
+	"DOH_PROXY_UPSTREAM": "default",
+}
+
+// secretFlags are logged masked.
+var secretFlags = map[string]bool{
+	"log-anonymize-key": true,
+	"api-token":         true,
+}
+
+// envFlags maps the flags set from the environment to the variables that
+// set them.
+var envFlags = make(map[string]string)
+
+// envName returns the environment variable for a flag.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// loadEnv applies DOH_PROXY_* environment variables to the flags not given
+// on the command line.
+func loadEnv() error {
+	recordCmdlineFlags()
+	vars := make(map[string]string) // flag name to variable
+	for variable, name := range envAliases {
+		if _, ok := os.LookupEnv(variable); ok {
+			vars[name] = variable
+		}
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if _, ok := os.LookupEnv(envName(f.Name)); ok {
+			vars[f.Name] = envName(f.Name)
+		}
+	})
+
+	for name, variable := range vars {
+		if cmdlineFlags[name] {
+			continue
+		}
+		f := flag.Lookup(name)
+		value := os.Getenv(variable)
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			value = envBool(value)
+		}
+		if err := f.Value.Set(value); err != nil {
+			return fmt.Errorf("%s: %v", variable, err)
+		}
+		envFlags[name] = variable
+	}
+	return nil
+}
+
+// envBool translates the yes/no and on/off forms of a boolean.
+func envBool(value string) string {
+	switch strings.ToLower(value) {
+	case "yes", "y", "on":
+		return "true"
+	case "no", "n", "off":
+		return "false"
+	}
+	return value
+}
+
+// logEnvFlags logs the settings taken from the environment.
+func logEnvFlags() {
+	var names []string
+	for name := range envFlags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := flag.Lookup(name).Value.String()
+		if secretFlags[name] && value != "" {
+			value = "********"
+		}
+		infof("Setting %s = %q from %s", name, value, envFlags[name])
+	}
+}
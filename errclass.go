@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Classes of upstream failure, used as metric labels and in log lines.
+const (
+	errClassDNS          = "dns"
+	errClassConnRefused  = "connect_refused"
+	errClassConnTimeout  = "connect_timeout"
+	errClassConnect      = "connect"
+	errClassTLSVerify    = "tls_verify"
+	errClassTLS          = "tls"
+	errClassDeadline     = "deadline"
+	errClassTimeout      = "timeout"
+	errClassNetwork      = "network"
+	errClassHTTP4xx      = "http_4xx"
+	errClassHTTP5xx      = "http_5xx"
+	errClassHTTPOther    = "http_other"
+	errClassContentType  = "content_type"
+	errClassBodyTooLarge = "body_too_large"
+	errClassParse        = "parse"
+	errClassOversized    = "oversized"
+)
+
+// transportErrorClass classifies an error from sending an HTTP request,
+// looking through the url.Error and net.OpError wrapping to the cause.
+func transportErrorClass(ctx context.Context, err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return errClassDNS
+	}
+
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid) {
+		return errClassTLSVerify
+	}
+	var recordHeader tls.RecordHeaderError
+	if errors.As(err, &recordHeader) {
+		return errClassTLS
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		switch {
+		case opErr.Op == "dial" && errors.Is(opErr.Err, syscall.ECONNREFUSED):
+			return errClassConnRefused
+		case opErr.Op == "dial" && opErr.Timeout():
+			return errClassConnTimeout
+		case opErr.Op == "dial":
+			return errClassConnect
+		case opErr.Op == "remote error":
+			// A TLS alert from the server, such as a failed handshake
+			return errClassTLS
+		}
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || ctx.Err() == context.DeadlineExceeded {
+		return errClassDeadline
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errClassTimeout
+	}
+	return errClassNetwork
+}
+
+// httpErrorClass classifies an unsuccessful HTTP status.
+func httpErrorClass(status int) string {
+	switch {
+	case status >= 500:
+		return errClassHTTP5xx
+	case status >= 400:
+		return errClassHTTP4xx
+	}
+	return errClassHTTPOther
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// timeoutError is a net.Error which timed out, as a deadline on a
+// connection makes.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// urlError wraps err as http.Client.Do does.
+func urlError(err error) error {
+	return &url.Error{Op: "Get", URL: "https://dns.example/resolve", Err: err}
+}
+
+func TestTransportErrorClass(t *testing.T) {
+	dial := func(err error) error {
+		return urlError(&net.OpError{Op: "dial", Net: "tcp", Err: err})
+	}
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{urlError(&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "dns.example", IsNotFound: true}}), errClassDNS},
+		{dial(os.NewSyscallError("connect", syscall.ECONNREFUSED)), errClassConnRefused},
+		{dial(timeoutError{}), errClassConnTimeout},
+		{dial(os.NewSyscallError("connect", syscall.ENETUNREACH)), errClassConnect},
+		{urlError(&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}), errClassTLSVerify},
+		{urlError(&tls.CertificateVerificationError{Err: x509.HostnameError{Host: "dns.example", Certificate: &x509.Certificate{}}}), errClassTLSVerify},
+		{urlError(&tls.CertificateVerificationError{Err: x509.CertificateInvalidError{Reason: x509.Expired}}), errClassTLSVerify},
+		{urlError(tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}), errClassTLS},
+		{urlError(&net.OpError{Op: "remote error", Err: errors.New("tls: handshake failure")}), errClassTLS},
+		{urlError(fmt.Errorf("reading body: %w", context.DeadlineExceeded)), errClassDeadline},
+		{urlError(&net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}), errClassTimeout},
+		{urlError(&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), errClassNetwork},
+		{urlError(errors.New("unexpected EOF")), errClassNetwork},
+	} {
+		if got := transportErrorClass(context.Background(), tc.err); got != tc.want {
+			t.Errorf("transportErrorClass(%v) = %s, want %s", tc.err, got, tc.want)
+		}
+	}
+
+	// A request cut short by the query's deadline
+	ctx, cancel := context.WithDeadline(context.Background(), time.Unix(0, 0))
+	defer cancel()
+	if got := transportErrorClass(ctx, urlError(context.Canceled)); got != errClassDeadline {
+		t.Errorf("got %s once the query's deadline passed, want %s", got, errClassDeadline)
+	}
+}
+
+func TestTransportErrorClassOfRealErrors(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	untrusted := httptest.NewUnstartedServer(http.NotFoundHandler())
+	untrusted.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	untrusted.StartTLS()
+	defer untrusted.Close()
+
+	for _, tc := range []struct {
+		url  string
+		want string
+	}{
+		{closed.URL, errClassConnRefused},
+		{untrusted.URL, errClassTLSVerify},
+	} {
+		_, err := http.Get(tc.url)
+		if err == nil {
+			t.Fatalf("GET %s succeeded", tc.url)
+		}
+		if got := transportErrorClass(context.Background(), err); got != tc.want {
+			t.Errorf("transportErrorClass(%v) = %s, want %s", err, got, tc.want)
+		}
+	}
+}
+
+func TestHTTPErrorClass(t *testing.T) {
+	for status, want := range map[int]string{
+		400: errClassHTTP4xx,
+		404: errClassHTTP4xx,
+		429: errClassHTTP4xx,
+		500: errClassHTTP5xx,
+		503: errClassHTTP5xx,
+		302: errClassHTTPOther,
+	} {
+		if got := httpErrorClass(status); got != want {
+			t.Errorf("httpErrorClass(%d) = %s, want %s", status, got, want)
+		}
+	}
+}
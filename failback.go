@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A failed endpoint is passed over until it is taken back: after
+// -failback-probes probes in a row succeed, when a request to it succeeds
+// anyway (every other endpoint being down too), or when it is undrained
+// with the control socket or API. With -failback-ramp, an endpoint taken
+// back by probes gets a growing share of the queries its group would send
+// it, so a just-recovered server isn't flooded at once.
+
+// endpointFailure is the state of a failed endpoint.
+type endpointFailure struct {
+	at time.Time
+	// passes counts the probes in a row it has passed since failing
+	passes int32
+}
+
+// endpointFailures holds an *endpointFailure for each endpoint taken out of
+// service, until it is taken back.
+var endpointFailures sync.Map
+
+// failbackRamps holds the time each endpoint taken back by probes started
+// its -failback-ramp.
+var failbackRamps sync.Map
+
+// markEndpointFailed takes endpoint out of service after a failed request.
+func markEndpointFailed(endpoint string) {
+	f, loaded := endpointFailures.LoadOrStore(endpoint, &endpointFailure{at: time.Now()})
+	if loaded {
+		atomic.StoreInt32(&f.(*endpointFailure).passes, 0)
+		return
+	}
+	failbackRamps.Delete(endpoint)
+	metrics.UpstreamTransitions.With(endpoint, "down").Inc()
+	if *failback {
+		warnf("Upstream %s failed, passing it over until %d probes in a row succeed", endpoint, *failbackProbes)
+	} else {
+		warnf("Upstream %s failed, passing it over until it is undrained", endpoint)
+	}
+}
+
+// markEndpointUp takes endpoint back after it answered a request or was
+// undrained.
+func markEndpointUp(endpoint string) {
+	if _, failed := endpointFailures.Load(endpoint); !failed {
+		return
+	}
+	endpointFailures.Delete(endpoint)
+	metrics.UpstreamTransitions.With(endpoint, "up").Inc()
+	infof("Upstream %s is up again, taking it back", endpoint)
+}
+
+// probePassed counts a successful probe of endpoint, taking it back once
+// it has passed -failback-probes in a row.
+func probePassed(endpoint string) {
+	v, failed := endpointFailures.Load(endpoint)
+	if !failed {
+		return
+	}
+	passes := atomic.AddInt32(&v.(*endpointFailure).passes, 1)
+	if !*failback || int(passes) < *failbackProbes {
+		debugf("Upstream %s passed %d probes in a row", endpoint, passes)
+		return
+	}
+	endpointFailures.Delete(endpoint)
+	metrics.UpstreamTransitions.With(endpoint, "up").Inc()
+	if *failbackRamp > 0 {
+		failbackRamps.Store(endpoint, time.Now())
+		infof("Upstream %s passed %d probes in a row, failing back over %s", endpoint, passes, *failbackRamp)
+	} else {
+		infof("Upstream %s passed %d probes in a row, failing back", endpoint, passes)
+	}
+}
+
+// probeFailed restarts the count of probes a failed endpoint passed.
+func probeFailed(endpoint string) {
+	if v, failed := endpointFailures.Load(endpoint); failed {
+		atomic.StoreInt32(&v.(*endpointFailure).passes, 0)
+	}
+}
+
+// rampingAway reports whether a query should go past endpoint, which is
+// in its -failback-ramp: the share of queries it gets grows linearly from
+// none to all over the ramp.
+func rampingAway(endpoint string) bool {
+	v, ok := failbackRamps.Load(endpoint)
+	if !ok {
+		return false
+	}
+	elapsed := time.Since(v.(time.Time))
+	if elapsed >= *failbackRamp {
+		failbackRamps.Delete(endpoint)
+		return false
+	}
+	return rand.Int63n(int64(*failbackRamp)) >= int64(elapsed)
+}
+
+// failbackLoop probes the failed endpoints of the upstream group every
+// interval, so that they can be taken back.
+func failbackLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		for _, endpoint := range currentUpstream().endpoints {
+			if _, failed := endpointFailures.Load(endpoint); !failed {
+				continue
+			}
+			if _, drained := drainedEndpoints.Load(endpoint); drained {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			if err := probeUpstream(ctx, endpoint); err != nil {
+				debugf("Failback probe of %s failed: %v", endpoint, err)
+			}
+			cancel()
+		}
+	}
+}
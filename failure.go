@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/miekg/dns"
+)
+
+// EDNS0 option code for Extended DNS Errors (RFC 8914).
+const edns0EDE = 15
+
+// Extended DNS Error info codes used by the proxy.
+const (
+	edeOther                 = 0
+	edeUnsupportedDNSKEYAlgo = 1
+	edeDNSSECBogus           = 6
+	edeSignatureExpired      = 7
+	edeSignatureNotYetValid  = 8
+	edeDNSKEYMissing         = 9
+	edeRRSIGsMissing         = 10
+	edeBlocked               = 15
+	edeCensored              = 16
+	edeFiltered              = 17
+	edeProhibited            = 18
+	edeNoReachableAuthority  = 22
+	edeNetworkError          = 23
+	edeInvalidData           = 24
+)
+
+// ednsUDPSize is the UDP payload size advertised in our OPT records.
+const ednsUDPSize = 4096
+
+// newEDE builds an Extended DNS Error option with optional extra text.
+func newEDE(code uint16, text string) *dns.EDNS0_LOCAL {
+	data := make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(data, code)
+	return &dns.EDNS0_LOCAL{Code: edns0EDE, Data: append(data, text...)}
+}
+
+// newFailure builds an error response to req with the given rcode. The
+// question is echoed and, if the query carried EDNS, an OPT record is
+// attached holding any of the supplied options.
+func newFailure(req *dns.Msg, rcode int, opts ...dns.EDNS0) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetRcode(req, rcode)
+	resp.Question = append([]dns.Question(nil), req.Question...)
+	resp.RecursionAvailable = true
+
+	if req.IsEdns0() != nil {
+		resp.Extra = append(resp.Extra, newOPT(req, opts...))
+	}
+	return resp
+}
+
+// newOPT builds the OPT record of a response to req, which must carry
+// EDNS, holding the supplied options.
+func newOPT(req *dns.Msg, opts ...dns.EDNS0) *dns.OPT {
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(ednsUDPSize)
+	if req.IsEdns0().Do() {
+		opt.SetDo()
+	}
+	opt.Option = opts
+	return opt
+}
+
+// echoOPT gives resp, the response to req built from the upstream's
+// answer, our own OPT record if req carried EDNS, and none otherwise. Any
+// OPT the upstream passed on is about its hop, not ours.
+func echoOPT(resp, req *dns.Msg) {
+	extra := resp.Extra[:0]
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	resp.Extra = extra
+	if req.IsEdns0() != nil {
+		resp.Extra = append(resp.Extra, newOPT(req))
+	}
+}
+
+// writeFailure answers req with an error response carrying rcode.
+func writeFailure(w dns.ResponseWriter, req *dns.Msg, rcode int, opts ...dns.EDNS0) {
+	if rec, ok := w.(*responseRecorder); ok {
+		rec.reason = failureReason(opts)
+		rec.blocked = hasEDE(opts, edeBlocked)
+	}
+	if err := w.WriteMsg(newFailure(req, rcode, opts...)); err != nil {
+		errorf("Error writing DNS failure response: %v", err)
+	}
+}
+
+// handleFailed answers req with SERVFAIL.
+func handleFailed(w dns.ResponseWriter, req *dns.Msg, opts ...dns.EDNS0) {
+	writeFailure(w, req, dns.RcodeServerFailure, opts...)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestEchoOPT(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		edns, do bool
+		upstream bool
+	}{
+		{name: "no EDNS"},
+		{name: "no EDNS, upstream OPT", upstream: true},
+		{name: "EDNS", edns: true},
+		{name: "EDNS with DO", edns: true, do: true},
+		{name: "EDNS, upstream OPT", edns: true, upstream: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			if tc.edns {
+				req.SetEdns0(1232, tc.do)
+			}
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			resp.Extra = []dns.RR{mustRR(t, "example.com. 300 IN A 192.0.2.1")}
+			if tc.upstream {
+				resp.SetEdns0(512, false)
+			}
+
+			echoOPT(resp, req)
+			opt := resp.IsEdns0()
+			if !tc.edns {
+				if opt != nil {
+					t.Fatalf("got OPT %v for a query without EDNS", opt)
+				}
+				return
+			}
+			if opt == nil {
+				t.Fatal("got no OPT for a query with EDNS")
+			}
+			if opt.UDPSize() != ednsUDPSize || opt.Do() != tc.do {
+				t.Errorf("got OPT with UDP size %d and DO %v, want %d and %v",
+					opt.UDPSize(), opt.Do(), ednsUDPSize, tc.do)
+			}
+			if len(resp.Extra) != 2 {
+				t.Errorf("got additional %v, want the A record and one OPT", resp.Extra)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fetchFrom sends one query for example.com A to the endpoint handler
+// serves.
+func fetchFrom(t *testing.T, handler http.HandlerFunc) *upstreamReply {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	endpoint := srv.URL + "/resolve"
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	httpreq, err := newHedgeRequest(ctx, endpoint, "", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &httpResponseWriter{local: &net.TCPAddr{}, remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 7)}}
+	return fetch(ctx, endpoint, httpreq, w, req, nil)
+}
+
+func TestFetchFailsOnHTTPError(t *testing.T) {
+	for _, status := range []int{http.StatusInternalServerError, http.StatusNotFound} {
+		reply := fetchFrom(t, func(w http.ResponseWriter, r *http.Request) {
+			// A body the JSON decoder would half-decode, were it reached
+			w.Header().Set("Content-Type", "application/dns-json")
+			w.WriteHeader(status)
+			w.Write([]byte(`{"Status":0,"Answer":[`))
+		})
+		if reply.json != nil {
+			t.Errorf("HTTP %d: got a response, want the query failed", status)
+		}
+		if len(reply.fail) != 1 {
+			t.Fatalf("HTTP %d: got EDNS options %v, want one EDE", status, reply.fail)
+		}
+		ede := reply.fail[0].(*dns.EDNS0_LOCAL)
+		if text := string(ede.Data[2:]); !strings.Contains(text, http.StatusText(status)) {
+			t.Errorf("HTTP %d: extended error %q doesn't give the status", status, text)
+		}
+	}
+}
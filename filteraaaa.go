@@ -0,0 +1,57 @@
+package main
+
+import "github.com/miekg/dns"
+
+// -filter-aaaa modes.
+const (
+	filterAAAAOff    = ""
+	filterAAAANoData = "nodata"
+	filterAAAAStrip  = "strip"
+)
+
+// filterAAAAExcept holds the domains -filter-aaaa leaves alone.
+var filterAAAAExcept *suffixSet
+
+// filteringAAAA reports whether -filter-aaaa applies to queries for qname,
+// which must be normalized.
+func filteringAAAA(qname string) bool {
+	return *filterAAAA != filterAAAAOff && !filterAAAAExcept.Match(qname)
+}
+
+// answerFilteredAAAA answers an AAAA query with NODATA if -filter-aaaa=nodata
+// applies to it, reporting whether it did.
+func answerFilteredAAAA(w dns.ResponseWriter, req *dns.Msg) bool {
+	if *filterAAAA != filterAAAANoData || req.Question[0].Qtype != dns.TypeAAAA ||
+		!filteringAAAA(normalizeName(req.Question[0].Name)) {
+		return false
+	}
+	stats.AAAAFiltered.Inc()
+	if err := w.WriteMsg(newFailure(req, dns.RcodeSuccess)); err != nil {
+		errorf("Error writing DNS response: %v", err)
+	}
+	return true
+}
+
+// stripAAAA removes the AAAA records from an upstream response to a query
+// -filter-aaaa applies to, leaving NODATA for an AAAA query. The response
+// is the query's own, so the shared upstream reply is untouched.
+func stripAAAA(resp *dns.Msg, qname string) {
+	if !filteringAAAA(qname) {
+		return
+	}
+	answer, additional := withoutAAAA(resp.Answer), withoutAAAA(resp.Extra)
+	if len(answer) != len(resp.Answer) || len(additional) != len(resp.Extra) {
+		stats.AAAAFiltered.Inc()
+	}
+	resp.Answer, resp.Extra = answer, additional
+}
+
+func withoutAAAA(rrs []dns.RR) []dns.RR {
+	kept := rrs[:0]
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeAAAA {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
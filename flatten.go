@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+// flattenDomains holds the domains whose A and AAAA answers -flatten-cnames
+// flattens.
+var flattenDomains *suffixSet
+
+// flattenMaxDepth bounds the queries made to resolve the tail of a CNAME
+// chain for flattening.
+const flattenMaxDepth = 8
+
+// flatteningKey marks the context of a query made to resolve the tail of a
+// chain, whose answer is not flattened itself.
+type flatteningKey struct{}
+
+// cnameChain is a CNAME chain being followed.
+type cnameChain struct {
+	// name is where the chain has got to, normalized
+	name string
+	// ttl is the lowest TTL of the chain and addrs
+	ttl    uint32
+	cnames int
+	seen   map[string]bool
+	addrs  []dns.RR
+}
+
+// follow follows the chain through the CNAMEs in rrs, then collects the
+// records of qtype owned by the name it ends at. It reports false if the
+// chain loops.
+func (c *cnameChain) follow(rrs []dns.RR, qtype uint16) bool {
+	for {
+		var next *dns.CNAME
+		for _, rr := range rrs {
+			if cname, ok := rr.(*dns.CNAME); ok && normalizeName(cname.Hdr.Name) == c.name {
+				next = cname
+				break
+			}
+		}
+		if next == nil {
+			break
+		}
+		if c.seen[c.name] {
+			return false
+		}
+		c.seen[c.name] = true
+		if next.Hdr.Ttl < c.ttl {
+			c.ttl = next.Hdr.Ttl
+		}
+		c.name = normalizeName(next.Target)
+		c.cnames++
+	}
+	for _, rr := range rrs {
+		if h := rr.Header(); h.Rrtype == qtype && normalizeName(h.Name) == c.name {
+			c.addrs = append(c.addrs, rr)
+			if h.Ttl < c.ttl {
+				c.ttl = h.Ttl
+			}
+		}
+	}
+	return true
+}
+
+// flattenCNAMEs rewrites the answer to an A or AAAA query for a
+// -flatten-cnames domain from a CNAME chain ending in address records to
+// those records alone, owned by the name asked and with the lowest TTL of
+// the chain. A chain whose tail the response leaves unresolved is followed
+// through the usual pipeline first. Answers to clients setting DO are left
+// as they are, since flattening breaks their validation, as are chains
+// that loop or end without an address.
+func flattenCNAMEs(ctx context.Context, w dns.ResponseWriter, req, resp *dns.Msg) {
+	q := req.Question[0]
+	if (q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA) || resp.Rcode != dns.RcodeSuccess ||
+		ctx.Value(flatteningKey{}) != nil || !flattenDomains.Match(normalizeName(q.Name)) {
+		return
+	}
+	if opt := req.IsEdns0(); opt != nil && opt.Do() {
+		return
+	}
+	chain := &cnameChain{name: normalizeName(q.Name), ttl: ^uint32(0), seen: make(map[string]bool)}
+	if !chain.follow(resp.Answer, q.Qtype) || chain.cnames == 0 {
+		return
+	}
+	for depth := 0; len(chain.addrs) == 0; depth++ {
+		if depth == flattenMaxDepth {
+			debugf("Not flattening %s: the CNAME chain is too long", q.Name)
+			return
+		}
+		sub := req.Copy()
+		sub.Question[0].Name = chain.name
+		cw := &captureWriter{ResponseWriter: w}
+		forward(context.WithValue(ctx, flatteningKey{}, true), cw, sub)
+		if cw.msg == nil || cw.msg.Rcode != dns.RcodeSuccess {
+			debugf("Not flattening %s: resolving %s failed", q.Name, chain.name)
+			return
+		}
+		cnames := chain.cnames
+		if !chain.follow(cw.msg.Answer, q.Qtype) || (chain.cnames == cnames && len(chain.addrs) == 0) {
+			return
+		}
+	}
+
+	answer := make([]dns.RR, len(chain.addrs))
+	for i, rr := range chain.addrs {
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+		rr.Header().Ttl = chain.ttl
+		answer[i] = rr
+	}
+	debugf("Flattened %d CNAMEs for %s", chain.cnames, q.Name)
+	resp.Answer = answer
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// flightGroup runs one upstream request for identical concurrent queries,
+// handing its reply to every caller. The reply must not be modified.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done  chan struct{}
+	reply *upstreamReply
+	// waiters counts the callers still waiting for the reply, the one
+	// making the request included; the request is cancelled when the
+	// last of them goes away
+	waiters int
+	cancel  context.CancelFunc
+}
+
+var upstreamFlights = &flightGroup{flights: make(map[string]*flight)}
+
+// flightKey identifies the upstream request httpreq for the endpoint addr,
+// whose query string holds everything the answer depends on: the name,
+// type, CD bit and client subnet.
+func flightKey(addr string, httpreq *http.Request) string {
+	return addr + "?" + httpreq.URL.RawQuery
+}
+
+// Do returns the reply of fn for key, calling it only if no call for key
+// is in flight already; shared reports that another call's reply was
+// returned. fn runs with a context which keeps the values and deadline of
+// ctx but is only cancelled once every caller's ctx is done, so the callers
+// sharing a request don't fail because the one making it went away. A
+// caller whose ctx is done before the reply comes gets an abandoned reply.
+func (g *flightGroup) Do(ctx context.Context, key string, fn func(ctx context.Context) *upstreamReply) (reply *upstreamReply, shared bool) {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		f.waiters++
+		g.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.reply, true
+		case <-ctx.Done():
+			g.leave(key, f)
+			return &upstreamReply{abandoned: true}, true
+		}
+	}
+	fctx, cancel := detachContext(ctx)
+	f := &flight{done: make(chan struct{}), waiters: 1, cancel: cancel}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			g.leave(key, f)
+		case <-stop:
+		}
+	}()
+	defer func() {
+		close(stop)
+		cancel()
+		if f.reply == nil {
+			// fn panicked; fail the waiting queries
+			f.reply = &upstreamReply{}
+		}
+		g.mu.Lock()
+		if g.flights[key] == f {
+			delete(g.flights, key)
+		}
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	f.reply = fn(fctx)
+	return f.reply, false
+}
+
+// leave records that a caller waiting for f stopped waiting, cancelling
+// the request if it was the last. Queries arriving after that start a new
+// request rather than joining the cancelled one.
+func (g *flightGroup) leave(key string, f *flight) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f.waiters--; f.waiters == 0 {
+		f.cancel()
+		if g.flights[key] == f {
+			delete(g.flights, key)
+		}
+	}
+}
+
+// detachContext returns a context with the values and deadline of ctx
+// that is not cancelled with it.
+func detachContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(detached, deadline)
+	}
+	return context.WithCancel(detached)
+}
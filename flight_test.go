@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFlightKeyIncludesEndpoint(t *testing.T) {
+	r := httptest.NewRequest("GET", "https://a.example/resolve?name=example.com.&type=1", nil)
+	if flightKey("https://a.example/resolve", r) == flightKey("https://b.example/resolve", r) {
+		t.Error("queries for different endpoints share a flight key")
+	}
+}
+
+// joinFlight starts a caller of key in the background once the flight is
+// under way, returning its result.
+func joinFlight(g *flightGroup, ctx context.Context, key string) <-chan *upstreamReply {
+	replies := make(chan *upstreamReply, 1)
+	go func() {
+		reply, _ := g.Do(ctx, key, func(context.Context) *upstreamReply {
+			return &upstreamReply{endpoint: "joiner"}
+		})
+		replies <- reply
+	}()
+	return replies
+}
+
+func waitForWaiters(t *testing.T, g *flightGroup, key string, n int) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		g.mu.Lock()
+		f := g.flights[key]
+		waiting := f != nil && f.waiters == n
+		g.mu.Unlock()
+		if waiting {
+			return
+		}
+	}
+	t.Fatalf("never got %d waiters for %s", n, key)
+}
+
+func TestFlightOutlivesOwner(t *testing.T) {
+	g := &flightGroup{flights: make(map[string]*flight)}
+	owner, cancelOwner := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	ownerDone := make(chan *upstreamReply, 1)
+	go func() {
+		reply, _ := g.Do(owner, "k", func(ctx context.Context) *upstreamReply {
+			<-release
+			if ctx.Err() != nil {
+				return &upstreamReply{abandoned: true}
+			}
+			return &upstreamReply{endpoint: "owner"}
+		})
+		ownerDone <- reply
+	}()
+	waitForWaiters(t, g, "k", 1)
+	joined := joinFlight(g, context.Background(), "k")
+	waitForWaiters(t, g, "k", 2)
+
+	cancelOwner()
+	waitForWaiters(t, g, "k", 1)
+	close(release)
+	if reply := <-joined; reply.abandoned || reply.endpoint != "owner" {
+		t.Errorf("waiter got %+v, want the owner's reply", reply)
+	}
+	<-ownerDone
+}
+
+func TestFlightCancelledWhenEveryoneLeaves(t *testing.T) {
+	g := &flightGroup{flights: make(map[string]*flight)}
+	owner, cancelOwner := context.WithCancel(context.Background())
+	waiter, cancelWaiter := context.WithCancel(context.Background())
+	cancelled := make(chan bool, 1)
+	go g.Do(owner, "k", func(ctx context.Context) *upstreamReply {
+		select {
+		case <-ctx.Done():
+			cancelled <- true
+		case <-time.After(5 * time.Second):
+			cancelled <- false
+		}
+		return &upstreamReply{abandoned: true}
+	})
+	waitForWaiters(t, g, "k", 1)
+	joined := joinFlight(g, waiter, "k")
+	waitForWaiters(t, g, "k", 2)
+
+	cancelWaiter()
+	if reply := <-joined; !reply.abandoned {
+		t.Errorf("waiter that went away got %+v, want an abandoned reply", reply)
+	}
+	cancelOwner()
+	if !<-cancelled {
+		t.Error("the request was not cancelled once every caller had gone")
+	}
+}
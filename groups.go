@@ -0,0 +1,278 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	"github.com/wrouesnel/dns-over-https-proxy/dohproxy"
+)
+
+// Load-balancing policies of an upstream group.
+const (
+	policyFailover   = "failover"
+	policyRoundRobin = "round-robin"
+	policyRandom     = "random"
+)
+
+// upstreamGroup is a named set of endpoints with a policy choosing between
+// them for each query.
+type upstreamGroup struct {
+	name      string
+	endpoints []string
+	policy    string
+	// subnet replaces -subnet for the group; "none" sends no subnet
+	subnet string
+	next   uint32
+}
+
+// String formats the group as an -upstream-group value.
+func (g *upstreamGroup) String() string {
+	s := g.name + "=" + strings.Join(g.endpoints, ",")
+	if g.policy != policyFailover {
+		s += ";policy=" + g.policy
+	}
+	if g.subnet != "" {
+		s += ";subnet=" + g.subnet
+	}
+	return s
+}
+
+// ecs returns the subnets to send for queries without one of their own.
+func (g *upstreamGroup) ecs() ecsSubnets {
+	if *privacyECS {
+		return ecsSubnets{v4: dohproxy.OptOutSubnet, v6: dohproxy.OptOutSubnet}
+	}
+	switch g.subnet {
+	case "":
+		return ecsSubnets{v4: *subnet, v6: *subnet6}
+	case "none":
+		return ecsSubnets{}
+	}
+	return ecsSubnets{v4: g.subnet, v6: g.subnet}
+}
+
+// ecsSubnets are the client subnets to send upstream, by address family.
+type ecsSubnets struct {
+	v4, v6 string
+}
+
+// forType returns the subnet for a query type: the IPv6 one for AAAA, the
+// IPv4 one for A, and the -subnet-prefer family's for other types, or
+// whichever is set if only one is.
+func (s ecsSubnets) forType(qtype uint16) string {
+	first, second := s.v4, s.v6
+	if qtype == dns.TypeAAAA || (qtype != dns.TypeA && *subnetPrefer == "ipv6") {
+		first, second = s.v6, s.v4
+	}
+	if first != "" {
+		return first
+	}
+	return second
+}
+
+// pick returns the endpoint for a query. Endpoints that failed or are
+// backing off are skipped, and those in their -failback-ramp skipped in
+// proportion; if every one is, the policy's first choice is tried anyway.
+func (g *upstreamGroup) pick() string {
+	first := 0
+	switch g.policy {
+	case policyRoundRobin:
+		first = int((atomic.AddUint32(&g.next, 1) - 1) % uint32(len(g.endpoints)))
+	case policyRandom:
+		first = rand.Intn(len(g.endpoints))
+	}
+	ramping := ""
+	for i := range g.endpoints {
+		endpoint := g.endpoints[(first+i)%len(g.endpoints)]
+		if endpointDown(endpoint) {
+			continue
+		}
+		if !rampingAway(endpoint) {
+			return endpoint
+		}
+		if ramping == "" {
+			ramping = endpoint
+		}
+	}
+	if ramping != "" {
+		return ramping
+	}
+	return g.endpoints[first]
+}
+
+// alternate returns the endpoint to retry a request to endpoint with: the
+// next one of the group that isn't down, or endpoint itself.
+func (g *upstreamGroup) alternate(endpoint string) string {
+	for i, e := range g.endpoints {
+		if e != endpoint {
+			continue
+		}
+		for j := 1; j < len(g.endpoints); j++ {
+			if next := g.endpoints[(i+j)%len(g.endpoints)]; !endpointDown(next) {
+				return next
+			}
+		}
+	}
+	return endpoint
+}
+
+// parseGroup parses an -upstream-group value:
+// name=url[,url...][;policy=failover|round-robin|random][;subnet=CIDR|none].
+func parseGroup(spec string) (*upstreamGroup, error) {
+	parts := strings.Split(spec, ";")
+	eq := strings.Index(parts[0], "=")
+	if eq <= 0 {
+		return nil, fmt.Errorf("%q is not name=url[,url...]", spec)
+	}
+	g := &upstreamGroup{name: parts[0][:eq], policy: policyFailover}
+	if strings.Contains(g.name, "://") {
+		return nil, fmt.Errorf("group name %q looks like a URL", g.name)
+	}
+	g.endpoints = splitList(parts[0][eq+1:])
+	if len(g.endpoints) == 0 {
+		return nil, fmt.Errorf("group %s has no endpoints", g.name)
+	}
+	for _, option := range parts[1:] {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("group %s: %q is not key=value", g.name, option)
+		}
+		switch kv[0] {
+		case "policy":
+			switch kv[1] {
+			case policyFailover, policyRoundRobin, policyRandom:
+				g.policy = kv[1]
+			default:
+				return nil, fmt.Errorf("group %s: policy must be failover, round-robin or random", g.name)
+			}
+		case "subnet":
+			if kv[1] != "none" {
+				if _, _, err := net.ParseCIDR(kv[1]); err != nil {
+					return nil, fmt.Errorf("group %s: subnet: %v", g.name, err)
+				}
+			}
+			g.subnet = kv[1]
+		default:
+			return nil, fmt.Errorf("group %s: unknown option %q", g.name, kv[0])
+		}
+	}
+	return g, nil
+}
+
+// groupList is the set of -upstream-group flags. Each Set adds the
+// whitespace-separated groups of its value.
+type groupList map[string]*upstreamGroup
+
+func (l *groupList) String() string {
+	var specs []string
+	for _, g := range *l {
+		specs = append(specs, g.String())
+	}
+	sort.Strings(specs)
+	return strings.Join(specs, " ")
+}
+
+func (l *groupList) Set(value string) error {
+	if *l == nil {
+		*l = make(groupList)
+	}
+	for _, spec := range strings.Fields(value) {
+		g, err := parseGroup(spec)
+		if err != nil {
+			return err
+		}
+		if _, ok := (*l)[g.name]; ok {
+			return fmt.Errorf("group %s defined twice", g.name)
+		}
+		(*l)[g.name] = g
+	}
+	return nil
+}
+
+// Reset empties the list, so that a config reload replaces the groups
+// rather than adding to them.
+func (l *groupList) Reset() {
+	*l = make(groupList)
+}
+
+// upstreamGroups holds the groups defined with -upstream-group. Queries
+// look groups up in activeGroups instead, which a config reload replaces
+// whole.
+var (
+	upstreamGroups = make(groupList)
+	activeGroups   atomic.Value
+)
+
+func init() {
+	flag.Var(&upstreamGroups, "upstream-group",
+		"Named group of endpoints for -default, as name=url[,url...][;policy=failover|round-robin|random][;subnet=CIDR|none] (repeatable)")
+	activeGroups.Store(upstreamGroups)
+}
+
+// lookupGroup returns the -upstream-group named name, for a query.
+func lookupGroup(name string) (*upstreamGroup, bool) {
+	g, ok := activeGroups.Load().(groupList)[name]
+	return g, ok
+}
+
+// setUpstreamGroups makes the groups of the reloaded -upstream-group flag
+// the ones in use, and switches queries to the new version of the group
+// -default names. Queries in flight keep the group they started with.
+func setUpstreamGroups(string) {
+	if _, ok := upstreamGroups[presetGroupName]; ok && presetGroup != nil {
+		warnf("Ignoring the -upstream-group named %s, which -preset defines", presetGroupName)
+		delete(upstreamGroups, presetGroupName)
+	}
+	activeGroups.Store(upstreamGroups)
+	setUpstream(*defaultServer)
+}
+
+// resolveUpstream returns the group -default names, which may be the
+// -preset group, or a single-endpoint group "default" if it is an endpoint
+// URL.
+func resolveUpstream(value string) (*upstreamGroup, error) {
+	if strings.Contains(value, "://") {
+		return &upstreamGroup{name: "default", endpoints: []string{value}, policy: policyFailover}, nil
+	}
+	if g, ok := lookupGroup(value); ok {
+		return g, nil
+	}
+	if value == presetGroupName && presetGroup != nil {
+		return presetGroup, nil
+	}
+	return nil, fmt.Errorf("no upstream group named %q", value)
+}
+
+// setUpstream switches queries to the upstream -default names, keeping the
+// current one if it names no group.
+func setUpstream(value string) {
+	g, err := resolveUpstream(value)
+	if err != nil {
+		warnf("Keeping the current upstream: %v", err)
+		return
+	}
+	upstream.Store(g)
+}
+
+// drainedEndpoints holds the endpoints marked down for maintenance with the
+// control socket.
+var drainedEndpoints sync.Map
+
+// endpointDown reports whether endpoint should be passed over for now.
+func endpointDown(endpoint string) bool {
+	if _, drained := drainedEndpoints.Load(endpoint); drained {
+		return true
+	}
+	if upstreamBackoff.Suspended(endpoint) {
+		return true
+	}
+	_, failed := endpointFailures.Load(endpoint)
+	return failed
+}
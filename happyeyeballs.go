@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// happyDialer connects to the upstream racing its IPv6 and IPv4 addresses,
+// as in Happy Eyeballs (RFC 8305): addresses are tried alternating between
+// the families, IPv6 first, each attempt starting delay after the previous
+// one or as soon as it fails, and the first connection made wins. A
+// blackholed family then costs one delay rather than a connect timeout.
+type happyDialer struct {
+	dialer *net.Dialer
+	delay  time.Duration
+}
+
+// dialResult is the outcome of one connection attempt.
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// DialContext connects to address, a host:port. The hosts of -preset
+// endpoints are not looked up but dialled at their bootstrap addresses.
+func (d *happyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if addrs, ok := bootstrapAddrs[host]; ok {
+		ips = addrs
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	ips = interleaveFamilies(ips, d.dialer.LocalAddr)
+	if len(ips) == 0 {
+		return nil, &net.AddrError{Err: "no address of the source address's family", Addr: host}
+	}
+	return d.race(ctx, network, host, port, ips)
+}
+
+// race connects to port on the first of ips to accept, giving each attempt
+// a head start of d.delay.
+func (d *happyDialer) race(ctx context.Context, network, host, port string, ips []net.IP) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(ips))
+	next, pending := 0, 0
+	var timer <-chan time.Time
+	var firstErr error
+	for {
+		if next < len(ips) && (pending == 0 || timer == nil) {
+			addr := net.JoinHostPort(ips[next].String(), port)
+			go func() {
+				conn, err := d.dialer.DialContext(ctx, network, addr)
+				results <- dialResult{conn, err}
+			}()
+			next++
+			pending++
+			timer = time.After(d.delay)
+		}
+		select {
+		case <-timer:
+			timer = nil
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close the connections of attempts that finish too late
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				family := addrFamily(r.conn.RemoteAddr())
+				metrics.UpstreamConnections.With(family).Inc()
+				debugf("Connected to %s via %s (%s)", host, r.conn.RemoteAddr(), family)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if pending == 0 && (next == len(ips) || ctx.Err() != nil) {
+				return nil, firstErr
+			}
+			// Start the next attempt now rather than when the timer fires
+			timer = nil
+		}
+	}
+}
+
+// interleaveFamilies orders ips alternating IPv6 and IPv4, IPv6 first,
+// keeping the resolver's order within each family. With a source address
+// only its family is kept.
+func interleaveFamilies(ips []net.IP, local net.Addr) []net.IP {
+	var v6, v4 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	if tcp, ok := local.(*net.TCPAddr); ok && tcp.IP != nil {
+		if tcp.IP.To4() != nil {
+			v6 = nil
+		} else {
+			v4 = nil
+		}
+	}
+	ordered := make([]net.IP, 0, len(v6)+len(v4))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			ordered = append(ordered, v6[i])
+		}
+		if i < len(v4) {
+			ordered = append(ordered, v4[i])
+		}
+	}
+	return ordered
+}
+
+// addrFamily names the IP family of a connection's address.
+func addrFamily(addr net.Addr) string {
+	if ip := addrIP(addr); ip != nil && ip.To4() == nil {
+		return "ipv6"
+	}
+	return "ipv4"
+}
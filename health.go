@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// dnsServing is set once every DNS listener has started.
+var dnsServing int32
+
+// healthStatus is the JSON body of /healthz and /readyz.
+type healthStatus struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+	// Seconds since an upstream last answered, if one ever has
+	LastUpstreamSuccess *int64 `json:"last_upstream_success_seconds,omitempty"`
+}
+
+// addHealth serves /healthz and /readyz on the admin listener on addr, and
+// probes the upstream in the background so that readiness can be answered
+// without waiting on it.
+func addHealth(addr string) {
+	mux := adminMux(addr, "health")
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	go probeLoop(*readyWindow / 3)
+}
+
+func probeLoop(interval time.Duration) {
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for {
+		// Probe every endpoint of the group, so failed ones are taken back
+		for _, endpoint := range currentUpstream().endpoints {
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			probeUpstream(ctx, endpoint)
+			cancel()
+		}
+		time.Sleep(interval)
+	}
+}
+
+// handleHealthz reports whether the process is up with its listeners bound,
+// and not failing the -watchdog self-test.
+func handleHealthz(hw http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&dnsServing) == 0 {
+		writeHealth(hw, http.StatusServiceUnavailable, healthStatus{Status: "starting", Reason: "listeners not bound"})
+		return
+	}
+	if reason := watchdogReason(); reason != "" {
+		writeHealth(hw, http.StatusServiceUnavailable, healthStatus{Status: "unhealthy", Reason: reason})
+		return
+	}
+	writeHealth(hw, http.StatusOK, healthStatus{Status: "ok"})
+}
+
+// handleReadyz reports whether queries can be answered: the listeners are
+// up, the proxy didn't start degraded or an upstream has answered since,
+// and, with -ready-require-upstream, an upstream answered a query or a
+// probe within -ready-window.
+func handleReadyz(hw http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&dnsServing) == 0 {
+		writeHealth(hw, http.StatusServiceUnavailable, healthStatus{Status: "not ready", Reason: "listeners not bound"})
+		return
+	}
+	st := healthStatus{Status: "ready"}
+	var last time.Time
+	for _, endpoint := range currentUpstream().endpoints {
+		if t := lastUpstreamSuccess(endpoint); t.After(last) {
+			last = t
+		}
+	}
+	if !last.IsZero() {
+		age := int64(time.Since(last) / time.Second)
+		st.LastUpstreamSuccess = &age
+	}
+	if reason := startupDegraded(); reason != "" {
+		st.Status = "not ready"
+		st.Reason = reason
+		writeHealth(hw, http.StatusServiceUnavailable, st)
+		return
+	}
+	if *readyRequireUpstream && (last.IsZero() || time.Since(last) > *readyWindow) {
+		st.Status = "not ready"
+		st.Reason = "no upstream answered within " + readyWindow.String()
+		writeHealth(hw, http.StatusServiceUnavailable, st)
+		return
+	}
+	writeHealth(hw, http.StatusOK, st)
+}
+
+// lastUpstreamSuccess returns when endpoint last answered a client query or
+// a probe.
+func lastUpstreamSuccess(endpoint string) time.Time {
+	last := metrics.UpstreamLastSuccess.With(endpoint).Value()
+	if probe := metrics.ProbeLastSuccess.With(endpoint).Value(); probe > last {
+		last = probe
+	}
+	if last == 0 {
+		return time.Time{}
+	}
+	return time.Unix(last, 0)
+}
+
+func writeHealth(hw http.ResponseWriter, code int, st healthStatus) {
+	hw.Header().Set("Content-Type", "application/json")
+	hw.Header().Set("Cache-Control", "no-store")
+	hw.WriteHeader(code)
+	json.NewEncoder(hw).Encode(st)
+}
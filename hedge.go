@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// hedgeMinSamples is how many successful requests to an endpoint are needed
+// before its 95th percentile is trusted as the -hedge delay.
+const hedgeMinSamples = 20
+
+// hedgeTokens is the budget for hedged requests in thousandths of a request:
+// every upstream request earns -hedge-ratio of one and every hedge spends
+// one. It is capped at hedgeBurst, so that a quiet spell can't save up for
+// hedging every request once the upstream really slows down.
+var hedgeTokens int64
+
+const hedgeBurst = 10 * 1000
+
+func earnHedge() {
+	earned := int64(*hedgeRatio * 1000)
+	for {
+		old := atomic.LoadInt64(&hedgeTokens)
+		n := old + earned
+		if n > hedgeBurst {
+			n = hedgeBurst
+		}
+		if n == old || atomic.CompareAndSwapInt64(&hedgeTokens, old, n) {
+			return
+		}
+	}
+}
+
+func spendHedge() bool {
+	for {
+		old := atomic.LoadInt64(&hedgeTokens)
+		if old < 1000 {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&hedgeTokens, old, old-1000) {
+			return true
+		}
+	}
+}
+
+// hedgeAfter returns how long to wait for endpoint before hedging, and false
+// if there isn't enough history to tell what is slow for it.
+func hedgeAfter(endpoint string) (time.Duration, bool) {
+	if *hedgeDelay > 0 {
+		return *hedgeDelay, true
+	}
+	h := metrics.UpstreamDuration.With(endpoint)
+	if atomic.LoadUint64(&h.count) < hedgeMinSamples {
+		return 0, false
+	}
+	return h.quantile(.95), true
+}
+
+// fetchHedged is fetch, sending a second request after -hedge-delay if the
+// first hasn't been answered, to another endpoint of group, the one addr was
+// picked from, when there is one. The first successful reply is used and the
+// other request cancelled.
+func fetchHedged(ctx context.Context, group *upstreamGroup, addr, ecs string, httpreq *http.Request, w dns.ResponseWriter, req *dns.Msg, trace *queryTrace) *upstreamReply {
+	if !*hedge {
+		return fetch(ctx, addr, httpreq, w, req, trace)
+	}
+	earnHedge()
+	delay, ok := hedgeAfter(addr)
+	if !ok {
+		return fetch(ctx, addr, httpreq, w, req, trace)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	replies := make(chan *upstreamReply, 2)
+	go func(replies chan<- *upstreamReply) {
+		replies <- fetch(ctx, addr, httpreq.WithContext(ctx), w, req, trace)
+	}(replies)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case reply := <-replies:
+		return reply
+	case <-timer.C:
+	}
+
+	second := group.alternate(addr)
+	hedgereq, err := newHedgeRequest(ctx, second, ecs, req)
+	if err != nil || !spendHedge() {
+		return <-replies
+	}
+	if !tryUpstreamSlot() {
+		atomic.AddInt64(&hedgeTokens, 1000)
+		return <-replies
+	}
+	stats.UpstreamHedged.Inc()
+	trace.Printf("no upstream answer after %v, hedging with %s", delay, second)
+	hedged := make(chan *upstreamReply, 1)
+	go func(hedged chan<- *upstreamReply) {
+		defer releaseUpstreamSlot()
+		hedged <- fetch(ctx, second, hedgereq, w, req, trace.fork())
+	}(hedged)
+
+	// Take the first successful reply, or the last failure
+	var reply *upstreamReply
+	for pending := 2; pending > 0; pending-- {
+		select {
+		case reply = <-replies:
+			replies = nil
+		case reply = <-hedged:
+			if reply.json != nil {
+				stats.UpstreamHedgeWins.Inc()
+			}
+			hedged = nil
+		}
+		if reply.json != nil {
+			break
+		}
+	}
+	return reply
+}
+
+func newHedgeRequest(ctx context.Context, endpoint, ecs string, req *dns.Msg) (*http.Request, error) {
+	builder, err := requestBuilder(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return builder.NewRequest(ctx, req, ecs)
+}
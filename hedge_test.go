@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// jsonUpstream serves a fixed JSON answer for example.com after delay,
+// counting the requests it gets.
+func jsonUpstream(t *testing.T, delay time.Duration, hits *int32) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-json")
+		w.Write([]byte(`{"Status":0,"Question":[{"name":"example.com.","type":1}],` +
+			`"Answer":[{"name":"example.com.","type":1,"TTL":300,"data":"192.0.2.1"}]}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestHedgeStaysInGroup(t *testing.T) {
+	var slowHits, fastHits, otherHits int32
+	slow := jsonUpstream(t, 5*time.Second, &slowHits).URL + "/resolve"
+	fast := jsonUpstream(t, 0, &fastHits).URL + "/resolve"
+	other := jsonUpstream(t, 0, &otherHits).URL + "/resolve"
+
+	upstream.Store(&upstreamGroup{name: "default", endpoints: []string{other}, policy: policyFailover})
+	defer func(on bool, delay time.Duration) { *hedge, *hedgeDelay = on, delay }(*hedge, *hedgeDelay)
+	*hedge, *hedgeDelay = true, 20*time.Millisecond
+	atomic.StoreInt64(&hedgeTokens, hedgeBurst)
+
+	group := &upstreamGroup{name: "lan", endpoints: []string{slow, fast}, policy: policyFailover}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	httpreq, err := newHedgeRequest(ctx, slow, "", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &httpResponseWriter{local: &net.TCPAddr{}, remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 7)}}
+	reply := fetchHedged(ctx, group, slow, "", httpreq, w, req, nil)
+	if reply.json == nil || reply.endpoint != fast {
+		t.Errorf("got a reply from %q, want one from the group's other endpoint %q", reply.endpoint, fast)
+	}
+	if atomic.LoadInt32(&otherHits) != 0 {
+		t.Error("hedged with the default group rather than the query's")
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/wrouesnel/dns-over-https-proxy/dohproxy"
+)
+
+// ageTTLs takes the Age of the HTTP response r came in off its record
+// TTLs, never going below 1 second. An endpoint behind a CDN or HTTP cache
+// may send an answer that sat in the cache for that long, which the TTLs
+// in the body don't account for. An absent or malformed Age is ignored.
+func ageTTLs(r *dohproxy.DNSResponseJson, h http.Header) {
+	age, err := strconv.ParseUint(strings.TrimSpace(h.Get("Age")), 10, 31)
+	if err != nil || age == 0 {
+		return
+	}
+	debugf("Upstream response is %d seconds old, lowering its TTLs", age)
+	for _, section := range [][]dohproxy.DNSRR{r.Answer, r.Authority, r.Additional} {
+		for i := range section {
+			if ttl := int64(section[i].TTL) - int64(age); ttl >= 1 {
+				section[i].TTL = int32(ttl)
+			} else if section[i].TTL > 1 {
+				section[i].TTL = 1
+			}
+		}
+	}
+}
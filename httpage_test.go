@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAgeTTLs(t *testing.T) {
+	for _, tc := range []struct {
+		age  string
+		want []int32 // TTLs of the A records of 300 and 100 seconds, and the authority's 0
+	}{
+		{"120", []int32{180, 1, 0}},
+		{" 120 ", []int32{180, 1, 0}},
+		{"", []int32{300, 100, 0}},
+		{"0", []int32{300, 100, 0}},
+		{"xyz", []int32{300, 100, 0}},
+		{"-5", []int32{300, 100, 0}},
+		{"1.5", []int32{300, 100, 0}},
+		{"99999999999", []int32{300, 100, 0}},
+	} {
+		reply := fetchFrom(t, func(w http.ResponseWriter, r *http.Request) {
+			if tc.age != "" {
+				w.Header().Set("Age", tc.age)
+			}
+			w.Header().Set("Content-Type", "application/dns-json")
+			w.Write([]byte(`{"Status":0,"Question":[{"name":"example.com.","type":1}],` +
+				`"Answer":[{"name":"example.com.","type":1,"TTL":300,"data":"192.0.2.1"},` +
+				`{"name":"example.com.","type":1,"TTL":100,"data":"192.0.2.2"}],` +
+				`"Authority":[{"name":"example.com.","type":6,"TTL":0,` +
+				`"data":"ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 300"}]}`))
+		})
+		if reply.json == nil {
+			t.Fatalf("Age %q: the query failed", tc.age)
+		}
+		got := []int32{reply.json.Answer[0].TTL, reply.json.Answer[1].TTL, reply.json.Authority[0].TTL}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("Age %q: got TTLs %v, want %v", tc.age, got, tc.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How long shutdown waits for in-flight HTTP requests.
+const httpShutdownTimeout = 5 * time.Second
+
+var (
+	httpServersMu sync.Mutex
+	httpServers   []*http.Server
+)
+
+// serveHTTP binds addr and serves handler on it, over TLS when tlsConfig is
+// set. name identifies the server in log and error messages.
+func serveHTTP(name, addr string, handler http.Handler, tlsConfig *tls.Config) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("cannot listen on %s (%s): %v", addr, name, err)
+	}
+	srv := &http.Server{Handler: handler, TLSConfig: tlsConfig}
+
+	httpServersMu.Lock()
+	httpServers = append(httpServers, srv)
+	httpServersMu.Unlock()
+
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != http.ErrServerClosed {
+			serverFailed(fmt.Errorf("%s server on %s failed: %v", name, addr, err))
+		}
+	}()
+	infof("Listening on %s (%s)", addr, name)
+	return nil
+}
+
+// shutdownHTTP gracefully stops all HTTP servers.
+func shutdownHTTP() {
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+
+	httpServersMu.Lock()
+	defer httpServersMu.Unlock()
+	for _, srv := range httpServers {
+		if err := srv.Shutdown(ctx); err != nil {
+			errorf("Error shutting down HTTP server: %v", err)
+		}
+	}
+}
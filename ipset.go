@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ipsetSets are the sets the addresses of a domain's responses are added
+// to. v6 may be empty.
+type ipsetSets struct {
+	v4, v6 string
+}
+
+// ipsetRules maps domains to the sets for them and their subdomains. Each
+// Set adds the whitespace-separated rules of its value, each of the form
+// domain[,domain...]:v4set[,v6set].
+type ipsetRules map[string]ipsetSets
+
+func (r *ipsetRules) String() string {
+	var rules []string
+	for domain, sets := range *r {
+		rule := domain + ":" + sets.v4
+		if sets.v6 != "" {
+			rule += "," + sets.v6
+		}
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	return strings.Join(rules, " ")
+}
+
+func (r *ipsetRules) Set(value string) error {
+	if *r == nil {
+		*r = make(ipsetRules)
+	}
+	for _, rule := range strings.Fields(value) {
+		i := strings.LastIndexByte(rule, ':')
+		if i <= 0 {
+			return fmt.Errorf("%q is not domain[,domain...]:v4set[,v6set]", rule)
+		}
+		names := splitList(rule[i+1:])
+		if len(names) < 1 || len(names) > 2 {
+			return fmt.Errorf("%q: give a set for IPv4 and optionally one for IPv6", rule)
+		}
+		sets := ipsetSets{v4: names[0]}
+		if len(names) == 2 {
+			sets.v6 = names[1]
+		}
+		for _, domain := range splitList(rule[:i]) {
+			(*r)[normalizeName(domain)] = sets
+		}
+	}
+	return nil
+}
+
+// -ipset-backend values.
+const (
+	ipsetBackendIPSet = "ipset"
+	ipsetBackendNft   = "nft"
+)
+
+var (
+	ipsets       ipsetRules
+	ipsetBackend = flag.String("ipset-backend", ipsetBackendIPSet,
+		"Command updating -ipset sets: ipset, or nft with sets named family#table#set")
+)
+
+func init() {
+	flag.Var(&ipsets, "ipset",
+		"Add the A and AAAA records of responses for domains and their subdomains to sets, as domain[,domain...]:v4set[,v6set] (repeatable; Linux only)")
+}
+
+// ipsetMaxTTL bounds the timeout of set entries, which the kernel limits.
+const ipsetMaxTTL = 2147483
+
+// ipsetEntry is an address to add to a set, for ttl seconds.
+type ipsetEntry struct {
+	ip  string
+	ttl uint32
+}
+
+// ipsetBatch is the entries one response adds to one set.
+type ipsetBatch struct {
+	set     string
+	entries []ipsetEntry
+}
+
+// ipsetQueue feeds the goroutine running the set commands, so that slow
+// updates never hold up a response.
+var ipsetQueue chan ipsetBatch
+
+// startIPSets checks the -ipset-backend and starts updating sets, if there
+// are -ipset rules.
+func startIPSets() error {
+	if len(ipsets) == 0 {
+		return nil
+	}
+	if err := checkIPSetBackend(*ipsetBackend); err != nil {
+		return fmt.Errorf("-ipset: %v", err)
+	}
+	ipsetQueue = make(chan ipsetBatch, 1000)
+	go func() {
+		for batch := range ipsetQueue {
+			if err := updateIPSet(*ipsetBackend, batch); err != nil {
+				metrics.IPSetUpdates.With("failed").Inc()
+				warnf("Cannot add %d addresses to set %s: %v", len(batch.entries), batch.set, err)
+				continue
+			}
+			metrics.IPSetUpdates.With("ok").Inc()
+		}
+	}()
+	return nil
+}
+
+// addToIPSets queues the addresses in a response to a query for qname,
+// which must be normalized, for the sets its -ipset rule names.
+func addToIPSets(resp *dns.Msg, qname string) {
+	if ipsetQueue == nil {
+		return
+	}
+	domain, ok := longestSuffix(qname, func(domain string) bool {
+		_, ok := ipsets[domain]
+		return ok
+	})
+	if !ok {
+		return
+	}
+	sets := ipsets[domain]
+	var v4, v6 []ipsetEntry
+	for _, rr := range resp.Answer {
+		ttl := rr.Header().Ttl
+		if ttl > ipsetMaxTTL {
+			ttl = ipsetMaxTTL
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			v4 = append(v4, ipsetEntry{rr.A.String(), ttl})
+		case *dns.AAAA:
+			if sets.v6 != "" {
+				v6 = append(v6, ipsetEntry{rr.AAAA.String(), ttl})
+			}
+		}
+	}
+	for _, batch := range []ipsetBatch{{sets.v4, v4}, {sets.v6, v6}} {
+		if len(batch.entries) == 0 {
+			continue
+		}
+		select {
+		case ipsetQueue <- batch:
+		default:
+			metrics.IPSetUpdates.With("dropped").Inc()
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+func checkIPSetBackend(backend string) error {
+	switch backend {
+	case ipsetBackendIPSet, ipsetBackendNft:
+	default:
+		return fmt.Errorf("-ipset-backend must be ipset or nft")
+	}
+	_, err := exec.LookPath(backend)
+	return err
+}
+
+// updateIPSet adds a batch of addresses to a set with one command. With
+// nft, sets are named family#table#set, as in dnsmasq's nftset option.
+func updateIPSet(backend string, batch ipsetBatch) error {
+	var cmd *exec.Cmd
+	if backend == ipsetBackendNft {
+		name := strings.Split(batch.set, "#")
+		if len(name) != 3 {
+			return fmt.Errorf("nft set %q is not family#table#set", batch.set)
+		}
+		elements := make([]string, len(batch.entries))
+		for i, e := range batch.entries {
+			elements[i] = fmt.Sprintf("%s timeout %ds", e.ip, e.ttl)
+		}
+		cmd = exec.Command("nft", "add", "element", name[0], name[1], name[2],
+			"{ "+strings.Join(elements, ", ")+" }")
+	} else {
+		var script bytes.Buffer
+		for _, e := range batch.entries {
+			fmt.Fprintf(&script, "add %s %s timeout %d\n", batch.set, e.ip, e.ttl)
+		}
+		cmd = exec.Command("ipset", "-exist", "restore")
+		cmd.Stdin = &script
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func checkIPSetBackend(backend string) error {
+	return errors.New("sets are only supported on Linux")
+}
+
+func updateIPSet(backend string, batch ipsetBatch) error {
+	return errors.New("sets are only supported on Linux")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/miekg/dns"
+)
+
+// queryLog writes one JSON object per completed query for -query-log-format
+// json, or is nil when that is off.
+var queryLog *jsonQueryLog
+
+type jsonQueryLog struct {
+	path string
+
+	mu  sync.Mutex
+	out io.Writer
+	buf []byte
+}
+
+// newJSONQueryLog logs to path, or to stderr if path is empty. A file is
+// reopened on SIGHUP so it can be rotated.
+func newJSONQueryLog(path string) (*jsonQueryLog, error) {
+	l := &jsonQueryLog{path: path, out: os.Stderr}
+	if path == "" {
+		return l, nil
+	}
+	f, err := openLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	l.out = f
+	onReload(func() {
+		f, err := openLogFile(path)
+		if err != nil {
+			warnf("Cannot reopen query log %s: %v", path, err)
+			return
+		}
+		l.mu.Lock()
+		old := l.out.(*os.File)
+		l.out = f
+		l.mu.Unlock()
+		old.Close()
+	})
+	return l, nil
+}
+
+func openLogFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+}
+
+// Log records a completed query answered through rec.
+func (l *jsonQueryLog) Log(req *dns.Msg, rec *responseRecorder, start time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := append(l.buf[:0], `{"time":"`...)
+	b = start.UTC().AppendFormat(b, time.RFC3339Nano)
+	b = append(b, '"')
+	if client := clientAddr(rec); client != "" {
+		b = append(b, `,"client":`...)
+		b = appendJSONString(b, client)
+	}
+	b = append(b, `,"proto":`...)
+	b = appendJSONString(b, clientProto(rec))
+	if len(req.Question) > 0 {
+		b = append(b, `,"qname":`...)
+		b = appendJSONString(b, normalizeName(req.Question[0].Name))
+		b = append(b, `,"qtype":`...)
+		b = appendJSONString(b, dns.Type(req.Question[0].Qtype).String())
+	}
+	if rec.msg != nil {
+		b = append(b, `,"rcode":`...)
+		b = appendJSONString(b, dns.RcodeToString[rec.msg.Rcode])
+		b = append(b, `,"answers":`...)
+		b = strconv.AppendInt(b, int64(len(rec.msg.Answer)), 10)
+	}
+	if rec.upstream != "" {
+		b = append(b, `,"upstream":`...)
+		b = appendJSONString(b, rec.upstream)
+	}
+	if rec.reason != "" {
+		b = append(b, `,"error":`...)
+		b = appendJSONString(b, rec.reason)
+	}
+	if rec.comment != "" {
+		b = append(b, `,"comment":`...)
+		b = appendJSONString(b, rec.comment)
+	}
+	b = append(b, `,"duration_ms":`...)
+	b = strconv.AppendFloat(b, float64(time.Since(start))/float64(time.Millisecond), 'f', 3, 64)
+	b = append(b, "}\n"...)
+	l.buf = b
+
+	l.out.Write(b)
+}
+
+// clientProto names the transport a query arrived over.
+func clientProto(rec *responseRecorder) string {
+	if _, ok := rec.ResponseWriter.(*httpResponseWriter); ok {
+		return "doh"
+	}
+	return rec.RemoteAddr().Network()
+}
+
+// appendJSONString appends s as a quoted JSON string.
+func appendJSONString(b []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	b = append(b, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c < ' ':
+			b = append(b, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+		case c < utf8.RuneSelf:
+			b = append(b, c)
+		default:
+			r, size := utf8.DecodeRuneInString(s[i:])
+			if r == utf8.RuneError && size == 1 {
+				b = append(b, `�`...)
+			} else {
+				b = append(b, s[i:i+size]...)
+			}
+			i += size
+			continue
+		}
+		i++
+	}
+	return append(b, '"')
+}
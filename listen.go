@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// How long to wait for bound listeners to start serving.
+const startupTimeout = 5 * time.Second
+
+// dnsListener is a bound DNS server on one address and transport.
+type dnsListener struct {
+	Proto  string
+	Addr   string
+	Server *dns.Server
+}
+
+func (l *dnsListener) String() string {
+	return fmt.Sprintf("%s (%s)", l.Addr, l.Proto)
+}
+
+// openListeners binds every configured DNS listener, or adopts the sockets
+// passed in by systemd when socket activated.
+func openListeners() ([]*dnsListener, error) {
+	listeners, err := activationListeners()
+	if err != nil {
+		return nil, err
+	}
+	if listeners != nil {
+		infof("Using sockets from systemd socket activation, ignoring listen addresses")
+	} else {
+		if *listenInterface != "" {
+			infof("Binding DNS listeners to interface %s", *listenInterface)
+		}
+		for _, t := range []struct{ proto, addrs string }{
+			{"udp", *listenUDP},
+			{"tcp", *listenTCP},
+			{"unix", *listenUnixPath},
+			{"tls", *listenTLSAddr},
+		} {
+			for _, spec := range splitList(t.addrs) {
+				addr, acl, err := parseListenSpec(spec)
+				if err != nil {
+					closeDNS(listeners)
+					return nil, err
+				}
+				var ls []*dnsListener
+				if t.proto == "udp" && *reusePort > 1 {
+					ls, err = listenUDPReusePort(addr, *reusePort)
+				} else {
+					var l *dnsListener
+					l, err = listenDNS(t.proto, addr)
+					ls = []*dnsListener{l}
+				}
+				if err != nil {
+					closeDNS(listeners)
+					return nil, err
+				}
+				if acl != nil {
+					for _, l := range ls {
+						l.Server.Handler = aclHandler(acl, dns.DefaultServeMux)
+					}
+				}
+				listeners = append(listeners, ls...)
+			}
+		}
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("at least one of -listen-udp or -listen-tcp is required")
+	}
+
+	for _, l := range listeners {
+		if l.Proto == "tcp" {
+			tcpAvailable = true
+		}
+	}
+	return listeners, nil
+}
+
+// listenDNS binds a DNS server on addr for proto, which is "udp", "tcp",
+// "unix" or "tls". Unix sockets speak DNS-over-TCP framing.
+func listenDNS(proto, addr string) (*dnsListener, error) {
+	l := &dnsListener{Proto: proto, Addr: addr}
+	control, err := listenControl(false)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on %s: %v", l, err)
+	}
+	lc := net.ListenConfig{Control: control}
+
+	switch proto {
+	case "udp":
+		pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot listen on %s: %v", l, err)
+		}
+		l.Server = &dns.Server{PacketConn: pc, Net: "udp"}
+	case "tcp":
+		ln, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot listen on %s: %v", l, err)
+		}
+		l.Server = newTCPServer(ln)
+	case "tls":
+		ln, err := listenTLS(lc, addr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot listen on %s: %v", l, err)
+		}
+		l.Server = &dns.Server{Listener: ln, Net: "tcp-tls", IdleTimeout: func() time.Duration {
+			return *tlsIdleTimeout
+		}}
+	case "unix":
+		ln, err := listenUnix(addr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot listen on %s: %v", l, err)
+		}
+		l.Server = &dns.Server{Listener: ln, Net: "tcp"}
+	default:
+		return nil, fmt.Errorf("cannot listen on %s: unknown protocol", l)
+	}
+	return l, nil
+}
+
+// newTCPServer returns a DNS server for a bound TCP listener, applying the
+// connection limit, idle timeout and PROXY protocol handling.
+func newTCPServer(ln net.Listener) *dns.Server {
+	ln = limitListener(ln, *tcpMaxConns, &stats.TCPConns, &stats.TCPConnsRejected)
+	if *proxyProtocol {
+		ln = newProxyProtoListener(ln)
+	}
+	return &dns.Server{Listener: &connListener{ln}, Net: "tcp", IdleTimeout: func() time.Duration {
+		return *tcpIdleTimeout
+	}}
+}
+
+// listenUDPReusePort binds n UDP sockets on addr with SO_REUSEPORT, each
+// served by its own DNS server. Where the option isn't supported a single
+// socket is used instead.
+func listenUDPReusePort(addr string, n int) ([]*dnsListener, error) {
+	if reusePortControl == nil {
+		warnf("SO_REUSEPORT is not supported on this platform, using one socket for %s", addr)
+		l, err := listenDNS("udp", addr)
+		return []*dnsListener{l}, err
+	}
+
+	control, err := listenControl(true)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on %s (udp): %v", addr, err)
+	}
+	lc := net.ListenConfig{Control: control}
+	var listeners []*dnsListener
+	for i := 0; i < n; i++ {
+		l := &dnsListener{Proto: "udp", Addr: addr}
+		pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+		if err != nil && i == 0 {
+			warnf("Cannot use SO_REUSEPORT on %s, using one socket: %v", addr, err)
+			l, err := listenDNS("udp", addr)
+			return []*dnsListener{l}, err
+		}
+		if err != nil {
+			closeDNS(listeners)
+			return nil, fmt.Errorf("cannot listen on %s: %v", l, err)
+		}
+		l.Server = &dns.Server{PacketConn: pc, Net: "udp"}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+var tlsCerts *certReloader
+
+// listenTLS binds a DNS-over-TLS listener on addr using the -tls-cert and
+// -tls-key certificate, which is reloaded on SIGHUP.
+func listenTLS(lc net.ListenConfig, addr string) (net.Listener, error) {
+	if tlsCerts == nil {
+		certs, err := newCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsCerts = certs
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ln = &connListener{limitListener(ln, *tlsMaxConns, &stats.TLSConns, &stats.TLSConnsRejected)}
+	return tls.NewListener(ln, tlsCerts.TLSConfig()), nil
+}
+
+// listenControl returns the socket setup for DNS listeners: SO_BINDTODEVICE
+// for -interface, plus SO_REUSEPORT when reusePort is set.
+func listenControl(reusePort bool) (func(network, address string, c syscall.RawConn) error, error) {
+	var controls []func(network, address string, c syscall.RawConn) error
+	if *listenInterface != "" {
+		if _, err := net.InterfaceByName(*listenInterface); err != nil {
+			return nil, fmt.Errorf("-interface %s: %v", *listenInterface, err)
+		}
+		control, err := bindToDevice(*listenInterface)
+		if err != nil {
+			return nil, fmt.Errorf("-interface %s: %v", *listenInterface, err)
+		}
+		controls = append(controls, control)
+	}
+	if reusePort {
+		controls = append(controls, reusePortControl)
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		for _, control := range controls {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+// listenUnix creates a Unix socket at path with -listen-unix-mode
+// permissions, replacing a stale socket left behind by a previous run. The
+// socket file is removed again when the listener is closed.
+func listenUnix(path string) (net.Listener, error) {
+	mode, err := strconv.ParseUint(*listenUnixMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -listen-unix-mode %q: %v", *listenUnixMode, err)
+	}
+	return listenUnixSocket(path, os.FileMode(mode))
+}
+
+// listenUnixSocket creates a Unix socket at path with mode permissions, as
+// listenUnix does.
+func listenUnixSocket(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		infof("Removing stale socket %s", path)
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// serverErrs receives the first error from any server which stops
+// unexpectedly, which makes main shut down.
+var serverErrs = make(chan error, 1)
+
+func serverFailed(err error) {
+	select {
+	case serverErrs <- err:
+	default:
+	}
+}
+
+// serveDNS starts serving on all listeners and waits until each has started.
+func serveDNS(listeners []*dnsListener) error {
+	started := make(chan *dnsListener, len(listeners))
+	failed := make(chan error, len(listeners))
+	for _, l := range listeners {
+		l := l
+		l.Server.NotifyStartedFunc = func() { started <- l }
+		go func() {
+			err := l.Server.ActivateAndServe()
+			if err == nil {
+				return
+			}
+			err = fmt.Errorf("DNS server on %s failed: %v", l, err)
+			select {
+			case failed <- err:
+			default:
+			}
+			serverFailed(err)
+		}()
+	}
+
+	timer := time.NewTimer(startupTimeout)
+	defer timer.Stop()
+	for range listeners {
+		select {
+		case l := <-started:
+			infof("Listening on %s", l)
+		case err := <-failed:
+			return err
+		case <-timer.C:
+			return fmt.Errorf("timed out waiting for DNS servers to start")
+		}
+	}
+	return nil
+}
+
+// shutdownDNS gracefully stops all listeners.
+func shutdownDNS(listeners []*dnsListener) {
+	for _, l := range listeners {
+		if err := l.Server.Shutdown(); err != nil {
+			errorf("Error shutting down %s: %v", l, err)
+		}
+	}
+}
+
+// closeDNS releases the sockets of listeners which never started serving.
+func closeDNS(listeners []*dnsListener) {
+	for _, l := range listeners {
+		if l.Server.PacketConn != nil {
+			l.Server.PacketConn.Close()
+		}
+		if l.Server.Listener != nil {
+			l.Server.Listener.Close()
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestOpenListenersPortInUse(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	// A free UDP port, to check that it is given back
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpAddr := pc.LocalAddr().String()
+	pc.Close()
+
+	defer func(udp, tcp string) { *listenUDP, *listenTCP = udp, tcp }(*listenUDP, *listenTCP)
+	*listenUDP, *listenTCP = udpAddr, taken.Addr().String()
+	listeners, err := openListeners()
+	if err == nil {
+		closeDNS(listeners)
+		t.Fatal("openListeners succeeded with the TCP port in use")
+	}
+	if want := "cannot listen on " + taken.Addr().String() + " (tcp)"; !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %q, want it to name %s", err, want)
+	}
+	pc, err = net.ListenPacket("udp", udpAddr)
+	if err != nil {
+		t.Fatalf("the UDP listener was left open: %v", err)
+	}
+	pc.Close()
+}
+
+// BenchmarkUDPListeners compares serving UDP queries from one socket and
+// from four sharing the address with SO_REUSEPORT.
+func BenchmarkUDPListeners(b *testing.B) {
+	if reusePortControl == nil {
+		b.Skip("SO_REUSEPORT is not supported on this platform")
+	}
+	for _, n := range []int{1, 4} {
+		b.Run(fmt.Sprintf("sockets=%d", n), func(b *testing.B) { benchmarkUDPListeners(b, n) })
+	}
+}
+
+func benchmarkUDPListeners(b *testing.B, n int) {
+	// A free port, as each socket binding port 0 would get its own
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	listeners, err := listenUDPReusePort(addr, n)
+	if err != nil {
+		b.Fatal(err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(192, 0, 2, 1),
+		}}
+		w.WriteMsg(resp)
+	})
+	for _, l := range listeners {
+		l.Server.Handler = handler
+		go l.Server.ActivateAndServe()
+		defer l.Server.Shutdown()
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// Each client socket is a flow of its own, which the kernel hashes
+		// to one of the sockets
+		conn, err := dns.Dial("udp", addr)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer conn.Close()
+		for pb.Next() {
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if err := conn.WriteMsg(req); err != nil {
+				b.Error(err)
+				return
+			}
+			if _, err := conn.ReadMsg(); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// loadResults collects the outcome of every query a load test sends.
+type loadResults struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	rcodes    map[string]int
+	timeouts  int
+	errors    int
+	skipped   int
+}
+
+// runLoadtest implements the loadtest subcommand: it sends queries at a
+// fixed rate to a DNS server, this proxy or any other, and prints latency
+// percentiles, timeouts and rcodes. It returns the exit status.
+func runLoadtest(args []string) int {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: dns-over-https-proxy loadtest [flags] host:port")
+		fs.PrintDefaults()
+	}
+	qps := fs.Int("qps", 100, "Queries to send per second")
+	duration := fs.Duration("duration", 10*time.Second, "How long to send queries for")
+	queryTimeout := fs.Duration("timeout", 2*time.Second, "How long to wait for each answer")
+	proto := fs.String("proto", "udp", "Transport: udp or tcp")
+	names := fs.String("names", "example.com", "Comma-separated names to query, in turn")
+	namesFile := fs.String("names-file", "", "File of names to query, one per line, instead of -names")
+	qtypeName := fs.String("qtype", "A", "Query type")
+	randomPrefix := fs.Bool("random-prefix", false, "Prefix each name with a random label, so no query is answered from a cache")
+	maxInFlight := fs.Int("max-in-flight", 10000, "Queries outstanding at once before further ones are skipped")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || *qps <= 0 {
+		fs.Usage()
+		return 2
+	}
+	target := fs.Arg(0)
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "53")
+	}
+	if *proto != "udp" && *proto != "tcp" {
+		fmt.Fprintln(os.Stderr, "loadtest: -proto must be udp or tcp")
+		return 2
+	}
+	qtype, err := parseQType(*qtypeName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "loadtest: -qtype:", err)
+		return 2
+	}
+	list := splitList(*names)
+	if *namesFile != "" {
+		data, err := ioutil.ReadFile(*namesFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "loadtest:", err)
+			return 2
+		}
+		list = strings.Fields(string(data))
+	}
+	if len(list) == 0 {
+		fmt.Fprintln(os.Stderr, "loadtest: no names to query")
+		return 2
+	}
+
+	client := &dns.Client{Net: *proto, Timeout: *queryTimeout}
+	results := &loadResults{rcodes: make(map[string]int)}
+	slots := make(chan struct{}, *maxInFlight)
+	var wg sync.WaitGroup
+
+	fmt.Printf("Sending %d queries per second to %s over %s for %v\n", *qps, target, *proto, *duration)
+	ticker := time.NewTicker(time.Second / time.Duration(*qps))
+	defer ticker.Stop()
+	start := time.Now()
+	sent := 0
+	for time.Since(start) < *duration {
+		<-ticker.C
+		name := dns.Fqdn(list[sent%len(list)])
+		if *randomPrefix {
+			name = fmt.Sprintf("%08x.%s", rand.Uint32(), name)
+		}
+		sent++
+		select {
+		case slots <- struct{}{}:
+		default:
+			results.mu.Lock()
+			results.skipped++
+			results.mu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			req := new(dns.Msg)
+			req.SetQuestion(name, qtype)
+			resp, rtt, err := client.Exchange(req, target)
+			results.add(resp, rtt, err)
+		}(name)
+	}
+	wg.Wait()
+	results.print(sent, time.Since(start))
+	return 0
+}
+
+func (r *loadResults) add(resp *dns.Msg, rtt time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			r.timeouts++
+		} else {
+			r.errors++
+		}
+		return
+	}
+	r.latencies = append(r.latencies, rtt)
+	r.rcodes[dns.RcodeToString[resp.Rcode]]++
+}
+
+func (r *loadResults) print(sent int, elapsed time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Printf("sent=%d answered=%d timeouts=%d errors=%d skipped=%d rate=%.1f/s\n",
+		sent, len(r.latencies), r.timeouts, r.errors, r.skipped, float64(sent)/elapsed.Seconds())
+
+	var codes []string
+	for code := range r.rcodes {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	var pairs []string
+	for _, code := range codes {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", code, r.rcodes[code]))
+	}
+	if len(pairs) == 0 {
+		pairs = []string{"none"}
+	}
+	fmt.Println("rcodes", strings.Join(pairs, " "))
+
+	if len(r.latencies) == 0 {
+		return
+	}
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+	at := func(q float64) time.Duration {
+		return r.latencies[int(q*float64(len(r.latencies)-1))].Round(time.Microsecond)
+	}
+	fmt.Printf("latency min=%v p50=%v p90=%v p99=%v p99.9=%v max=%v\n",
+		at(0), at(.5), at(.9), at(.99), at(.999), at(1))
+}
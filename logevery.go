@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// logEvery limits a recurring log message to one line per interval, so that
+// a flood of identical events doesn't flood the log too.
+type logEvery struct {
+	interval time.Duration
+
+	mu         sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+func newLogEvery(interval time.Duration) *logEvery {
+	return &logEvery{interval: interval}
+}
+
+// Printf logs the message unless one was already logged within the interval.
+func (l *logEvery) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	now := time.Now()
+	if now.Sub(l.last) < l.interval {
+		l.suppressed++
+		l.mu.Unlock()
+		return
+	}
+	suppressed := l.suppressed
+	l.last = now
+	l.suppressed = 0
+	l.mu.Unlock()
+
+	msg := fmt.Sprintf(format, v...)
+	if suppressed > 0 {
+		msg += fmt.Sprintf(" (%d similar messages suppressed)", suppressed)
+	}
+	warnf("%v", msg)
+}
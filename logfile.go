@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// logFile is the -log-file destination of the standard logger. It can be
+// reopened after external rotation, or rotate itself once it reaches
+// maxSize bytes, keeping keep old files as path.1 to path.N.
+type logFile struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	failed   bool
+	warnOnce sync.Once
+}
+
+func newLogFile(path string, maxSize int64, keep int) (*logFile, error) {
+	l := &logFile{path: path, maxSize: maxSize, keep: keep}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *logFile) open() error {
+	f, err := openLogFile(l.path)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.f, l.size, l.failed = f, fi.Size(), false
+	return nil
+}
+
+// Reopen closes and reopens the file, for use after it has been rotated.
+func (l *logFile) Reopen() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.open(); err != nil {
+		l.fallback(err)
+	}
+}
+
+// Write writes p to the file, falling back to stderr if that fails.
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			l.fallback(err)
+		}
+	}
+	if !l.failed {
+		n, err := l.f.Write(p)
+		l.size += int64(n)
+		if err == nil {
+			return n, nil
+		}
+		l.fallback(err)
+	}
+	return os.Stderr.Write(p)
+}
+
+// rotate shifts path.N-1 to path.N and so on, moves the current file to
+// path.1 and starts a new one.
+func (l *logFile) rotate() error {
+	if l.keep <= 0 {
+		os.Remove(l.path)
+		return l.open()
+	}
+	os.Remove(fmt.Sprintf("%s.%d", l.path, l.keep))
+	for i := l.keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// fallback switches output to stderr until the next successful reopen,
+// warning about it only the first time.
+func (l *logFile) fallback(err error) {
+	l.failed = true
+	l.warnOnce.Do(func() {
+		fmt.Fprintf(os.Stderr, "Cannot write to log file %s, logging to stderr: %v\n", l.path, err)
+	})
+}
+
+// setupLogFile sends the standard logger's output to path.
+func setupLogFile(path string, maxSize int64, keep int) error {
+	lf, err := newLogFile(path, maxSize, keep)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(lf)
+	onReload(lf.Reopen)
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// Log levels for -log-level, least verbose first. Output asked for
+// explicitly, such as -log-queries, -trace-domain and statistics dumps, is
+// logged whatever the level.
+const (
+	levelError int32 = iota
+	levelWarn
+	levelInfo
+	levelDebug
+)
+
+var levelNames = []string{"error", "warn", "info", "debug"}
+
+// logLevel is the current level, which a reload may change.
+var logLevel = levelInfo
+
+// parseLogLevel returns the level named by name.
+func parseLogLevel(name string) (int32, error) {
+	for level, n := range levelNames {
+		if n == name {
+			return int32(level), nil
+		}
+	}
+	return 0, fmt.Errorf("-log-level must be error, warn, info or debug")
+}
+
+// setLogLevel applies -log-level, -debug and -quiet. -debug raises the
+// level to debug, and -quiet then lowers it to warn at most.
+func setLogLevel() error {
+	level, err := parseLogLevel(*logLevelName)
+	if err != nil {
+		return err
+	}
+	if *debug {
+		level = levelDebug
+	}
+	if *quiet && level > levelWarn {
+		level = levelWarn
+	}
+	atomic.StoreInt32(&logLevel, level)
+	return nil
+}
+
+// logAt reports whether messages at level are logged.
+func logAt(level int32) bool {
+	return atomic.LoadInt32(&logLevel) >= level
+}
+
+func errorf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+func warnf(format string, v ...interface{}) {
+	if logAt(levelWarn) {
+		log.Printf(format, v...)
+	}
+}
+
+func infof(format string, v ...interface{}) {
+	if logAt(levelInfo) {
+		log.Printf(format, v...)
+	}
+}
+
+func debugf(format string, v ...interface{}) {
+	if logAt(levelDebug) {
+		log.Printf(format, v...)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Names under local. belong to Multicast DNS (RFC 6762) and are never sent
+// upstream. With -mdns they are resolved with one-shot multicast queries
+// on the LAN; otherwise, or when nothing answers, they are NXDOMAIN.
+
+// mdnsGroups are the multicast addresses of mDNS, by network.
+var mdnsGroups = map[string]string{
+	"udp4": "224.0.0.251:5353",
+	"udp6": "[ff02::fb]:5353",
+}
+
+// mdnsCacheFlush is the cache-flush bit mDNS sets in the class of records.
+const mdnsCacheFlush = 1 << 15
+
+// mdnsTypes are the query types resolved with mDNS. Others are NXDOMAIN.
+var mdnsTypes = map[uint16]bool{
+	dns.TypeA:    true,
+	dns.TypeAAAA: true,
+	dns.TypePTR:  true,
+	dns.TypeSRV:  true,
+	dns.TypeTXT:  true,
+}
+
+// isLocalName reports whether a normalized name is in the mDNS zone local.
+func isLocalName(name string) bool {
+	return name == "local." || strings.HasSuffix(name, ".local.")
+}
+
+// answerLocal answers queries for local. names, from mDNS if enabled. It
+// returns false for other names.
+func answerLocal(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) bool {
+	q := req.Question[0]
+	name := normalizeName(q.Name)
+	if !isLocalName(name) {
+		return false
+	}
+	if !*mdns || !mdnsTypes[q.Qtype] {
+		writeFailure(w, req, dns.RcodeNameError)
+		return true
+	}
+	answer, extra := queryMDNS(ctx, name, q.Qtype)
+	if len(answer) == 0 {
+		metrics.MDNSQueries.With("unanswered").Inc()
+		debugf("mDNS: no answer for %s %s", name, dns.Type(q.Qtype))
+		writeFailure(w, req, dns.RcodeNameError)
+		return true
+	}
+	metrics.MDNSQueries.With("answered").Inc()
+	resp := newFailure(req, dns.RcodeSuccess)
+	resp.Authoritative = true
+	resp.Answer = answer
+	resp.Extra = append(extra, resp.Extra...)
+	if err := w.WriteMsg(resp); err != nil {
+		errorf("Error writing DNS response: %v", err)
+	}
+	return true
+}
+
+// queryMDNS sends a one-shot query for name on every mDNS group and collects
+// the matching records answered within -mdns-timeout. A and AAAA names are
+// unique on the link, so the first answer is taken; PTR, SRV and TXT
+// answers are merged from every responder.
+func queryMDNS(ctx context.Context, name string, qtype uint16) (answer, extra []dns.RR) {
+	ctx, cancel := context.WithTimeout(ctx, *mdnsTimeout)
+	defer cancel()
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.RecursionDesired = false
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, nil
+	}
+
+	replies := make(chan *dns.Msg)
+	for network, group := range mdnsGroups {
+		go mdnsExchange(ctx, network, group, packed, replies)
+	}
+	seen := make(map[string]bool)
+	for {
+		select {
+		case <-ctx.Done():
+			return answer, extra
+		case r := <-replies:
+			for _, rr := range r.Answer {
+				h := rr.Header()
+				h.Class &^= mdnsCacheFlush
+				if normalizeName(h.Name) != name || h.Rrtype != qtype || seen[rr.String()] {
+					continue
+				}
+				seen[rr.String()] = true
+				answer = append(answer, rr)
+			}
+			for _, rr := range r.Extra {
+				if rr.Header().Rrtype != dns.TypeOPT {
+					rr.Header().Class &^= mdnsCacheFlush
+					extra = append(extra, rr)
+				}
+			}
+			if len(answer) > 0 && (qtype == dns.TypeA || qtype == dns.TypeAAAA) {
+				return answer, extra
+			}
+		}
+	}
+}
+
+// mdnsExchange sends a query to an mDNS group from an ephemeral port, so
+// responders answer it by unicast, and passes on the replies until ctx is
+// done.
+func mdnsExchange(ctx context.Context, network, group string, query []byte, replies chan<- *dns.Msg) {
+	var lc net.ListenConfig
+	if *mdnsInterface != "" {
+		control, err := bindToDevice(*mdnsInterface)
+		if err != nil {
+			debugf("mDNS: %v", err)
+			return
+		}
+		lc.Control = control
+		if network == "udp6" {
+			group = "[ff02::fb%" + *mdnsInterface + "]:5353"
+		}
+	}
+	conn, err := lc.ListenPacket(ctx, network, ":0")
+	if err != nil {
+		debugf("mDNS: %v", err)
+		return
+	}
+	defer conn.Close()
+	addr, err := net.ResolveUDPAddr(network, group)
+	if err != nil {
+		return
+	}
+	if _, err := conn.WriteTo(query, addr); err != nil {
+		debugf("mDNS: sending to %s: %v", group, err)
+		return
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetReadDeadline(deadline)
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		r := new(dns.Msg)
+		if r.Unpack(buf[:n]) != nil || !r.Response {
+			continue
+		}
+		select {
+		case replies <- r:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
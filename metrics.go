@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upper bounds in seconds of the upstream request duration histogram.
+var durationBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// counterVec is a family of counters distinguished by label values.
+type counterVec struct {
+	labels []string
+
+	mu       sync.RWMutex
+	counters map[string]*counter
+}
+
+func newCounterVec(labels ...string) *counterVec {
+	return &counterVec{labels: labels, counters: make(map[string]*counter)}
+}
+
+// With returns the counter for the given label values, in label order.
+func (v *counterVec) With(values ...string) *counter {
+	key := strings.Join(values, "\xff")
+	v.mu.RLock()
+	c := v.counters[key]
+	v.mu.RUnlock()
+	if c != nil {
+		return c
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c = v.counters[key]
+	if c == nil {
+		c = new(counter)
+		v.counters[key] = c
+	}
+	return c
+}
+
+// gaugeVec is a family of gauges distinguished by label values.
+type gaugeVec struct {
+	labels []string
+
+	mu     sync.RWMutex
+	gauges map[string]*gauge
+}
+
+func newGaugeVec(labels ...string) *gaugeVec {
+	return &gaugeVec{labels: labels, gauges: make(map[string]*gauge)}
+}
+
+func (v *gaugeVec) With(values ...string) *gauge {
+	key := strings.Join(values, "\xff")
+	v.mu.RLock()
+	g := v.gauges[key]
+	v.mu.RUnlock()
+	if g != nil {
+		return g
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	g = v.gauges[key]
+	if g == nil {
+		g = new(gauge)
+		v.gauges[key] = g
+	}
+	return g
+}
+
+// histogram counts observations into cumulative buckets.
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     uint64 // float64 bits
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) Observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			atomic.AddUint64(&h.counts[i], 1)
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sum, old, sum) {
+			return
+		}
+	}
+}
+
+// histogramVec is a family of histograms distinguished by label values.
+type histogramVec struct {
+	labels  []string
+	buckets []float64
+
+	mu         sync.RWMutex
+	histograms map[string]*histogram
+}
+
+func newHistogramVec(buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{labels: labels, buckets: buckets, histograms: make(map[string]*histogram)}
+}
+
+func (v *histogramVec) With(values ...string) *histogram {
+	key := strings.Join(values, "\xff")
+	v.mu.RLock()
+	h := v.histograms[key]
+	v.mu.RUnlock()
+	if h != nil {
+		return h
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h = v.histograms[key]
+	if h == nil {
+		h = newHistogram(v.buckets)
+		v.histograms[key] = h
+	}
+	return h
+}
+
+// metrics holds the labelled statistics exported in addition to stats.
+var metrics = struct {
+	Queries          *counterVec
+	QueriesByProto   *counterVec
+	UpstreamDuration *histogramVec
+	UpstreamErrors   *counterVec
+	// Unix time of the last successful request to each endpoint
+	UpstreamLastSuccess *gaugeVec
+
+	// Queries for type ANY, by the -refuse-any policy applied
+	AnyQueries *counterVec
+	// Config file reloads, by result
+	ConfigReloads *counterVec
+	// How long UDP queries waited for a worker
+	UDPQueueWait *histogramVec
+	// Batches of -ipset additions, by result
+	IPSetUpdates *counterVec
+	// -policy-hook decisions, by action, and failures
+	PolicyHook *counterVec
+	// Upstream connections made, by the address family that won the race
+	UpstreamConnections *counterVec
+	// Queries resolved with -mdns, by whether a responder answered
+	MDNSQueries *counterVec
+	// Switches of the upstream request method after repeated 4xx errors
+	UpstreamMethodSwitches *counterVec
+	// Endpoints taken out of service and back, by the new state
+	UpstreamTransitions *counterVec
+	// -watchdog self-test queries, by result
+	WatchdogChecks *counterVec
+	// Blocked queries, by the source of the block
+	BlockedQueries *counterVec
+
+	// Health probes are kept apart from client traffic
+	ProbeDuration    *histogramVec
+	ProbeErrors      *counterVec
+	ProbeLastSuccess *gaugeVec
+}{
+	Queries:                newCounterVec("qtype", "rcode"),
+	QueriesByProto:         newCounterVec("proto"),
+	AnyQueries:             newCounterVec("action"),
+	ConfigReloads:          newCounterVec("result"),
+	UDPQueueWait:           newHistogramVec(durationBuckets),
+	IPSetUpdates:           newCounterVec("result"),
+	PolicyHook:             newCounterVec("action"),
+	MDNSQueries:            newCounterVec("result"),
+	UpstreamConnections:    newCounterVec("family"),
+	UpstreamMethodSwitches: newCounterVec("endpoint", "method"),
+	UpstreamTransitions:    newCounterVec("endpoint", "state"),
+	WatchdogChecks:         newCounterVec("result"),
+	BlockedQueries:         newCounterVec("source"),
+	UpstreamDuration:       newHistogramVec(durationBuckets, "endpoint"),
+	UpstreamErrors:         newCounterVec("endpoint", "class"),
+	UpstreamLastSuccess:    newGaugeVec("endpoint"),
+	ProbeDuration:          newHistogramVec(durationBuckets, "endpoint"),
+	ProbeErrors:            newCounterVec("endpoint", "class"),
+	ProbeLastSuccess:       newGaugeVec("endpoint"),
+}
+
+// observeUpstream records a successful request to endpoint and how long it
+// took, including reading the body.
+func observeUpstream(endpoint string, start time.Time) {
+	now := time.Now()
+	metrics.UpstreamDuration.With(endpoint).Observe(now.Sub(start).Seconds())
+	if *adaptiveTimeout {
+		endpointLatency(endpoint).observe(now.Sub(start))
+	}
+	atomic.StoreInt64(&metrics.UpstreamLastSuccess.With(endpoint).v, now.Unix())
+	markEndpointUp(endpoint)
+}
+
+// upstreamLatency returns the mean duration of successful requests to
+// endpoint, and false if there have been none.
+func upstreamLatency(endpoint string) (time.Duration, bool) {
+	h := metrics.UpstreamDuration.With(endpoint)
+	count := atomic.LoadUint64(&h.count)
+	if count == 0 {
+		return 0, false
+	}
+	mean := math.Float64frombits(atomic.LoadUint64(&h.sum)) / float64(count)
+	return time.Duration(mean * float64(time.Second)), true
+}
+
+// upstreamFailed counts a failed request to endpoint under class.
+func upstreamFailed(endpoint, class string) {
+	metrics.UpstreamErrors.With(endpoint, class).Inc()
+	// With adaptive timeouts, a slow but working endpoint may time out now
+	// and then; only repeated timeouts mean it is down
+	if *adaptiveTimeout && (class == errClassDeadline || class == errClassTimeout) && !timedOut(endpoint) {
+		return
+	}
+	markEndpointFailed(endpoint)
+}
+
+// countQuery counts a query by its type and the rcode of the response it
+// got, if any, and by the transport it arrived over.
+func countQuery(req *dns.Msg, rec *responseRecorder) {
+	qtype, rcode := "none", "none"
+	if len(req.Question) > 0 {
+		qtype = typeString(req.Question[0].Qtype)
+	}
+	if rec.msg != nil {
+		rcode = dns.RcodeToString[rec.msg.Rcode]
+	}
+	metrics.Queries.With(qtype, rcode).Inc()
+	metrics.QueriesByProto.With(clientProto(rec)).Inc()
+	queryMinutes.Inc()
+}
+
+// typeString names a query type, keeping the label set bounded.
+func typeString(qtype uint16) string {
+	if s, ok := dns.TypeToString[qtype]; ok {
+		return s
+	}
+	return "other"
+}
+
+// responseRecorder is a dns.ResponseWriter which keeps the response written,
+// the upstream asked and why the response is a failure if it is one.
+type responseRecorder struct {
+	dns.ResponseWriter
+	msg      *dns.Msg
+	upstream string
+	reason   string
+	// blocked is set when the answer carries the Blocked extended error
+	blocked bool
+	// comment is the upstream's Comment on the answer
+	comment string
+}
+
+func (w *responseRecorder) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// addMetrics serves Prometheus metrics on the admin listener on addr.
+func addMetrics(addr string) {
+	adminMux(addr, "metrics").HandleFunc("/metrics", handleMetrics)
+}
+
+func handleMetrics(hw http.ResponseWriter, r *http.Request) {
+	hw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(hw)
+	writeMetrics(bw)
+	bw.Flush()
+}
+
+// writeMetrics writes all metrics in the Prometheus text exposition format.
+func writeMetrics(w io.Writer) {
+	writeBuildInfo(w)
+	writeCounterVec(w, "doh_proxy_queries_total", "Queries answered, by query type and response code.",
+		metrics.Queries)
+	writeCounterVec(w, "doh_proxy_queries_by_proto_total", "Queries answered, by client transport.",
+		metrics.QueriesByProto)
+	writeCounterVec(w, "doh_proxy_any_queries_total", "Queries for type ANY, by -refuse-any action.",
+		metrics.AnyQueries)
+	writeCounterVec(w, "doh_proxy_config_reloads_total", "Config file reloads on SIGHUP, by result.",
+		metrics.ConfigReloads)
+	writeHistogramVec(w, "doh_proxy_upstream_request_duration_seconds",
+		"Duration of successful upstream requests including reading the body.", metrics.UpstreamDuration)
+	writeCounterVec(w, "doh_proxy_upstream_errors_total", "Failed upstream requests, by cause.",
+		metrics.UpstreamErrors)
+	writeGaugeVec(w, "doh_proxy_upstream_last_success_timestamp_seconds",
+		"Unix time of the last successful upstream request.", metrics.UpstreamLastSuccess)
+	writeAdaptiveTimeouts(w)
+	writeCounterVec(w, "doh_proxy_upstream_connections_total", "Connections made to upstream endpoints, by address family.",
+		metrics.UpstreamConnections)
+	writeCounterVec(w, "doh_proxy_upstream_method_switches_total",
+		"Switches of the request method of an endpoint after repeated client errors, by the method switched to.",
+		metrics.UpstreamMethodSwitches)
+	writeCounterVec(w, "doh_proxy_upstream_transitions_total",
+		"Endpoints taken out of service after failing (down) and taken back (up).", metrics.UpstreamTransitions)
+	writeCounterVec(w, "doh_proxy_watchdog_checks_total", "Self-test queries of the -watchdog, by result.",
+		metrics.WatchdogChecks)
+	writeHistogramVec(w, "doh_proxy_udp_queue_wait_seconds",
+		"How long UDP queries waited for a worker.", metrics.UDPQueueWait)
+	writeCounterVec(w, "doh_proxy_ipset_updates_total", "Batches of addresses added to -ipset sets, by result.",
+		metrics.IPSetUpdates)
+	writeCounterVec(w, "doh_proxy_policy_hook_decisions_total", "Decisions of the -policy-hook, by action, or error.",
+		metrics.PolicyHook)
+	writeCounterVec(w, "doh_proxy_blocked_queries_total",
+		"Queries blocked, by source: the policy hook's blocklist, the hook itself, or the upstream endpoint.",
+		metrics.BlockedQueries)
+	writeCounterVec(w, "doh_proxy_mdns_queries_total", "Queries for local. names resolved with -mdns, by result.",
+		metrics.MDNSQueries)
+	writeHistogramVec(w, "doh_proxy_upstream_probe_duration_seconds",
+		"Duration of successful upstream health probes.", metrics.ProbeDuration)
+	writeCounterVec(w, "doh_proxy_upstream_probe_errors_total", "Failed upstream health probes, by cause.",
+		metrics.ProbeErrors)
+	writeGaugeVec(w, "doh_proxy_upstream_probe_last_success_timestamp_seconds",
+		"Unix time of the last successful upstream health probe.", metrics.ProbeLastSuccess)
+
+	for _, m := range []struct {
+		name, help string
+		c          *counter
+	}{
+		{"doh_proxy_handler_panics_total", "Panics recovered while handling queries.", &stats.HandlerPanics},
+		{"doh_proxy_queries_denied_total", "Queries refused or dropped by an access list.", &stats.QueriesDenied},
+		{"doh_proxy_queries_rate_limited_total", "Queries dropped or refused for exceeding -client-qps.", &stats.QueriesRateLimited},
+		{"doh_proxy_responses_rate_limited_total", "UDP responses dropped by response rate limiting.", &stats.ResponsesRateLimited},
+		{"doh_proxy_responses_slipped_total", "UDP responses truncated by response rate limiting.", &stats.ResponsesSlipped},
+		{"doh_proxy_nxdomain_bursts_total", "Clients detected sending bursts of NXDOMAIN queries.", &stats.NXDomainBursts},
+		{"doh_proxy_queries_queued_total", "Queries which waited for an upstream request slot.", &stats.QueriesQueued},
+		{"doh_proxy_queries_rejected_total", "Queries failed for lack of an upstream request slot.", &stats.QueriesRejected},
+		{"doh_proxy_upstream_deduplicated_total", "Queries answered by an identical query's upstream request.", &stats.UpstreamDeduplicated},
+		{"doh_proxy_upstream_hedged_total", "Upstream requests hedged with a second request.", &stats.UpstreamHedged},
+		{"doh_proxy_upstream_hedge_wins_total", "Hedged upstream requests answered first by the second request.", &stats.UpstreamHedgeWins},
+		{"doh_proxy_prefetches_total", "Upstream requests made by -prefetch.", &stats.Prefetches},
+		{"doh_proxy_prefetch_hits_total", "Queries answered by a -prefetch request.", &stats.PrefetchHits},
+		{"doh_proxy_aaaa_filtered_total", "Queries whose IPv6 addresses -filter-aaaa suppressed.", &stats.AAAAFiltered},
+		{"doh_proxy_upstream_bad_content_type_total", "Upstream responses with an unexpected Content-Type.", &stats.UpstreamBadContentType},
+		{"doh_proxy_upstream_body_too_large_total", "Upstream responses exceeding -max-body-size.", &stats.UpstreamBodyTooLarge},
+		{"doh_proxy_udp_queue_rejected_total", "UDP queries answered SERVFAIL because -udp-queue was full.", &stats.UDPQueueRejected},
+		{"doh_proxy_udp_queue_dropped_total", "UDP queries dropped from a full -udp-queue.", &stats.UDPQueueDropped},
+		{"doh_proxy_tcp_connections_rejected_total", "TCP connections refused over -tcp-max-conns.", &stats.TCPConnsRejected},
+		{"doh_proxy_tls_connections_rejected_total", "DNS-over-TLS connections refused over -tls-max-conns.", &stats.TLSConnsRejected},
+		{"doh_proxy_quic_connections_rejected_total", "DNS-over-QUIC connections refused over -quic-max-conns.", &stats.QUICConnsRejected},
+		{"doh_proxy_dnstap_dropped_total", "dnstap messages dropped because the collector was slow or down.", &stats.DnstapDropped},
+		{"doh_proxy_query_log_db_dropped_total", "Queries -query-log-db dropped because writing failed or fell behind.", &stats.QueryDBDropped},
+		{"doh_proxy_otel_spans_dropped_total", "Trace spans dropped because the collector was slow or down.", &stats.OTelSpansDropped},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", m.name, m.help, m.name, m.name, m.c.Value())
+	}
+	for _, m := range []struct {
+		name, help string
+		g          *gauge
+	}{
+		{"doh_proxy_upstream_in_flight", "Upstream requests in progress.", &stats.UpstreamInFlight},
+		{"doh_proxy_rate_limit_clients", "Clients tracked by the -client-qps rate limiter.", &stats.RateLimitClients},
+		{"doh_proxy_nxdomain_bursting_clients", "Clients currently in an NXDOMAIN burst.", &stats.NXDomainBursting},
+		{"doh_proxy_udp_queue_depth", "UDP queries waiting for a worker.", &stats.UDPQueueDepth},
+		{"doh_proxy_tcp_connections", "Open TCP client connections.", &stats.TCPConns},
+		{"doh_proxy_tls_connections", "Open DNS-over-TLS client connections.", &stats.TLSConns},
+		{"doh_proxy_quic_connections", "Open DNS-over-QUIC client connections.", &stats.QUICConns},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", m.name, m.help, m.name, m.name, m.g.Value())
+	}
+}
+
+func writeCounterVec(w io.Writer, name, help string, v *counterVec) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	v.mu.RLock()
+	keys := sortedKeys(v.counters)
+	counters := make([]*counter, len(keys))
+	for i, k := range keys {
+		counters[i] = v.counters[k]
+	}
+	v.mu.RUnlock()
+	for i, k := range keys {
+		fmt.Fprintf(w, "%s{%s} %d\n", name, labelPairs(v.labels, k, ""), counters[i].Value())
+	}
+}
+
+func writeGaugeVec(w io.Writer, name, help string, v *gaugeVec) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.gauges))
+	for k := range v.gauges {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	gauges := make([]*gauge, len(keys))
+	for i, k := range keys {
+		gauges[i] = v.gauges[k]
+	}
+	v.mu.RUnlock()
+	for i, k := range keys {
+		fmt.Fprintf(w, "%s{%s} %d\n", name, labelPairs(v.labels, k, ""), gauges[i].Value())
+	}
+}
+
+func writeHistogramVec(w io.Writer, name, help string, v *histogramVec) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.histograms))
+	for k := range v.histograms {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	histograms := make([]*histogram, len(keys))
+	for i, k := range keys {
+		histograms[i] = v.histograms[k]
+	}
+	v.mu.RUnlock()
+	for i, k := range keys {
+		h := histograms[i]
+		for j, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s} %d\n", name,
+				labelPairs(v.labels, k, fmt.Sprintf("%g", b)), atomic.LoadUint64(&h.counts[j]))
+		}
+		count := atomic.LoadUint64(&h.count)
+		fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, labelPairs(v.labels, k, "+Inf"), count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labelPairs(v.labels, k, ""),
+			math.Float64frombits(atomic.LoadUint64(&h.sum)))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labelPairs(v.labels, k, ""), count)
+	}
+}
+
+func sortedKeys(m map[string]*counter) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelPairs formats the label values joined in key as name="value" pairs,
+// adding an le label for histogram buckets when le is set.
+func labelPairs(labels []string, key, le string) string {
+	values := strings.Split(key, "\xff")
+	pairs := make([]string, 0, len(labels)+1)
+	for i, l := range labels {
+		var v string
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%q", l, v))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=%q", le))
+	}
+	return strings.Join(pairs, ",")
+}
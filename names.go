@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Wire format limits on domain names (RFC 1035 section 2.3.4).
+const (
+	maxLabelLength = 63
+	maxNameLength  = 255
+)
+
+var (
+	errNameInvalid  = errors.New("malformed query name")
+	errNameNotHost  = errors.New("query name has characters outside the hostname set")
+	errNameTooLong  = errors.New("query name longer than 255 bytes")
+	errLabelTooLong = errors.New("query name label longer than 63 bytes")
+	errNameNUL      = errors.New("query name contains a NUL byte")
+)
+
+// checkQueryName validates a query name in presentation format. Names which
+// are structurally invalid, or contain NUL bytes, yield an error that
+// isn't errNameNotHost. Otherwise names with bytes other than letters,
+// digits, hyphens and underscores (as in _dmarc or SRV names), or a leading
+// "*" label, yield errNameNotHost.
+func checkQueryName(name string) error {
+	if name == "." {
+		return nil
+	}
+	wire := 1 // the root label
+	var label []byte
+	var notHost bool
+	endLabel := func() error {
+		if len(label) == 0 {
+			return errNameInvalid
+		}
+		if len(label) > maxLabelLength {
+			return errLabelTooLong
+		}
+		if !(wire == 1 && len(label) == 1 && label[0] == '*') {
+			for _, c := range label {
+				if !hostnameByte(c) {
+					notHost = true
+				}
+			}
+		}
+		wire += 1 + len(label)
+		label = label[:0]
+		return nil
+	}
+
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '.':
+			if err := endLabel(); err != nil {
+				return err
+			}
+			continue
+		case c == '\\':
+			if i+1 >= len(name) {
+				return errNameInvalid
+			}
+			if isDigit(name[i+1]) {
+				if i+3 >= len(name) || !isDigit(name[i+2]) || !isDigit(name[i+3]) {
+					return errNameInvalid
+				}
+				n, _ := strconv.Atoi(name[i+1 : i+4])
+				if n > 0xff {
+					return errNameInvalid
+				}
+				c = byte(n)
+				i += 3
+			} else {
+				c = name[i+1]
+				i++
+			}
+		}
+		if c == 0 {
+			return errNameNUL
+		}
+		label = append(label, c)
+	}
+	if len(label) > 0 {
+		if err := endLabel(); err != nil {
+			return err
+		}
+	}
+	if wire > maxNameLength {
+		return errNameTooLong
+	}
+	if notHost {
+		return errNameNotHost
+	}
+	return nil
+}
+
+func hostnameByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || isDigit(c) || c == '-' || c == '_'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
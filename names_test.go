@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckQueryName(t *testing.T) {
+	label63 := strings.Repeat("a", 63)
+	// 1 + 3*64 + 62 = 255 bytes on the wire
+	name255 := label63 + "." + label63 + "." + label63 + "." + strings.Repeat("b", 61) + "."
+
+	for _, tc := range []struct {
+		name string
+		want error
+	}{
+		{".", nil},
+		{"example.com.", nil},
+		{"example.com", nil},
+		{"_dmarc.example.com.", nil},
+		{"_sip._tcp.example.com.", nil},
+		{"*.example.com.", nil},
+		{"a.*.example.com.", errNameNotHost},
+		{label63 + ".example.com.", nil},
+		{label63 + "a.example.com.", errLabelTooLong},
+		{name255, nil},
+		{"c" + name255, errLabelTooLong},
+		{"c." + name255, errNameTooLong},
+		{"a\\000b.example.com.", errNameNUL},
+		{"\\000.example.com.", errNameNUL},
+		{"a\\.b.example.com.", errNameNotHost},
+		{"a\\\\b.example.com.", errNameNotHost},
+		{"\\097bc.example.com.", nil},
+		// An escape is one byte of its label
+		{label63[1:] + "\\..example.com.", errNameNotHost},
+		{label63 + "\\..example.com.", errLabelTooLong},
+		{label63[3:] + "\\097\\098\\099.example.com.", nil},
+		{"a b.example.com.", errNameNotHost},
+		{"a..example.com.", errNameInvalid},
+		{"..", errNameInvalid},
+		{"example.com\\", errNameInvalid},
+		{"a\\25.example.com.", errNameInvalid},
+		{"a\\256.example.com.", errNameInvalid},
+	} {
+		if got := checkQueryName(tc.name); got != tc.want {
+			t.Errorf("checkQueryName(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// How many clients the NXDOMAIN burst detector tracks at once. Others
+	// go unwatched until there is room.
+	nxdomainMaxClients = 10000
+	// How many of a client's failing names a burst warning shows.
+	nxdomainSampleSize = 5
+)
+
+// nxdomains watches for clients producing bursts of NXDOMAIN answers, as
+// malware trying domain-generation algorithm names does. It is nil when
+// -nxdomain-burst is unset.
+var nxdomains *nxdomainDetector
+
+// nxdomainDetector counts NXDOMAIN answers per client over a sliding
+// window, approximated from counts in the current and previous windows.
+type nxdomainDetector struct {
+	threshold int
+	window    time.Duration
+
+	mu      sync.Mutex
+	clients map[[16]byte]*nxdomainClient
+}
+
+type nxdomainClient struct {
+	start     time.Time // of the current window
+	cur, prev int
+	sample    []string
+	bursting  bool
+}
+
+func newNXDomainDetector(threshold int, window time.Duration) *nxdomainDetector {
+	d := &nxdomainDetector{
+		threshold: threshold,
+		window:    window,
+		clients:   make(map[[16]byte]*nxdomainClient),
+	}
+	go d.sweep()
+	return d
+}
+
+// advance moves c's windows forward to now.
+func (d *nxdomainDetector) advance(c *nxdomainClient, now time.Time) {
+	switch elapsed := now.Sub(c.start); {
+	case elapsed >= 2*d.window:
+		c.start, c.prev, c.cur = now, 0, 0
+	case elapsed >= d.window:
+		c.start, c.prev, c.cur = c.start.Add(d.window), c.cur, 0
+	}
+}
+
+// rate estimates the NXDOMAINs in the window ending at now.
+func (d *nxdomainDetector) rate(c *nxdomainClient, now time.Time) int {
+	frac := float64(now.Sub(c.start)) / float64(d.window)
+	return c.cur + int(float64(c.prev)*(1-frac))
+}
+
+// Record counts an NXDOMAIN answer for name to the client at ip.
+func (d *nxdomainDetector) Record(ip net.IP, name string) {
+	var key [16]byte
+	copy(key[:], ip.To16())
+	now := time.Now()
+
+	d.mu.Lock()
+	c := d.clients[key]
+	if c == nil {
+		if len(d.clients) >= nxdomainMaxClients {
+			d.mu.Unlock()
+			return
+		}
+		c = &nxdomainClient{start: now}
+		d.clients[key] = c
+	}
+	d.advance(c, now)
+	c.cur++
+	if len(c.sample) < nxdomainSampleSize {
+		c.sample = append(c.sample, name)
+	}
+	n := d.rate(c, now)
+	started := !c.bursting && n >= d.threshold
+	var sample []string
+	if started {
+		c.bursting = true
+		sample = c.sample
+		stats.NXDomainBursting.Inc()
+	}
+	d.mu.Unlock()
+
+	if started {
+		stats.NXDomainBursts.Inc()
+		warnf("NXDOMAIN burst: client=%s nxdomains=%d window=%s sample=%s",
+			nxdomainClientName(ip), n, d.window, strings.Join(sample, ","))
+	}
+}
+
+// Bursting reports whether the client at ip is in an NXDOMAIN burst.
+func (d *nxdomainDetector) Bursting(ip net.IP) bool {
+	var key [16]byte
+	copy(key[:], ip.To16())
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := d.clients[key]
+	return c != nil && c.bursting
+}
+
+// sweep ends bursts which have died down and forgets quiet clients.
+func (d *nxdomainDetector) sweep() {
+	for range time.Tick(d.window / 2) {
+		now := time.Now()
+		var ended []net.IP
+		d.mu.Lock()
+		for key, c := range d.clients {
+			d.advance(c, now)
+			if c.bursting && d.rate(c, now) < d.threshold {
+				c.bursting = false
+				stats.NXDomainBursting.Dec()
+				ended = append(ended, net.IP(append([]byte(nil), key[:]...)))
+			}
+			if c.cur == 0 && c.prev == 0 && !c.bursting {
+				delete(d.clients, key)
+			} else if c.cur == 0 {
+				// Sample names from the burst in progress only
+				c.sample = nil
+			}
+		}
+		d.mu.Unlock()
+		for _, ip := range ended {
+			infof("NXDOMAIN burst ended: client=%s", nxdomainClientName(ip))
+		}
+	}
+}
+
+func nxdomainClientName(ip net.IP) string {
+	if name := anonymizeAddrString(ip); name != "" {
+		return name
+	}
+	return "-"
+}
+
+// nxdomainLimitHandler holds clients of next in an NXDOMAIN burst to the
+// rate allowed by l.
+func nxdomainLimitHandler(d *nxdomainDetector, l *clientLimiter, next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if ip := addrIP(w.RemoteAddr()); ip != nil && d.Bursting(ip) && !l.Allow(ip) {
+			hasCookie, _ := queryCookieState(w)
+			rejectRateLimited(w, req, hasCookie)
+			return
+		}
+		next.ServeDNS(w, req)
+	})
+}
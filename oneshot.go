@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// queryList collects the names of repeated -query flags.
+type queryList []string
+
+func (q *queryList) String() string { return strings.Join(*q, ",") }
+
+func (q *queryList) Set(name string) error {
+	*q = append(*q, name)
+	return nil
+}
+
+var oneShotQueries queryList
+
+func init() {
+	flag.Var(&oneShotQueries, "query",
+		"Resolve this name through the configured pipeline, print the answer and exit (repeatable)")
+}
+
+// runQueries resolves each name through the registered handlers as if it
+// had been sent by a local client, printing the responses in the format
+// dig uses. It returns the exit status: 0 if every query got NOERROR,
+// otherwise the rcode of the first that didn't.
+func runQueries(names []string, qtypeName string) int {
+	qtype, err := parseQType(qtypeName)
+	if err != nil {
+		fmt.Println("-qtype:", err)
+		return 2
+	}
+	status := 0
+	for _, name := range names {
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(name), qtype)
+		req.SetEdns0(ednsUDPSize, false)
+
+		loopback := &net.TCPAddr{IP: net.IPv6loopback}
+		w := &httpResponseWriter{local: loopback, remote: loopback}
+		start := time.Now()
+		dns.DefaultServeMux.ServeDNS(w, req)
+		elapsed := time.Since(start)
+
+		rcode := dns.RcodeServerFailure
+		if w.msg == nil {
+			fmt.Printf(";; no response for %s\n", req.Question[0].Name)
+		} else {
+			rcode = w.msg.Rcode
+			fmt.Println(w.msg)
+		}
+		fmt.Printf(";; UPSTREAM: %s\n;; Query time: %d msec\n\n", upstreamEndpoint(), elapsed/time.Millisecond)
+		if rcode != dns.RcodeSuccess && status == 0 {
+			status = rcode
+		}
+	}
+	return status
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// How many finished spans may wait for export before new ones are dropped.
+	otelQueueSize = 2048
+	// Spans are exported in batches of up to this many, at least this often.
+	otelBatchSize     = 512
+	otelBatchInterval = 5 * time.Second
+	otelExportTimeout = 10 * time.Second
+
+	otelServiceName = "dns-over-https-proxy"
+)
+
+// OTLP span kinds.
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+)
+
+// tracer exports sampled query spans to -otel-endpoint, or is nil when
+// tracing is off.
+var tracer *otelTracer
+
+// span is one timed operation in a trace.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]interface{}
+	failed   bool
+}
+
+type spanKey struct{}
+
+// spanFromContext returns the span carried by ctx, or nil.
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// SetAttr records an attribute on the span. A nil span ignores it.
+func (s *span) SetAttr(key string, value interface{}) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+// Fail marks the span as having ended in error.
+func (s *span) Fail() {
+	if s != nil {
+		s.failed = true
+	}
+}
+
+// End finishes the span and queues it for export.
+func (s *span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	tracer.queue(s)
+}
+
+// traceparent returns the W3C Trace Context header value for the span.
+func (s *span) traceparent() string {
+	return fmt.Sprintf("00-%x-%x-01", s.traceID, s.spanID)
+}
+
+type otelTracer struct {
+	url   string
+	ratio float64
+	spans chan *span
+
+	mu     sync.Mutex
+	rand   *mrand.Rand
+	logger *logEvery
+}
+
+// newOTelTracer starts exporting spans over OTLP/HTTP with JSON encoding to
+// endpoint, sampling the given ratio of queries.
+func newOTelTracer(endpoint string, ratio float64) *otelTracer {
+	t := &otelTracer{
+		url:    strings.TrimRight(endpoint, "/") + "/v1/traces",
+		ratio:  ratio,
+		spans:  make(chan *span, otelQueueSize),
+		rand:   mrand.New(mrand.NewSource(time.Now().UnixNano())),
+		logger: newLogEvery(time.Minute),
+	}
+	go t.run()
+	return t
+}
+
+// startQuery starts a root span for a client query if it is sampled,
+// returning ctx carrying it. A nil tracer never samples.
+func (t *otelTracer) startQuery(ctx context.Context, name string) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	t.mu.Lock()
+	sampled := t.rand.Float64() < t.ratio
+	t.mu.Unlock()
+	if !sampled {
+		return ctx, nil
+	}
+	s := newSpan(name, spanKindServer)
+	rand.Read(s.traceID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// endQuerySpan records the query and its outcome on a root span and ends it.
+func endQuerySpan(s *span, req *dns.Msg, rec *responseRecorder) {
+	if s == nil {
+		return
+	}
+	if len(req.Question) > 0 {
+		s.SetAttr("dns.question.name", normalizeName(req.Question[0].Name))
+		s.SetAttr("dns.question.type", dns.Type(req.Question[0].Qtype).String())
+	}
+	if client := clientAddr(rec); client != "" {
+		s.SetAttr("client.address", client)
+	}
+	s.SetAttr("network.transport", clientProto(rec))
+	if rec.msg != nil {
+		s.SetAttr("dns.response.code", dns.RcodeToString[rec.msg.Rcode])
+		if rec.msg.Rcode == dns.RcodeServerFailure {
+			s.Fail()
+		}
+	}
+	if rec.reason != "" {
+		s.SetAttr("error.message", rec.reason)
+	}
+	s.End()
+}
+
+// startChild starts a span under the one in ctx, if any.
+func startChild(ctx context.Context, name string, kind int) *span {
+	parent := spanFromContext(ctx)
+	if parent == nil {
+		return nil
+	}
+	s := newSpan(name, kind)
+	s.traceID = parent.traceID
+	s.parentID = parent.spanID
+	return s
+}
+
+func newSpan(name string, kind int) *span {
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: make(map[string]interface{})}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+func (t *otelTracer) queue(s *span) {
+	select {
+	case t.spans <- s:
+	default:
+		stats.OTelSpansDropped.Inc()
+	}
+}
+
+func (t *otelTracer) run() {
+	ticker := time.NewTicker(otelBatchInterval)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < otelBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.export(batch); err != nil {
+			stats.OTelSpansDropped.Add(uint64(len(batch)))
+			t.logger.Printf("Cannot export spans to %s: %v", t.url, err)
+		}
+		batch = nil
+	}
+}
+
+var otelClient = &http.Client{Timeout: otelExportTimeout}
+
+func (t *otelTracer) export(batch []*span) error {
+	spans := make([]map[string]interface{}, len(batch))
+	for i, s := range batch {
+		spans[i] = s.otlp()
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttrs(map[string]interface{}{"service.name": otelServiceName}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": otelServiceName},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := otelClient.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+// otlp returns the span in the OTLP JSON encoding.
+func (s *span) otlp() map[string]interface{} {
+	m := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttrs(s.attrs),
+	}
+	if s.parentID != [8]byte{} {
+		m["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	if s.failed {
+		m["status"] = map[string]interface{}{"code": 2}
+	}
+	return m
+}
+
+func otlpAttrs(attrs map[string]interface{}) []interface{} {
+	var out []interface{}
+	for k, v := range attrs {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, map[string]interface{}{"key": k, "value": value})
+	}
+	return out
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// checkPidfile refuses to start if path names a running instance of this
+// program. A file left behind by a crash or naming some other process is
+// stale, and is overwritten later by writePidfile.
+func checkPidfile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("-pidfile: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 || pid == os.Getpid() {
+		return nil
+	}
+	if processIsUs(pid) {
+		return fmt.Errorf("-pidfile: %s says the proxy is already running as pid %d", path, pid)
+	}
+	infof("Replacing stale pidfile %s (pid %d)", path, pid)
+	return nil
+}
+
+// writePidfile writes our pid to path atomically, readable by all.
+func writePidfile(path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("cannot write -pidfile %s: %v", path, err)
+	}
+	_, err = fmt.Fprintf(tmp, "%d\n", os.Getpid())
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("cannot write -pidfile %s: %v", path, err)
+	}
+	return nil
+}
+
+// removePidfile removes path if it still holds our pid.
+func removePidfile(path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		warnf("Cannot remove pidfile: %v", err)
+	}
+}
+
+// ourName is the name of this program as the process table shows it.
+func ourName() string {
+	exe, err := os.Executable()
+	if err != nil {
+		exe = os.Args[0]
+	}
+	return filepath.Base(exe)
+}
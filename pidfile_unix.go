@@ -0,0 +1,34 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// processIsUs reports whether pid is a live process running this program.
+// Where /proc is unavailable any live process counts.
+func processIsUs(pid int) bool {
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		return false
+	}
+	if exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid)); err == nil {
+		return filepath.Base(strings.TrimSuffix(exe, " (deleted)")) == ourName()
+	}
+	// The kernel keeps the first 15 bytes of the name in comm
+	comm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return true
+	}
+	name := ourName()
+	if len(name) > 15 {
+		name = name[:15]
+	}
+	return strings.TrimSpace(string(comm)) == name
+}
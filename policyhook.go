@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Policy hook verbs.
+const (
+	hookAllow   = "allow"
+	hookBlock   = "block"
+	hookRewrite = "rewrite"
+	hookRoute   = "route"
+)
+
+// hookQuery is what the proxy posts to the -policy-hook URL for each query.
+type hookQuery struct {
+	Client string `json:"client"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	// The upstream group the query would go to
+	Group string `json:"group"`
+}
+
+// hookDecision is the policy hook's answer. Rcode is for block (NXDOMAIN
+// by default), with Source and Rule naming the blocklist and the entry the
+// name matched, Addresses and TTL for rewrite, Group for route. Cache is
+// how many seconds the decision may be reused for the same client, name
+// and type.
+type hookDecision struct {
+	Action    string   `json:"action"`
+	Rcode     string   `json:"rcode,omitempty"`
+	Source    string   `json:"source,omitempty"`
+	Rule      string   `json:"rule,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+	TTL       uint32   `json:"ttl,omitempty"`
+	Group     string   `json:"group,omitempty"`
+	Cache     int      `json:"cache,omitempty"`
+}
+
+// hookRewriteTTL is the TTL of rewritten answers if the hook gives none.
+const hookRewriteTTL = 60
+
+// hookCacheMax bounds the decisions held for reuse.
+const hookCacheMax = 10000
+
+type hookCacheEntry struct {
+	decision *hookDecision
+	expires  time.Time
+}
+
+var (
+	hookClient = &http.Client{}
+
+	hookCacheMu sync.Mutex
+	hookCache   = make(map[string]hookCacheEntry)
+)
+
+// consultHook asks the -policy-hook what to do with req, answering it if
+// the hook blocks or rewrites it. It returns the upstream group for the
+// query otherwise, and false if the query has been answered.
+func consultHook(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, group *upstreamGroup) (*upstreamGroup, bool) {
+	if *policyHook == "" {
+		return group, true
+	}
+	q := hookQuery{
+		Name:  normalizeName(req.Question[0].Name),
+		Type:  typeString(req.Question[0].Qtype),
+		Group: group.name,
+	}
+	if ip := addrIP(w.RemoteAddr()); ip != nil {
+		q.Client = ip.String()
+	}
+
+	d, err := hookDecide(ctx, q)
+	if err == nil && d.Action == hookRoute {
+		if g, ok := lookupGroup(d.Group); ok {
+			group = g
+		} else {
+			err = fmt.Errorf("no upstream group named %q", d.Group)
+		}
+	}
+	if err != nil {
+		metrics.PolicyHook.With("error").Inc()
+		if *policyHookFail == "open" {
+			warnf("Policy hook failed, allowing %s: %v", q.Name, err)
+			return group, true
+		}
+		warnf("Policy hook failed, refusing %s: %v", q.Name, err)
+		writeFailure(w, req, dns.RcodeRefused, newEDE(edeProhibited, "policy hook unavailable"))
+		return nil, false
+	}
+	metrics.PolicyHook.With(d.Action).Inc()
+	debugf("Policy hook: %s %s for %s: %s", q.Name, q.Type, q.Client, d.Action)
+
+	switch d.Action {
+	case hookBlock:
+		rcode := dns.RcodeNameError
+		if d.Rcode != "" {
+			rcode = dns.StringToRcode[strings.ToUpper(d.Rcode)]
+		}
+		topBlocked.Add(q.Name)
+		counted := hookBlockSource(d.Source)
+		source := d.Source
+		if source == "" {
+			source = counted
+		}
+		recordBlock(w, q.Name, source, counted, d.Rule)
+		writeFailure(w, req, rcode, newEDE(edeBlocked, "blocked by policy"))
+		return nil, false
+	case hookRewrite:
+		resp := newFailure(req, dns.RcodeSuccess)
+		resp.Answer = rewriteAnswers(req.Question[0], d)
+		if err := w.WriteMsg(resp); err != nil {
+			errorf("Error writing DNS response: %v", err)
+		}
+		return nil, false
+	}
+	return group, true
+}
+
+// hookDecide returns the hook's decision for q, from the cache if the hook
+// allowed that.
+func hookDecide(ctx context.Context, q hookQuery) (*hookDecision, error) {
+	key := q.Client + " " + q.Name + " " + q.Type
+	hookCacheMu.Lock()
+	entry, ok := hookCache[key]
+	hookCacheMu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.decision, nil
+	}
+
+	d, err := callHook(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if d.Cache > 0 {
+		hookCacheMu.Lock()
+		if len(hookCache) >= hookCacheMax {
+			now := time.Now()
+			for k, e := range hookCache {
+				if now.After(e.expires) {
+					delete(hookCache, k)
+				}
+			}
+		}
+		if len(hookCache) < hookCacheMax {
+			hookCache[key] = hookCacheEntry{d, time.Now().Add(time.Duration(d.Cache) * time.Second)}
+		}
+		hookCacheMu.Unlock()
+	}
+	return d, nil
+}
+
+func callHook(ctx context.Context, q hookQuery) (*hookDecision, error) {
+	ctx, cancel := context.WithTimeout(ctx, *policyHookTimeout)
+	defer cancel()
+	body, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	httpreq, err := http.NewRequestWithContext(ctx, "POST", *policyHook, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpreq.Header.Set("Content-Type", "application/json")
+	httpresp, err := hookClient.Do(httpreq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpresp.Body.Close()
+	data, err := ioutil.ReadAll(limitBody(httpresp.Body))
+	if err != nil {
+		return nil, err
+	}
+	if httpresp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %s", httpresp.Status)
+	}
+	d := new(hookDecision)
+	if err := json.Unmarshal(data, d); err != nil {
+		return nil, err
+	}
+	switch d.Action {
+	case hookAllow, hookRoute:
+	case hookBlock:
+		if _, ok := dns.StringToRcode[strings.ToUpper(d.Rcode)]; d.Rcode != "" && !ok {
+			return nil, fmt.Errorf("unknown rcode %q", d.Rcode)
+		}
+	case hookRewrite:
+		for _, a := range d.Addresses {
+			if net.ParseIP(a) == nil {
+				return nil, fmt.Errorf("bad address %q", a)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %q", d.Action)
+	}
+	return d, nil
+}
+
+// rewriteAnswers returns the records of a rewrite decision that answer q:
+// its IPv4 addresses for A, its IPv6 addresses for AAAA, none otherwise.
+func rewriteAnswers(q dns.Question, d *hookDecision) []dns.RR {
+	ttl := d.TTL
+	if ttl == 0 {
+		ttl = hookRewriteTTL
+	}
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: ttl}
+	var rrs []dns.RR
+	for _, a := range d.Addresses {
+		ip := net.ParseIP(a)
+		switch {
+		case q.Qtype == dns.TypeA && ip.To4() != nil:
+			rrs = append(rrs, &dns.A{Hdr: hdr, A: ip.To4()})
+		case q.Qtype == dns.TypeAAAA && ip.To4() == nil:
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return rrs
+}
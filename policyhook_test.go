@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// hookServer is a policy hook deciding by query name, counting the
+// queries it is asked about.
+func hookServer(t *testing.T, asked *int32) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(asked, 1)
+		var q hookQuery
+		if err := json.NewDecoder(r.Body).Decode(&q); err != nil || q.Client != "192.0.2.7" || q.Group != "default" {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		decisions := map[string]string{
+			"allow.example.":       `{"action":"allow"}`,
+			"block.example.":       `{"action":"block"}`,
+			"refuse.example.":      `{"action":"block","rcode":"refused","source":"corp","rule":"refuse.example"}`,
+			"rewrite.example.":     `{"action":"rewrite","addresses":["192.0.2.9","2001:db8::9"],"ttl":30}`,
+			"route.example.":       `{"action":"route","group":"lan"}`,
+			"nowhere.example.":     `{"action":"route","group":"missing"}`,
+			"cached.example.":      `{"action":"block","cache":60}`,
+			"unknown.example.":     `{"action":"shrug"}`,
+			"slow.example.":        "",
+			"bad-address.example.": `{"action":"rewrite","addresses":["192.0.2.300"]}`,
+		}
+		d, ok := decisions[q.Name]
+		if !ok {
+			http.Error(w, "no decision", http.StatusInternalServerError)
+			return
+		}
+		if q.Name == "slow.example." {
+			select {
+			case <-time.After(5 * time.Second):
+			case <-r.Context().Done():
+			}
+			return
+		}
+		w.Write([]byte(d))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestPolicyHook(t *testing.T) {
+	var asked int32
+	defer func(hook, fail string, timeout time.Duration) {
+		*policyHook, *policyHookFail, *policyHookTimeout = hook, fail, timeout
+	}(*policyHook, *policyHookFail, *policyHookTimeout)
+	hook := hookServer(t, &asked)
+	*policyHookTimeout = 200 * time.Millisecond
+	lan := &upstreamGroup{name: "lan", endpoints: []string{"https://lan.example/resolve"}, policy: policyFailover}
+	activeGroups.Store(groupList{"lan": lan})
+	defer activeGroups.Store(upstreamGroups)
+	defaultGroup := &upstreamGroup{name: "default", endpoints: []string{"https://dns.example/resolve"}, policy: policyFailover}
+
+	consult := func(name string, qtype uint16) (*upstreamGroup, bool, *dns.Msg) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		w := &httpResponseWriter{local: &net.TCPAddr{}, remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 4000}}
+		group, ok := consultHook(context.Background(), w, req, defaultGroup)
+		if ok == (w.msg != nil) {
+			t.Fatalf("%s: consultHook returned %v with response %v", name, ok, w.msg)
+		}
+		return group, ok, w.msg
+	}
+
+	// Off unless configured
+	*policyHook = ""
+	if group, ok, _ := consult("block.example.", dns.TypeA); !ok || group != defaultGroup || asked != 0 {
+		t.Errorf("without -policy-hook: got group %v and %d hook requests, want the query's and none", group, asked)
+	}
+	*policyHook = hook
+
+	for _, fail := range []string{"open", "closed"} {
+		*policyHookFail = fail
+		if group, ok, _ := consult("allow.example.", dns.TypeA); !ok || group != defaultGroup {
+			t.Errorf("allow: got group %v, want the query's", group)
+		}
+		if _, _, resp := consult("block.example.", dns.TypeA); resp == nil || resp.Rcode != dns.RcodeNameError {
+			t.Errorf("block: got %v, want NXDOMAIN", resp)
+		}
+		if _, _, resp := consult("refuse.example.", dns.TypeA); resp == nil || resp.Rcode != dns.RcodeRefused {
+			t.Errorf("block with rcode refused: got %v, want REFUSED", resp)
+		}
+		if group, ok, _ := consult("route.example.", dns.TypeA); !ok || group != lan {
+			t.Errorf("route: got group %v, want lan", group)
+		}
+	}
+
+	// Rewrites answer with the addresses of the query's type
+	for qtype, want := range map[uint16]string{dns.TypeA: "192.0.2.9", dns.TypeAAAA: "2001:db8::9", dns.TypeMX: ""} {
+		_, _, resp := consult("rewrite.example.", qtype)
+		if resp == nil || resp.Rcode != dns.RcodeSuccess {
+			t.Fatalf("rewrite: got %v, want NOERROR", resp)
+		}
+		if want == "" {
+			if len(resp.Answer) != 0 {
+				t.Errorf("rewrite of %s: got %v, want no answer", dns.TypeToString[qtype], resp.Answer)
+			}
+			continue
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != 30 {
+			t.Fatalf("rewrite of %s: got %v, want one record with TTL 30", dns.TypeToString[qtype], resp.Answer)
+		}
+		var got string
+		switch rr := resp.Answer[0].(type) {
+		case *dns.A:
+			got = rr.A.String()
+		case *dns.AAAA:
+			got = rr.AAAA.String()
+		}
+		if got != want {
+			t.Errorf("rewrite of %s: got %v, want %s", dns.TypeToString[qtype], resp.Answer[0], want)
+		}
+	}
+
+	// A decision the hook allows to be cached is reused
+	atomic.StoreInt32(&asked, 0)
+	for i := 0; i < 3; i++ {
+		consult("cached.example.", dns.TypeA)
+	}
+	if n := atomic.LoadInt32(&asked); n != 1 {
+		t.Errorf("asked the hook %d times about a cached decision, want once", n)
+	}
+
+	// Failures are allowed or refused as -policy-hook-fail says
+	for _, name := range []string{"nowhere.example.", "unknown.example.", "slow.example.", "bad-address.example.", "error.example."} {
+		*policyHookFail = "open"
+		if group, ok, _ := consult(name, dns.TypeA); !ok || group != defaultGroup {
+			t.Errorf("%s failing open: got group %v, want the query's", name, group)
+		}
+		*policyHookFail = "closed"
+		if _, _, resp := consult(name, dns.TypeA); resp == nil || resp.Rcode != dns.RcodeRefused {
+			t.Errorf("%s failing closed: got %v, want REFUSED", name, resp)
+		}
+	}
+}
+
+func TestPolicyHookBlockSources(t *testing.T) {
+	var asked int32
+	defer func(hook, sources string) { *policyHook, *blockSources = hook, sources }(*policyHook, *blockSources)
+	*policyHook = hookServer(t, &asked)
+	defaultGroup := &upstreamGroup{name: "default", endpoints: []string{"https://dns.example/resolve"}, policy: policyFailover}
+	count := func(source string) uint64 { return metrics.BlockedQueries.With(source).Value() }
+	block := func(name string) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		w := &httpResponseWriter{local: &net.TCPAddr{}, remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 4000}}
+		if _, ok := consultHook(context.Background(), w, req, defaultGroup); ok {
+			t.Fatalf("%s: not blocked", name)
+		}
+	}
+
+	for _, tc := range []struct {
+		sources, name, counted string
+	}{
+		{"", "refuse.example.", otherSource},
+		{"ads, corp", "refuse.example.", "corp"},
+		{"ads", "block.example.", hookSource},
+	} {
+		*blockSources = tc.sources
+		before, corp := count(tc.counted), count("corp")
+		block(tc.name)
+		if got := count(tc.counted) - before; got != 1 {
+			t.Errorf("-block-sources %q, %s: %q counted %d blocks, want 1", tc.sources, tc.name, tc.counted, got)
+		}
+		if tc.counted != "corp" && count("corp") != corp {
+			t.Errorf("-block-sources %q: an unlisted source got a counter of its own", tc.sources)
+		}
+		if e := recentBlocks()[len(recentBlocks())-1]; tc.name == "refuse.example." && e.Source != "corp" {
+			t.Errorf("-block-sources %q: recent event source %q, want the hook's corp", tc.sources, e.Source)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/wrouesnel/dns-over-https-proxy/dohproxy"
+)
+
+// prefetchHold is how long a prefetched reply waits for the query it was
+// fetched for. Clients that follow an A query with AAAA do so within
+// milliseconds, so this is short enough that the TTLs barely drift.
+const prefetchHold = 5 * time.Second
+
+// typeHTTPS is the HTTPS record type, which the dns package predates.
+const typeHTTPS = 65
+
+// prefetchMax bounds the prefetched replies held at once.
+const prefetchMax = 10000
+
+// prefetchStore holds prefetched replies by flight key until a query takes
+// them or they expire. Each reply is used once; this is not a cache.
+type prefetchStore struct {
+	mu      sync.Mutex
+	replies map[string]*upstreamReply
+	expiry  []prefetchExpiry // in order of expiry
+}
+
+type prefetchExpiry struct {
+	key string
+	at  time.Time
+}
+
+var prefetched = &prefetchStore{replies: make(map[string]*upstreamReply)}
+
+func (s *prefetchStore) put(key string, reply *upstreamReply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for len(s.expiry) > 0 && now.After(s.expiry[0].at) {
+		delete(s.replies, s.expiry[0].key)
+		s.expiry = s.expiry[1:]
+	}
+	if len(s.replies) >= prefetchMax {
+		return
+	}
+	if _, ok := s.replies[key]; !ok {
+		s.expiry = append(s.expiry, prefetchExpiry{key, now.Add(prefetchHold)})
+	}
+	s.replies[key] = reply
+}
+
+// take returns the reply prefetched for key, removing it, or nil.
+func (s *prefetchStore) take(key string) *upstreamReply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reply := s.replies[key]
+	if reply == nil {
+		return nil
+	}
+	delete(s.replies, key)
+	if time.Since(reply.start) > prefetchHold {
+		return nil
+	}
+	return reply
+}
+
+// prefetchFor starts fetching, in the background, the AAAA and with
+// -prefetch-https the HTTPS records of the name req asks for. The replies
+// are held for the client's follow-up queries, which also join the request
+// if it is still in flight. Prefetches never wait for an upstream request
+// slot, and are skipped if none is free.
+func prefetchFor(addr string, subnets ecsSubnets, w dns.ResponseWriter, req *dns.Msg) {
+	var qtypes []uint16
+	if *filterAAAA != filterAAAANoData || !filteringAAAA(normalizeName(req.Question[0].Name)) {
+		qtypes = append(qtypes, dns.TypeAAAA)
+	}
+	if *prefetchHTTPS {
+		qtypes = append(qtypes, typeHTTPS)
+	}
+	for _, qtype := range qtypes {
+		pre := req.Copy()
+		pre.Question[0].Qtype = qtype
+		go prefetchOne(addr, subnets.forType(qtype), w, pre)
+	}
+}
+
+func prefetchOne(addr, ecs string, w dns.ResponseWriter, req *dns.Msg) {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	builder, err := requestBuilder(addr)
+	if err != nil {
+		return
+	}
+	httpreq, err := builder.NewRequest(ctx, req, ecs)
+	if err != nil {
+		return
+	}
+	if !tryUpstreamSlot() {
+		return
+	}
+	defer releaseUpstreamSlot()
+
+	// The reply is stored before the flight ends, so that a query which
+	// joined it can remove it again
+	key := flightKey(addr, httpreq)
+	upstreamFlights.Do(ctx, key, func(ctx context.Context) *upstreamReply {
+		stats.UpstreamInFlight.Inc()
+		defer stats.UpstreamInFlight.Dec()
+		stats.Prefetches.Inc()
+		reply := fetch(ctx, addr, httpreq.WithContext(ctx), w, req, nil)
+		reply.prefetched = true
+		if reply.json != nil {
+			if tap != nil {
+				tapForwarder(dnstapForwarderResponse, dohproxy.NewResponse(req, reply.json), reply.start)
+			}
+			prefetched.put(key, reply)
+		}
+		return reply
+	})
+}
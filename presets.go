@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Response formats of a preset's endpoints.
+const (
+	formatJSON = "json"
+	formatWire = "wire"
+)
+
+// presetGroupName is the upstream group -preset defines.
+const presetGroupName = "preset"
+
+// upstreamPreset describes a public DNS-over-HTTPS provider.
+type upstreamPreset struct {
+	// endpoints are the provider's JSON API, with any parameters it needs
+	endpoints []string
+	format    string
+	// bootstrap are the addresses of the endpoints' host, so that it needs
+	// no lookup through a resolver that may be this proxy
+	bootstrap []string
+	// ecs is whether the provider uses the client subnet it is sent
+	ecs  bool
+	note string
+}
+
+// presets are the providers -preset knows. Keep them current with the
+// providers' documentation.
+var presets = map[string]upstreamPreset{
+	"google": {
+		endpoints: []string{"https://dns.google/resolve"},
+		format:    formatJSON,
+		bootstrap: []string{"8.8.8.8", "8.8.4.4", "2001:4860:4860::8888", "2001:4860:4860::8844"},
+		ecs:       true,
+	},
+	"cloudflare": {
+		// Cloudflare serves JSON only when asked for it
+		endpoints: []string{"https://cloudflare-dns.com/dns-query?ct=application/dns-json"},
+		format:    formatJSON,
+		bootstrap: []string{"1.1.1.1", "1.0.0.1", "2606:4700:4700::1111", "2606:4700:4700::1001"},
+	},
+	"quad9": {
+		endpoints: []string{"https://dns.quad9.net:5053/dns-query"},
+		format:    formatJSON,
+		bootstrap: []string{"9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9"},
+		note:      "malware blocking; JSON on port 5053",
+	},
+	"quad9-ecs": {
+		endpoints: []string{"https://dns11.quad9.net:5053/dns-query"},
+		format:    formatJSON,
+		bootstrap: []string{"9.9.9.11", "149.112.112.11", "2620:fe::11", "2620:fe::fe:11"},
+		ecs:       true,
+		note:      "malware blocking; JSON on port 5053",
+	},
+	"adguard": {
+		endpoints: []string{"https://dns.adguard-dns.com/resolve"},
+		format:    formatJSON,
+		bootstrap: []string{"94.140.14.14", "94.140.15.15", "2a10:50c0::ad1:ff", "2a10:50c0::ad2:ff"},
+		note:      "ad blocking",
+	},
+	"mullvad": {
+		endpoints: []string{"https://dns.mullvad.net/dns-query"},
+		format:    formatWire,
+		bootstrap: []string{"194.242.2.2", "2a07:e340::2"},
+		note:      "wire format only, not usable by this proxy",
+	},
+}
+
+// presetGroup is the group of the -preset endpoints, or nil without
+// -preset.
+var presetGroup *upstreamGroup
+
+// bootstrapAddrs maps the hosts of the -preset endpoints to their addresses.
+var bootstrapAddrs map[string][]net.IP
+
+// applyPresets expands -preset into the failover group "preset", made the
+// -default unless that was set explicitly, and the bootstrap addresses of
+// its hosts. The other flags apply to the group's queries as usual.
+func applyPresets(names string, defaultSet bool) error {
+	if names == "" {
+		return nil
+	}
+	g := &upstreamGroup{name: presetGroupName, policy: policyFailover}
+	addrs := make(map[string][]net.IP)
+	for _, name := range splitList(names) {
+		p, ok := presets[name]
+		if !ok {
+			return fmt.Errorf("-preset: unknown provider %q, want one of %s", name, strings.Join(presetNames(), ", "))
+		}
+		if p.format != formatJSON {
+			return fmt.Errorf("-preset: %s only serves the DNS wire format, and this proxy speaks the JSON API", name)
+		}
+		g.endpoints = append(g.endpoints, p.endpoints...)
+		for _, endpoint := range p.endpoints {
+			u, err := url.Parse(endpoint)
+			if err != nil {
+				return fmt.Errorf("-preset %s: %v", name, err)
+			}
+			for _, a := range p.bootstrap {
+				addrs[u.Hostname()] = append(addrs[u.Hostname()], net.ParseIP(a))
+			}
+		}
+	}
+	if _, ok := upstreamGroups[presetGroupName]; ok {
+		return fmt.Errorf("-preset: an -upstream-group is already named %s", presetGroupName)
+	}
+	presetGroup, bootstrapAddrs = g, addrs
+	if !defaultSet {
+		*defaultServer = presetGroupName
+	}
+	return nil
+}
+
+// presetsWithoutECS returns the -preset providers which ignore client
+// subnets.
+func presetsWithoutECS(names string) []string {
+	var without []string
+	for _, name := range splitList(names) {
+		if p, ok := presets[name]; ok && !p.ecs {
+			without = append(without, name)
+		}
+	}
+	return without
+}
+
+func presetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writePresets prints the table of presets for -preset list.
+func writePresets(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tFORMAT\tECS\tENDPOINT\tBOOTSTRAP\tNOTES")
+	for _, name := range presetNames() {
+		p := presets[name]
+		ecs := "no"
+		if p.ecs {
+			ecs = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", name, p.format, ecs,
+			strings.Join(p.endpoints, " "), strings.Join(p.bootstrap, " "), p.note)
+	}
+	tw.Flush()
+}
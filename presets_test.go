@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wrouesnel/dns-over-https-proxy/dohproxy"
+)
+
+func TestPresetsAreValid(t *testing.T) {
+	for name, p := range presets {
+		if p.format != formatJSON && p.format != formatWire {
+			t.Errorf("%s: unknown format %q", name, p.format)
+		}
+		if len(p.endpoints) == 0 || len(p.bootstrap) == 0 {
+			t.Errorf("%s: want endpoints and bootstrap addresses", name)
+		}
+		for _, endpoint := range p.endpoints {
+			u, err := url.Parse(endpoint)
+			if err != nil || u.Scheme != "https" || u.Hostname() == "" || net.ParseIP(u.Hostname()) != nil {
+				t.Errorf("%s: endpoint %q is not an https URL with a host name", name, endpoint)
+			}
+			if _, err := dohproxy.NewRequestBuilder(endpoint); err != nil {
+				t.Errorf("%s: endpoint %q: %v", name, endpoint, err)
+			}
+		}
+		for _, a := range p.bootstrap {
+			if net.ParseIP(a) == nil {
+				t.Errorf("%s: bootstrap address %q is not an IP address", name, a)
+			}
+		}
+	}
+}
+
+func TestApplyPresets(t *testing.T) {
+	defer func(d string) { *defaultServer = d }(*defaultServer)
+	t.Cleanup(func() { presetGroup, bootstrapAddrs = nil, nil })
+
+	// Every JSON preset expands on its own
+	for _, name := range presetNames() {
+		presetGroup = nil
+		err := applyPresets(name, true)
+		if presets[name].format == formatWire {
+			if err == nil {
+				t.Errorf("%s: applied a wire format preset", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(presetGroup.endpoints, presets[name].endpoints) {
+			t.Errorf("%s: got endpoints %v, want %v", name, presetGroup.endpoints, presets[name].endpoints)
+		}
+	}
+
+	// Presets compose into one failover group, in order
+	*defaultServer = "https://dns.example/resolve"
+	if err := applyPresets("cloudflare,google", false); err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]string(nil), presets["cloudflare"].endpoints...), presets["google"].endpoints...)
+	if presetGroup.name != presetGroupName || presetGroup.policy != policyFailover || !reflect.DeepEqual(presetGroup.endpoints, want) {
+		t.Errorf("got group %s (%s) of %v, want %s (failover) of %v",
+			presetGroup.name, presetGroup.policy, presetGroup.endpoints, presetGroupName, want)
+	}
+	if *defaultServer != presetGroupName {
+		t.Errorf("-default is %q, want %q", *defaultServer, presetGroupName)
+	}
+	for _, host := range []string{"cloudflare-dns.com", "dns.google"} {
+		if len(bootstrapAddrs[host]) == 0 {
+			t.Errorf("no bootstrap addresses for %s", host)
+		}
+	}
+	if g, err := resolveUpstream(presetGroupName); err != nil || g != presetGroup {
+		t.Errorf("-default %s resolves to %v, %v", presetGroupName, g, err)
+	}
+
+	// An explicit -default overrides the preset's
+	*defaultServer = "https://dns.example/resolve"
+	if err := applyPresets("quad9", true); err != nil {
+		t.Fatal(err)
+	}
+	if *defaultServer != "https://dns.example/resolve" {
+		t.Errorf("-preset replaced the explicit -default with %q", *defaultServer)
+	}
+
+	if err := applyPresets("google,nosuch", false); err == nil || !strings.Contains(err.Error(), `"nosuch"`) {
+		t.Errorf("an unknown preset gave error %v", err)
+	}
+}
+
+func TestPresetsWithoutECS(t *testing.T) {
+	if got, want := presetsWithoutECS("google,cloudflare,quad9-ecs,quad9"), []string{"cloudflare", "quad9"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestWritePresets(t *testing.T) {
+	var b bytes.Buffer
+	writePresets(&b)
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != len(presets)+1 {
+		t.Fatalf("got %d lines, want a header and one per preset:\n%s", len(lines), b.String())
+	}
+	for i, name := range presetNames() {
+		if !strings.HasPrefix(lines[i+1], name+" ") {
+			t.Errorf("line %d is %q, want the %s preset", i+2, lines[i+1], name)
+		}
+	}
+}
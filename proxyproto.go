@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a trusted proxy has to send the PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// Signature starting every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// trustedProxies holds the sources whose PROXY protocol headers are honored.
+var trustedProxies *cidrSet
+
+// proxyProtoListener reads a PROXY protocol (v1 or v2) header from each
+// connection accepted from a trusted proxy, and reports the client address
+// it conveys as the connection's remote address. Connections from other
+// sources are passed through untouched, so a header they send is never
+// believed.
+type proxyProtoListener struct {
+	net.Listener
+	logger *logEvery
+}
+
+func newProxyProtoListener(ln net.Listener) net.Listener {
+	return &proxyProtoListener{Listener: ln, logger: newLogEvery(time.Minute)}
+}
+
+// Accept returns connections straight away; the header is read on the
+// first Read, so that a trusted peer which sends none, such as a load
+// balancer's health check, holds up only its own connection.
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !trustedProxies.Contains(addrIP(c.RemoteAddr())) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c), logger: l.logger, remote: c.RemoteAddr()}, nil
+}
+
+// proxyConn is a connection from a trusted proxy, whose PROXY protocol
+// header is consumed by the first Read. Until then its remote address is
+// the proxy's.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	logger *logEvery
+	once   sync.Once
+	err    error
+
+	mu       sync.Mutex
+	remote   net.Addr
+	deadline time.Time
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.once.Do(c.consumeHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remote
+}
+
+// SetReadDeadline keeps the caller's deadline to restore once the header
+// has been read under its own.
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+// consumeHeader reads the header, within proxyHeaderTimeout, failing every
+// Read if it is bad.
+func (c *proxyConn) consumeHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	remote, err := c.readHeader()
+	c.mu.Lock()
+	if err == nil && remote != nil {
+		c.remote = remote
+	}
+	c.Conn.SetReadDeadline(c.deadline)
+	c.mu.Unlock()
+	if err != nil {
+		c.logger.Printf("Bad PROXY protocol header from %s: %v", c.Conn.RemoteAddr(), err)
+		c.err = fmt.Errorf("bad PROXY protocol header: %v", err)
+	}
+}
+
+// readHeader consumes the header, returning the client address it conveys,
+// or nil to keep the proxy's.
+func (c *proxyConn) readHeader() (net.Addr, error) {
+	sig, err := c.r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return c.readV2()
+	}
+	if p, err := c.r.Peek(6); err == nil && string(p) == "PROXY " {
+		return c.readV1()
+	}
+	return nil, fmt.Errorf("no PROXY protocol header")
+}
+
+// readV1 parses a text header such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 53\r\n".
+func (c *proxyConn) readV1() (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("v1 header too long or not CRLF terminated")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed v1 source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readV2 parses a binary header, skipping any TLVs after the addresses.
+func (c *proxyConn) readV2() (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return nil, err
+	}
+
+	// LOCAL connections are health checks from the proxy itself
+	if hdr[12]&0xf == 0 {
+		return nil, nil
+	}
+	if hdr[12]&0xf != 1 {
+		return nil, fmt.Errorf("unsupported v2 command %d", hdr[12]&0xf)
+	}
+
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, fmt.Errorf("short v2 IPv4 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), body[0:4]...)),
+			Port: int(binary.BigEndian.Uint16(body[8:10])),
+		}, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("short v2 IPv6 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), body[0:16]...)),
+			Port: int(binary.BigEndian.Uint16(body[32:34])),
+		}, nil
+	}
+	// Other families (AF_UNSPEC, AF_UNIX) keep the proxy's own address
+	return nil, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// proxyV2Header builds a v2 header of command cmd and family fam, with
+// addrs and tlvs as its body.
+func proxyV2Header(cmd, fam byte, addrs, tlvs []byte) []byte {
+	b := append([]byte(nil), proxyV2Signature...)
+	b = append(b, 0x20|cmd, fam<<4|1, 0, 0)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(addrs)+len(tlvs)))
+	return append(append(b, addrs...), tlvs...)
+}
+
+func TestProxyProtoHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0, 53}
+	ipv6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::53").To16()...), 0xdc, 0x04, 0, 53)
+	// An ALPN TLV, a NOOP padding TLV and an authority TLV
+	tlvs := []byte{0x01, 0, 2, 'h', '2', 0x04, 0, 3, 0, 0, 0, 0x02, 0, 11}
+	tlvs = append(tlvs, "example.com"...)
+
+	for _, tc := range []struct {
+		name   string
+		header []byte
+		want   string // the remote address, or "" for an error
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 53\r\n"), "192.0.2.1:56324"},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::1 2001:db8::53 56324 53\r\n"), "[2001:db8::1]:56324"},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "203.0.113.9:4000"},
+		{"v1 without CRLF", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 53\n"), ""},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 port 53\r\n"), ""},
+		{"v2 IPv4", proxyV2Header(1, 1, ipv4, nil), "192.0.2.1:56324"},
+		{"v2 IPv4 with TLVs", proxyV2Header(1, 1, ipv4, tlvs), "192.0.2.1:56324"},
+		{"v2 IPv6 with TLVs", proxyV2Header(1, 2, ipv6, tlvs), "[2001:db8::1]:56324"},
+		{"v2 LOCAL", proxyV2Header(0, 1, ipv4, tlvs), "203.0.113.9:4000"},
+		{"v2 AF_UNSPEC", proxyV2Header(1, 0, nil, nil), "203.0.113.9:4000"},
+		{"v2 short IPv4 block", proxyV2Header(1, 1, ipv4[:8], nil), ""},
+		{"v2 short IPv6 block", proxyV2Header(1, 2, ipv6[:32], nil), ""},
+		{"v2 bad command", proxyV2Header(2, 1, ipv4, nil), ""},
+		{"v2 bad version", append(append([]byte(nil), proxyV2Signature...), 0x11, 0x11, 0, 0), ""},
+		{"v2 truncated body", proxyV2Header(1, 1, ipv4, tlvs)[:30], ""},
+		{"no header", []byte("\x00\x1d\x12\x34"), ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// The query following the header must be left to read
+			r := bufio.NewReader(bytes.NewReader(append(tc.header, "query"...)))
+			c := &proxyConn{r: r, remote: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 9), Port: 4000}}
+			remote, err := c.readHeader()
+			if tc.want == "" {
+				if err == nil {
+					t.Fatalf("accepted the header, with remote address %v", remote)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if remote == nil {
+				remote = c.remote
+			}
+			if got := remote.String(); got != tc.want {
+				t.Errorf("got remote address %s, want %s", got, tc.want)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "query" {
+				t.Errorf("left %q after the header, want the query", rest)
+			}
+		})
+	}
+}
+
+func TestProxyProtoListenerTrust(t *testing.T) {
+	defer func(s *cidrSet) { trustedProxies = s }(trustedProxies)
+	header := "PROXY TCP4 192.0.2.1 198.51.100.1 56324 53\r\n"
+
+	for _, tc := range []struct {
+		trusted    string
+		want, read string
+	}{
+		{"127.0.0.1/32", "192.0.2.1", "query"},
+		// The header of an untrusted source is not believed, nor consumed
+		{"192.0.2.0/24", "127.0.0.1", header + "query"},
+	} {
+		trustedProxies, _ = parseCIDRSet(tc.trusted)
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pl := newProxyProtoListener(ln)
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Write([]byte(header + "query"))
+		client.Close()
+
+		c, err := pl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		rest, _ := io.ReadAll(c)
+		c.Close()
+		pl.Close()
+		if got := addrIP(c.RemoteAddr()).String(); got != tc.want {
+			t.Errorf("trusting %s: got remote address %s, want %s", tc.trusted, got, tc.want)
+		}
+		if string(rest) != tc.read {
+			t.Errorf("trusting %s: read %q, want %q", tc.trusted, rest, tc.read)
+		}
+	}
+}
+
+// A trusted peer that connects without sending a header holds up only its
+// own connection, not the clients accepted after it.
+func TestProxyProtoListenerSilentPeer(t *testing.T) {
+	defer func(s *cidrSet) { trustedProxies = s }(trustedProxies)
+	trustedProxies, _ = parseCIDRSet("127.0.0.1/32")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracked := make(chan bool, 1)
+	srv := &dns.Server{
+		Listener: &connListener{newProxyProtoListener(ln)},
+		Net:      "tcp",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			tracked <- lookupConn(w) != nil
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			resp.Answer = append(resp.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+				Txt: []string{w.RemoteAddr().String()},
+			})
+			w.WriteMsg(resp)
+		}),
+	}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	defer srv.Shutdown()
+
+	silent, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Well within proxyHeaderTimeout, which the silent peer keeps up
+	conn.SetDeadline(time.Now().Add(proxyHeaderTimeout / 2))
+	if _, err := conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 53\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeTXT)
+	dc := &dns.Conn{Conn: conn}
+	if err := dc.WriteMsg(req); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := dc.ReadMsg()
+	if err != nil {
+		t.Fatalf("no answer while a silent peer is connected: %v", err)
+	}
+	if txt, ok := resp.Answer[0].(*dns.TXT); !ok || txt.Txt[0] != "192.0.2.1:56324" {
+		t.Errorf("got %v, want the client address from the header", resp.Answer[0])
+	}
+	if !<-tracked {
+		t.Error("the connection is not tracked under the client address")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The -query-log-db writer keeps completed queries in a SQLite database
+// through modernc.org/sqlite, a translation of SQLite to Go, so the binary
+// still needs no cgo to cross compile. Platforms it doesn't support build
+// without the database (see querydb_other.go).
+
+const (
+	// queryDBQueue bounds the records waiting to be written, queued or
+	// held back by a failed write; beyond it the oldest are dropped and
+	// counted.
+	queryDBQueue = 10000
+	// queryDBBatch is how many queued records start a write before the
+	// next tick.
+	queryDBBatch = 1000
+	// queryDBPruneEvery is how often records older than the retention are
+	// deleted.
+	queryDBPruneEvery = 10 * time.Minute
+)
+
+// queryDB is the -query-log-db writer, or nil when that is off.
+var queryDB *queryDBWriter
+
+// queryRecord is a row of the queries table.
+type queryRecord struct {
+	time     time.Time
+	client   string
+	qname    string
+	qtype    string
+	rcode    string
+	upstream string
+	duration time.Duration
+	blocked  bool
+}
+
+// queryStore is the database the records go to.
+type queryStore interface {
+	// write inserts batch in one transaction, first deleting the records
+	// from before prune unless it is zero. On error nothing is written.
+	write(batch []queryRecord, prune time.Time) error
+	Close() error
+}
+
+type queryDBWriter struct {
+	path      string
+	retention time.Duration
+	store     queryStore
+
+	// mu is held for reading while a record is queued, so that Close can
+	// stop the queuing before draining the queue
+	mu      sync.RWMutex
+	closed  bool
+	records chan queryRecord
+	done    chan struct{}
+	warn    *logEvery
+}
+
+// newQueryDB opens the database at path, creating the queries table if
+// needed, and starts writing records to it.
+func newQueryDB(path string, retention time.Duration) (*queryDBWriter, error) {
+	store, err := openQueryStore(path)
+	if err != nil {
+		return nil, err
+	}
+	return startQueryDB(path, retention, store), nil
+}
+
+func startQueryDB(path string, retention time.Duration, store queryStore) *queryDBWriter {
+	db := &queryDBWriter{
+		path:      path,
+		retention: retention,
+		store:     store,
+		records:   make(chan queryRecord, queryDBQueue),
+		done:      make(chan struct{}),
+		warn:      newLogEvery(time.Minute),
+	}
+	go db.run()
+	return db
+}
+
+// Log queues a completed query answered through rec, without waiting.
+func (db *queryDBWriter) Log(req *dns.Msg, rec *responseRecorder, start time.Time) {
+	r := queryRecord{
+		time:     start,
+		client:   clientAddr(rec),
+		upstream: rec.upstream,
+		duration: time.Since(start),
+		blocked:  rec.blocked,
+	}
+	if len(req.Question) > 0 {
+		r.qname = normalizeName(req.Question[0].Name)
+		r.qtype = dns.Type(req.Question[0].Qtype).String()
+	}
+	if rec.msg != nil {
+		r.rcode = dns.RcodeToString[rec.msg.Rcode]
+	}
+	db.queue(r)
+}
+
+func (db *queryDBWriter) queue(r queryRecord) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		stats.QueryDBDropped.Inc()
+		return
+	}
+	select {
+	case db.records <- r:
+	default:
+		stats.QueryDBDropped.Inc()
+	}
+}
+
+// run writes the queued records once a second, or as soon as a batch is
+// full, and prunes old ones. Records a write failed for are kept and
+// written with the next, as the queue allows.
+func (db *queryDBWriter) run() {
+	defer close(db.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var pending []queryRecord
+	failing := false
+	nextPrune := time.Now()
+	for {
+		select {
+		case r, ok := <-db.records:
+			if !ok {
+				db.flush(pending, time.Time{}, true)
+				return
+			}
+			pending = append(pending, r)
+			if len(pending) < queryDBBatch || failing {
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		var prune time.Time
+		if now := time.Now(); now.After(nextPrune) {
+			prune = now.Add(-db.retention)
+			nextPrune = now.Add(queryDBPruneEvery)
+		}
+		if len(pending) > 0 || !prune.IsZero() {
+			pending = db.flush(pending, prune, false)
+			failing = len(pending) > 0
+		}
+	}
+}
+
+// flush writes pending, returning the records left to write: none, or
+// pending if the write failed, less the oldest beyond queryDBQueue. On the
+// last flush a failure drops every record.
+func (db *queryDBWriter) flush(pending []queryRecord, prune time.Time, last bool) []queryRecord {
+	err := db.store.write(pending, prune)
+	if err == nil {
+		return pending[:0]
+	}
+	if last {
+		stats.QueryDBDropped.Add(uint64(len(pending)))
+		errorf("Cannot write %d queries to %s, dropping them: %v", len(pending), db.path, err)
+		return nil
+	}
+	db.warn.Printf("Cannot write %d queries to %s, retrying: %v", len(pending), db.path, err)
+	if over := len(pending) - queryDBQueue; over > 0 {
+		stats.QueryDBDropped.Add(uint64(over))
+		pending = append(pending[:0], pending[over:]...)
+	}
+	return pending
+}
+
+// Close stops queuing records and writes every record queued, then closes
+// the database.
+func (db *queryDBWriter) Close() {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return
+	}
+	db.closed = true
+	close(db.records)
+	db.mu.Unlock()
+	<-db.done
+	if err := db.store.Close(); err != nil {
+		errorf("Cannot close %s: %v", db.path, err)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !((darwin && (amd64 || arm64)) || (freebsd && (386 || amd64 || arm || arm64)) || (linux && (386 || amd64 || arm || arm64 || loong64 || ppc64le || riscv64 || s390x)) || (netbsd && amd64) || (openbsd && (amd64 || arm64)) || (windows && (386 || amd64 || arm64)))
+
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+var errQueryDBUnsupported = errors.New("the query database is not supported on " + runtime.GOOS + "/" + runtime.GOARCH)
+
+func checkQueryDB() error {
+	return errQueryDBUnsupported
+}
+
+func openQueryStore(path string) (queryStore, error) {
+	return nil, errQueryDBUnsupported
+}
@@ -0,0 +1,103 @@
+//go:build (darwin && (amd64 || arm64)) || (freebsd && (386 || amd64 || arm || arm64)) || (linux && (386 || amd64 || arm || arm64 || loong64 || ppc64le || riscv64 || s390x)) || (netbsd && amd64) || (openbsd && (amd64 || arm64)) || (windows && (386 || amd64 || arm64))
+
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// queryDBSchema creates the queries table. time is in Unix seconds and
+// duration_ms in milliseconds; empty columns are NULL.
+const queryDBSchema = `
+CREATE TABLE IF NOT EXISTS queries (
+	time INTEGER NOT NULL,
+	client TEXT,
+	qname TEXT,
+	qtype TEXT,
+	rcode TEXT,
+	upstream TEXT,
+	duration_ms REAL,
+	blocked INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS queries_time ON queries (time);
+CREATE INDEX IF NOT EXISTS queries_client ON queries (client, time);
+`
+
+func checkQueryDB() error {
+	return nil
+}
+
+type sqliteStore struct {
+	db     *sql.DB
+	insert *sql.Stmt
+	prune  *sql.Stmt
+}
+
+// openQueryStore opens the SQLite database at path in WAL mode, so that
+// it can be read while queries are written.
+func openQueryStore(path string) (queryStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// One connection is all the writer needs, and saves SQLite from
+	// locking against itself
+	db.SetMaxOpenConns(1)
+	s := &sqliteStore{db: db}
+	if _, err = db.Exec(queryDBSchema); err == nil {
+		s.insert, err = db.Prepare(`INSERT INTO queries
+			(time, client, qname, qtype, rcode, upstream, duration_ms, blocked)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	}
+	if err == nil {
+		s.prune, err = db.Prepare(`DELETE FROM queries WHERE time < ?`)
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *sqliteStore) write(batch []queryRecord, prune time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if !prune.IsZero() {
+		if _, err := tx.Stmt(s.prune).Exec(prune.Unix()); err != nil {
+			return err
+		}
+	}
+	insert := tx.Stmt(s.insert)
+	for _, r := range batch {
+		_, err := insert.Exec(r.time.Unix(), nullString(r.client), nullString(r.qname),
+			nullString(r.qtype), nullString(r.rcode), nullString(r.upstream),
+			r.duration.Seconds()*1000, r.blocked)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Close() error {
+	for _, stmt := range []*sql.Stmt{s.insert, s.prune} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return s.db.Close()
+}
+
+// nullString is s, or NULL if it is empty.
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
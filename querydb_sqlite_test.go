@@ -0,0 +1,65 @@
+//go:build (darwin && (amd64 || arm64)) || (freebsd && (386 || amd64 || arm || arm64)) || (linux && (386 || amd64 || arm || arm64 || loong64 || ppc64le || riscv64 || s390x)) || (netbsd && amd64) || (openbsd && (amd64 || arm64)) || (windows && (386 || amd64 || arm64))
+
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueryDBSQLite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.db")
+	db, err := newQueryDB(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	db.queue(queryRecord{time: now.Add(-2 * time.Hour), qname: "old.example."})
+	db.queue(queryRecord{time: now, client: "192.0.2.7", qname: "it's.example.", qtype: "A",
+		rcode: "NOERROR", duration: 1500 * time.Microsecond, blocked: true})
+	db.Close()
+
+	conn, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var (
+		n        int
+		client   string
+		qname    string
+		upstream sql.NullString
+		duration float64
+		blocked  bool
+	)
+	if err := conn.QueryRow(`SELECT COUNT(*) FROM queries`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("got %d rows, want both queued by Close", n)
+	}
+	err = conn.QueryRow(`SELECT client, qname, upstream, duration_ms, blocked FROM queries WHERE time = ?`,
+		now.Unix()).Scan(&client, &qname, &upstream, &duration, &blocked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client != "192.0.2.7" || qname != "it's.example." || upstream.Valid || duration != 1.5 || !blocked {
+		t.Errorf("got row %q %q %v %v %v", client, qname, upstream, duration, blocked)
+	}
+
+	// Reopening prunes the old row on the first write
+	db, err = newQueryDB(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	db.Close()
+	if err := conn.QueryRow(`SELECT COUNT(*) FROM queries`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("got %d rows after pruning, want 1", n)
+	}
+}
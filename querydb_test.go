@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyStore is a queryStore keeping the records written to it, failing
+// each write while failing is set.
+type flakyStore struct {
+	mu      sync.Mutex
+	failing bool
+	written []queryRecord
+	closed  bool
+}
+
+func (s *flakyStore) write(batch []queryRecord, prune time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failing {
+		return errors.New("database is locked")
+	}
+	s.written = append(s.written, batch...)
+	return nil
+}
+
+func (s *flakyStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *flakyStore) setFailing(failing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failing = failing
+}
+
+func TestQueryDBCloseDrains(t *testing.T) {
+	store := &flakyStore{}
+	db := startQueryDB("test.db", time.Hour, store)
+	for i := 0; i < queryDBBatch+10; i++ {
+		db.queue(queryRecord{time: time.Now(), qname: "example.com."})
+	}
+	db.Close()
+	if len(store.written) != queryDBBatch+10 || !store.closed {
+		t.Errorf("wrote %d of %d records by Close, closed %v", len(store.written), queryDBBatch+10, store.closed)
+	}
+
+	dropped := stats.QueryDBDropped.Value()
+	db.queue(queryRecord{time: time.Now()})
+	if stats.QueryDBDropped.Value() != dropped+1 {
+		t.Error("a record queued after Close was not counted as dropped")
+	}
+	db.Close()
+}
+
+func TestQueryDBKeepsRecordsAWriteFailedFor(t *testing.T) {
+	store := &flakyStore{failing: true}
+	db := startQueryDB("test.db", time.Hour, store)
+	dropped := stats.QueryDBDropped.Value()
+	for i := 0; i < 3; i++ {
+		db.queue(queryRecord{time: time.Now(), qname: "example.com."})
+	}
+	// Let a tick fail to write them
+	time.Sleep(1500 * time.Millisecond)
+	store.setFailing(false)
+	db.Close()
+	if len(store.written) != 3 {
+		t.Errorf("wrote %d records after the failed write, want all 3", len(store.written))
+	}
+	if stats.QueryDBDropped.Value() != dropped {
+		t.Error("records were dropped for a failed write")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Names of the Extended DNS Error codes used by the proxy.
+var edeNames = map[uint16]string{
+	edeOther:                 "other",
+	edeUnsupportedDNSKEYAlgo: "unsupported DNSKEY algorithm",
+	edeDNSSECBogus:           "DNSSEC bogus",
+	edeSignatureExpired:      "signature expired",
+	edeSignatureNotYetValid:  "signature not yet valid",
+	edeDNSKEYMissing:         "DNSKEY missing",
+	edeRRSIGsMissing:         "RRSIGs missing",
+	edeBlocked:               "blocked",
+	edeCensored:              "censored",
+	edeFiltered:              "filtered",
+	edeProhibited:            "prohibited",
+	edeNoReachableAuthority:  "no reachable authority",
+	edeNetworkError:          "network error",
+	edeInvalidData:           "invalid data",
+}
+
+// hasEDE reports whether opts carry the Extended DNS Error code.
+func hasEDE(opts []dns.EDNS0, code uint16) bool {
+	for _, o := range opts {
+		if ede, ok := o.(*dns.EDNS0_LOCAL); ok && ede.Code == edns0EDE && len(ede.Data) >= 2 &&
+			uint16(ede.Data[0])<<8|uint16(ede.Data[1]) == code {
+			return true
+		}
+	}
+	return false
+}
+
+// failureReason describes the Extended DNS Error among opts, if any.
+func failureReason(opts []dns.EDNS0) string {
+	for _, o := range opts {
+		if ede, ok := o.(*dns.EDNS0_LOCAL); ok && ede.Code == edns0EDE && len(ede.Data) >= 2 {
+			if text := string(ede.Data[2:]); text != "" {
+				return text
+			}
+			return edeNames[uint16(ede.Data[0])<<8|uint16(ede.Data[1])]
+		}
+	}
+	return ""
+}
+
+// logQuery logs a query received from a client, in the style of dnsmasq's
+// log-queries. Callers check -log-queries first.
+func logQuery(w dns.ResponseWriter, req *dns.Msg) {
+	name, qtype := "", "none"
+	if len(req.Question) > 0 {
+		name, qtype = req.Question[0].Name+" ", dns.Type(req.Question[0].Qtype).String()
+	}
+	if client := clientAddr(w); client != "" {
+		log.Printf("query[%s] %sfrom %s", qtype, name, client)
+	} else {
+		log.Printf("query[%s] %s", qtype, name)
+	}
+}
+
+// logReply logs the outcome of a query and the first answer.
+func logReply(req *dns.Msg, rec *responseRecorder) {
+	if len(req.Question) == 0 {
+		return
+	}
+	name := req.Question[0].Name
+	resp := rec.msg
+	switch {
+	case resp == nil:
+		log.Printf("reply %s is <no response>", name)
+	case resp.Rcode == dns.RcodeServerFailure && rec.reason != "":
+		log.Printf("reply %s is SERVFAIL (%s)", name, rec.reason)
+	case resp.Rcode != dns.RcodeSuccess:
+		log.Printf("reply %s is %s", name, dns.RcodeToString[resp.Rcode])
+	case len(resp.Answer) == 0 || resp.Answer[0] == nil:
+		log.Printf("reply %s is NODATA", name)
+	default:
+		rr := resp.Answer[0]
+		if rr.Header().Rrtype == dns.TypeCNAME {
+			log.Printf("reply %s is <CNAME>", name)
+			return
+		}
+		log.Printf("reply %s is %s", name, strings.TrimPrefix(rr.String(), rr.Header().String()))
+	}
+}
+
+// clientAddr returns the client's IP for logging, anonymized as set by
+// -log-anonymize, or its whole address when it has no IP. It returns ""
+// when the client must not be logged.
+func clientAddr(w dns.ResponseWriter) string {
+	if ip := addrIP(w.RemoteAddr()); ip != nil {
+		return anonymizeAddrString(ip)
+	}
+	if *logAnonymize == anonymizeDrop {
+		return ""
+	}
+	return w.RemoteAddr().String()
+}
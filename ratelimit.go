@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// How often idle client buckets are swept from the rate limiter.
+const rateLimitSweepInterval = time.Minute
+
+// clientLimiter is a token bucket rate limiter keyed by client IP.
+type clientLimiter struct {
+	rate   float64 // tokens per second
+	burst  float64
+	exempt *cidrSet
+
+	mu      sync.Mutex
+	buckets map[[16]byte]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newClientLimiter starts a limiter allowing each client rate queries per
+// second on average, and up to burst at once.
+func newClientLimiter(rate float64, burst int, exempt *cidrSet) *clientLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	l := &clientLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		exempt:  exempt,
+		buckets: make(map[[16]byte]*tokenBucket),
+	}
+	go l.sweep()
+	return l
+}
+
+// Allow takes a token from the client's bucket, reporting false if it is
+// empty.
+func (l *clientLimiter) Allow(ip net.IP) bool {
+	if l.exempt.Contains(ip) {
+		return true
+	}
+	var key [16]byte
+	copy(key[:], ip.To16())
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep forgets buckets which have refilled completely, since they are no
+// different from a client's first query.
+func (l *clientLimiter) sweep() {
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for range time.Tick(rateLimitSweepInterval) {
+		now := time.Now()
+		l.mu.Lock()
+		for key, b := range l.buckets {
+			if now.Sub(b.last) >= refill {
+				delete(l.buckets, key)
+			}
+		}
+		stats.RateLimitClients.Set(int64(len(l.buckets)))
+		l.mu.Unlock()
+	}
+}
+
+var rateLimitLogger = newLogEvery(time.Minute)
+
+// rateLimitHandler wraps next so that clients over -client-qps are turned
+// away: dropped over UDP, where a reply could be reflected at a spoofed
+// address, and answered REFUSED over connection-oriented transports.
+// Queries with a valid DNS cookie are exempt, and UDP clients sending only
+// a client cookie are answered BADCOOKIE.
+func rateLimitHandler(l *clientLimiter, next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		ip := addrIP(w.RemoteAddr())
+		hasCookie, validCookie := queryCookieState(w)
+		if ip == nil || validCookie || l.Allow(ip) {
+			next.ServeDNS(w, req)
+			return
+		}
+		rejectRateLimited(w, req, hasCookie)
+	})
+}
+
+// rejectRateLimited turns away a query over a rate limit.
+func rejectRateLimited(w dns.ResponseWriter, req *dns.Msg, hasCookie bool) {
+	stats.QueriesRateLimited.Inc()
+	if client := clientAddr(w); client != "" {
+		rateLimitLogger.Printf("Rate limiting queries from %s", client)
+	} else {
+		rateLimitLogger.Printf("Rate limiting queries from a client")
+	}
+	switch {
+	case w.RemoteAddr().Network() != "udp":
+		writeFailure(w, req, dns.RcodeRefused)
+	case hasCookie:
+		// A small answer handing out a server cookie lets a genuine
+		// client retry past the limit
+		writeFailure(w, req, dns.RcodeBadCookie)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var panicLogger = newLogEvery(time.Minute)
+
+// recoverHandler wraps next so that a panic while handling a query is
+// logged and answered SERVFAIL, rather than taking the process down with
+// it.
+func recoverHandler(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		pw := &panicWriter{ResponseWriter: w}
+		defer func() {
+			if v := recover(); v != nil {
+				stats.HandlerPanics.Inc()
+				buf := make([]byte, 16*1024)
+				buf = buf[:runtime.Stack(buf, false)]
+				panicLogger.Printf("Panic handling query %s: %v\n%s", queryString(req), v, buf)
+				if !pw.wrote {
+					writePanicFailure(w, req)
+				}
+			}
+		}()
+		next.ServeDNS(pw, req)
+	})
+}
+
+// writePanicFailure answers SERVFAIL after a panic, giving up quietly if
+// that panics too.
+func writePanicFailure(w dns.ResponseWriter, req *dns.Msg) {
+	defer func() { recover() }()
+	handleFailed(w, req)
+}
+
+func queryString(req *dns.Msg) string {
+	if len(req.Question) == 0 {
+		return "(no question)"
+	}
+	return req.Question[0].Name + " " + dns.Type(req.Question[0].Qtype).String()
+}
+
+// panicWriter records whether a response was sent.
+type panicWriter struct {
+	dns.ResponseWriter
+	wrote bool
+}
+
+func (w *panicWriter) WriteMsg(m *dns.Msg) error {
+	w.wrote = true
+	return w.ResponseWriter.WriteMsg(m)
+}
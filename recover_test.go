@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRecoverHandler(t *testing.T) {
+	mux := dns.NewServeMux()
+	mux.HandleFunc("panic.example.", func(w dns.ResponseWriter, req *dns.Msg) {
+		var m map[string]int
+		m["boom"]++
+	})
+	mux.HandleFunc("late.example.", func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		w.WriteMsg(resp)
+		panic("after answering")
+	})
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{mustRR(t, req.Question[0].Name+" 300 IN A 192.0.2.1")}
+		w.WriteMsg(resp)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: recoverHandler(mux)}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	panics := stats.HandlerPanics.Value()
+	c := &dns.Client{Timeout: 5 * time.Second}
+	query := func(name string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		resp, _, err := c.Exchange(req, pc.LocalAddr().String())
+		if err != nil {
+			t.Fatalf("query for %s: %v", name, err)
+		}
+		return resp
+	}
+	for i := 0; i < 2; i++ {
+		if resp := query("panic.example."); resp.Rcode != dns.RcodeServerFailure {
+			t.Errorf("got rcode %s from the panicking handler, want SERVFAIL", dns.RcodeToString[resp.Rcode])
+		}
+		if resp := query("example.com."); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+			t.Errorf("got %v after a panic, want the answer", resp)
+		}
+	}
+	// A handler which answered before panicking isn't answered twice
+	w := &countingWriter{ResponseWriter: &httpResponseWriter{local: &net.TCPAddr{}, remote: &net.TCPAddr{}}}
+	req := new(dns.Msg)
+	req.SetQuestion("late.example.", dns.TypeA)
+	recoverHandler(mux).ServeDNS(w, req)
+	if w.writes != 1 || w.msg.Rcode != dns.RcodeSuccess {
+		t.Errorf("got %d responses, the last %v, want only the handler's", w.writes, w.msg)
+	}
+	if got := stats.HandlerPanics.Value() - panics; got != 3 {
+		t.Errorf("counted %d panics, want 3", got)
+	}
+}
+
+// countingWriter counts the responses written to it.
+type countingWriter struct {
+	dns.ResponseWriter
+	writes int
+	msg    *dns.Msg
+}
+
+func (w *countingWriter) WriteMsg(m *dns.Msg) error {
+	w.writes++
+	w.msg = m
+	return nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import "sync"
+
+var (
+	reloadMu    sync.Mutex
+	reloadHooks []func()
+)
+
+// onReload registers a function to be run when the proxy is asked to reload
+// its configuration with SIGHUP.
+func onReload(f func()) {
+	reloadMu.Lock()
+	reloadHooks = append(reloadHooks, f)
+	reloadMu.Unlock()
+}
+
+// reload runs every registered reload hook in registration order.
+func reload() {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	for _, f := range reloadHooks {
+		f()
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// -rotate-answers modes.
+const (
+	rotateOff     = ""
+	rotateCounter = "rotate"
+	rotateShuffle = "shuffle"
+)
+
+// rotation advances once per response in rotate mode. It is kept unsigned
+// through the modulo, as an int would go negative on 32-bit platforms.
+var rotation uint32
+
+// rotateAnswers reorders each set of A or AAAA records with the same owner
+// name in the answer section, so that clients don't all use the first
+// address. The records of a set swap places among themselves; everything
+// else, CNAMEs included, keeps its position.
+func rotateAnswers(resp *dns.Msg) {
+	if *rotateMode == rotateOff || len(resp.Answer) < 2 {
+		return
+	}
+	type rrset struct {
+		name   string
+		rrtype uint16
+	}
+	var sets map[rrset][]int
+	for i, rr := range resp.Answer {
+		h := rr.Header()
+		if h.Rrtype != dns.TypeA && h.Rrtype != dns.TypeAAAA {
+			continue
+		}
+		if sets == nil {
+			sets = make(map[rrset][]int)
+		}
+		key := rrset{strings.ToLower(h.Name), h.Rrtype}
+		sets[key] = append(sets[key], i)
+	}
+
+	n := atomic.AddUint32(&rotation, 1)
+	for _, positions := range sets {
+		if len(positions) < 2 {
+			continue
+		}
+		rrs := make([]dns.RR, len(positions))
+		for i, p := range positions {
+			rrs[i] = resp.Answer[p]
+		}
+		if *rotateMode == rotateShuffle {
+			rand.Shuffle(len(rrs), func(i, j int) { rrs[i], rrs[j] = rrs[j], rrs[i] })
+		}
+		for i, p := range positions {
+			if *rotateMode == rotateShuffle {
+				resp.Answer[p] = rrs[i]
+			} else {
+				resp.Answer[p] = rrs[(uint32(i)+n)%uint32(len(rrs))]
+			}
+		}
+	}
+}
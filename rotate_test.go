@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/wrouesnel/dns-over-https-proxy/dohproxy"
+)
+
+// TestPostProcessingUnknownType runs a response with a record of a type
+// NewRR can't build through the steps that rewrite responses after the
+// upstream's answer, which index every record's header.
+func TestPostProcessingUnknownType(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	rr := func(rrtype int32, data string) dohproxy.DNSRR {
+		return dohproxy.DNSRR{Name: "example.com.", Type: rrtype, TTL: 300, Data: data}
+	}
+	r := &dohproxy.DNSResponseJson{
+		Answer: []dohproxy.DNSRR{
+			rr(int32(dns.TypeA), "192.0.2.1"),
+			rr(65280, "opaque"),
+			rr(int32(dns.TypeAAAA), "2001:db8::1"),
+			rr(int32(dns.TypeA), "192.0.2.2"),
+		},
+		Authority:  []dohproxy.DNSRR{rr(65280, "opaque")},
+		Additional: []dohproxy.DNSRR{rr(65280, "opaque"), rr(int32(dns.TypeAAAA), "2001:db8::2")},
+	}
+
+	defer func(rotate, filter string, answers, bytes int) {
+		*rotateMode, *filterAAAA, *maxAnswers, *maxResponseBytes = rotate, filter, answers, bytes
+	}(*rotateMode, *filterAAAA, *maxAnswers, *maxResponseBytes)
+	*rotateMode, *filterAAAA, *maxAnswers, *maxResponseBytes = rotateCounter, filterAAAAStrip, 2, 64
+
+	resp := dohproxy.NewResponse(req, r)
+	dedupeRecords(resp)
+	stripAAAA(resp, "example.com.")
+	rotateAnswers(resp)
+	overrideTTL(resp, "example.com.", ttlRules{"example.com.": 60})
+	if !capResponse(resp) {
+		t.Fatal("capResponse rejected the response")
+	}
+	truncateForUDP(resp, req)
+	if _, err := resp.Pack(); err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	if len(resp.Answer) != 1 || len(resp.Ns) != 0 || len(resp.Extra) != 0 {
+		t.Errorf("got %d answer, %d authority and %d additional records, want 1, 0 and 0:\n%s",
+			len(resp.Answer), len(resp.Ns), len(resp.Extra), resp)
+	}
+	for _, rr := range resp.Answer {
+		if rr.Header().Ttl != 60 {
+			t.Errorf("%v: TTL not overridden", rr)
+		}
+	}
+}
+
+// rotationAnswer is a CNAME chain to two sets of addresses.
+func rotationAnswer(t *testing.T) []dns.RR {
+	return []dns.RR{
+		mustRR(t, "www.example.com. 300 IN CNAME web.example.com."),
+		mustRR(t, "web.example.com. 300 IN A 192.0.2.1"),
+		mustRR(t, "web.example.com. 300 IN A 192.0.2.2"),
+		mustRR(t, "web.example.com. 300 IN A 192.0.2.3"),
+		mustRR(t, "web.example.com. 300 IN AAAA 2001:db8::1"),
+		mustRR(t, "web.example.com. 300 IN AAAA 2001:db8::2"),
+	}
+}
+
+func TestRotateAnswers(t *testing.T) {
+	defer func(mode string, n uint32) { *rotateMode, rotation = mode, n }(*rotateMode, rotation)
+
+	for _, mode := range []string{rotateCounter, rotateShuffle} {
+		*rotateMode = mode
+		orders := make(map[string]bool)
+		for i := 0; i < 50; i++ {
+			in := rotationAnswer(t)
+			resp := new(dns.Msg)
+			resp.SetQuestion("www.example.com.", dns.TypeA)
+			resp.Answer = append([]dns.RR(nil), in...)
+			rotateAnswers(resp)
+
+			// The same records, each set keeping its positions
+			if resp.Answer[0] != in[0] {
+				t.Fatalf("%s: the CNAME moved: %v", mode, resp.Answer)
+			}
+			seen := make(map[dns.RR]bool)
+			for j, rr := range resp.Answer {
+				if rr.Header().Rrtype != in[j].Header().Rrtype {
+					t.Fatalf("%s: got %v at %d, want a %s", mode, rr, j, dns.TypeToString[in[j].Header().Rrtype])
+				}
+				seen[rr] = true
+			}
+			for _, rr := range in {
+				if !seen[rr] {
+					t.Fatalf("%s: lost %v: %v", mode, rr, resp.Answer)
+				}
+			}
+			orders[fmt.Sprint(resp.Answer)] = true
+		}
+		// rotate cycles through 3 orders of the A records and 2 of the
+		// AAAA ones; shuffle reaches at least as many in 50 tries
+		if len(orders) < 6 {
+			t.Errorf("%s: %d different orders in 50 responses, want at least 6", mode, len(orders))
+		}
+	}
+
+	*rotateMode = rotateOff
+	resp := new(dns.Msg)
+	resp.Answer = rotationAnswer(t)
+	want := fmt.Sprint(resp.Answer)
+	rotateAnswers(resp)
+	if got := fmt.Sprint(resp.Answer); got != want {
+		t.Errorf("reordered with rotation off: %s", got)
+	}
+}
+
+// The counter wraps past 2^31 and 2^32 without indexing out of range.
+func TestRotateAnswersWrap(t *testing.T) {
+	defer func(mode string, n uint32) { *rotateMode, rotation = mode, n }(*rotateMode, rotation)
+	*rotateMode = rotateCounter
+	for _, start := range []uint32{1<<31 - 2, 1<<32 - 2} {
+		rotation = start
+		for i := 0; i < 4; i++ {
+			resp := new(dns.Msg)
+			resp.Answer = rotationAnswer(t)
+			rotateAnswers(resp)
+		}
+	}
+}
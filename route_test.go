@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRouteTwoQuestions(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.Question = append(req.Question, dns.Question{Name: "example.net.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+	w := &httpResponseWriter{local: &net.TCPAddr{}, remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 7)}}
+	route(w, req)
+	if w.msg == nil || w.msg.Rcode != dns.RcodeFormatError {
+		t.Fatalf("got %v, want FORMERR", w.msg)
+	}
+	if len(w.msg.Question) != 2 {
+		t.Errorf("got question %v, want both echoed", w.msg.Question)
+	}
+}
+
+func TestTrustUpstreamAD(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/dns-json")
+		w.Write([]byte(`{"Status":0,"AD":true,"Question":[{"name":"ad.example.com.","type":1}],` +
+			`"Answer":[{"name":"ad.example.com.","type":1,"TTL":0,"data":"192.0.2.1"}]}`))
+	}))
+	defer srv.Close()
+	upstream.Store(&upstreamGroup{name: "default", endpoints: []string{srv.URL + "/resolve"}, policy: policyFailover})
+	defer func(trust bool) { *trustUpstreamAD = trust }(*trustUpstreamAD)
+
+	for _, trust := range []bool{true, false} {
+		*trustUpstreamAD = trust
+		req := new(dns.Msg)
+		req.SetQuestion("ad.example.com.", dns.TypeA)
+		req.SetEdns0(1232, true)
+		w := &httpResponseWriter{local: &net.TCPAddr{}, remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 7)}}
+		route(w, req)
+		if w.msg == nil || len(w.msg.Answer) != 1 {
+			t.Fatalf("got %v, want one answer", w.msg)
+		}
+		if w.msg.AuthenticatedData != trust {
+			t.Errorf("-trust-upstream-ad=%v: got AD %v", trust, w.msg.AuthenticatedData)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// How many (client network, response) pairs response rate limiting tracks.
+// New pairs beyond this are answered without being accounted for.
+const rrlMaxEntries = 100000
+
+// responseLimiter implements response rate limiting (RRL) in the style of
+// BIND: identical responses to one client network are limited to a number
+// per second, and the excess is dropped or, every slip'th time, replaced
+// by an empty truncated response so a genuine client retries over TCP.
+type responseLimiter struct {
+	limit  int
+	slip   int
+	v4Mask net.IPMask
+	v6Mask net.IPMask
+	exempt *cidrSet
+
+	mu      sync.Mutex
+	entries map[string]*rrlEntry
+}
+
+type rrlEntry struct {
+	window  int64
+	count   int
+	dropped int
+}
+
+// newResponseLimiter allows limit identical responses per second to each
+// client network, grouping clients by the given prefix lengths.
+func newResponseLimiter(limit, slip, v4Prefix, v6Prefix int, exempt *cidrSet) *responseLimiter {
+	return &responseLimiter{
+		limit:   limit,
+		slip:    slip,
+		v4Mask:  net.CIDRMask(v4Prefix, 32),
+		v6Mask:  net.CIDRMask(v6Prefix, 128),
+		exempt:  exempt,
+		entries: make(map[string]*rrlEntry),
+	}
+}
+
+// RRL decisions.
+const (
+	rrlPass = iota
+	rrlDrop
+	rrlTruncate
+)
+
+// Check accounts for sending resp to ip and decides what to do with it.
+func (l *responseLimiter) Check(ip net.IP, resp *dns.Msg) int {
+	if l.exempt.Contains(ip) {
+		return rrlPass
+	}
+	key := l.key(ip, resp)
+	now := time.Now().Unix()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := l.entries[key]
+	if e == nil {
+		if len(l.entries) >= rrlMaxEntries {
+			l.expire(now)
+			if len(l.entries) >= rrlMaxEntries {
+				return rrlPass
+			}
+		}
+		e = &rrlEntry{window: now}
+		l.entries[key] = e
+	}
+	if e.window != now {
+		e.window, e.count = now, 0
+	}
+	e.count++
+	if e.count <= l.limit {
+		return rrlPass
+	}
+	e.dropped++
+	if l.slip > 0 && e.dropped%l.slip == 0 {
+		return rrlTruncate
+	}
+	return rrlDrop
+}
+
+// expire forgets entries from earlier windows.
+func (l *responseLimiter) expire(now int64) {
+	for key, e := range l.entries {
+		if e.window != now {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// key identifies the client network and the response sent to it. Answers
+// are told apart by name and type, NXDOMAIN by the zone which denied the
+// name so that random subdomains count together, and errors by rcode alone.
+func (l *responseLimiter) key(ip net.IP, resp *dns.Msg) string {
+	var b strings.Builder
+	if ip4 := ip.To4(); ip4 != nil {
+		b.Write(ip4.Mask(l.v4Mask))
+	} else {
+		b.Write(ip.To16().Mask(l.v6Mask))
+	}
+	b.WriteByte(byte(resp.Rcode))
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+		if len(resp.Question) > 0 {
+			q := resp.Question[0]
+			b.WriteByte(byte(q.Qtype >> 8))
+			b.WriteByte(byte(q.Qtype))
+			b.WriteString(normalizeName(q.Name))
+		}
+	case dns.RcodeNameError:
+		zone := ""
+		for _, rr := range resp.Ns {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				zone = rr.Header().Name
+				break
+			}
+		}
+		if zone == "" && len(resp.Question) > 0 {
+			zone = resp.Question[0].Name
+		}
+		b.WriteString(normalizeName(zone))
+	}
+	return b.String()
+}
+
+// sweep periodically forgets entries from past windows.
+func (l *responseLimiter) sweep() {
+	for range time.Tick(rateLimitSweepInterval) {
+		l.mu.Lock()
+		l.expire(time.Now().Unix())
+		l.mu.Unlock()
+	}
+}
+
+// rrlHandler applies response rate limiting to UDP clients of next. TCP
+// clients and those returning a valid DNS cookie can't have spoofed their
+// address, so they are never limited.
+func rrlHandler(l *responseLimiter, next dns.Handler) dns.Handler {
+	go l.sweep()
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		hasCookie, validCookie := queryCookieState(w)
+		if w.RemoteAddr().Network() == "udp" && !validCookie {
+			if ip := addrIP(w.RemoteAddr()); ip != nil {
+				w = &rrlWriter{ResponseWriter: w, limiter: l, ip: ip, hasCookie: hasCookie}
+			}
+		}
+		next.ServeDNS(w, req)
+	})
+}
+
+// rrlWriter holds back responses over the rate limit.
+type rrlWriter struct {
+	dns.ResponseWriter
+	limiter   *responseLimiter
+	ip        net.IP
+	hasCookie bool
+}
+
+func (w *rrlWriter) WriteMsg(m *dns.Msg) error {
+	switch w.limiter.Check(w.ip, m) {
+	case rrlDrop:
+		stats.ResponsesRateLimited.Inc()
+		if logAt(levelDebug) {
+			log.Println("Dropping rate limited response to", w.ip)
+		}
+		return nil
+	case rrlTruncate:
+		stats.ResponsesSlipped.Inc()
+		tc := new(dns.Msg)
+		tc.SetReply(m)
+		tc.Rcode = m.Rcode
+		if w.hasCookie {
+			// The client can retry over UDP with the cookie it gets
+			tc.Rcode = dns.RcodeBadCookie
+		} else {
+			tc.Truncated = true
+		}
+		tc.RecursionAvailable = m.RecursionAvailable
+		return w.ResponseWriter.WriteMsg(tc)
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
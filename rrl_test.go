@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rrlBurst sends n identical queries through h, each from the address
+// addr(i), and counts the responses passed, slipped (truncated) and
+// dropped.
+func rrlBurst(h dns.Handler, n int, addr func(i int) string) (passed, slipped, dropped int) {
+	for i := 0; i < n; i++ {
+		w := &httpResponseWriter{
+			local:  &net.UDPAddr{IP: net.IPv4(192, 0, 2, 53), Port: 53},
+			remote: &net.UDPAddr{IP: net.ParseIP(addr(i)), Port: 5353},
+		}
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		h.ServeDNS(w, req)
+		switch {
+		case w.msg == nil:
+			dropped++
+		case w.msg.Truncated && len(w.msg.Answer) == 0:
+			slipped++
+		default:
+			passed++
+		}
+	}
+	return
+}
+
+// untilNextSecond sleeps into the next RRL window.
+func untilNextSecond() {
+	now := time.Now()
+	time.Sleep(now.Truncate(time.Second).Add(time.Second + 10*time.Millisecond).Sub(now))
+}
+
+func TestResponseRateLimit(t *testing.T) {
+	exempt, _ := parseCIDRSet("127.0.0.0/8,203.0.113.0/24")
+	answer := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.RecursionAvailable = true
+		resp.Answer = append(resp.Answer, mustRR(t, "www.example.com. 300 IN A 192.0.2.1"))
+		w.WriteMsg(resp)
+	})
+	// 5 identical responses per second, every second one over the limit
+	// slipped
+	h := rrlHandler(newResponseLimiter(5, 2, 24, 56, exempt), answer)
+
+	untilNextSecond()
+	for _, tc := range []struct {
+		name                     string
+		addr                     func(i int) string
+		passed, slipped, dropped int
+	}{
+		// Every host of the /24 counts together: of the 15 over the limit,
+		// each second one slips
+		{"a /24", func(i int) string { return fmt.Sprintf("192.0.2.%d", i+1) }, 5, 7, 8},
+		{"a /56", func(i int) string { return fmt.Sprintf("2001:db8:0:ff%02x::%d", i, i+1) }, 5, 7, 8},
+		// Another network has its own allowance
+		{"another /24", func(i int) string { return "198.51.100.1" }, 5, 7, 8},
+		{"an exempt /24", func(i int) string { return fmt.Sprintf("203.0.113.%d", i+1) }, 20, 0, 0},
+		{"an exempt address", func(i int) string { return "127.0.0.1" }, 20, 0, 0},
+	} {
+		passed, slipped, dropped := rrlBurst(h, 20, tc.addr)
+		if passed != tc.passed || slipped != tc.slipped || dropped != tc.dropped {
+			t.Errorf("burst of 20 from %s: %d passed, %d slipped and %d dropped, want %d, %d and %d",
+				tc.name, passed, slipped, dropped, tc.passed, tc.slipped, tc.dropped)
+		}
+	}
+
+	// The next window starts afresh
+	untilNextSecond()
+	for _, addr := range []string{"192.0.2.1", "2001:db8:0:ff00::1"} {
+		passed, slipped, dropped := rrlBurst(h, 5, func(int) string { return addr })
+		if passed != 5 {
+			t.Errorf("%s in the next second: %d passed, %d slipped and %d dropped, want all passed",
+				addr, passed, slipped, dropped)
+		}
+	}
+}
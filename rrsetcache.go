@@ -0,0 +1,172 @@
+package main
+
+import (
+	"container/list"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// anyCacheNames bounds the names -refuse-any=cache keeps RRsets for.
+const anyCacheNames = 10000
+
+// anyCache holds the RRsets -refuse-any=cache answers ANY from, or is nil
+// in the other modes.
+var anyCache *rrsetCache
+
+// rrsetCache keeps the answer RRsets of recent upstream responses by owner
+// name and type, until their TTLs run out. It only serves ANY queries:
+// every other query still goes upstream. It is given the upstream's TTLs,
+// before -ttl-override, which is applied to the records as they are
+// served; a reload of the rules thus applies to what is cached.
+//
+// Answers are kept apart by rrsetScope, and beyond max names the least
+// recently used is dropped.
+type rrsetCache struct {
+	max   int
+	mu    sync.Mutex
+	names map[string]*list.Element // of *cachedName, by scope and name
+	lru   list.List                // most recently used first
+}
+
+type cachedName struct {
+	key   string
+	types map[uint16]cachedRRset
+}
+
+type cachedRRset struct {
+	rrs     []dns.RR
+	expires time.Time
+}
+
+func newRRsetCache(max int) *rrsetCache {
+	return &rrsetCache{max: max, names: make(map[string]*list.Element)}
+}
+
+// rrsetScope tells apart the queries the upstream may answer differently
+// for the same name: those with the Checking Disabled bit, and those with
+// an EDNS Client Subnet option, by the subnet passed on.
+func rrsetScope(req *dns.Msg) string {
+	scope := ""
+	if req.CheckingDisabled {
+		scope = "cd "
+	}
+	if opt := req.IsEdns0(); opt != nil && !*privacyECS {
+		for _, o := range opt.Option {
+			if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+				bits := 128
+				if e.Family == 1 {
+					bits = 32
+				}
+				addr := e.Address
+				if int(e.SourceNetmask) <= bits {
+					addr = addr.Mask(net.CIDRMask(int(e.SourceNetmask), bits))
+				}
+				scope += addr.String() + "/" + strconv.Itoa(int(e.SourceNetmask)) + " "
+			}
+		}
+	}
+	return scope
+}
+
+// Add keeps the answer RRsets of a successful response to req, replacing
+// those kept for the same name and type. Records with a TTL of 0 are left
+// out.
+func (c *rrsetCache) Add(req, resp *dns.Msg) {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) == 0 {
+		return
+	}
+	type key struct {
+		name   string
+		rrtype uint16
+	}
+	sets := make(map[key][]dns.RR)
+	minTTL := make(map[key]uint32)
+	for _, rr := range resp.Answer {
+		h := rr.Header()
+		if h.Ttl == 0 {
+			continue
+		}
+		k := key{normalizeName(h.Name), h.Rrtype}
+		if ttl, ok := minTTL[k]; !ok || h.Ttl < ttl {
+			minTTL[k] = h.Ttl
+		}
+		sets[k] = append(sets[k], dns.Copy(rr))
+	}
+
+	scope := rrsetScope(req)
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, rrs := range sets {
+		name := c.lookup(scope + k.name)
+		if name == nil {
+			if c.lru.Len() >= c.max {
+				c.remove(c.lru.Back())
+			}
+			name = &cachedName{key: scope + k.name, types: make(map[uint16]cachedRRset)}
+			c.names[name.key] = c.lru.PushFront(name)
+		}
+		name.types[k.rrtype] = cachedRRset{rrs: rrs, expires: now.Add(time.Duration(minTTL[k]) * time.Second)}
+	}
+}
+
+// lookup returns the entry for key, marking it as the most recently used,
+// or nil.
+func (c *rrsetCache) lookup(key string) *cachedName {
+	e := c.names[key]
+	if e == nil {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedName)
+}
+
+func (c *rrsetCache) remove(e *list.Element) {
+	delete(c.names, e.Value.(*cachedName).key)
+	c.lru.Remove(e)
+}
+
+// Get returns copies of the unexpired RRsets kept for the name queried by
+// req, in type order, with their remaining TTLs.
+func (c *rrsetCache) Get(req *dns.Msg) []dns.RR {
+	key := rrsetScope(req) + normalizeName(req.Question[0].Name)
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name := c.lookup(key)
+	if name == nil {
+		return nil
+	}
+	var rrtypes []int
+	for rrtype, set := range name.types {
+		if now.Before(set.expires) {
+			rrtypes = append(rrtypes, int(rrtype))
+		} else {
+			delete(name.types, rrtype)
+		}
+	}
+	if len(name.types) == 0 {
+		c.remove(c.names[key])
+		return nil
+	}
+	sort.Ints(rrtypes)
+	var rrs []dns.RR
+	for _, rrtype := range rrtypes {
+		set := name.types[uint16(rrtype)]
+		ttl := uint32(set.expires.Sub(now) / time.Second)
+		if ttl == 0 {
+			ttl = 1
+		}
+		for _, rr := range set.rrs {
+			rr = dns.Copy(rr)
+			rr.Header().Ttl = ttl
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// anyQuery is an ANY query for name.
+func anyQuery(name string) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeANY)
+	return req
+}
+
+func TestRRsetCache(t *testing.T) {
+	c := newRRsetCache(2)
+	req := anyQuery("example.com.")
+	resp := new(dns.Msg)
+	resp.Answer = []dns.RR{
+		mustRR(t, "www.example.com. 300 IN CNAME example.com."),
+		mustRR(t, "example.com. 60 IN A 192.0.2.1"),
+		mustRR(t, "example.com. 30 IN A 192.0.2.2"),
+		mustRR(t, "example.com. 0 IN TXT \"uncacheable\""),
+	}
+	c.Add(req, resp)
+	resp.Answer = []dns.RR{mustRR(t, "Example.com. 600 IN AAAA 2001:db8::1")}
+	c.Add(req, resp)
+
+	rrs := c.Get(anyQuery("EXAMPLE.com"))
+	if len(rrs) != 3 {
+		t.Fatalf("got %v, want the two A records and the AAAA record", rrs)
+	}
+	for i, want := range []struct {
+		rrtype uint16
+		ttl    uint32
+	}{{dns.TypeA, 30}, {dns.TypeA, 30}, {dns.TypeAAAA, 600}} {
+		if h := rrs[i].Header(); h.Rrtype != want.rrtype || h.Ttl > want.ttl || h.Ttl < want.ttl-1 {
+			t.Errorf("record %d is %v, want type %s with the set's remaining TTL %d",
+				i, rrs[i], dns.TypeToString[want.rrtype], want.ttl)
+		}
+	}
+	rrs[0].Header().Ttl = 1
+	if c.Get(anyQuery("example.com."))[0].Header().Ttl == 1 {
+		t.Error("Get returned the kept records rather than copies")
+	}
+
+	// A third name evicts one of the two
+	resp.Answer = []dns.RR{mustRR(t, "other.example. 60 IN A 192.0.2.3")}
+	c.Add(req, resp)
+	if len(c.names) != 2 || c.Get(anyQuery("other.example.")) == nil {
+		t.Errorf("kept %d names after adding a third to a cache of 2", len(c.names))
+	}
+
+	// Expired sets are not returned
+	c.names["other.example."].Value.(*cachedName).types[dns.TypeA] = cachedRRset{rrs: resp.Answer, expires: time.Now().Add(-time.Second)}
+	if rrs := c.Get(anyQuery("other.example.")); rrs != nil {
+		t.Errorf("got expired records %v", rrs)
+	}
+}
+
+func TestAnswerANYFromCache(t *testing.T) {
+	defer func(mode string, cache *rrsetCache) { *refuseAny, anyCache = mode, cache }(*refuseAny, anyCache)
+	*refuseAny, anyCache = anyCached, newRRsetCache(anyCacheNames)
+	resp := new(dns.Msg)
+	resp.Answer = []dns.RR{mustRR(t, "example.com. 300 IN A 192.0.2.1")}
+	anyCache.Add(anyQuery("example.com."), resp)
+
+	query := func(name string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeANY)
+		w := &httpResponseWriter{local: &net.TCPAddr{}, remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 53)}}
+		if !answerANY(w, req) {
+			t.Fatalf("ANY %s was not answered without going upstream", name)
+		}
+		return w.msg
+	}
+	if m := query("Example.COM."); len(m.Answer) != 1 || m.Answer[0].Header().Rrtype != dns.TypeA ||
+		m.Answer[0].Header().Name != "Example.COM." {
+		t.Errorf("got %v, want the cached A record under the query's name", m.Answer)
+	}
+	if m := query("nothing.example."); len(m.Answer) != 1 || m.Answer[0].Header().Rrtype != dns.TypeHINFO {
+		t.Errorf("got %v, want the RFC 8482 HINFO record with nothing cached", m.Answer)
+	}
+}
+
+// The least recently used name makes room for a new one.
+func TestRRsetCacheLRU(t *testing.T) {
+	c := newRRsetCache(2)
+	add := func(name string) {
+		resp := new(dns.Msg)
+		resp.Answer = []dns.RR{mustRR(t, name+" 300 IN A 192.0.2.1")}
+		c.Add(anyQuery(name), resp)
+	}
+	add("a.example.")
+	add("b.example.")
+	c.Get(anyQuery("a.example."))
+	add("c.example.")
+	for name, kept := range map[string]bool{"a.example.": true, "b.example.": false, "c.example.": true} {
+		if got := c.Get(anyQuery(name)) != nil; got != kept {
+			t.Errorf("%s kept: %v, want %v", name, got, kept)
+		}
+	}
+	if len(c.names) != 2 || c.lru.Len() != 2 {
+		t.Errorf("%d names and %d list entries, want 2", len(c.names), c.lru.Len())
+	}
+}
+
+// Answers to queries with a client subnet or the CD bit are only served to
+// queries with the same.
+func TestRRsetCacheScope(t *testing.T) {
+	defer func(privacy bool) { *privacyECS = privacy }(*privacyECS)
+	withECS := func(req *dns.Msg, addr string, prefix uint8) *dns.Msg {
+		req.SetEdns0(1232, false)
+		family := uint16(1)
+		if net.ParseIP(addr).To4() == nil {
+			family = 2
+		}
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+			Code: dns.EDNS0SUBNET, Family: family, SourceNetmask: prefix, Address: net.ParseIP(addr),
+		})
+		return req
+	}
+	withCD := func(req *dns.Msg) *dns.Msg {
+		req.CheckingDisabled = true
+		return req
+	}
+
+	c := newRRsetCache(anyCacheNames)
+	resp := new(dns.Msg)
+	resp.Answer = []dns.RR{mustRR(t, "example.com. 300 IN A 192.0.2.1")}
+	c.Add(withECS(anyQuery("example.com."), "192.0.2.1", 24), resp)
+	resp.Answer = []dns.RR{mustRR(t, "example.com. 300 IN A 198.51.100.1")}
+	c.Add(withCD(anyQuery("example.com.")), resp)
+
+	served := func(req *dns.Msg) string {
+		if rrs := c.Get(req); len(rrs) == 1 {
+			return rrs[0].(*dns.A).A.String()
+		}
+		return ""
+	}
+	for _, tc := range []struct {
+		name string
+		req  *dns.Msg
+		want string // the address served, or "" for nothing
+	}{
+		{"same subnet", withECS(anyQuery("example.com."), "192.0.2.77", 24), "192.0.2.1"},
+		{"other subnet", withECS(anyQuery("example.com."), "203.0.113.1", 24), ""},
+		{"longer prefix", withECS(anyQuery("example.com."), "192.0.2.1", 32), ""},
+		{"IPv6 subnet", withECS(anyQuery("example.com."), "2001:db8::1", 56), ""},
+		{"CD", withCD(anyQuery("example.com.")), "198.51.100.1"},
+		{"CD and subnet", withCD(withECS(anyQuery("example.com."), "192.0.2.1", 24)), ""},
+		{"neither", anyQuery("example.com."), ""},
+	} {
+		if got := served(tc.req); got != tc.want {
+			t.Errorf("%s: served %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	// With -privacy-ecs no subnet is passed on, so none tells answers apart
+	*privacyECS = true
+	c = newRRsetCache(anyCacheNames)
+	resp.Answer = []dns.RR{mustRR(t, "example.com. 300 IN A 192.0.2.1")}
+	c.Add(withECS(anyQuery("example.com."), "192.0.2.1", 24), resp)
+	if got := served(anyQuery("example.com.")); got != "192.0.2.1" {
+		t.Errorf("-privacy-ecs: served %q without a subnet, want the answer cached with one", got)
+	}
+}
+
+func BenchmarkRRsetCacheGet(b *testing.B) {
+	c := newRRsetCache(anyCacheNames)
+	resp := new(dns.Msg)
+	queries := make([]*dns.Msg, 1000)
+	for i := range queries {
+		name := fmt.Sprintf("host%d.example.com.", i)
+		queries[i] = anyQuery(strings.ToUpper(name[:1]) + name[1:])
+		resp.Answer = []dns.RR{
+			mustRR(b, name+" 300 IN A 192.0.2.1"),
+			mustRR(b, name+" 300 IN AAAA 2001:db8::1"),
+		}
+		c.Add(queries[i], resp)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if rrs := c.Get(queries[i%len(queries)]); len(rrs) != 2 {
+			b.Fatalf("got %v, want both records", rrs)
+		}
+	}
+}
+
+// BenchmarkRRsetCacheAddFull adds new names to a full cache, each one
+// evicting another.
+func BenchmarkRRsetCacheAddFull(b *testing.B) {
+	c := newRRsetCache(anyCacheNames)
+	queries := make([]*dns.Msg, 2*anyCacheNames)
+	resps := make([]*dns.Msg, len(queries))
+	for i := range queries {
+		name := fmt.Sprintf("host%d.example.com.", i)
+		queries[i] = anyQuery(name)
+		resps[i] = new(dns.Msg)
+		resps[i].Answer = []dns.RR{mustRR(b, name+" 300 IN A 192.0.2.1")}
+	}
+	for i := 0; i < anyCacheNames; i++ {
+		c.Add(queries[i], resps[i])
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		j := i % len(queries)
+		c.Add(queries[j], resps[j])
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Names with fewer than -search-ndots dots, such as "printer", are bare:
+// like a stub resolver's search list, -search tries them under each of its
+// domains in turn, through the usual pipeline, and the first that has an
+// answer is returned for the name asked. If none has one the bare name is
+// forwarded as it is, unless -block-bare-names answers it NXDOMAIN instead.
+
+// Which -search domain answered a bare name is remembered for the TTL of
+// the answer, and that no domain did for the negative TTL, both up to
+// searchMemoTTL, so that a client repeating a query doesn't send one
+// upstream per domain each time.
+const (
+	searchMemoTTL = 5 * time.Minute
+	searchMemoMax = 10000
+)
+
+type searchMemo struct {
+	// domain is the -search domain that answered, or "" if none did
+	domain  string
+	expires time.Time
+}
+
+var (
+	searchMemoMu sync.Mutex
+	searchMemos  = make(map[string]searchMemo)
+)
+
+// isBareName reports whether name, which must be normalized, has fewer
+// than -search-ndots dots.
+func isBareName(name string) bool {
+	return name != "." && dns.CountLabel(name)-1 < *searchNdots
+}
+
+// searchDomains returns the -search domains, normalized.
+func searchDomains() []string {
+	var domains []string
+	for _, d := range splitList(*searchList) {
+		domains = append(domains, normalizeName(strings.TrimPrefix(d, ".")))
+	}
+	return domains
+}
+
+// answerSearch answers a query for a bare name from the -search domains,
+// or NXDOMAIN with -block-bare-names. It returns false to forward the query
+// as usual.
+func answerSearch(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) bool {
+	q := req.Question[0]
+	name := normalizeName(q.Name)
+	if !isBareName(name) {
+		return false
+	}
+	domains := searchDomains()
+	if len(domains) == 0 && !*blockBareNames {
+		return false
+	}
+
+	key := name + " " + strconv.Itoa(int(q.Qtype))
+	memo, ok := loadSearchMemo(key)
+	if ok && memo.domain == "" {
+		debugf("Search: no -search domain has %s %s", name, dns.Type(q.Qtype))
+		return bareNameFailed(w, req, false)
+	}
+	if ok {
+		domains = append([]string{memo.domain}, removeString(domains, memo.domain)...)
+	}
+
+	failed := false
+	negative := uint32(searchMemoTTL / time.Second)
+	for _, domain := range domains {
+		expanded := name + domain
+		resp := searchExchange(ctx, w, req, expanded)
+		switch {
+		case resp == nil || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError):
+			failed = true
+		case resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0:
+			storeSearchMemo(key, domain, minTTL(resp))
+			debugf("Search: answering %s with %s", name, expanded)
+			writeSearchAnswer(w, req, expanded, resp)
+			return true
+		default:
+			if ttl := minTTL(resp); ttl < negative && len(resp.Ns) > 0 {
+				negative = ttl
+			}
+		}
+	}
+	if !failed && len(domains) > 0 {
+		storeSearchMemo(key, "", negative)
+	}
+	return bareNameFailed(w, req, failed)
+}
+
+// bareNameFailed handles a bare name no -search domain answered: with
+// -block-bare-names it is answered NXDOMAIN, or SERVFAIL if a domain could
+// not be resolved, otherwise it is left to be forwarded.
+func bareNameFailed(w dns.ResponseWriter, req *dns.Msg, failed bool) bool {
+	if !*blockBareNames {
+		return false
+	}
+	if failed {
+		handleFailed(w, req)
+	} else {
+		writeFailure(w, req, dns.RcodeNameError)
+	}
+	return true
+}
+
+// searchExchange resolves the question of req for expanded through the
+// usual pipeline, returning the response, or nil if there was none.
+func searchExchange(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, expanded string) *dns.Msg {
+	sub := req.Copy()
+	sub.Question[0].Name = expanded
+	cw := &captureWriter{ResponseWriter: w}
+	forward(ctx, cw, sub)
+	return cw.msg
+}
+
+// writeSearchAnswer answers req, a query for a bare name, with resp, the
+// response for the name under a -search domain, expanded. With
+// -search-cname a CNAME from the name asked to expanded leads the answer;
+// otherwise the records owned by expanded are given the name asked.
+func writeSearchAnswer(w dns.ResponseWriter, req *dns.Msg, expanded string, resp *dns.Msg) {
+	resp.Id = req.Id
+	resp.Question = append([]dns.Question(nil), req.Question...)
+	if *searchCNAME {
+		cname := &dns.CNAME{
+			Hdr: dns.RR_Header{
+				Name:   req.Question[0].Name,
+				Rrtype: dns.TypeCNAME,
+				Class:  dns.ClassINET,
+				Ttl:    minTTL(resp),
+			},
+			Target: expanded,
+		}
+		resp.Answer = append([]dns.RR{cname}, resp.Answer...)
+	} else {
+		for _, rr := range resp.Answer {
+			if normalizeName(rr.Header().Name) == expanded {
+				rr.Header().Name = req.Question[0].Name
+			}
+		}
+	}
+	if w.RemoteAddr().Network() == "udp" {
+		truncateForUDP(resp, req)
+	}
+	if err := w.WriteMsg(resp); err != nil {
+		errorf("Error writing DNS response: %v", err)
+	}
+}
+
+// captureWriter keeps the response written to it instead of sending it, for
+// a query the proxy makes of its own pipeline. It reports the client as
+// connected over TCP, so that the response is not truncated before it is
+// used to answer the client's own query.
+type captureWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *captureWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *captureWriter) RemoteAddr() net.Addr {
+	addr := w.ResponseWriter.RemoteAddr()
+	if u, ok := addr.(*net.UDPAddr); ok {
+		return &net.TCPAddr{IP: u.IP, Port: u.Port, Zone: u.Zone}
+	}
+	return addr
+}
+
+func loadSearchMemo(key string) (searchMemo, bool) {
+	searchMemoMu.Lock()
+	defer searchMemoMu.Unlock()
+	memo, ok := searchMemos[key]
+	if ok && time.Now().After(memo.expires) {
+		delete(searchMemos, key)
+		return searchMemo{}, false
+	}
+	return memo, ok
+}
+
+func storeSearchMemo(key, domain string, ttl uint32) {
+	d := time.Duration(ttl) * time.Second
+	if d <= 0 {
+		return
+	}
+	if d > searchMemoTTL {
+		d = searchMemoTTL
+	}
+	searchMemoMu.Lock()
+	defer searchMemoMu.Unlock()
+	if len(searchMemos) >= searchMemoMax {
+		now := time.Now()
+		for k, memo := range searchMemos {
+			if now.After(memo.expires) {
+				delete(searchMemos, k)
+			}
+		}
+	}
+	if len(searchMemos) < searchMemoMax {
+		searchMemos[key] = searchMemo{domain, time.Now().Add(d)}
+	}
+}
+
+func removeString(list []string, s string) []string {
+	var out []string
+	for _, v := range list {
+		if v != s {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "os"
+
+// Running as a service is only supported on Windows; elsewhere use the
+// init system, with sd_notify and socket activation under systemd.
+
+func serviceCommand(args []string) (bool, error) { return false, nil }
+
+func initService() error { return nil }
+
+func startService(sigs chan<- os.Signal) {}
+
+func serviceStopped(exitCode int) {}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	serviceName        = "dns-over-https-proxy"
+	serviceDisplayName = "DNS-over-HTTPS proxy"
+	serviceDescription = "Answers DNS queries by forwarding them to a DNS-over-HTTPS upstream."
+)
+
+// winService is set when running under the service control manager.
+var winService *scmService
+
+// serviceCommand runs the install, uninstall, start and stop subcommands.
+// It reports false if args hold none of them.
+func serviceCommand(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	switch args[0] {
+	case "install":
+		return true, installService(args[1:])
+	case "uninstall":
+		return true, uninstallService()
+	case "start":
+		return true, controlService(func(s *mgr.Service) error { return s.Start() })
+	case "stop":
+		return true, controlService(stopService)
+	}
+	return false, nil
+}
+
+// installService registers the service to start automatically with args
+// as its command line, and registers its event log source.
+func installService(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s is already installed", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: serviceDisplayName,
+		Description: serviceDescription,
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("cannot register event log source: %v", err)
+	}
+	fmt.Printf("Installed service %s running %s %s\n", serviceName, exe, strings.Join(args, " "))
+	return nil
+}
+
+// uninstallService removes the service and its event log source.
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	if err := eventlog.Remove(serviceName); err != nil {
+		return fmt.Errorf("cannot remove event log source: %v", err)
+	}
+	fmt.Println("Uninstalled service", serviceName)
+	return nil
+}
+
+func controlService(f func(*mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+	return f(s)
+}
+
+// stopService asks the service to stop and waits until it has.
+func stopService(s *mgr.Service) error {
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service %s did not stop within 30s", serviceName)
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// initService sends the log to the event log when running as a service,
+// unless -log-file is set, as there is no stderr to write to.
+func initService() error {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return err
+	}
+	winService = &scmService{stopped: make(chan uint32), done: make(chan struct{})}
+	if *logFilePath == "" {
+		elog, err := eventlog.Open(serviceName)
+		if err != nil {
+			return err
+		}
+		log.SetFlags(0)
+		log.SetOutput(eventLogWriter{elog})
+	}
+	return nil
+}
+
+// startService reports the proxy as running to the service control
+// manager, which then delivers Stop and Shutdown as SIGTERM and
+// ParamChange (sc control ... paramchange) as SIGHUP.
+func startService(sigs chan<- os.Signal) {
+	if winService == nil {
+		return
+	}
+	winService.sigs = sigs
+	go func() {
+		if err := svc.Run(serviceName, winService); err != nil {
+			errorf("Service control manager: %v", err)
+		}
+		close(winService.done)
+	}()
+}
+
+// serviceStopped reports the service as stopped before the process exits.
+func serviceStopped(exitCode int) {
+	if winService == nil || winService.sigs == nil {
+		return
+	}
+	select {
+	case winService.stopped <- uint32(exitCode):
+		<-winService.done
+	case <-winService.done:
+	}
+}
+
+type scmService struct {
+	sigs    chan<- os.Signal
+	stopped chan uint32
+	done    chan struct{}
+}
+
+func (s *scmService) Execute(args []string, r <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+	for {
+		select {
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				status <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				s.signal(syscall.SIGTERM)
+			case svc.ParamChange:
+				s.signal(syscall.SIGHUP)
+			}
+		case code := <-s.stopped:
+			// A non-zero code is reported as a service-specific error
+			return code != 0, code
+		}
+	}
+}
+
+// signal passes sig to the main loop, dropping it if one is already
+// pending as signal.Notify does.
+func (s *scmService) signal(sig os.Signal) {
+	select {
+	case s.sigs <- sig:
+	default:
+	}
+}
+
+// eventLogWriter writes each log line as an event log entry.
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	var err error
+	if strings.HasPrefix(msg, "Warning") {
+		err = w.elog.Warning(1, msg)
+	} else {
+		err = w.elog.Info(1, msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
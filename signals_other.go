@@ -0,0 +1,9 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "os"
+
+// statsSignal is unavailable here, so statistics can't be dumped on demand.
+var statsSignal os.Signal
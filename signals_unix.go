@@ -0,0 +1,12 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statsSignal asks for a statistics dump.
+var statsSignal os.Signal = syscall.SIGUSR1
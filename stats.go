@@ -0,0 +1,109 @@
+package main
+
+import "sync/atomic"
+
+// counter is a monotonically increasing statistic which is safe to update
+// from concurrent query handlers.
+type counter struct {
+	v uint64
+}
+
+func (c *counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// gauge is a statistic which can go up and down.
+type gauge struct {
+	v int64
+}
+
+func (g *gauge) Inc() {
+	atomic.AddInt64(&g.v, 1)
+}
+
+func (g *gauge) Dec() {
+	atomic.AddInt64(&g.v, -1)
+}
+
+func (g *gauge) Set(v int64) {
+	atomic.StoreInt64(&g.v, v)
+}
+
+func (g *gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+// stats holds the proxy's runtime counters.
+var stats struct {
+	// Upstream responses rejected for an unexpected Content-Type
+	UpstreamBadContentType counter
+	// Upstream responses rejected for exceeding -max-body-size
+	UpstreamBodyTooLarge counter
+
+	// Panics recovered while handling queries
+	HandlerPanics counter
+
+	// Queries refused or dropped by an access list
+	QueriesDenied counter
+
+	// Queries turned away for exceeding -client-qps, and the number of
+	// clients the rate limiter is currently tracking
+	QueriesRateLimited counter
+	RateLimitClients   gauge
+
+	// UDP responses withheld by response rate limiting, and those replaced
+	// by a truncated response
+	ResponsesRateLimited counter
+	ResponsesSlipped     counter
+
+	// Clients detected sending bursts of NXDOMAIN queries, and those whose
+	// burst is still going
+	NXDomainBursts   counter
+	NXDomainBursting gauge
+
+	// Queries which waited for, or were refused, an upstream request slot
+	QueriesQueued   counter
+	QueriesRejected counter
+	// Upstream requests currently in progress
+	UpstreamInFlight gauge
+	// Queries answered by an identical query's upstream request
+	UpstreamDeduplicated counter
+	// Upstream requests hedged with a second request, and those the second
+	// request answered first
+	UpstreamHedged    counter
+	UpstreamHedgeWins counter
+	// Upstream requests made by -prefetch, and queries they answered
+	Prefetches   counter
+	PrefetchHits counter
+	// Queries whose IPv6 addresses -filter-aaaa suppressed
+	AAAAFiltered counter
+
+	// UDP queries waiting for a worker, and those turned away because the
+	// queue was full
+	UDPQueueDepth    gauge
+	UDPQueueRejected counter
+	UDPQueueDropped  counter
+
+	// Open client connections and those refused for being over the limit
+	TCPConns          gauge
+	TCPConnsRejected  counter
+	TLSConns          gauge
+	TLSConnsRejected  counter
+	QUICConns         gauge
+	QUICConnsRejected counter
+
+	// dnstap messages dropped because the collector was slow or down
+	DnstapDropped counter
+	// Completed queries -query-log-db failed or fell too far behind to write
+	QueryDBDropped counter
+	// Trace spans dropped because the OpenTelemetry collector was slow or down
+	OTelSpansDropped counter
+}
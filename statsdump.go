@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var startTime = time.Now()
+
+// dumpMu keeps the lines of concurrent dumps from interleaving.
+var dumpMu sync.Mutex
+
+// dumpStats logs a summary of the runtime statistics, as key=value pairs.
+func dumpStats() {
+	dumpMu.Lock()
+	defer dumpMu.Unlock()
+	writeStats(log.Printf)
+}
+
+// writeStats formats the statistics dumpStats logs, a line per call of
+// printf.
+func writeStats(printf func(format string, v ...interface{})) {
+	printf("stats: uptime=%s goroutines=%d upstream_in_flight=%d tcp_conns=%d tls_conns=%d udp_queue=%d udp_rejected=%d udp_dropped=%d",
+		time.Since(startTime).Round(time.Second), runtime.NumGoroutine(),
+		stats.UpstreamInFlight.Value(), stats.TCPConns.Value(), stats.TLSConns.Value(),
+		stats.UDPQueueDepth.Value(), stats.UDPQueueRejected.Value(), stats.UDPQueueDropped.Value())
+	printf("stats: queries %s", sumByLabel(metrics.QueriesByProto, 0))
+	printf("stats: rcodes %s", sumByLabel(metrics.Queries, 1))
+	printf("stats: any_queries %s", sumByLabel(metrics.AnyQueries, 0))
+	printf("stats: denied=%d queued=%d rejected=%d deduplicated=%d hedged=%d hedge_wins=%d prefetches=%d prefetch_hits=%d dnstap_dropped=%d panics=%d",
+		stats.QueriesDenied.Value(), stats.QueriesQueued.Value(), stats.QueriesRejected.Value(),
+		stats.UpstreamDeduplicated.Value(), stats.UpstreamHedged.Value(), stats.UpstreamHedgeWins.Value(),
+		stats.Prefetches.Value(), stats.PrefetchHits.Value(),
+		stats.DnstapDropped.Value(), stats.HandlerPanics.Value())
+	printf("stats: rate_limited=%d rrl_dropped=%d rrl_slipped=%d nxdomain_bursts=%d",
+		stats.QueriesRateLimited.Value(), stats.ResponsesRateLimited.Value(),
+		stats.ResponsesSlipped.Value(), stats.NXDomainBursts.Value())
+
+	v := metrics.UpstreamDuration
+	v.mu.RLock()
+	endpoints := make([]string, 0, len(v.histograms))
+	for k := range v.histograms {
+		endpoints = append(endpoints, k)
+	}
+	sort.Strings(endpoints)
+	histograms := make([]*histogram, len(endpoints))
+	for i, k := range endpoints {
+		histograms[i] = v.histograms[k]
+	}
+	v.mu.RUnlock()
+	if topQueries != nil {
+		printf("stats: top_queries %s", formatTop(topQueries.Top(topKReport)))
+		printf("stats: top_denied %s", formatTop(topDenied.Top(topKReport)))
+		printf("stats: top_blocked %s", formatTop(topBlocked.Top(topKReport)))
+		printf("stats: top_clients %s", formatTop(topClients.Top(topKReport)))
+	}
+
+	printf("stats: blocked %s", sumByLabel(metrics.BlockedQueries, 0))
+	for _, e := range recentBlocks() {
+		printf("stats: block time=%s client=%s name=%s source=%s rule=%q",
+			e.Time.Format(time.RFC3339), e.Client, e.Name, e.Source, e.Rule)
+	}
+
+	for i, endpoint := range endpoints {
+		h := histograms[i]
+		mean, _ := upstreamLatency(endpoint)
+		last := time.Unix(metrics.UpstreamLastSuccess.With(endpoint).Value(), 0)
+		printf("stats: upstream=%s succeeded=%d failed=%s mean=%s p50=%s p95=%s p99=%s last_success=%s",
+			endpoint, atomic.LoadUint64(&h.count), upstreamErrors(endpoint), mean,
+			h.quantile(.5), h.quantile(.95), h.quantile(.99), last.Format(time.RFC3339))
+	}
+}
+
+// sumByLabel totals the counters of v by the value of one label, formatted
+// as sorted key=value pairs.
+func sumByLabel(v *counterVec, label int) string {
+	totals := make(map[string]uint64)
+	v.mu.RLock()
+	for k, c := range v.counters {
+		values := strings.Split(k, "\xff")
+		if label < len(values) {
+			totals[values[label]] += c.Value()
+		}
+	}
+	v.mu.RUnlock()
+
+	keys := make([]string, 0, len(totals))
+	for k := range totals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf("%s=%d", k, totals[k])
+	}
+	if len(pairs) == 0 {
+		return "none"
+	}
+	return strings.Join(pairs, " ")
+}
+
+func formatTop(entries []topKEntry) string {
+	if len(entries) == 0 {
+		return "none"
+	}
+	pairs := make([]string, len(entries))
+	for i, e := range entries {
+		pairs[i] = fmt.Sprintf("%s=%d", e.Name, e.Count)
+	}
+	return strings.Join(pairs, " ")
+}
+
+// upstreamErrors totals the failed requests to endpoint, with the count
+// for each error class.
+func upstreamErrors(endpoint string) string {
+	var n uint64
+	var classes []string
+	metrics.UpstreamErrors.mu.RLock()
+	for k, c := range metrics.UpstreamErrors.counters {
+		if strings.HasPrefix(k, endpoint+"\xff") {
+			n += c.Value()
+			classes = append(classes, fmt.Sprintf("%s:%d", strings.TrimPrefix(k, endpoint+"\xff"), c.Value()))
+		}
+	}
+	metrics.UpstreamErrors.mu.RUnlock()
+	if len(classes) == 0 {
+		return "0"
+	}
+	sort.Strings(classes)
+	return fmt.Sprintf("%d(%s)", n, strings.Join(classes, ","))
+}
+
+// quantile estimates the q-quantile of the observations by interpolating
+// within the bucket it falls in.
+func (h *histogram) quantile(q float64) time.Duration {
+	count := atomic.LoadUint64(&h.count)
+	if count == 0 {
+		return 0
+	}
+	rank := q * float64(count)
+	lower, prev := 0.0, uint64(0)
+	for i, upper := range h.buckets {
+		n := atomic.LoadUint64(&h.counts[i])
+		if float64(n) >= rank {
+			frac := (rank - float64(prev)) / float64(n-prev)
+			return time.Duration((lower + (upper-lower)*frac) * float64(time.Second))
+		}
+		lower, prev = upper, n
+	}
+	return time.Duration(lower * float64(time.Second))
+}
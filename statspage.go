@@ -0,0 +1,124 @@
+package main
+
+import (
+	_ "embed"
+	"html/template"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// statsPageTop is how many entries each table of the stats page lists.
+const statsPageTop = 20
+
+// minuteCounts counts events in each of the last 60 minutes. A slot is
+// reset by the first event of a new minute, so an event racing with the
+// reset may be lost; the counts are for display only.
+type minuteCounts struct {
+	minute [60]int64
+	count  [60]uint64
+}
+
+// queryMinutes counts the queries answered each minute, for the stats page.
+var queryMinutes minuteCounts
+
+func (m *minuteCounts) Inc() {
+	now := time.Now().Unix() / 60
+	i := now % 60
+	if atomic.LoadInt64(&m.minute[i]) != now && atomic.SwapInt64(&m.minute[i], now) != now {
+		atomic.StoreUint64(&m.count[i], 0)
+	}
+	atomic.AddUint64(&m.count[i], 1)
+}
+
+// Last returns the counts of the last n minutes, ending with the current
+// one.
+func (m *minuteCounts) Last(n int) []uint64 {
+	now := time.Now().Unix() / 60
+	counts := make([]uint64, n)
+	for j := range counts {
+		minute := now - int64(n-1-j)
+		if i := minute % 60; atomic.LoadInt64(&m.minute[i]) == minute {
+			counts[j] = atomic.LoadUint64(&m.count[i])
+		}
+	}
+	return counts
+}
+
+// statsPageBar is a minute of the queries chart.
+type statsPageBar struct {
+	Count  uint64
+	Height int
+}
+
+// statsPageData is what the stats page shows; sections for features that
+// are off are left empty.
+type statsPageData struct {
+	Version    string
+	Uptime     time.Duration
+	Goroutines int
+	LastMinute uint64
+	Bars       []statsPageBar
+	Rcodes     string
+	Shared     uint64
+	TopOff     bool
+	Top        []topKEntry
+	Blocking   bool
+	Blocked    []topKEntry
+	Denied     []topKEntry
+	Clients    []topKEntry
+	Upstreams  []endpointState
+}
+
+// addStatsPage serves the statistics page at /stats on the admin listener
+// on addr.
+func addStatsPage(addr string) {
+	adminMux(addr, "stats page").HandleFunc("/stats", apiMethods(handleStatsPage, "GET"))
+}
+
+func handleStatsPage(hw http.ResponseWriter, r *http.Request) {
+	counts := queryMinutes.Last(60)
+	var peak uint64
+	for _, n := range counts {
+		if n > peak {
+			peak = n
+		}
+	}
+	d := statsPageData{
+		Version:    versionString(),
+		Uptime:     time.Since(startTime).Round(time.Second),
+		Goroutines: runtime.NumGoroutine(),
+		LastMinute: counts[len(counts)-2],
+		Rcodes:     sumByLabel(metrics.Queries, 1),
+		Shared:     stats.UpstreamDeduplicated.Value() + stats.PrefetchHits.Value(),
+		TopOff:     topQueries == nil,
+		Blocking:   *policyHook != "",
+		Upstreams:  upstreamStates(),
+	}
+	for _, n := range counts {
+		bar := statsPageBar{Count: n}
+		if peak > 0 {
+			bar.Height = int(n * 100 / peak)
+		}
+		d.Bars = append(d.Bars, bar)
+	}
+	if topQueries != nil {
+		d.Top = topQueries.Top(statsPageTop)
+		d.Blocked = topBlocked.Top(statsPageTop)
+		d.Denied = topDenied.Top(statsPageTop)
+		d.Clients = topClients.Top(statsPageTop)
+	}
+	hw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	hw.Header().Set("Cache-Control", "no-store")
+	if err := statsPage.Execute(hw, d); err != nil {
+		warnf("Cannot render the stats page: %v", err)
+	}
+}
+
+// statsPageHTML is the template of the stats page, built into the binary.
+//
+//go:embed statspage.html
+var statsPageHTML string
+
+var statsPage = template.Must(template.New("stats").Parse(statsPageHTML))
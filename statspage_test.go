@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStatsPageRenders(t *testing.T) {
+	upstream.Store(&upstreamGroup{name: "default", endpoints: []string{"https://dns.example/resolve"}})
+	queryMinutes.Inc()
+	w := httptest.NewRecorder()
+	handleStatsPage(w, httptest.NewRequest("GET", "/stats", nil))
+	body := w.Body.String()
+	if w.Code != 200 || !strings.Contains(body, "<h1>DNS-over-HTTPS proxy</h1>") ||
+		!strings.Contains(body, "https://dns.example/resolve") {
+		t.Errorf("got %d:\n%s", w.Code, body)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Severities the proxy's log lines are mapped to.
+const (
+	sevErr = iota
+	sevWarning
+	sevInfo
+)
+
+const (
+	// Lines kept while the syslog socket can't be reached.
+	syslogBufferLines = 256
+	// How often to retry reaching the syslog socket.
+	syslogRetryInterval = 5 * time.Second
+)
+
+// syslogConn is a connection to the system or a remote syslog.
+type syslogConn interface {
+	write(severity int, msg string) error
+	Close() error
+}
+
+// syslogWriter sends log lines to syslog. While syslog can't be reached,
+// lines are buffered and the connection retried, so logging never blocks
+// or fails.
+type syslogWriter struct {
+	addr, facility string
+
+	mu        sync.Mutex
+	conn      syslogConn
+	lastDial  time.Time
+	pending   []string
+	dropped   int
+	lastError error
+}
+
+func newSyslogWriter(addr, facility string) (*syslogWriter, error) {
+	if _, err := syslogFacility(facility); err != nil {
+		return nil, err
+	}
+	w := &syslogWriter{addr: addr, facility: facility}
+	w.mu.Lock()
+	w.connect()
+	w.mu.Unlock()
+	return w, nil
+}
+
+func (w *syslogWriter) connect() {
+	w.lastDial = time.Now()
+	conn, err := dialSyslog(w.addr, w.facility)
+	if err != nil {
+		w.lastError = err
+		return
+	}
+	w.conn = conn
+	if w.dropped > 0 {
+		w.conn.write(sevWarning, fmt.Sprintf("%d log messages lost while syslog was unavailable", w.dropped))
+		w.dropped = 0
+	}
+	for _, line := range w.pending {
+		w.send(line)
+	}
+	w.pending = nil
+}
+
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil && time.Since(w.lastDial) >= syslogRetryInterval {
+		w.connect()
+	}
+	for _, line := range strings.Split(string(bytes.TrimRight(p, "\n")), "\n") {
+		line = stripLogTimestamp(line)
+		if w.conn != nil {
+			w.send(line)
+			continue
+		}
+		if len(w.pending) < syslogBufferLines {
+			w.pending = append(w.pending, line)
+		} else {
+			w.dropped++
+		}
+	}
+	return len(p), nil
+}
+
+// send writes a line, dropping the connection to retry later if it fails.
+func (w *syslogWriter) send(line string) {
+	if err := w.conn.write(logSeverity(line), line); err != nil {
+		w.conn.Close()
+		w.conn = nil
+		w.lastError = err
+		w.pending = append(w.pending, line)
+	}
+}
+
+// logSeverity guesses the severity of a log line from how it starts.
+func logSeverity(line string) int {
+	lower := strings.ToLower(line)
+	switch {
+	case strings.HasPrefix(lower, "error"), strings.HasPrefix(lower, "cannot"),
+		strings.Contains(lower, "failed"):
+		return sevErr
+	case strings.HasPrefix(lower, "warning"):
+		return sevWarning
+	}
+	return sevInfo
+}
+
+// stripLogTimestamp removes the date and time added by the standard
+// logger, as syslog stamps messages itself.
+func stripLogTimestamp(line string) string {
+	const layout = "2006/01/02 15:04:05 "
+	if len(line) >= len(layout) {
+		if _, err := time.Parse(layout, line[:len(layout)]); err == nil {
+			return line[len(layout):]
+		}
+	}
+	return line
+}
+
+// setupSyslog adds syslog to the standard logger's outputs, keeping the
+// current output as well unless keepCurrent is false.
+func setupSyslog(addr, facility string, keepCurrent bool) error {
+	w, err := newSyslogWriter(addr, facility)
+	if err != nil {
+		return err
+	}
+	if keepCurrent {
+		log.SetOutput(io.MultiWriter(log.Writer(), w))
+	} else {
+		log.SetOutput(w)
+	}
+	if w.conn == nil {
+		warnf("Warning: syslog unavailable, buffering and retrying: %v", w.lastError)
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "errors"
+
+var errNoSyslog = errors.New("syslog is not supported on this platform")
+
+func syslogFacility(name string) (int, error) {
+	return 0, errNoSyslog
+}
+
+func dialSyslog(addr, facility string) (syslogConn, error) {
+	return nil, errNoSyslog
+}
@@ -0,0 +1,63 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL,
+	"daemon": syslog.LOG_DAEMON, "auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG,
+	"lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS, "uucp": syslog.LOG_UUCP,
+	"cron": syslog.LOG_CRON, "authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3, "local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+func syslogFacility(name string) (syslog.Priority, error) {
+	f, ok := syslogFacilities[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown syslog facility %q", name)
+	}
+	return f, nil
+}
+
+type unixSyslog struct {
+	*syslog.Writer
+}
+
+// dialSyslog connects to the local syslog socket, or to addr given as
+// [udp:|tcp:]host:port.
+func dialSyslog(addr, facility string) (syslogConn, error) {
+	f, err := syslogFacility(facility)
+	if err != nil {
+		return nil, err
+	}
+	network := ""
+	if addr != "" {
+		network = "udp"
+		if i := strings.Index(addr, ":"); i > 0 && (addr[:i] == "udp" || addr[:i] == "tcp") {
+			network, addr = addr[:i], addr[i+1:]
+		}
+	}
+	w, err := syslog.Dial(network, addr, f|syslog.LOG_INFO, "dns-over-https-proxy")
+	if err != nil {
+		return nil, err
+	}
+	return unixSyslog{w}, nil
+}
+
+func (s unixSyslog) write(severity int, msg string) error {
+	switch severity {
+	case sevErr:
+		return s.Err(msg)
+	case sevWarning:
+		return s.Warning(msg)
+	}
+	return s.Info(msg)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// How many names each top-K tracker holds, bounding its memory.
+	topKCapacity = 1000
+	// How many names are reported.
+	topKReport = 50
+)
+
+// topK approximates the most frequent names with the Space-Saving
+// algorithm: when full, a new name replaces the least counted one and
+// inherits its count. Counts are halved every window so that old traffic
+// fades out. Names are spread by hash over independently locked shards, so
+// concurrent queries rarely wait on each other.
+type topK struct {
+	shards []topKShard
+}
+
+type topKShard struct {
+	mu       sync.Mutex
+	counts   map[string]uint64
+	capacity int
+	decay    time.Time
+	window   time.Duration
+}
+
+// shardCount returns the default -lock-shards: the power of two at or
+// above procs.
+func shardCount(procs int) int {
+	n := 1
+	for n < procs {
+		n *= 2
+	}
+	return n
+}
+
+func newTopK(window time.Duration, shards int) *topK {
+	t := &topK{shards: make([]topKShard, shards)}
+	for i := range t.shards {
+		t.shards[i] = topKShard{
+			counts:   make(map[string]uint64),
+			capacity: (topKCapacity + shards - 1) / shards,
+			window:   window,
+			decay:    time.Now().Add(window),
+		}
+	}
+	return t
+}
+
+// Top query names, those denied by an access list or blocked by the policy
+// hook, and the clients asking most; nil when disabled.
+var topQueries, topDenied, topBlocked, topClients *topK
+
+// Add counts one occurrence of name. A nil topK ignores it.
+func (t *topK) Add(name string) {
+	if t == nil {
+		return
+	}
+	// FNV-1a, inline to avoid allocating a hash.Hash
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h = (h ^ uint32(name[i])) * 16777619
+	}
+	t.shards[h%uint32(len(t.shards))].add(name)
+}
+
+func (t *topKShard) add(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now := time.Now(); now.After(t.decay) {
+		for k, n := range t.counts {
+			if n /= 2; n == 0 {
+				delete(t.counts, k)
+			} else {
+				t.counts[k] = n
+			}
+		}
+		t.decay = now.Add(t.window)
+	}
+
+	if _, ok := t.counts[name]; ok || len(t.counts) < t.capacity {
+		t.counts[name]++
+		return
+	}
+	var minName string
+	var min uint64
+	for k, n := range t.counts {
+		if minName == "" || n < min {
+			minName, min = k, n
+		}
+	}
+	delete(t.counts, minName)
+	t.counts[name] = min + 1
+}
+
+type topKEntry struct {
+	Name  string
+	Count uint64
+}
+
+// Top returns up to n names with the highest counts, highest first.
+func (t *topK) Top(n int) []topKEntry {
+	var entries []topKEntry
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.mu.Lock()
+		for k, c := range shard.counts {
+			entries = append(entries, topKEntry{k, c})
+		}
+		shard.mu.Unlock()
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
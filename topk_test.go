@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTopK(t *testing.T) {
+	for _, shards := range []int{1, 8} {
+		k := newTopK(time.Hour, shards)
+		for i := 0; i < 10; i++ {
+			for j := 0; j <= i; j++ {
+				k.Add(fmt.Sprintf("name%d.", i))
+			}
+		}
+		top := k.Top(3)
+		want := []topKEntry{{"name9.", 10}, {"name8.", 9}, {"name7.", 8}}
+		if fmt.Sprint(top) != fmt.Sprint(want) {
+			t.Errorf("%d shards: got %v, want %v", shards, top, want)
+		}
+	}
+}
+
+// BenchmarkTopKAdd counts names from every CPU at once, as the queries
+// do, with one shard and with eight.
+func BenchmarkTopKAdd(b *testing.B) {
+	for _, names := range []int{500, 5000} {
+		list := make([]string, names)
+		for i := range list {
+			list[i] = fmt.Sprintf("host%d.example.com.", i)
+		}
+		for _, shards := range []int{1, 8} {
+			b.Run(fmt.Sprintf("names=%d/shards=%d", names, shards), func(b *testing.B) {
+				k := newTopK(time.Hour, shards)
+				b.ReportAllocs()
+				b.RunParallel(func(pb *testing.PB) {
+					i := 0
+					for pb.Next() {
+						k.Add(list[i%len(list)])
+						i++
+					}
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"log"
+	"time"
+)
+
+// Most of an upstream response body kept for a trace.
+const traceBodyLimit = 4096
+
+// traceDomains are the domains whose queries are traced, set by
+// -trace-domain.
+var traceDomains *suffixSet
+
+// queryTrace logs the handling of one query in detail. A nil *queryTrace
+// logs nothing, so callers needn't check whether tracing is on.
+type queryTrace struct {
+	qname string
+	start time.Time
+	body  []byte
+}
+
+// newQueryTrace returns a trace for qname if it matches -trace-domain.
+func newQueryTrace(qname string) *queryTrace {
+	if !traceDomains.Match(qname) {
+		return nil
+	}
+	return &queryTrace{qname: qname, start: time.Now()}
+}
+
+func (t *queryTrace) Printf(format string, v ...interface{}) {
+	if t == nil {
+		return
+	}
+	log.Printf("trace %s +%s: "+format, append([]interface{}{t.qname, time.Since(t.start)}, v...)...)
+}
+
+// fork returns a trace for a concurrent upstream request of the same query.
+func (t *queryTrace) fork() *queryTrace {
+	if t == nil {
+		return nil
+	}
+	return &queryTrace{qname: t.qname, start: t.start}
+}
+
+// capture returns r, keeping a copy of the first traceBodyLimit bytes read.
+func (t *queryTrace) capture(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return io.TeeReader(r, t)
+}
+
+func (t *queryTrace) Write(p []byte) (int, error) {
+	if room := traceBodyLimit - len(t.body); room > 0 {
+		if len(p) > room {
+			t.body = append(t.body, p[:room]...)
+		} else {
+			t.body = append(t.body, p...)
+		}
+	}
+	return len(p), nil
+}
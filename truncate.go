@@ -0,0 +1,106 @@
+package main
+
+import "github.com/miekg/dns"
+
+// tcpAvailable records whether any TCP listener is running, in which case
+// oversized UDP responses are truncated with TC set so the client retries
+// over TCP. Without one a retry can't succeed, so records are dropped until
+// the response fits and TC is left alone.
+var tcpAvailable bool
+
+// udpSize returns the largest response the client of req accepts over UDP.
+func udpSize(req *dns.Msg) int {
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	return size
+}
+
+// truncateForUDP shrinks resp to fit the client's UDP buffer size.
+func truncateForUDP(resp *dns.Msg, req *dns.Msg) {
+	size := udpSize(req)
+	if resp.Len() <= size {
+		return
+	}
+
+	if tcpAvailable {
+		resp.Truncated = true
+		resp.Answer = nil
+		resp.Ns = nil
+		resp.Extra = keepOPT(resp.Extra)
+		return
+	}
+
+	dropToFit(resp, size)
+}
+
+// dropToFit removes records from the end of resp, additional section
+// first, until it packs into size bytes.
+func dropToFit(resp *dns.Msg, size int) {
+	for resp.Len() > size {
+		switch {
+		case len(resp.Extra) > len(keepOPT(resp.Extra)):
+			resp.Extra = dropLastNonOPT(resp.Extra)
+		case len(resp.Ns) > 0:
+			resp.Ns = resp.Ns[:len(resp.Ns)-1]
+		case len(resp.Answer) > 0:
+			resp.Answer = resp.Answer[:len(resp.Answer)-1]
+		default:
+			return
+		}
+	}
+}
+
+// Upstream responses more than this many times over -max-answers or
+// -max-response-bytes are rejected rather than cut down.
+const oversizeRejectFactor = 4
+
+// capResponse enforces -max-answers and -max-response-bytes on a response
+// built from the upstream's answer, before any UDP truncation. It reports
+// false if the response is so far over that it should be treated as
+// malformed.
+func capResponse(resp *dns.Msg) bool {
+	name := resp.Question[0].Name
+	if *maxAnswers > 0 && len(resp.Answer) > *maxAnswers {
+		if len(resp.Answer) > *maxAnswers*oversizeRejectFactor {
+			warnf("Rejecting upstream response for %s with %d answers", name, len(resp.Answer))
+			return false
+		}
+		debugf("Truncating upstream response for %s from %d to %d answers",
+			name, len(resp.Answer), *maxAnswers)
+		resp.Answer = resp.Answer[:*maxAnswers]
+	}
+	if *maxResponseBytes > 0 {
+		if n := resp.Len(); n > *maxResponseBytes {
+			if n > *maxResponseBytes*oversizeRejectFactor {
+				warnf("Rejecting %d byte upstream response for %s", n, name)
+				return false
+			}
+			debugf("Truncating %d byte upstream response for %s to %d bytes", n, name, *maxResponseBytes)
+			dropToFit(resp, *maxResponseBytes)
+		}
+	}
+	return true
+}
+
+// keepOPT returns only the OPT pseudo-records of an additional section.
+func keepOPT(extra []dns.RR) []dns.RR {
+	var opts []dns.RR
+	for _, rr := range extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			opts = append(opts, rr)
+		}
+	}
+	return opts
+}
+
+// dropLastNonOPT removes the last record of extra which isn't an OPT.
+func dropLastNonOPT(extra []dns.RR) []dns.RR {
+	for i := len(extra) - 1; i >= 0; i-- {
+		if extra[i].Header().Rrtype != dns.TypeOPT {
+			return append(extra[:i:i], extra[i+1:]...)
+		}
+	}
+	return extra
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// ttlRules maps domains to the TTL given to every record of the responses
+// to queries for them or their subdomains. Each Set adds the
+// comma-separated domain:seconds rules of its value, to a copy, so that
+// rules in use are never modified.
+type ttlRules map[string]uint32
+
+func (r *ttlRules) String() string {
+	var rules []string
+	for name, ttl := range *r {
+		rules = append(rules, fmt.Sprintf("%s:%d", name, ttl))
+	}
+	sort.Strings(rules)
+	return strings.Join(rules, ",")
+}
+
+func (r *ttlRules) Set(value string) error {
+	rules := make(ttlRules, len(*r))
+	for name, ttl := range *r {
+		rules[name] = ttl
+	}
+	for _, rule := range splitList(value) {
+		i := strings.LastIndexByte(rule, ':')
+		if i <= 0 {
+			return fmt.Errorf("%q is not domain:seconds", rule)
+		}
+		ttl, err := strconv.ParseUint(rule[i+1:], 10, 31)
+		if err != nil {
+			return fmt.Errorf("%q: bad TTL: %v", rule, err)
+		}
+		rules[normalizeName(rule[:i])] = uint32(ttl)
+	}
+	*r = rules
+	return nil
+}
+
+var ttlOverrides ttlRules
+
+// activeTTLRules holds the ttlRules queries use, replaced on reload.
+var activeTTLRules atomic.Value
+
+func init() {
+	flag.Var(&ttlOverrides, "ttl-override",
+		"Give every record of the responses for a domain and its subdomains this TTL, as domain:seconds (repeatable; the longest match wins)")
+	activeTTLRules.Store(ttlRules(nil))
+}
+
+// setTTLOverrides makes value the rules in use. On reload the flag has
+// merged value into the old rules, so it is parsed afresh.
+func setTTLOverrides(value string) {
+	var rules ttlRules
+	if err := rules.Set(value); err != nil {
+		warnf("Keeping the current TTL overrides: %v", err)
+		return
+	}
+	ttlOverrides = rules
+	activeTTLRules.Store(rules)
+}
+
+// overrideTTL applies the rule of rules, the -ttl-override rules in use
+// when the query arrived, matching qname, which must be normalized, to resp.
+func overrideTTL(resp *dns.Msg, qname string, rules ttlRules) {
+	if len(rules) == 0 {
+		return
+	}
+	domain, ttl, ok := rules.match(qname)
+	if !ok {
+		return
+	}
+	debugf("TTL override %s: setting TTL %d for %s", domain, ttl, qname)
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = ttl
+			}
+		}
+	}
+}
+
+// match returns the longest domain with a rule that qname is or is under.
+func (r ttlRules) match(qname string) (string, uint32, bool) {
+	domain, ok := longestSuffix(qname, func(domain string) bool {
+		_, ok := r[domain]
+		return ok
+	})
+	return domain, r[domain], ok
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// The -refuse-any=cache records are kept with the upstream's TTLs, and
+// served with the -ttl-override rules in use when they are asked for.
+func TestTTLOverrideReload(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/dns-json")
+		w.Write([]byte(`{"Status":0,"Question":[{"name":"www.example.com.","type":1}],` +
+			`"Answer":[{"name":"www.example.com.","type":1,"TTL":300,"data":"192.0.2.1"}]}`))
+	}))
+	defer srv.Close()
+	upstream.Store(&upstreamGroup{name: "default", endpoints: []string{srv.URL + "/resolve"}, policy: policyFailover})
+	defer func(mode string, cache *rrsetCache) { *refuseAny, anyCache = mode, cache }(*refuseAny, anyCache)
+	*refuseAny, anyCache = anyCached, newRRsetCache(anyCacheNames)
+	defer func(rules ttlRules) {
+		ttlOverrides = rules
+		activeTTLRules.Store(rules)
+	}(ttlOverrides)
+
+	query := func(qtype uint16) uint32 {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", qtype)
+		w := &httpResponseWriter{local: &net.TCPAddr{}, remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 7)}}
+		route(w, req)
+		if w.msg == nil || len(w.msg.Answer) != 1 || w.msg.Answer[0].Header().Rrtype != dns.TypeA {
+			t.Fatalf("%s query: got %v, want the A record", dns.TypeToString[qtype], w.msg)
+		}
+		return w.msg.Answer[0].Header().Ttl
+	}
+
+	setTTLOverrides("example.com:60")
+	if ttl := query(dns.TypeA); ttl != 60 {
+		t.Errorf("A answered with TTL %d, want the override of 60", ttl)
+	}
+	if ttl := query(dns.TypeANY); ttl != 60 {
+		t.Errorf("ANY answered from the cache with TTL %d, want the override of 60", ttl)
+	}
+
+	setTTLOverrides("www.example.com:900")
+	if ttl := query(dns.TypeANY); ttl != 900 {
+		t.Errorf("after a reload, ANY answered with TTL %d, want the new override of 900", ttl)
+	}
+
+	// Without a rule, the upstream's TTL runs down as it would have
+	setTTLOverrides("")
+	if ttl := query(dns.TypeANY); ttl < 299 || ttl > 300 {
+		t.Errorf("without overrides, ANY answered with TTL %d, want the upstream's 300", ttl)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/wrouesnel/dns-over-https-proxy/dohproxy"
+)
+
+// upstream holds the *upstreamGroup queries are forwarded to. A config
+// reload may replace it while queries are in flight.
+var upstream atomic.Value
+
+// currentUpstream returns the current upstream group.
+func currentUpstream() *upstreamGroup {
+	return upstream.Load().(*upstreamGroup)
+}
+
+// upstreamEndpoint returns the endpoint of the current upstream group that
+// a query would be sent to now.
+func upstreamEndpoint() string {
+	return currentUpstream().pick()
+}
+
+// requestBuilders holds a *dohproxy.RequestBuilder for each endpoint used,
+// so endpoints are parsed once rather than for every query.
+var requestBuilders sync.Map
+
+func requestBuilder(endpoint string) (*dohproxy.RequestBuilder, error) {
+	if b, ok := requestBuilders.Load(endpoint); ok {
+		return b.(*dohproxy.RequestBuilder), nil
+	}
+	b, err := dohproxy.NewRequestBuilder(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	requestBuilders.Store(endpoint, b)
+	return b, nil
+}
+
+// upstreamClient sends requests to the DNS-over-HTTPS endpoint.
+var upstreamClient = http.DefaultClient
+
+// initUpstreamClient builds the upstream HTTP client, applying
+// -upstream-interface and -upstream-source-ip.
+func initUpstreamClient() error {
+	dialer, err := upstreamDialer(*upstreamInterface, *upstreamSourceIP)
+	if err != nil {
+		return err
+	}
+	if *upstreamInterface != "" {
+		infof("Sending upstream requests via interface %s", *upstreamInterface)
+	}
+	if *upstreamSourceIP != "" {
+		infof("Sending upstream requests from %s", *upstreamSourceIP)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&happyDialer{dialer: dialer, delay: *upstreamAttemptDelay}).DialContext
+	upstreamClient = &http.Client{Transport: transport}
+	return nil
+}
+
+// probeUpstream checks that endpoint answers a query for the root NS set.
+// Probes are measured separately from client queries.
+func probeUpstream(ctx context.Context, endpoint string) error {
+	start := time.Now()
+	class, err := probe(ctx, endpoint)
+	if err != nil {
+		metrics.ProbeErrors.With(endpoint, class).Inc()
+		probeFailed(endpoint)
+		return err
+	}
+	probePassed(endpoint)
+	metrics.ProbeDuration.With(endpoint).Observe(time.Since(start).Seconds())
+	atomic.StoreInt64(&metrics.ProbeLastSuccess.With(endpoint).v, time.Now().Unix())
+	return nil
+}
+
+// probe sends a probe query, returning the class of any error.
+func probe(ctx context.Context, endpoint string) (string, error) {
+	builder, err := requestBuilder(endpoint)
+	if err != nil {
+		return errClassNetwork, err
+	}
+	req := new(dns.Msg)
+	req.SetQuestion(".", dns.TypeNS)
+	httpreq, err := builder.NewRequest(ctx, req, "")
+	if err != nil {
+		return errClassNetwork, err
+	}
+	httpreq, method := upstreamRequest(endpoint, httpreq)
+	httpresp, err := upstreamClient.Do(httpreq)
+	if err != nil {
+		return transportErrorClass(ctx, err), err
+	}
+	observeMethod(endpoint, method, httpresp.StatusCode)
+	defer httpresp.Body.Close()
+	if httpresp.StatusCode != http.StatusOK {
+		return httpErrorClass(httpresp.StatusCode), fmt.Errorf("HTTP status %s", httpresp.Status)
+	}
+	var dnsResp dohproxy.DNSResponseJson
+	if err := json.NewDecoder(limitBody(httpresp.Body)).Decode(&dnsResp); err != nil {
+		return errClassParse, fmt.Errorf("malformed JSON response: %v", err)
+	}
+	return "", nil
+}
+
+// upstreamDialer returns the dialer for upstream connections, optionally
+// bound to a network interface and/or source address. Neither needs to
+// exist yet (see checkUpstreamLink).
+func upstreamDialer(iface, sourceIP string) (*net.Dialer, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if iface != "" {
+		control, err := bindToDevice(iface)
+		if err != nil {
+			return nil, fmt.Errorf("-upstream-interface %s: %v", iface, err)
+		}
+		dialer.Control = control
+	}
+	if sourceIP != "" {
+		ip := net.ParseIP(sourceIP)
+		if ip == nil {
+			return nil, fmt.Errorf("-upstream-source-ip %q is not an IP address", sourceIP)
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	return dialer, nil
+}
+
+// checkUpstreamLink returns an error if the upstream interface or source
+// address doesn't exist, as before the WAN link is up.
+func checkUpstreamLink(iface, sourceIP string) error {
+	if iface != "" {
+		if _, err := net.InterfaceByName(iface); err != nil {
+			return fmt.Errorf("-upstream-interface %s: %v", iface, err)
+		}
+	}
+	if ip := net.ParseIP(sourceIP); ip != nil {
+		if err := checkLocalIP(ip); err != nil {
+			return fmt.Errorf("-upstream-source-ip: %v", err)
+		}
+	}
+	return nil
+}
+
+// checkLocalIP returns an error unless ip is assigned to a local interface.
+func checkLocalIP(ip net.IP) error {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not assigned to any interface", ip)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/miekg/dns"
+)
+
+// commentTextLimit bounds the EXTRA-TEXT taken from an upstream comment,
+// leaving room in a 512-byte UDP response for the rest.
+const commentTextLimit = 120
+
+// commentCodes maps phrases found in upstream comments, lower-cased, to the
+// Extended DNS Error they describe. The first match wins.
+var commentCodes = []struct {
+	phrase string
+	code   uint16
+}{
+	{"signature expired", edeSignatureExpired},
+	{"signature not yet valid", edeSignatureNotYetValid},
+	{"dnskey missing", edeDNSKEYMissing},
+	{"rrsigs missing", edeRRSIGsMissing},
+	{"unsupported dnskey algorithm", edeUnsupportedDNSKEYAlgo},
+	{"dnssec", edeDNSSECBogus},
+	{"blocked", edeBlocked},
+	{"blocklist", edeBlocked},
+	{"censored", edeCensored},
+	{"filtered", edeFiltered},
+	{"prohibited", edeProhibited},
+	{"no reachable authority", edeNoReachableAuthority},
+	{"timed out", edeNoReachableAuthority},
+	{"lame", edeNoReachableAuthority},
+}
+
+// commentEDE builds the Extended DNS Error relaying an upstream comment on
+// a failed query: the code it names, as in Cloudflare's "EDE(10): RRSIGs
+// Missing", or one recognized from its wording, else Other. The comment is
+// the EXTRA-TEXT, truncated to commentTextLimit bytes.
+func commentEDE(comment string) *dns.EDNS0_LOCAL {
+	text := truncateText(comment, commentTextLimit)
+	if code, ok := explicitEDE(comment); ok {
+		return newEDE(code, text)
+	}
+	lower := strings.ToLower(comment)
+	for _, c := range commentCodes {
+		if strings.Contains(lower, c.phrase) {
+			return newEDE(c.code, text)
+		}
+	}
+	return newEDE(edeOther, text)
+}
+
+// explicitEDE finds an "EDE(n)" or "EDE n" code in a comment.
+func explicitEDE(comment string) (uint16, bool) {
+	i := strings.Index(comment, "EDE")
+	if i < 0 {
+		return 0, false
+	}
+	rest := strings.TrimLeft(comment[i+3:], "(: ")
+	end := 0
+	for end < len(rest) && rest[end] >= '0' && rest[end] <= '9' {
+		end++
+	}
+	code, err := strconv.ParseUint(rest[:end], 10, 16)
+	return uint16(code), err == nil
+}
+
+// truncateText shortens s to at most n bytes without splitting a UTF-8
+// sequence.
+func truncateText(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// relayComment handles the upstream's comment on resp, the response to req
+// which w is to send: it is logged at debug level and kept for the query
+// log, and on a failed query relayed to EDNS clients as an Extended DNS
+// Error. A comment saying the name is blocked is recorded as a block by
+// the endpoint.
+func relayComment(w dns.ResponseWriter, req, resp *dns.Msg, qname, comment string) {
+	if comment == "" {
+		return
+	}
+	debugf("Upstream comment for %s: %s", qname, comment)
+	rec, _ := w.(*responseRecorder)
+	if rec != nil {
+		rec.comment = comment
+	}
+	if resp.Rcode == dns.RcodeSuccess {
+		return
+	}
+	opts := []dns.EDNS0{commentEDE(comment)}
+	if hasEDE(opts, edeBlocked) && rec != nil {
+		recordBlock(w, qname, rec.upstream, rec.upstream, comment)
+	}
+	if req.IsEdns0() == nil {
+		return
+	}
+	if opt := resp.IsEdns0(); opt != nil {
+		opt.Option = append(opt.Option, opts...)
+	} else {
+		resp.Extra = append(resp.Extra, newOPT(req, opts...))
+	}
+	if rec != nil {
+		rec.reason = failureReason(opts)
+		rec.blocked = hasEDE(opts, edeBlocked)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/wrouesnel/dns-over-https-proxy/dohproxy"
+)
+
+// Values of -doh-json-method.
+const (
+	methodGet      = "get"
+	methodPost     = "post"
+	methodPostJSON = "post-json"
+)
+
+// methodFallbackAfter is how many client errors in a row with one method
+// make an endpoint switch to the other.
+const methodFallbackAfter = 3
+
+// endpointMethod is the method used for one endpoint, and how many
+// requests in a row it refused.
+type endpointMethod struct {
+	mu      sync.Mutex
+	method  string
+	refused int
+}
+
+// endpointMethods holds an *endpointMethod for each endpoint used.
+var endpointMethods sync.Map
+
+func methodFor(endpoint string) *endpointMethod {
+	if m, ok := endpointMethods.Load(endpoint); ok {
+		return m.(*endpointMethod)
+	}
+	m, _ := endpointMethods.LoadOrStore(endpoint, &endpointMethod{method: *dohJSONMethod})
+	return m.(*endpointMethod)
+}
+
+// upstreamRequest turns httpreq, a GET built for endpoint, into a request
+// with the method in use for it, which it also returns.
+func upstreamRequest(endpoint string, httpreq *http.Request) (*http.Request, string) {
+	m := methodFor(endpoint)
+	m.mu.Lock()
+	method := m.method
+	m.mu.Unlock()
+	if method == methodGet {
+		return httpreq, method
+	}
+	contentType := dohproxy.PostForm
+	if method == methodPostJSON {
+		contentType = dohproxy.PostJSON
+	}
+	builder, err := requestBuilder(endpoint)
+	if err == nil {
+		var post *http.Request
+		if post, err = builder.NewPostRequest(httpreq, contentType); err == nil {
+			return post, method
+		}
+	}
+	warnf("Cannot build a POST request for %s, sending GET: %v", endpoint, err)
+	return httpreq, methodGet
+}
+
+// observeMethod notes the HTTP status endpoint answered a request sent with
+// method. After methodFallbackAfter client errors in a row the endpoint
+// switches between GET and the POST of -doh-json-method, as a last resort
+// for endpoints which only take one of them.
+func observeMethod(endpoint, method string, status int) {
+	m := methodFor(endpoint)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if method != m.method {
+		return
+	}
+	if status < 400 || status >= 500 || status == http.StatusTooManyRequests {
+		m.refused = 0
+		return
+	}
+	m.refused++
+	if !*dohJSONMethodFallback || m.refused < methodFallbackAfter {
+		return
+	}
+	next := methodGet
+	if method == methodGet {
+		next = methodPost
+		if *dohJSONMethod == methodPostJSON {
+			next = methodPostJSON
+		}
+	}
+	warnf("Upstream %s refused %d %s requests in a row, switching to %s",
+		endpoint, m.refused, method, next)
+	metrics.UpstreamMethodSwitches.With(endpoint, next).Inc()
+	m.method = next
+	m.refused = 0
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// answerJSON writes the JSON answer of example.com A 192.0.2.1.
+func answerJSON(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/dns-json")
+	w.Write([]byte(`{"Status":0,"Question":[{"name":"example.com.","type":1}],` +
+		`"Answer":[{"name":"example.com.","type":1,"TTL":300,"data":"192.0.2.1"}]}`))
+}
+
+func TestUpstreamMethod(t *testing.T) {
+	defer func(m string) { *dohJSONMethod = m }(*dohJSONMethod)
+	want := url.Values{"name": {"example.com."}, "type": {"1"}}
+
+	for _, tc := range []struct {
+		method      string
+		httpMethod  string
+		contentType string
+	}{
+		{methodGet, "GET", ""},
+		{methodPost, "POST", "application/x-www-form-urlencoded"},
+		{methodPostJSON, "POST", "application/json"},
+	} {
+		*dohJSONMethod = tc.method
+		reply := fetchFrom(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != tc.httpMethod || r.Header.Get("Content-Type") != tc.contentType {
+				t.Errorf("-doh-json-method %s: got %s with Content-Type %q, want %s with %q",
+					tc.method, r.Method, r.Header.Get("Content-Type"), tc.httpMethod, tc.contentType)
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			params := r.URL.Query()
+			switch tc.method {
+			case methodPost:
+				if len(params) != 0 {
+					t.Errorf("POST: got parameters %v in the URL", params)
+				}
+				params, _ = url.ParseQuery(string(body))
+			case methodPostJSON:
+				var fields map[string]string
+				if err := json.Unmarshal(body, &fields); err != nil {
+					t.Errorf("POST of JSON: body %q: %v", body, err)
+				}
+				params = url.Values{}
+				for k, v := range fields {
+					params.Set(k, v)
+				}
+			default:
+				if len(body) != 0 {
+					t.Errorf("GET: got body %q", body)
+				}
+			}
+			if params.Encode() != want.Encode() {
+				t.Errorf("-doh-json-method %s: got parameters %v, want %v", tc.method, params, want)
+			}
+			answerJSON(w)
+		})
+		if reply.json == nil {
+			t.Errorf("-doh-json-method %s: the query failed", tc.method)
+		}
+	}
+}
+
+func TestUpstreamMethodFallback(t *testing.T) {
+	defer func(m string, fallback bool) { *dohJSONMethod, *dohJSONMethodFallback = m, fallback }(*dohJSONMethod, *dohJSONMethodFallback)
+	*dohJSONMethod, *dohJSONMethodFallback = methodGet, true
+
+	// An endpoint behind a WAF refusing GET
+	var methods []string
+	endpoint := "https://waf.example/resolve"
+	for i := 0; i < methodFallbackAfter+1; i++ {
+		m := methodFor(endpoint)
+		m.mu.Lock()
+		method := m.method
+		m.mu.Unlock()
+		methods = append(methods, method)
+		status := http.StatusForbidden
+		if method != methodGet {
+			status = http.StatusOK
+		}
+		observeMethod(endpoint, method, status)
+	}
+	if got := methods[len(methods)-1]; got != methodPost {
+		t.Errorf("sent %v, want a switch to POST after %d refusals", methods, methodFallbackAfter)
+	}
+
+	// Server errors and rate limiting are no reason to switch
+	endpoint = "https://busy.example/resolve"
+	for _, status := range []int{500, 503, http.StatusTooManyRequests, 500} {
+		observeMethod(endpoint, methodGet, status)
+	}
+	if m := methodFor(endpoint); m.method != methodGet {
+		t.Errorf("switched to %s on server errors", m.method)
+	}
+
+	// Nor without -doh-json-method-fallback
+	*dohJSONMethodFallback = false
+	endpoint = "https://strict.example/resolve"
+	for i := 0; i < 2*methodFallbackAfter; i++ {
+		observeMethod(endpoint, methodGet, http.StatusForbidden)
+	}
+	if m := methodFor(endpoint); m.method != methodGet {
+		t.Errorf("switched to %s with -doh-json-method-fallback=false", m.method)
+	}
+}
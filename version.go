@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	rdebug "runtime/debug"
+)
+
+// Build information, set with -ldflags "-X main.version=..." by the
+// Makefile. Plain go builds fall back to what the toolchain recorded.
+var (
+	version   = "devel"
+	commit    = ""
+	buildDate = ""
+)
+
+func init() {
+	if commit != "" {
+		return
+	}
+	if info, ok := rdebug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		version = info.Main.Version
+	}
+}
+
+// versionString describes the build on one line.
+func versionString() string {
+	s := "dns-over-https-proxy " + version
+	if commit != "" {
+		s += " (" + commit + ")"
+	}
+	if buildDate != "" {
+		s += " built " + buildDate
+	}
+	return fmt.Sprintf("%s with %s for %s/%s", s, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// writeBuildInfo exports the build information as the labels of a metric.
+func writeBuildInfo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP doh_proxy_build_info Build information of the running binary.\n")
+	fmt.Fprintf(w, "# TYPE doh_proxy_build_info gauge\n")
+	fmt.Fprintf(w, "doh_proxy_build_info{version=%q,commit=%q,build_date=%q,go_version=%q} 1\n",
+		version, commit, buildDate, runtime.Version())
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The -watchdog self-test sends a query for -watchdog-name to one of our
+// own listeners every -watchdog-interval, through the whole pipeline, and
+// acts once -watchdog-failures in a row go unanswered. Any response counts,
+// SERVFAIL included: an unreachable upstream is reported elsewhere, and
+// this is for a proxy that no longer answers at all.
+
+// Actions of -watchdog-action.
+const (
+	watchdogLog       = "log"
+	watchdogStacks    = "stacks"
+	watchdogUnhealthy = "unhealthy"
+	watchdogExit      = "exit"
+)
+
+// watchdogStackLimit bounds the goroutine dump logged by the stacks action.
+const watchdogStackLimit = 4 << 20
+
+// watchdogTripped holds the reason the unhealthy action gave /healthz, or
+// "" while the self-test passes.
+var watchdogTripped atomic.Value
+
+// watchdogTarget returns the address to send self-test queries to, and its
+// protocol: the first UDP or TCP listener, with an unspecified address
+// replaced by loopback.
+func watchdogTarget(listeners []*dnsListener) (addr, proto string, ok bool) {
+	for _, l := range listeners {
+		if l.Proto != "udp" && l.Proto != "tcp" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(l.Addr)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); host == "" || ip.IsUnspecified() {
+			host = "127.0.0.1"
+			if ip != nil && ip.To4() == nil {
+				host = "::1"
+			}
+		}
+		return net.JoinHostPort(host, port), l.Proto, true
+	}
+	return "", "", false
+}
+
+// runWatchdog runs the self-test against listeners until the process
+// exits. Each query runs in a goroutine of its own and is given up on
+// after twice -watchdog-timeout, so a stalled pipeline can't stall the
+// watchdog too.
+func runWatchdog(listeners []*dnsListener) {
+	addr, proto, ok := watchdogTarget(listeners)
+	if !ok {
+		warnf("-watchdog: no UDP or TCP listener to send self-test queries to, not starting")
+		return
+	}
+	infof("Watchdog: querying %s on %s (%s) every %s", *watchdogName, addr, proto, *watchdogInterval)
+	client := &dns.Client{Net: proto, Timeout: *watchdogTimeout}
+	failures := 0
+	for range time.Tick(*watchdogInterval) {
+		result := make(chan error, 1)
+		go func() {
+			req := new(dns.Msg)
+			req.SetQuestion(dns.Fqdn(*watchdogName), dns.TypeA)
+			_, _, err := client.Exchange(req, addr)
+			result <- err
+		}()
+		var err error
+		select {
+		case err = <-result:
+		case <-time.After(2 * *watchdogTimeout):
+			err = fmt.Errorf("query stuck for %s", 2**watchdogTimeout)
+		}
+		if err == nil {
+			metrics.WatchdogChecks.With("ok").Inc()
+			if failures >= *watchdogFailures {
+				infof("Watchdog: self-test query answered again")
+				watchdogTripped.Store("")
+			}
+			failures = 0
+			continue
+		}
+		metrics.WatchdogChecks.With("failed").Inc()
+		failures++
+		debugf("Watchdog: self-test query %d failed: %v", failures, err)
+		if failures == *watchdogFailures {
+			watchdogAct(fmt.Sprintf("%d self-test queries in a row failed, the last with: %v", failures, err))
+		}
+	}
+}
+
+// watchdogAct takes the -watchdog-action for a failed self-test.
+func watchdogAct(reason string) {
+	for _, action := range splitList(*watchdogAction) {
+		switch action {
+		case watchdogLog:
+			errorf("Watchdog: %s", reason)
+		case watchdogStacks:
+			buf := make([]byte, watchdogStackLimit)
+			buf = buf[:runtime.Stack(buf, true)]
+			log.Printf("Watchdog: %d goroutines:\n%s", runtime.NumGoroutine(), buf)
+		case watchdogUnhealthy:
+			warnf("Watchdog: %s; reporting unhealthy", reason)
+			watchdogTripped.Store("watchdog: " + reason)
+		case watchdogExit:
+			errorf("Watchdog: %s; exiting", reason)
+			os.Exit(1)
+		}
+	}
+}
+
+// watchdogReason returns why the watchdog made the proxy unhealthy, or "".
+func watchdogReason() string {
+	reason, _ := watchdogTripped.Load().(string)
+	return reason
+}
+
+// checkWatchdogActions returns an error for an unknown -watchdog-action.
+func checkWatchdogActions(actions string) error {
+	for _, action := range splitList(actions) {
+		switch action {
+		case watchdogLog, watchdogStacks, watchdogUnhealthy, watchdogExit:
+		default:
+			return fmt.Errorf("-watchdog-action: unknown action %q, want %s", action,
+				strings.Join([]string{watchdogLog, watchdogStacks, watchdogUnhealthy, watchdogExit}, ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Overflow policies for a full -udp-queue.
+const (
+	overflowReject     = "reject"
+	overflowDropOldest = "drop-oldest"
+)
+
+// udpQuery is a UDP query waiting for a worker.
+type udpQuery struct {
+	w        dns.ResponseWriter
+	req      *dns.Msg
+	enqueued time.Time
+}
+
+// udpWorkers answers UDP queries with a fixed number of goroutines, so a
+// stalled upstream can't make the proxy pile up one goroutine per packet.
+// The goroutine miekg/dns starts for each packet only applies the rate
+// limits and queues it; a UDP response can be written after that goroutine
+// has returned.
+type udpWorkers struct {
+	queue    chan udpQuery
+	next     dns.Handler
+	overflow string
+}
+
+// newUDPWorkers starts n workers answering queries with next, behind a
+// queue of size queued.
+func newUDPWorkers(n, queued int, overflow string, next dns.Handler) *udpWorkers {
+	p := &udpWorkers{queue: make(chan udpQuery, queued), next: next, overflow: overflow}
+	for i := 0; i < n; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *udpWorkers) work() {
+	for q := range p.queue {
+		stats.UDPQueueDepth.Dec()
+		metrics.UDPQueueWait.With().Observe(time.Since(q.enqueued).Seconds())
+		p.next.ServeDNS(q.w, q.req)
+	}
+}
+
+// ServeDNS queues UDP queries for the workers, and answers the others
+// directly.
+func (p *udpWorkers) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if w.RemoteAddr().Network() != "udp" {
+		p.next.ServeDNS(w, req)
+		return
+	}
+	q := udpQuery{w: w, req: req, enqueued: time.Now()}
+	for {
+		stats.UDPQueueDepth.Inc()
+		select {
+		case p.queue <- q:
+			return
+		default:
+			stats.UDPQueueDepth.Dec()
+		}
+		if p.overflow == overflowReject {
+			stats.UDPQueueRejected.Inc()
+			handleFailed(w, req, newEDE(edeOther, "server busy"))
+			return
+		}
+		// Make room by dropping the query that has waited longest, whose
+		// client has most likely retried already
+		select {
+		case <-p.queue:
+			stats.UDPQueueDepth.Dec()
+			stats.UDPQueueDropped.Inc()
+		default:
+		}
+	}
+}
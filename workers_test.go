@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func udpWriter() *httpResponseWriter {
+	return &httpResponseWriter{
+		local:  &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53},
+		remote: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353},
+	}
+}
+
+// Queries the full queue turns away are answered through the cookie
+// handler, as the others are.
+func TestUDPWorkersRejectWithCookie(t *testing.T) {
+	defer func(s *cookieSecrets) { cookies = s }(cookies)
+	cookies = &cookieSecrets{}
+
+	// No workers and no room: every UDP query is rejected
+	handler := cookieHandler(newUDPWorkers(0, 0, overflowReject, dns.HandlerFunc(route)))
+	w := udpWriter()
+	before := stats.UDPQueueRejected.Value()
+	handler.ServeDNS(w, cookieQuery("0102030405060708"))
+	if w.msg == nil || w.msg.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("got %v, want SERVFAIL", w.msg)
+	}
+	if got := stats.UDPQueueRejected.Value() - before; got != 1 {
+		t.Errorf("rejected count moved by %d, want 1", got)
+	}
+	if c := responseCookie(t, w.msg); len(c) != 2*(clientCookieSize+serverCookieSize) || c[:16] != "0102030405060708" {
+		t.Errorf("got cookie %q, want the client cookie and a server cookie", c)
+	}
+}
+
+// Rejections count towards response rate limiting, so that a flood doesn't
+// get a SERVFAIL for every query.
+func TestUDPWorkersRejectRateLimited(t *testing.T) {
+	exempt, _ := parseCIDRSet("")
+	handler := rrlHandler(newResponseLimiter(1, 0, 24, 56, exempt),
+		newUDPWorkers(0, 0, overflowReject, dns.HandlerFunc(route)))
+	answered := 0
+	for i := 0; i < 5; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		w := udpWriter()
+		handler.ServeDNS(w, req)
+		if w.msg != nil {
+			answered++
+		}
+	}
+	if answered != 1 {
+		t.Errorf("%d of 5 rejections answered, want 1", answered)
+	}
+}